@@ -2,12 +2,11 @@ module service_discovery
 
 go 1.23.6
 
+require github.com/stretchr/testify v1.11.1
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/google/uuid v1.6.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.5.2 // indirect
-	github.com/stretchr/testify v1.11.1 // indirect
-	github.com/vektra/mockery v1.1.2 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -1,52 +1,233 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	pClient "service_discovery/pkg/client"
 	"service_discovery/pkg/counter"
+	"service_discovery/pkg/dns"
 	"service_discovery/pkg/handler"
 	pStore "service_discovery/pkg/peerStore"
 	"service_discovery/pkg/service"
+	"service_discovery/pkg/wal"
 	"strings"
+	"syscall"
 	"time"
 )
 
+// version is reported in this node's metadata; set it at build time with
+// -ldflags "-X main.version=1.2.0".
+var version = "dev"
+
+// tagFlags collects repeated --tag key=value flags.
+type tagFlags map[string]string
+
+func (t tagFlags) String() string {
+	return fmt.Sprint(map[string]string(t))
+}
+
+func (t tagFlags) Set(tag string) error {
+	k, v, err := pStore.ParseTag(tag, "=")
+	if err != nil {
+		return err
+	}
+	t[k] = v
+	return nil
+}
+
 func main() {
 	port := flag.String("port", "8010", "port to listen on")
 	peers := flag.String("peers", "", "comma separated peers")
+	dataDir := flag.String("data-dir", "", "directory for the write-ahead log, state is kept in memory only if empty")
+	phiThreshold := flag.Float64("phi-threshold", pStore.DefaultPhiThreshold, "phi above which a silent peer is suspected")
+	snapshotInterval := flag.Duration("snapshot-interval", 5*time.Minute, "how often to snapshot state and compact the write-ahead log")
+	nodeID := flag.String("node-id", "", "stable node ID, requires --data-dir and is stored there; must match the ID already stored, which is used if empty")
+	bind := flag.String("bind", "", "address to listen on, defaults to :<port>")
+	advertise := flag.String("advertise", "", "address peers reach this node at, defaults to localhost:<port>")
+	batchSize := flag.Int("batch-size", service.DefaultBatchSize, fmt.Sprintf("most counter events sent to a peer in one request, at most %d", handler.MaxBatch))
+	batchLinger := flag.Duration("batch-linger", service.DefaultBatchLinger, "how long a counter event waits for others to share its request")
+	maxPendingPerPeer := flag.Int("max-pending-per-peer", service.DefaultMaxPendingPerPeer, "undelivered counter events one peer may have queued before they are dead-lettered")
+	maxPending := flag.Int("max-pending", service.DefaultMaxPending, "undelivered counter events all peers may have queued before the largest queue is dead-lettered")
+	maxAttempts := flag.Int("max-attempts", service.DefaultMaxAttempts, "retries of a counter event before its peer's queue is dead-lettered")
+	maxPendingAge := flag.Duration("max-pending-age", service.DefaultMaxPendingAge, "how long a counter event may wait before its peer's queue is dead-lettered")
+	breakerThreshold := flag.Int("breaker-threshold", pClient.DefaultBreakerThreshold, "failed requests in a row that open the circuit to a peer")
+	breakerCooldown := flag.Duration("breaker-cooldown", pClient.DefaultBreakerCooldown, "how long an open circuit turns requests away before trying the peer again")
+	dnsPort := flag.String("dns-port", "", "port to answer DNS queries on over UDP and TCP, no DNS server if empty")
+	dnsDomain := flag.String("dns-domain", dns.DefaultDomain, "domain the DNS server answers for")
+	tags := tagFlags{}
+	flag.Var(tags, "tag", "key=value tag to advertise, may be repeated")
 	flag.Parse()
 
-	selfID := "localhost:" + *port
+	if *bind == "" {
+		*bind = ":" + *port
+	}
+	if *advertise == "" {
+		*advertise = "localhost:" + *port
+	}
+
+	// Peers answer a larger batch with 413, which is not retried
+	if *batchSize < 1 || *batchSize > handler.MaxBatch {
+		log.Fatal("--batch-size must be between 1 and ", handler.MaxBatch)
+	}
+	if *breakerThreshold < 1 {
+		log.Fatal("--breaker-threshold must be at least 1")
+	}
+
+	// A fixed ID without the log would restart its counters at sequence 1
+	// under an origin peers already hold updates for, and they would drop
+	// the new ones as duplicates
+	if *nodeID != "" && *dataDir == "" {
+		log.Fatal("--node-id requires --data-dir")
+	}
+
+	// The ID outlives the address, so a node that moves keeps its counters
+	// and dedup history
+	selfID := *nodeID
+	if *dataDir != "" {
+		var err error
+		selfID, err = pStore.LoadNodeID(*dataDir, *nodeID)
+		if err != nil {
+			log.Fatal("error in loading the node id ", err)
+		}
+	}
+	if selfID == "" {
+		selfID = pStore.NewNodeID()
+	}
+	log.Println("node id is", selfID, "advertising", *advertise)
 
-	peerStore := pStore.NewPeerStore(selfID)
+	peerStore := pStore.NewPeerStore(selfID, *advertise)
+	peerStore.Meta = pStore.Meta{Tags: tags, Version: version, StartedAt: time.Now()}
 	peerClient := pClient.NewClient()
+	peerClient.Breakers.Threshold = *breakerThreshold
+	peerClient.Breakers.Cooldown = *breakerCooldown
+
+	peerCounters := counter.NewCounters(selfID)
+	peerService := service.NewPeerService(selfID, peerStore, peerClient, peerCounters)
+	peerService.Breakers = peerClient.Breakers
+	peerService.PhiThreshold = *phiThreshold
+	peerService.BatchSize = *batchSize
+	peerService.BatchLinger = *batchLinger
+	peerService.MaxPendingPerPeer = *maxPendingPerPeer
+	peerService.MaxPending = *maxPending
+	peerService.MaxAttempts = *maxAttempts
+	peerService.MaxPendingAge = *maxPendingAge
+	peerStore.Events = peerService.Events
+	peerCounters.Events = peerService.Events
+
+	// Rebuild counters and undelivered events before serving anything
+	var eventLog wal.IWAL
+	if *dataDir != "" {
+		var err error
+		eventLog, err = wal.Open(*dataDir, wal.DefaultSegmentSize)
+		if err != nil {
+			log.Fatal("error in opening the write-ahead log ", err)
+		}
+		if err := peerService.Restore(eventLog); err != nil {
+			log.Fatal("error in replaying the write-ahead log ", err)
+		}
+	}
 
-	peerCounter := counter.NewCounter()
-	peerService := service.NewPeerService(selfID, peerStore, peerClient, peerCounter)
 	peerHandler := handler.NewPeerHandler(peerService)
 	mux := http.NewServeMux()
 	mux.HandleFunc("/nodes/join", peerHandler.Join)
 	mux.HandleFunc("/nodes", peerHandler.List)
 	mux.HandleFunc("/nodes/heartbeat", peerHandler.Heartbeat)
+	mux.HandleFunc("/nodes/ping-req", peerHandler.PingReq)
+	mux.HandleFunc("/nodes/gossip", peerHandler.Gossip)
+	mux.HandleFunc("/nodes/leave", peerHandler.Leave)
 
 	mux.HandleFunc("/counter/increment", peerHandler.Increment)
+	mux.HandleFunc("/counter/decrement", peerHandler.Decrement)
 	mux.HandleFunc("/counter/replicate", peerHandler.Replicate)
+	mux.HandleFunc("/counter/replicate/batch", peerHandler.ReplicateBatch)
 	mux.HandleFunc("/counter/count", peerHandler.Count)
+	mux.HandleFunc("/counter/sync", peerHandler.Sync)
+	mux.HandleFunc("/counter/merge", peerHandler.Merge)
+
+	mux.HandleFunc("/counters", peerHandler.ListCounters)
+	mux.HandleFunc("/counters/{name}", peerHandler.Count)
+	mux.HandleFunc("/counters/{name}/increment", peerHandler.Increment)
+	mux.HandleFunc("/counters/{name}/decrement", peerHandler.Decrement)
+
+	mux.HandleFunc("/services/{name}", peerHandler.Instances)
+	mux.HandleFunc("/services/{name}/instances/{id}", peerHandler.Instance)
+	mux.HandleFunc("/registry/replicate", peerHandler.ReplicateInstance)
+
+	mux.HandleFunc("/admin/snapshot", peerHandler.Snapshot)
+	mux.HandleFunc("/admin/status", peerHandler.Status)
+	mux.HandleFunc("/admin/deadletter", peerHandler.DeadLetters)
+	mux.HandleFunc("/admin/breakers", peerHandler.Breakers)
+
+	mux.HandleFunc("/events", peerHandler.Events)
 
 	if *peers != "" {
-		for _, peer := range strings.Split(*peers, ",") {
-			peerService.JoinPeer(peer)
+		peerService.Bootstrap(strings.Split(*peers, ","), 2*time.Second)
+	}
+
+	if *dnsPort != "" {
+		// Listen on the same interface as the HTTP API
+		host, _, _ := net.SplitHostPort(*bind)
+		dnsServer := dns.NewServer(*dnsDomain, peerService)
+		if err := dnsServer.Listen(net.JoinHostPort(host, *dnsPort)); err != nil {
+			log.Fatal("error in starting the dns server ", err)
 		}
+		defer dnsServer.Close()
+		log.Println("DNS listening on", dnsServer.Addr(), "for", dnsServer.Domain)
+		go dnsServer.Serve()
 	}
 
-	go peerService.StartHeartbeat()
-	go peerService.StartCleanup(5 * time.Second)
+	go peerService.StartProbing(time.Second, 3)
+	go peerService.StartGossip(200*time.Millisecond, 3)
+	go peerService.StartCleanup(time.Second)
+	go peerService.StartHealthChecks(time.Second)
 	go peerService.StartRetryLoop()
+	go peerService.StartAntiEntropy(10 * time.Second)
+	if *dataDir != "" {
+		go peerService.StartSnapshots(*snapshotInterval)
+	}
 
-	log.Println("Node running on port", *port)
-	log.Fatal(http.ListenAndServe(":"+*port, RequestLogger(mux)))
+	// Cancelled on shutdown so event streams and blocking queries end instead
+	// of holding the server open
+	serveCtx, cancelServe := context.WithCancel(context.Background())
+	server := &http.Server{
+		Addr:        *bind,
+		Handler:     RequestLogger(mux),
+		BaseContext: func(net.Listener) context.Context { return serveCtx },
+	}
+	server.RegisterOnShutdown(cancelServe)
+	go func() {
+		log.Println("Node listening on", *bind)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	// Tell the cluster first so peers stop queuing events for us, then
+	// deliver or hand off our own queue before going away
+	log.Println("shutting down, leaving the cluster")
+	peerService.Leave()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Println("error in shutting down the server", err)
+	}
+
+	if eventLog != nil {
+		if err := eventLog.Close(); err != nil {
+			log.Println("error in closing the write-ahead log", err)
+		}
+	}
 }
 
 func RequestLogger(next http.Handler) http.Handler {
@@ -2,7 +2,17 @@
 
 package client
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	client "service_discovery/pkg/client"
+
+	counter "service_discovery/pkg/counter"
+
+	mock "github.com/stretchr/testify/mock"
+
+	peerStore "service_discovery/pkg/peerStore"
+
+	registry "service_discovery/pkg/registry"
+)
 
 // MockIClient is an autogenerated mock type for the IClient type
 type MockIClient struct {
@@ -17,17 +27,17 @@ func (_m *MockIClient) EXPECT() *MockIClient_Expecter {
 	return &MockIClient_Expecter{mock: &_m.Mock}
 }
 
-// Heartbeat provides a mock function with given fields: peer, selfID
-func (_m *MockIClient) Heartbeat(peer string, selfID string) error {
-	ret := _m.Called(peer, selfID)
+// Gossip provides a mock function with given fields: peer, selfId, updates
+func (_m *MockIClient) Gossip(peer string, selfId string, updates []peerStore.Update) error {
+	ret := _m.Called(peer, selfId, updates)
 
 	if len(ret) == 0 {
-		panic("no return value specified for Heartbeat")
+		panic("no return value specified for Gossip")
 	}
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string) error); ok {
-		r0 = rf(peer, selfID)
+	if rf, ok := ret.Get(0).(func(string, string, []peerStore.Update) error); ok {
+		r0 = rf(peer, selfId, updates)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -35,6 +45,64 @@ func (_m *MockIClient) Heartbeat(peer string, selfID string) error {
 	return r0
 }
 
+// MockIClient_Gossip_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Gossip'
+type MockIClient_Gossip_Call struct {
+	*mock.Call
+}
+
+// Gossip is a helper method to define mock.On call
+//   - peer string
+//   - selfId string
+//   - updates []peerStore.Update
+func (_e *MockIClient_Expecter) Gossip(peer interface{}, selfId interface{}, updates interface{}) *MockIClient_Gossip_Call {
+	return &MockIClient_Gossip_Call{Call: _e.mock.On("Gossip", peer, selfId, updates)}
+}
+
+func (_c *MockIClient_Gossip_Call) Run(run func(peer string, selfId string, updates []peerStore.Update)) *MockIClient_Gossip_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string), args[2].([]peerStore.Update))
+	})
+	return _c
+}
+
+func (_c *MockIClient_Gossip_Call) Return(_a0 error) *MockIClient_Gossip_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIClient_Gossip_Call) RunAndReturn(run func(string, string, []peerStore.Update) error) *MockIClient_Gossip_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Heartbeat provides a mock function with given fields: peer, selfID, ping
+func (_m *MockIClient) Heartbeat(peer string, selfID string, ping client.Ping) (client.Ack, error) {
+	ret := _m.Called(peer, selfID, ping)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Heartbeat")
+	}
+
+	var r0 client.Ack
+	var r1 error
+	if rf, ok := ret.Get(0).(func(string, string, client.Ping) (client.Ack, error)); ok {
+		return rf(peer, selfID, ping)
+	}
+	if rf, ok := ret.Get(0).(func(string, string, client.Ping) client.Ack); ok {
+		r0 = rf(peer, selfID, ping)
+	} else {
+		r0 = ret.Get(0).(client.Ack)
+	}
+
+	if rf, ok := ret.Get(1).(func(string, string, client.Ping) error); ok {
+		r1 = rf(peer, selfID, ping)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
 // MockIClient_Heartbeat_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Heartbeat'
 type MockIClient_Heartbeat_Call struct {
 	*mock.Call
@@ -43,50 +111,49 @@ type MockIClient_Heartbeat_Call struct {
 // Heartbeat is a helper method to define mock.On call
 //   - peer string
 //   - selfID string
-func (_e *MockIClient_Expecter) Heartbeat(peer interface{}, selfID interface{}) *MockIClient_Heartbeat_Call {
-	return &MockIClient_Heartbeat_Call{Call: _e.mock.On("Heartbeat", peer, selfID)}
+//   - ping client.Ping
+func (_e *MockIClient_Expecter) Heartbeat(peer interface{}, selfID interface{}, ping interface{}) *MockIClient_Heartbeat_Call {
+	return &MockIClient_Heartbeat_Call{Call: _e.mock.On("Heartbeat", peer, selfID, ping)}
 }
 
-func (_c *MockIClient_Heartbeat_Call) Run(run func(peer string, selfID string)) *MockIClient_Heartbeat_Call {
+func (_c *MockIClient_Heartbeat_Call) Run(run func(peer string, selfID string, ping client.Ping)) *MockIClient_Heartbeat_Call {
 	_c.Call.Run(func(args mock.Arguments) {
-		run(args[0].(string), args[1].(string))
+		run(args[0].(string), args[1].(string), args[2].(client.Ping))
 	})
 	return _c
 }
 
-func (_c *MockIClient_Heartbeat_Call) Return(_a0 error) *MockIClient_Heartbeat_Call {
-	_c.Call.Return(_a0)
+func (_c *MockIClient_Heartbeat_Call) Return(_a0 client.Ack, _a1 error) *MockIClient_Heartbeat_Call {
+	_c.Call.Return(_a0, _a1)
 	return _c
 }
 
-func (_c *MockIClient_Heartbeat_Call) RunAndReturn(run func(string, string) error) *MockIClient_Heartbeat_Call {
+func (_c *MockIClient_Heartbeat_Call) RunAndReturn(run func(string, string, client.Ping) (client.Ack, error)) *MockIClient_Heartbeat_Call {
 	_c.Call.Return(run)
 	return _c
 }
 
-// JoinCluster provides a mock function with given fields: peerId, selfId
-func (_m *MockIClient) JoinCluster(peerId string, selfId string) ([]string, error) {
-	ret := _m.Called(peerId, selfId)
+// JoinCluster provides a mock function with given fields: peerId, selfId, selfAddr, incarnation, meta, wantState
+func (_m *MockIClient) JoinCluster(peerId string, selfId string, selfAddr string, incarnation uint64, meta peerStore.Meta, wantState bool) (client.JoinClusterResponse, error) {
+	ret := _m.Called(peerId, selfId, selfAddr, incarnation, meta, wantState)
 
 	if len(ret) == 0 {
 		panic("no return value specified for JoinCluster")
 	}
 
-	var r0 []string
+	var r0 client.JoinClusterResponse
 	var r1 error
-	if rf, ok := ret.Get(0).(func(string, string) ([]string, error)); ok {
-		return rf(peerId, selfId)
+	if rf, ok := ret.Get(0).(func(string, string, string, uint64, peerStore.Meta, bool) (client.JoinClusterResponse, error)); ok {
+		return rf(peerId, selfId, selfAddr, incarnation, meta, wantState)
 	}
-	if rf, ok := ret.Get(0).(func(string, string) []string); ok {
-		r0 = rf(peerId, selfId)
+	if rf, ok := ret.Get(0).(func(string, string, string, uint64, peerStore.Meta, bool) client.JoinClusterResponse); ok {
+		r0 = rf(peerId, selfId, selfAddr, incarnation, meta, wantState)
 	} else {
-		if ret.Get(0) != nil {
-			r0 = ret.Get(0).([]string)
-		}
+		r0 = ret.Get(0).(client.JoinClusterResponse)
 	}
 
-	if rf, ok := ret.Get(1).(func(string, string) error); ok {
-		r1 = rf(peerId, selfId)
+	if rf, ok := ret.Get(1).(func(string, string, string, uint64, peerStore.Meta, bool) error); ok {
+		r1 = rf(peerId, selfId, selfAddr, incarnation, meta, wantState)
 	} else {
 		r1 = ret.Error(1)
 	}
@@ -102,38 +169,198 @@ type MockIClient_JoinCluster_Call struct {
 // JoinCluster is a helper method to define mock.On call
 //   - peerId string
 //   - selfId string
-func (_e *MockIClient_Expecter) JoinCluster(peerId interface{}, selfId interface{}) *MockIClient_JoinCluster_Call {
-	return &MockIClient_JoinCluster_Call{Call: _e.mock.On("JoinCluster", peerId, selfId)}
+//   - selfAddr string
+//   - incarnation uint64
+//   - meta peerStore.Meta
+//   - wantState bool
+func (_e *MockIClient_Expecter) JoinCluster(peerId interface{}, selfId interface{}, selfAddr interface{}, incarnation interface{}, meta interface{}, wantState interface{}) *MockIClient_JoinCluster_Call {
+	return &MockIClient_JoinCluster_Call{Call: _e.mock.On("JoinCluster", peerId, selfId, selfAddr, incarnation, meta, wantState)}
+}
+
+func (_c *MockIClient_JoinCluster_Call) Run(run func(peerId string, selfId string, selfAddr string, incarnation uint64, meta peerStore.Meta, wantState bool)) *MockIClient_JoinCluster_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string), args[2].(string), args[3].(uint64), args[4].(peerStore.Meta), args[5].(bool))
+	})
+	return _c
+}
+
+func (_c *MockIClient_JoinCluster_Call) Return(_a0 client.JoinClusterResponse, _a1 error) *MockIClient_JoinCluster_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *MockIClient_JoinCluster_Call) RunAndReturn(run func(string, string, string, uint64, peerStore.Meta, bool) (client.JoinClusterResponse, error)) *MockIClient_JoinCluster_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Leave provides a mock function with given fields: peer, selfId, incarnation
+func (_m *MockIClient) Leave(peer string, selfId string, incarnation uint64) error {
+	ret := _m.Called(peer, selfId, incarnation)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Leave")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string, uint64) error); ok {
+		r0 = rf(peer, selfId, incarnation)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockIClient_Leave_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Leave'
+type MockIClient_Leave_Call struct {
+	*mock.Call
+}
+
+// Leave is a helper method to define mock.On call
+//   - peer string
+//   - selfId string
+//   - incarnation uint64
+func (_e *MockIClient_Expecter) Leave(peer interface{}, selfId interface{}, incarnation interface{}) *MockIClient_Leave_Call {
+	return &MockIClient_Leave_Call{Call: _e.mock.On("Leave", peer, selfId, incarnation)}
 }
 
-func (_c *MockIClient_JoinCluster_Call) Run(run func(peerId string, selfId string)) *MockIClient_JoinCluster_Call {
+func (_c *MockIClient_Leave_Call) Run(run func(peer string, selfId string, incarnation uint64)) *MockIClient_Leave_Call {
 	_c.Call.Run(func(args mock.Arguments) {
-		run(args[0].(string), args[1].(string))
+		run(args[0].(string), args[1].(string), args[2].(uint64))
 	})
 	return _c
 }
 
-func (_c *MockIClient_JoinCluster_Call) Return(_a0 []string, _a1 error) *MockIClient_JoinCluster_Call {
+func (_c *MockIClient_Leave_Call) Return(_a0 error) *MockIClient_Leave_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIClient_Leave_Call) RunAndReturn(run func(string, string, uint64) error) *MockIClient_Leave_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// PingReq provides a mock function with given fields: relay, selfId, target, targetAddr, ping
+func (_m *MockIClient) PingReq(relay string, selfId string, target string, targetAddr string, ping client.Ping) (client.Ack, error) {
+	ret := _m.Called(relay, selfId, target, targetAddr, ping)
+
+	if len(ret) == 0 {
+		panic("no return value specified for PingReq")
+	}
+
+	var r0 client.Ack
+	var r1 error
+	if rf, ok := ret.Get(0).(func(string, string, string, string, client.Ping) (client.Ack, error)); ok {
+		return rf(relay, selfId, target, targetAddr, ping)
+	}
+	if rf, ok := ret.Get(0).(func(string, string, string, string, client.Ping) client.Ack); ok {
+		r0 = rf(relay, selfId, target, targetAddr, ping)
+	} else {
+		r0 = ret.Get(0).(client.Ack)
+	}
+
+	if rf, ok := ret.Get(1).(func(string, string, string, string, client.Ping) error); ok {
+		r1 = rf(relay, selfId, target, targetAddr, ping)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// MockIClient_PingReq_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'PingReq'
+type MockIClient_PingReq_Call struct {
+	*mock.Call
+}
+
+// PingReq is a helper method to define mock.On call
+//   - relay string
+//   - selfId string
+//   - target string
+//   - targetAddr string
+//   - ping client.Ping
+func (_e *MockIClient_Expecter) PingReq(relay interface{}, selfId interface{}, target interface{}, targetAddr interface{}, ping interface{}) *MockIClient_PingReq_Call {
+	return &MockIClient_PingReq_Call{Call: _e.mock.On("PingReq", relay, selfId, target, targetAddr, ping)}
+}
+
+func (_c *MockIClient_PingReq_Call) Run(run func(relay string, selfId string, target string, targetAddr string, ping client.Ping)) *MockIClient_PingReq_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string), args[2].(string), args[3].(string), args[4].(client.Ping))
+	})
+	return _c
+}
+
+func (_c *MockIClient_PingReq_Call) Return(_a0 client.Ack, _a1 error) *MockIClient_PingReq_Call {
 	_c.Call.Return(_a0, _a1)
 	return _c
 }
 
-func (_c *MockIClient_JoinCluster_Call) RunAndReturn(run func(string, string) ([]string, error)) *MockIClient_JoinCluster_Call {
+func (_c *MockIClient_PingReq_Call) RunAndReturn(run func(string, string, string, string, client.Ping) (client.Ack, error)) *MockIClient_PingReq_Call {
 	_c.Call.Return(run)
 	return _c
 }
 
-// SendIncrement provides a mock function with given fields: peer, selfId, eventId
-func (_m *MockIClient) SendIncrement(peer string, selfId string, eventId string) error {
-	ret := _m.Called(peer, selfId, eventId)
+// PushState provides a mock function with given fields: peer, selfId, states
+func (_m *MockIClient) PushState(peer string, selfId string, states map[string]counter.State) error {
+	ret := _m.Called(peer, selfId, states)
+
+	if len(ret) == 0 {
+		panic("no return value specified for PushState")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string, map[string]counter.State) error); ok {
+		r0 = rf(peer, selfId, states)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockIClient_PushState_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'PushState'
+type MockIClient_PushState_Call struct {
+	*mock.Call
+}
+
+// PushState is a helper method to define mock.On call
+//   - peer string
+//   - selfId string
+//   - states map[string]counter.State
+func (_e *MockIClient_Expecter) PushState(peer interface{}, selfId interface{}, states interface{}) *MockIClient_PushState_Call {
+	return &MockIClient_PushState_Call{Call: _e.mock.On("PushState", peer, selfId, states)}
+}
+
+func (_c *MockIClient_PushState_Call) Run(run func(peer string, selfId string, states map[string]counter.State)) *MockIClient_PushState_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string), args[2].(map[string]counter.State))
+	})
+	return _c
+}
+
+func (_c *MockIClient_PushState_Call) Return(_a0 error) *MockIClient_PushState_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIClient_PushState_Call) RunAndReturn(run func(string, string, map[string]counter.State) error) *MockIClient_PushState_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// SendIncrement provides a mock function with given fields: peer, selfId, event
+func (_m *MockIClient) SendIncrement(peer string, selfId string, event counter.Event) error {
+	ret := _m.Called(peer, selfId, event)
 
 	if len(ret) == 0 {
 		panic("no return value specified for SendIncrement")
 	}
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string, string, string) error); ok {
-		r0 = rf(peer, selfId, eventId)
+	if rf, ok := ret.Get(0).(func(string, string, counter.Event) error); ok {
+		r0 = rf(peer, selfId, event)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -149,14 +376,14 @@ type MockIClient_SendIncrement_Call struct {
 // SendIncrement is a helper method to define mock.On call
 //   - peer string
 //   - selfId string
-//   - eventId string
-func (_e *MockIClient_Expecter) SendIncrement(peer interface{}, selfId interface{}, eventId interface{}) *MockIClient_SendIncrement_Call {
-	return &MockIClient_SendIncrement_Call{Call: _e.mock.On("SendIncrement", peer, selfId, eventId)}
+//   - event counter.Event
+func (_e *MockIClient_Expecter) SendIncrement(peer interface{}, selfId interface{}, event interface{}) *MockIClient_SendIncrement_Call {
+	return &MockIClient_SendIncrement_Call{Call: _e.mock.On("SendIncrement", peer, selfId, event)}
 }
 
-func (_c *MockIClient_SendIncrement_Call) Run(run func(peer string, selfId string, eventId string)) *MockIClient_SendIncrement_Call {
+func (_c *MockIClient_SendIncrement_Call) Run(run func(peer string, selfId string, event counter.Event)) *MockIClient_SendIncrement_Call {
 	_c.Call.Run(func(args mock.Arguments) {
-		run(args[0].(string), args[1].(string), args[2].(string))
+		run(args[0].(string), args[1].(string), args[2].(counter.Event))
 	})
 	return _c
 }
@@ -166,7 +393,173 @@ func (_c *MockIClient_SendIncrement_Call) Return(_a0 error) *MockIClient_SendInc
 	return _c
 }
 
-func (_c *MockIClient_SendIncrement_Call) RunAndReturn(run func(string, string, string) error) *MockIClient_SendIncrement_Call {
+func (_c *MockIClient_SendIncrement_Call) RunAndReturn(run func(string, string, counter.Event) error) *MockIClient_SendIncrement_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// SendIncrements provides a mock function with given fields: peer, selfId, events
+func (_m *MockIClient) SendIncrements(peer string, selfId string, events []counter.Event) ([]client.ReplicateResult, error) {
+	ret := _m.Called(peer, selfId, events)
+
+	if len(ret) == 0 {
+		panic("no return value specified for SendIncrements")
+	}
+
+	var r0 []client.ReplicateResult
+	var r1 error
+	if rf, ok := ret.Get(0).(func(string, string, []counter.Event) ([]client.ReplicateResult, error)); ok {
+		return rf(peer, selfId, events)
+	}
+	if rf, ok := ret.Get(0).(func(string, string, []counter.Event) []client.ReplicateResult); ok {
+		r0 = rf(peer, selfId, events)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]client.ReplicateResult)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(string, string, []counter.Event) error); ok {
+		r1 = rf(peer, selfId, events)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// MockIClient_SendIncrements_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'SendIncrements'
+type MockIClient_SendIncrements_Call struct {
+	*mock.Call
+}
+
+// SendIncrements is a helper method to define mock.On call
+//   - peer string
+//   - selfId string
+//   - events []counter.Event
+func (_e *MockIClient_Expecter) SendIncrements(peer interface{}, selfId interface{}, events interface{}) *MockIClient_SendIncrements_Call {
+	return &MockIClient_SendIncrements_Call{Call: _e.mock.On("SendIncrements", peer, selfId, events)}
+}
+
+func (_c *MockIClient_SendIncrements_Call) Run(run func(peer string, selfId string, events []counter.Event)) *MockIClient_SendIncrements_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string), args[2].([]counter.Event))
+	})
+	return _c
+}
+
+func (_c *MockIClient_SendIncrements_Call) Return(_a0 []client.ReplicateResult, _a1 error) *MockIClient_SendIncrements_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *MockIClient_SendIncrements_Call) RunAndReturn(run func(string, string, []counter.Event) ([]client.ReplicateResult, error)) *MockIClient_SendIncrements_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// SendInstance provides a mock function with given fields: peer, selfId, inst
+func (_m *MockIClient) SendInstance(peer string, selfId string, inst registry.Instance) error {
+	ret := _m.Called(peer, selfId, inst)
+
+	if len(ret) == 0 {
+		panic("no return value specified for SendInstance")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string, string, registry.Instance) error); ok {
+		r0 = rf(peer, selfId, inst)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockIClient_SendInstance_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'SendInstance'
+type MockIClient_SendInstance_Call struct {
+	*mock.Call
+}
+
+// SendInstance is a helper method to define mock.On call
+//   - peer string
+//   - selfId string
+//   - inst registry.Instance
+func (_e *MockIClient_Expecter) SendInstance(peer interface{}, selfId interface{}, inst interface{}) *MockIClient_SendInstance_Call {
+	return &MockIClient_SendInstance_Call{Call: _e.mock.On("SendInstance", peer, selfId, inst)}
+}
+
+func (_c *MockIClient_SendInstance_Call) Run(run func(peer string, selfId string, inst registry.Instance)) *MockIClient_SendInstance_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string), args[2].(registry.Instance))
+	})
+	return _c
+}
+
+func (_c *MockIClient_SendInstance_Call) Return(_a0 error) *MockIClient_SendInstance_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIClient_SendInstance_Call) RunAndReturn(run func(string, string, registry.Instance) error) *MockIClient_SendInstance_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// SyncDigest provides a mock function with given fields: peer, selfId, digests
+func (_m *MockIClient) SyncDigest(peer string, selfId string, digests map[string]counter.Digest) (client.SyncResponse, error) {
+	ret := _m.Called(peer, selfId, digests)
+
+	if len(ret) == 0 {
+		panic("no return value specified for SyncDigest")
+	}
+
+	var r0 client.SyncResponse
+	var r1 error
+	if rf, ok := ret.Get(0).(func(string, string, map[string]counter.Digest) (client.SyncResponse, error)); ok {
+		return rf(peer, selfId, digests)
+	}
+	if rf, ok := ret.Get(0).(func(string, string, map[string]counter.Digest) client.SyncResponse); ok {
+		r0 = rf(peer, selfId, digests)
+	} else {
+		r0 = ret.Get(0).(client.SyncResponse)
+	}
+
+	if rf, ok := ret.Get(1).(func(string, string, map[string]counter.Digest) error); ok {
+		r1 = rf(peer, selfId, digests)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// MockIClient_SyncDigest_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'SyncDigest'
+type MockIClient_SyncDigest_Call struct {
+	*mock.Call
+}
+
+// SyncDigest is a helper method to define mock.On call
+//   - peer string
+//   - selfId string
+//   - digests map[string]counter.Digest
+func (_e *MockIClient_Expecter) SyncDigest(peer interface{}, selfId interface{}, digests interface{}) *MockIClient_SyncDigest_Call {
+	return &MockIClient_SyncDigest_Call{Call: _e.mock.On("SyncDigest", peer, selfId, digests)}
+}
+
+func (_c *MockIClient_SyncDigest_Call) Run(run func(peer string, selfId string, digests map[string]counter.Digest)) *MockIClient_SyncDigest_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string), args[2].(map[string]counter.Digest))
+	})
+	return _c
+}
+
+func (_c *MockIClient_SyncDigest_Call) Return(_a0 client.SyncResponse, _a1 error) *MockIClient_SyncDigest_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *MockIClient_SyncDigest_Call) RunAndReturn(run func(string, string, map[string]counter.Digest) (client.SyncResponse, error)) *MockIClient_SyncDigest_Call {
 	_c.Call.Return(run)
 	return _c
 }
@@ -3,8 +3,12 @@
 package peerStore
 
 import (
+	context "context"
+
 	mock "github.com/stretchr/testify/mock"
 
+	peerStore "service_discovery/pkg/peerStore"
+
 	time "time"
 )
 
@@ -54,6 +58,240 @@ func (_c *MockIPeerStore_AddPeer_Call) RunAndReturn(run func(string)) *MockIPeer
 	return _c
 }
 
+// Alive provides a mock function with given fields: peerId, addr, incarnation, meta
+func (_m *MockIPeerStore) Alive(peerId string, addr string, incarnation uint64, meta peerStore.Meta) {
+	_m.Called(peerId, addr, incarnation, meta)
+}
+
+// MockIPeerStore_Alive_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Alive'
+type MockIPeerStore_Alive_Call struct {
+	*mock.Call
+}
+
+// Alive is a helper method to define mock.On call
+//   - peerId string
+//   - addr string
+//   - incarnation uint64
+//   - meta peerStore.Meta
+func (_e *MockIPeerStore_Expecter) Alive(peerId interface{}, addr interface{}, incarnation interface{}, meta interface{}) *MockIPeerStore_Alive_Call {
+	return &MockIPeerStore_Alive_Call{Call: _e.mock.On("Alive", peerId, addr, incarnation, meta)}
+}
+
+func (_c *MockIPeerStore_Alive_Call) Run(run func(peerId string, addr string, incarnation uint64, meta peerStore.Meta)) *MockIPeerStore_Alive_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string), args[2].(uint64), args[3].(peerStore.Meta))
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_Alive_Call) Return() *MockIPeerStore_Alive_Call {
+	_c.Call.Return()
+	return _c
+}
+
+func (_c *MockIPeerStore_Alive_Call) RunAndReturn(run func(string, string, uint64, peerStore.Meta)) *MockIPeerStore_Alive_Call {
+	_c.Run(run)
+	return _c
+}
+
+// Apply provides a mock function with given fields: u
+func (_m *MockIPeerStore) Apply(u peerStore.Update) bool {
+	ret := _m.Called(u)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Apply")
+	}
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(peerStore.Update) bool); ok {
+		r0 = rf(u)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	return r0
+}
+
+// MockIPeerStore_Apply_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Apply'
+type MockIPeerStore_Apply_Call struct {
+	*mock.Call
+}
+
+// Apply is a helper method to define mock.On call
+//   - u peerStore.Update
+func (_e *MockIPeerStore_Expecter) Apply(u interface{}) *MockIPeerStore_Apply_Call {
+	return &MockIPeerStore_Apply_Call{Call: _e.mock.On("Apply", u)}
+}
+
+func (_c *MockIPeerStore_Apply_Call) Run(run func(u peerStore.Update)) *MockIPeerStore_Apply_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(peerStore.Update))
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_Apply_Call) Return(_a0 bool) *MockIPeerStore_Apply_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerStore_Apply_Call) RunAndReturn(run func(peerStore.Update) bool) *MockIPeerStore_Apply_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Broadcasts provides a mock function with given fields: limit
+func (_m *MockIPeerStore) Broadcasts(limit int) []peerStore.Update {
+	ret := _m.Called(limit)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Broadcasts")
+	}
+
+	var r0 []peerStore.Update
+	if rf, ok := ret.Get(0).(func(int) []peerStore.Update); ok {
+		r0 = rf(limit)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]peerStore.Update)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerStore_Broadcasts_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Broadcasts'
+type MockIPeerStore_Broadcasts_Call struct {
+	*mock.Call
+}
+
+// Broadcasts is a helper method to define mock.On call
+//   - limit int
+func (_e *MockIPeerStore_Expecter) Broadcasts(limit interface{}) *MockIPeerStore_Broadcasts_Call {
+	return &MockIPeerStore_Broadcasts_Call{Call: _e.mock.On("Broadcasts", limit)}
+}
+
+func (_c *MockIPeerStore_Broadcasts_Call) Run(run func(limit int)) *MockIPeerStore_Broadcasts_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(int))
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_Broadcasts_Call) Return(_a0 []peerStore.Update) *MockIPeerStore_Broadcasts_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerStore_Broadcasts_Call) RunAndReturn(run func(int) []peerStore.Update) *MockIPeerStore_Broadcasts_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// ExpireSuspects provides a mock function with given fields: timeout
+func (_m *MockIPeerStore) ExpireSuspects(timeout time.Duration) []string {
+	ret := _m.Called(timeout)
+
+	if len(ret) == 0 {
+		panic("no return value specified for ExpireSuspects")
+	}
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(time.Duration) []string); ok {
+		r0 = rf(timeout)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerStore_ExpireSuspects_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ExpireSuspects'
+type MockIPeerStore_ExpireSuspects_Call struct {
+	*mock.Call
+}
+
+// ExpireSuspects is a helper method to define mock.On call
+//   - timeout time.Duration
+func (_e *MockIPeerStore_Expecter) ExpireSuspects(timeout interface{}) *MockIPeerStore_ExpireSuspects_Call {
+	return &MockIPeerStore_ExpireSuspects_Call{Call: _e.mock.On("ExpireSuspects", timeout)}
+}
+
+func (_c *MockIPeerStore_ExpireSuspects_Call) Run(run func(timeout time.Duration)) *MockIPeerStore_ExpireSuspects_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(time.Duration))
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_ExpireSuspects_Call) Return(_a0 []string) *MockIPeerStore_ExpireSuspects_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerStore_ExpireSuspects_Call) RunAndReturn(run func(time.Duration) []string) *MockIPeerStore_ExpireSuspects_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// GetMember provides a mock function with given fields: peerId
+func (_m *MockIPeerStore) GetMember(peerId string) (peerStore.Member, bool) {
+	ret := _m.Called(peerId)
+
+	if len(ret) == 0 {
+		panic("no return value specified for GetMember")
+	}
+
+	var r0 peerStore.Member
+	var r1 bool
+	if rf, ok := ret.Get(0).(func(string) (peerStore.Member, bool)); ok {
+		return rf(peerId)
+	}
+	if rf, ok := ret.Get(0).(func(string) peerStore.Member); ok {
+		r0 = rf(peerId)
+	} else {
+		r0 = ret.Get(0).(peerStore.Member)
+	}
+
+	if rf, ok := ret.Get(1).(func(string) bool); ok {
+		r1 = rf(peerId)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	return r0, r1
+}
+
+// MockIPeerStore_GetMember_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'GetMember'
+type MockIPeerStore_GetMember_Call struct {
+	*mock.Call
+}
+
+// GetMember is a helper method to define mock.On call
+//   - peerId string
+func (_e *MockIPeerStore_Expecter) GetMember(peerId interface{}) *MockIPeerStore_GetMember_Call {
+	return &MockIPeerStore_GetMember_Call{Call: _e.mock.On("GetMember", peerId)}
+}
+
+func (_c *MockIPeerStore_GetMember_Call) Run(run func(peerId string)) *MockIPeerStore_GetMember_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string))
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_GetMember_Call) Return(_a0 peerStore.Member, _a1 bool) *MockIPeerStore_GetMember_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *MockIPeerStore_GetMember_Call) RunAndReturn(run func(string) (peerStore.Member, bool)) *MockIPeerStore_GetMember_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // GetPeers provides a mock function with no fields
 func (_m *MockIPeerStore) GetPeers() []string {
 	ret := _m.Called()
@@ -101,6 +339,192 @@ func (_c *MockIPeerStore_GetPeers_Call) RunAndReturn(run func() []string) *MockI
 	return _c
 }
 
+// Members provides a mock function with no fields
+func (_m *MockIPeerStore) Members() []peerStore.Member {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for Members")
+	}
+
+	var r0 []peerStore.Member
+	if rf, ok := ret.Get(0).(func() []peerStore.Member); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]peerStore.Member)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerStore_Members_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Members'
+type MockIPeerStore_Members_Call struct {
+	*mock.Call
+}
+
+// Members is a helper method to define mock.On call
+func (_e *MockIPeerStore_Expecter) Members() *MockIPeerStore_Members_Call {
+	return &MockIPeerStore_Members_Call{Call: _e.mock.On("Members")}
+}
+
+func (_c *MockIPeerStore_Members_Call) Run(run func()) *MockIPeerStore_Members_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_Members_Call) Return(_a0 []peerStore.Member) *MockIPeerStore_Members_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerStore_Members_Call) RunAndReturn(run func() []peerStore.Member) *MockIPeerStore_Members_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// MembershipIndex provides a mock function with no fields
+func (_m *MockIPeerStore) MembershipIndex() uint64 {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for MembershipIndex")
+	}
+
+	var r0 uint64
+	if rf, ok := ret.Get(0).(func() uint64); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(uint64)
+	}
+
+	return r0
+}
+
+// MockIPeerStore_MembershipIndex_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'MembershipIndex'
+type MockIPeerStore_MembershipIndex_Call struct {
+	*mock.Call
+}
+
+// MembershipIndex is a helper method to define mock.On call
+func (_e *MockIPeerStore_Expecter) MembershipIndex() *MockIPeerStore_MembershipIndex_Call {
+	return &MockIPeerStore_MembershipIndex_Call{Call: _e.mock.On("MembershipIndex")}
+}
+
+func (_c *MockIPeerStore_MembershipIndex_Call) Run(run func()) *MockIPeerStore_MembershipIndex_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_MembershipIndex_Call) Return(_a0 uint64) *MockIPeerStore_MembershipIndex_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerStore_MembershipIndex_Call) RunAndReturn(run func() uint64) *MockIPeerStore_MembershipIndex_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// PruneTombstones provides a mock function with given fields: ttl
+func (_m *MockIPeerStore) PruneTombstones(ttl time.Duration) []string {
+	ret := _m.Called(ttl)
+
+	if len(ret) == 0 {
+		panic("no return value specified for PruneTombstones")
+	}
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(time.Duration) []string); ok {
+		r0 = rf(ttl)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerStore_PruneTombstones_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'PruneTombstones'
+type MockIPeerStore_PruneTombstones_Call struct {
+	*mock.Call
+}
+
+// PruneTombstones is a helper method to define mock.On call
+//   - ttl time.Duration
+func (_e *MockIPeerStore_Expecter) PruneTombstones(ttl interface{}) *MockIPeerStore_PruneTombstones_Call {
+	return &MockIPeerStore_PruneTombstones_Call{Call: _e.mock.On("PruneTombstones", ttl)}
+}
+
+func (_c *MockIPeerStore_PruneTombstones_Call) Run(run func(ttl time.Duration)) *MockIPeerStore_PruneTombstones_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(time.Duration))
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_PruneTombstones_Call) Return(_a0 []string) *MockIPeerStore_PruneTombstones_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerStore_PruneTombstones_Call) RunAndReturn(run func(time.Duration) []string) *MockIPeerStore_PruneTombstones_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Refute provides a mock function with given fields: incarnation
+func (_m *MockIPeerStore) Refute(incarnation uint64) uint64 {
+	ret := _m.Called(incarnation)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Refute")
+	}
+
+	var r0 uint64
+	if rf, ok := ret.Get(0).(func(uint64) uint64); ok {
+		r0 = rf(incarnation)
+	} else {
+		r0 = ret.Get(0).(uint64)
+	}
+
+	return r0
+}
+
+// MockIPeerStore_Refute_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Refute'
+type MockIPeerStore_Refute_Call struct {
+	*mock.Call
+}
+
+// Refute is a helper method to define mock.On call
+//   - incarnation uint64
+func (_e *MockIPeerStore_Expecter) Refute(incarnation interface{}) *MockIPeerStore_Refute_Call {
+	return &MockIPeerStore_Refute_Call{Call: _e.mock.On("Refute", incarnation)}
+}
+
+func (_c *MockIPeerStore_Refute_Call) Run(run func(incarnation uint64)) *MockIPeerStore_Refute_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(uint64))
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_Refute_Call) Return(_a0 uint64) *MockIPeerStore_Refute_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerStore_Refute_Call) RunAndReturn(run func(uint64) uint64) *MockIPeerStore_Refute_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // RemovePeer provides a mock function with given fields: peerId
 func (_m *MockIPeerStore) RemovePeer(peerId string) {
 	_m.Called(peerId)
@@ -134,6 +558,51 @@ func (_c *MockIPeerStore_RemovePeer_Call) RunAndReturn(run func(string)) *MockIP
 	return _c
 }
 
+// SelfAddr provides a mock function with no fields
+func (_m *MockIPeerStore) SelfAddr() string {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for SelfAddr")
+	}
+
+	var r0 string
+	if rf, ok := ret.Get(0).(func() string); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(string)
+	}
+
+	return r0
+}
+
+// MockIPeerStore_SelfAddr_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'SelfAddr'
+type MockIPeerStore_SelfAddr_Call struct {
+	*mock.Call
+}
+
+// SelfAddr is a helper method to define mock.On call
+func (_e *MockIPeerStore_Expecter) SelfAddr() *MockIPeerStore_SelfAddr_Call {
+	return &MockIPeerStore_SelfAddr_Call{Call: _e.mock.On("SelfAddr")}
+}
+
+func (_c *MockIPeerStore_SelfAddr_Call) Run(run func()) *MockIPeerStore_SelfAddr_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_SelfAddr_Call) Return(_a0 string) *MockIPeerStore_SelfAddr_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerStore_SelfAddr_Call) RunAndReturn(run func() string) *MockIPeerStore_SelfAddr_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // SelfID provides a mock function with no fields
 func (_m *MockIPeerStore) SelfID() string {
 	ret := _m.Called()
@@ -179,6 +648,96 @@ func (_c *MockIPeerStore_SelfID_Call) RunAndReturn(run func() string) *MockIPeer
 	return _c
 }
 
+// SelfIncarnation provides a mock function with no fields
+func (_m *MockIPeerStore) SelfIncarnation() uint64 {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for SelfIncarnation")
+	}
+
+	var r0 uint64
+	if rf, ok := ret.Get(0).(func() uint64); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(uint64)
+	}
+
+	return r0
+}
+
+// MockIPeerStore_SelfIncarnation_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'SelfIncarnation'
+type MockIPeerStore_SelfIncarnation_Call struct {
+	*mock.Call
+}
+
+// SelfIncarnation is a helper method to define mock.On call
+func (_e *MockIPeerStore_Expecter) SelfIncarnation() *MockIPeerStore_SelfIncarnation_Call {
+	return &MockIPeerStore_SelfIncarnation_Call{Call: _e.mock.On("SelfIncarnation")}
+}
+
+func (_c *MockIPeerStore_SelfIncarnation_Call) Run(run func()) *MockIPeerStore_SelfIncarnation_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_SelfIncarnation_Call) Return(_a0 uint64) *MockIPeerStore_SelfIncarnation_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerStore_SelfIncarnation_Call) RunAndReturn(run func() uint64) *MockIPeerStore_SelfIncarnation_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// SelfMeta provides a mock function with no fields
+func (_m *MockIPeerStore) SelfMeta() peerStore.Meta {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for SelfMeta")
+	}
+
+	var r0 peerStore.Meta
+	if rf, ok := ret.Get(0).(func() peerStore.Meta); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(peerStore.Meta)
+	}
+
+	return r0
+}
+
+// MockIPeerStore_SelfMeta_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'SelfMeta'
+type MockIPeerStore_SelfMeta_Call struct {
+	*mock.Call
+}
+
+// SelfMeta is a helper method to define mock.On call
+func (_e *MockIPeerStore_Expecter) SelfMeta() *MockIPeerStore_SelfMeta_Call {
+	return &MockIPeerStore_SelfMeta_Call{Call: _e.mock.On("SelfMeta")}
+}
+
+func (_c *MockIPeerStore_SelfMeta_Call) Run(run func()) *MockIPeerStore_SelfMeta_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_SelfMeta_Call) Return(_a0 peerStore.Meta) *MockIPeerStore_SelfMeta_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerStore_SelfMeta_Call) RunAndReturn(run func() peerStore.Meta) *MockIPeerStore_SelfMeta_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // SnapshotOfPeers provides a mock function with no fields
 func (_m *MockIPeerStore) SnapshotOfPeers() map[string]time.Time {
 	ret := _m.Called()
@@ -226,6 +785,181 @@ func (_c *MockIPeerStore_SnapshotOfPeers_Call) RunAndReturn(run func() map[strin
 	return _c
 }
 
+// SuspectByPhi provides a mock function with given fields: threshold
+func (_m *MockIPeerStore) SuspectByPhi(threshold float64) []string {
+	ret := _m.Called(threshold)
+
+	if len(ret) == 0 {
+		panic("no return value specified for SuspectByPhi")
+	}
+
+	var r0 []string
+	if rf, ok := ret.Get(0).(func(float64) []string); ok {
+		r0 = rf(threshold)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]string)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerStore_SuspectByPhi_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'SuspectByPhi'
+type MockIPeerStore_SuspectByPhi_Call struct {
+	*mock.Call
+}
+
+// SuspectByPhi is a helper method to define mock.On call
+//   - threshold float64
+func (_e *MockIPeerStore_Expecter) SuspectByPhi(threshold interface{}) *MockIPeerStore_SuspectByPhi_Call {
+	return &MockIPeerStore_SuspectByPhi_Call{Call: _e.mock.On("SuspectByPhi", threshold)}
+}
+
+func (_c *MockIPeerStore_SuspectByPhi_Call) Run(run func(threshold float64)) *MockIPeerStore_SuspectByPhi_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(float64))
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_SuspectByPhi_Call) Return(_a0 []string) *MockIPeerStore_SuspectByPhi_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerStore_SuspectByPhi_Call) RunAndReturn(run func(float64) []string) *MockIPeerStore_SuspectByPhi_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// SuspectPeer provides a mock function with given fields: peerId
+func (_m *MockIPeerStore) SuspectPeer(peerId string) {
+	_m.Called(peerId)
+}
+
+// MockIPeerStore_SuspectPeer_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'SuspectPeer'
+type MockIPeerStore_SuspectPeer_Call struct {
+	*mock.Call
+}
+
+// SuspectPeer is a helper method to define mock.On call
+//   - peerId string
+func (_e *MockIPeerStore_Expecter) SuspectPeer(peerId interface{}) *MockIPeerStore_SuspectPeer_Call {
+	return &MockIPeerStore_SuspectPeer_Call{Call: _e.mock.On("SuspectPeer", peerId)}
+}
+
+func (_c *MockIPeerStore_SuspectPeer_Call) Run(run func(peerId string)) *MockIPeerStore_SuspectPeer_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string))
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_SuspectPeer_Call) Return() *MockIPeerStore_SuspectPeer_Call {
+	_c.Call.Return()
+	return _c
+}
+
+func (_c *MockIPeerStore_SuspectPeer_Call) RunAndReturn(run func(string)) *MockIPeerStore_SuspectPeer_Call {
+	_c.Run(run)
+	return _c
+}
+
+// View provides a mock function with no fields
+func (_m *MockIPeerStore) View() []peerStore.Update {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for View")
+	}
+
+	var r0 []peerStore.Update
+	if rf, ok := ret.Get(0).(func() []peerStore.Update); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]peerStore.Update)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerStore_View_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'View'
+type MockIPeerStore_View_Call struct {
+	*mock.Call
+}
+
+// View is a helper method to define mock.On call
+func (_e *MockIPeerStore_Expecter) View() *MockIPeerStore_View_Call {
+	return &MockIPeerStore_View_Call{Call: _e.mock.On("View")}
+}
+
+func (_c *MockIPeerStore_View_Call) Run(run func()) *MockIPeerStore_View_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_View_Call) Return(_a0 []peerStore.Update) *MockIPeerStore_View_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerStore_View_Call) RunAndReturn(run func() []peerStore.Update) *MockIPeerStore_View_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// WaitIndex provides a mock function with given fields: ctx, index
+func (_m *MockIPeerStore) WaitIndex(ctx context.Context, index uint64) uint64 {
+	ret := _m.Called(ctx, index)
+
+	if len(ret) == 0 {
+		panic("no return value specified for WaitIndex")
+	}
+
+	var r0 uint64
+	if rf, ok := ret.Get(0).(func(context.Context, uint64) uint64); ok {
+		r0 = rf(ctx, index)
+	} else {
+		r0 = ret.Get(0).(uint64)
+	}
+
+	return r0
+}
+
+// MockIPeerStore_WaitIndex_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'WaitIndex'
+type MockIPeerStore_WaitIndex_Call struct {
+	*mock.Call
+}
+
+// WaitIndex is a helper method to define mock.On call
+//   - ctx context.Context
+//   - index uint64
+func (_e *MockIPeerStore_Expecter) WaitIndex(ctx interface{}, index interface{}) *MockIPeerStore_WaitIndex_Call {
+	return &MockIPeerStore_WaitIndex_Call{Call: _e.mock.On("WaitIndex", ctx, index)}
+}
+
+func (_c *MockIPeerStore_WaitIndex_Call) Run(run func(ctx context.Context, index uint64)) *MockIPeerStore_WaitIndex_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(context.Context), args[1].(uint64))
+	})
+	return _c
+}
+
+func (_c *MockIPeerStore_WaitIndex_Call) Return(_a0 uint64) *MockIPeerStore_WaitIndex_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerStore_WaitIndex_Call) RunAndReturn(run func(context.Context, uint64) uint64) *MockIPeerStore_WaitIndex_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // NewMockIPeerStore creates a new instance of MockIPeerStore. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
 // The first argument is typically a *testing.T value.
 func NewMockIPeerStore(t interface {
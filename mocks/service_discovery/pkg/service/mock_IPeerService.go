@@ -2,7 +2,23 @@
 
 package service
 
-import mock "github.com/stretchr/testify/mock"
+import (
+	client "service_discovery/pkg/client"
+
+	context "context"
+
+	counter "service_discovery/pkg/counter"
+
+	events "service_discovery/pkg/events"
+
+	mock "github.com/stretchr/testify/mock"
+
+	peerStore "service_discovery/pkg/peerStore"
+
+	registry "service_discovery/pkg/registry"
+
+	service "service_discovery/pkg/service"
+)
 
 // MockIPeerService is an autogenerated mock type for the IPeerService type
 type MockIPeerService struct {
@@ -17,6 +33,53 @@ func (_m *MockIPeerService) EXPECT() *MockIPeerService_Expecter {
 	return &MockIPeerService_Expecter{mock: &_m.Mock}
 }
 
+// Ack provides a mock function with given fields: from, ping
+func (_m *MockIPeerService) Ack(from string, ping client.Ping) client.Ack {
+	ret := _m.Called(from, ping)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Ack")
+	}
+
+	var r0 client.Ack
+	if rf, ok := ret.Get(0).(func(string, client.Ping) client.Ack); ok {
+		r0 = rf(from, ping)
+	} else {
+		r0 = ret.Get(0).(client.Ack)
+	}
+
+	return r0
+}
+
+// MockIPeerService_Ack_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Ack'
+type MockIPeerService_Ack_Call struct {
+	*mock.Call
+}
+
+// Ack is a helper method to define mock.On call
+//   - from string
+//   - ping client.Ping
+func (_e *MockIPeerService_Expecter) Ack(from interface{}, ping interface{}) *MockIPeerService_Ack_Call {
+	return &MockIPeerService_Ack_Call{Call: _e.mock.On("Ack", from, ping)}
+}
+
+func (_c *MockIPeerService_Ack_Call) Run(run func(from string, ping client.Ping)) *MockIPeerService_Ack_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(client.Ping))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Ack_Call) Return(_a0 client.Ack) *MockIPeerService_Ack_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_Ack_Call) RunAndReturn(run func(string, client.Ping) client.Ack) *MockIPeerService_Ack_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // AddPeer provides a mock function with given fields: peer
 func (_m *MockIPeerService) AddPeer(peer string) {
 	_m.Called(peer)
@@ -50,22 +113,209 @@ func (_c *MockIPeerService_AddPeer_Call) RunAndReturn(run func(string)) *MockIPe
 	return _c
 }
 
-// GetCounterValue provides a mock function with no fields
-func (_m *MockIPeerService) GetCounterValue() int64 {
+// Alive provides a mock function with given fields: peer, addr, incarnation, meta
+func (_m *MockIPeerService) Alive(peer string, addr string, incarnation uint64, meta peerStore.Meta) {
+	_m.Called(peer, addr, incarnation, meta)
+}
+
+// MockIPeerService_Alive_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Alive'
+type MockIPeerService_Alive_Call struct {
+	*mock.Call
+}
+
+// Alive is a helper method to define mock.On call
+//   - peer string
+//   - addr string
+//   - incarnation uint64
+//   - meta peerStore.Meta
+func (_e *MockIPeerService_Expecter) Alive(peer interface{}, addr interface{}, incarnation interface{}, meta interface{}) *MockIPeerService_Alive_Call {
+	return &MockIPeerService_Alive_Call{Call: _e.mock.On("Alive", peer, addr, incarnation, meta)}
+}
+
+func (_c *MockIPeerService_Alive_Call) Run(run func(peer string, addr string, incarnation uint64, meta peerStore.Meta)) *MockIPeerService_Alive_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string), args[2].(uint64), args[3].(peerStore.Meta))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Alive_Call) Return() *MockIPeerService_Alive_Call {
+	_c.Call.Return()
+	return _c
+}
+
+func (_c *MockIPeerService_Alive_Call) RunAndReturn(run func(string, string, uint64, peerStore.Meta)) *MockIPeerService_Alive_Call {
+	_c.Run(run)
+	return _c
+}
+
+// BreakerStates provides a mock function with no fields
+func (_m *MockIPeerService) BreakerStates() []client.BreakerStatus {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for BreakerStates")
+	}
+
+	var r0 []client.BreakerStatus
+	if rf, ok := ret.Get(0).(func() []client.BreakerStatus); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]client.BreakerStatus)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerService_BreakerStates_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'BreakerStates'
+type MockIPeerService_BreakerStates_Call struct {
+	*mock.Call
+}
+
+// BreakerStates is a helper method to define mock.On call
+func (_e *MockIPeerService_Expecter) BreakerStates() *MockIPeerService_BreakerStates_Call {
+	return &MockIPeerService_BreakerStates_Call{Call: _e.mock.On("BreakerStates")}
+}
+
+func (_c *MockIPeerService_BreakerStates_Call) Run(run func()) *MockIPeerService_BreakerStates_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_BreakerStates_Call) Return(_a0 []client.BreakerStatus) *MockIPeerService_BreakerStates_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_BreakerStates_Call) RunAndReturn(run func() []client.BreakerStatus) *MockIPeerService_BreakerStates_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// CounterStates provides a mock function with no fields
+func (_m *MockIPeerService) CounterStates() map[string]counter.State {
 	ret := _m.Called()
 
+	if len(ret) == 0 {
+		panic("no return value specified for CounterStates")
+	}
+
+	var r0 map[string]counter.State
+	if rf, ok := ret.Get(0).(func() map[string]counter.State); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]counter.State)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerService_CounterStates_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'CounterStates'
+type MockIPeerService_CounterStates_Call struct {
+	*mock.Call
+}
+
+// CounterStates is a helper method to define mock.On call
+func (_e *MockIPeerService_Expecter) CounterStates() *MockIPeerService_CounterStates_Call {
+	return &MockIPeerService_CounterStates_Call{Call: _e.mock.On("CounterStates")}
+}
+
+func (_c *MockIPeerService_CounterStates_Call) Run(run func()) *MockIPeerService_CounterStates_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_CounterStates_Call) Return(_a0 map[string]counter.State) *MockIPeerService_CounterStates_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_CounterStates_Call) RunAndReturn(run func() map[string]counter.State) *MockIPeerService_CounterStates_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Deregister provides a mock function with given fields: service, id
+func (_m *MockIPeerService) Deregister(service string, id string) bool {
+	ret := _m.Called(service, id)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Deregister")
+	}
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func(string, string) bool); ok {
+		r0 = rf(service, id)
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	return r0
+}
+
+// MockIPeerService_Deregister_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Deregister'
+type MockIPeerService_Deregister_Call struct {
+	*mock.Call
+}
+
+// Deregister is a helper method to define mock.On call
+//   - service string
+//   - id string
+func (_e *MockIPeerService_Expecter) Deregister(service interface{}, id interface{}) *MockIPeerService_Deregister_Call {
+	return &MockIPeerService_Deregister_Call{Call: _e.mock.On("Deregister", service, id)}
+}
+
+func (_c *MockIPeerService_Deregister_Call) Run(run func(service string, id string)) *MockIPeerService_Deregister_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Deregister_Call) Return(_a0 bool) *MockIPeerService_Deregister_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_Deregister_Call) RunAndReturn(run func(string, string) bool) *MockIPeerService_Deregister_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// GetCounterValue provides a mock function with given fields: name
+func (_m *MockIPeerService) GetCounterValue(name string) (int64, bool) {
+	ret := _m.Called(name)
+
 	if len(ret) == 0 {
 		panic("no return value specified for GetCounterValue")
 	}
 
 	var r0 int64
-	if rf, ok := ret.Get(0).(func() int64); ok {
-		r0 = rf()
+	var r1 bool
+	if rf, ok := ret.Get(0).(func(string) (int64, bool)); ok {
+		return rf(name)
+	}
+	if rf, ok := ret.Get(0).(func(string) int64); ok {
+		r0 = rf(name)
 	} else {
 		r0 = ret.Get(0).(int64)
 	}
 
-	return r0
+	if rf, ok := ret.Get(1).(func(string) bool); ok {
+		r1 = rf(name)
+	} else {
+		r1 = ret.Get(1).(bool)
+	}
+
+	return r0, r1
 }
 
 // MockIPeerService_GetCounterValue_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'GetCounterValue'
@@ -74,23 +324,24 @@ type MockIPeerService_GetCounterValue_Call struct {
 }
 
 // GetCounterValue is a helper method to define mock.On call
-func (_e *MockIPeerService_Expecter) GetCounterValue() *MockIPeerService_GetCounterValue_Call {
-	return &MockIPeerService_GetCounterValue_Call{Call: _e.mock.On("GetCounterValue")}
+//   - name string
+func (_e *MockIPeerService_Expecter) GetCounterValue(name interface{}) *MockIPeerService_GetCounterValue_Call {
+	return &MockIPeerService_GetCounterValue_Call{Call: _e.mock.On("GetCounterValue", name)}
 }
 
-func (_c *MockIPeerService_GetCounterValue_Call) Run(run func()) *MockIPeerService_GetCounterValue_Call {
+func (_c *MockIPeerService_GetCounterValue_Call) Run(run func(name string)) *MockIPeerService_GetCounterValue_Call {
 	_c.Call.Run(func(args mock.Arguments) {
-		run()
+		run(args[0].(string))
 	})
 	return _c
 }
 
-func (_c *MockIPeerService_GetCounterValue_Call) Return(_a0 int64) *MockIPeerService_GetCounterValue_Call {
-	_c.Call.Return(_a0)
+func (_c *MockIPeerService_GetCounterValue_Call) Return(_a0 int64, _a1 bool) *MockIPeerService_GetCounterValue_Call {
+	_c.Call.Return(_a0, _a1)
 	return _c
 }
 
-func (_c *MockIPeerService_GetCounterValue_Call) RunAndReturn(run func() int64) *MockIPeerService_GetCounterValue_Call {
+func (_c *MockIPeerService_GetCounterValue_Call) RunAndReturn(run func(string) (int64, bool)) *MockIPeerService_GetCounterValue_Call {
 	_c.Call.Return(run)
 	return _c
 }
@@ -142,17 +393,51 @@ func (_c *MockIPeerService_GetPeersList_Call) RunAndReturn(run func() []string)
 	return _c
 }
 
-// Increment provides a mock function with given fields: eventID
-func (_m *MockIPeerService) Increment(eventID string) error {
-	ret := _m.Called(eventID)
+// Gossip provides a mock function with given fields: from, updates
+func (_m *MockIPeerService) Gossip(from string, updates []peerStore.Update) {
+	_m.Called(from, updates)
+}
+
+// MockIPeerService_Gossip_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Gossip'
+type MockIPeerService_Gossip_Call struct {
+	*mock.Call
+}
+
+// Gossip is a helper method to define mock.On call
+//   - from string
+//   - updates []peerStore.Update
+func (_e *MockIPeerService_Expecter) Gossip(from interface{}, updates interface{}) *MockIPeerService_Gossip_Call {
+	return &MockIPeerService_Gossip_Call{Call: _e.mock.On("Gossip", from, updates)}
+}
+
+func (_c *MockIPeerService_Gossip_Call) Run(run func(from string, updates []peerStore.Update)) *MockIPeerService_Gossip_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].([]peerStore.Update))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Gossip_Call) Return() *MockIPeerService_Gossip_Call {
+	_c.Call.Return()
+	return _c
+}
+
+func (_c *MockIPeerService_Gossip_Call) RunAndReturn(run func(string, []peerStore.Update)) *MockIPeerService_Gossip_Call {
+	_c.Run(run)
+	return _c
+}
+
+// Increment provides a mock function with given fields: name, delta
+func (_m *MockIPeerService) Increment(name string, delta int64) error {
+	ret := _m.Called(name, delta)
 
 	if len(ret) == 0 {
 		panic("no return value specified for Increment")
 	}
 
 	var r0 error
-	if rf, ok := ret.Get(0).(func(string) error); ok {
-		r0 = rf(eventID)
+	if rf, ok := ret.Get(0).(func(string, int64) error); ok {
+		r0 = rf(name, delta)
 	} else {
 		r0 = ret.Error(0)
 	}
@@ -166,14 +451,15 @@ type MockIPeerService_Increment_Call struct {
 }
 
 // Increment is a helper method to define mock.On call
-//   - eventID string
-func (_e *MockIPeerService_Expecter) Increment(eventID interface{}) *MockIPeerService_Increment_Call {
-	return &MockIPeerService_Increment_Call{Call: _e.mock.On("Increment", eventID)}
+//   - name string
+//   - delta int64
+func (_e *MockIPeerService_Expecter) Increment(name interface{}, delta interface{}) *MockIPeerService_Increment_Call {
+	return &MockIPeerService_Increment_Call{Call: _e.mock.On("Increment", name, delta)}
 }
 
-func (_c *MockIPeerService_Increment_Call) Run(run func(eventID string)) *MockIPeerService_Increment_Call {
+func (_c *MockIPeerService_Increment_Call) Run(run func(name string, delta int64)) *MockIPeerService_Increment_Call {
 	_c.Call.Run(func(args mock.Arguments) {
-		run(args[0].(string))
+		run(args[0].(string), args[1].(int64))
 	})
 	return _c
 }
@@ -183,14 +469,120 @@ func (_c *MockIPeerService_Increment_Call) Return(_a0 error) *MockIPeerService_I
 	return _c
 }
 
-func (_c *MockIPeerService_Increment_Call) RunAndReturn(run func(string) error) *MockIPeerService_Increment_Call {
+func (_c *MockIPeerService_Increment_Call) RunAndReturn(run func(string, int64) error) *MockIPeerService_Increment_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Instances provides a mock function with given fields: service
+func (_m *MockIPeerService) Instances(service string) []registry.Instance {
+	ret := _m.Called(service)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Instances")
+	}
+
+	var r0 []registry.Instance
+	if rf, ok := ret.Get(0).(func(string) []registry.Instance); ok {
+		r0 = rf(service)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]registry.Instance)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerService_Instances_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Instances'
+type MockIPeerService_Instances_Call struct {
+	*mock.Call
+}
+
+// Instances is a helper method to define mock.On call
+//   - service string
+func (_e *MockIPeerService_Expecter) Instances(service interface{}) *MockIPeerService_Instances_Call {
+	return &MockIPeerService_Instances_Call{Call: _e.mock.On("Instances", service)}
+}
+
+func (_c *MockIPeerService_Instances_Call) Run(run func(service string)) *MockIPeerService_Instances_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Instances_Call) Return(_a0 []registry.Instance) *MockIPeerService_Instances_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_Instances_Call) RunAndReturn(run func(string) []registry.Instance) *MockIPeerService_Instances_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// IsReady provides a mock function with no fields
+func (_m *MockIPeerService) IsReady() bool {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for IsReady")
+	}
+
+	var r0 bool
+	if rf, ok := ret.Get(0).(func() bool); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(bool)
+	}
+
+	return r0
+}
+
+// MockIPeerService_IsReady_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'IsReady'
+type MockIPeerService_IsReady_Call struct {
+	*mock.Call
+}
+
+// IsReady is a helper method to define mock.On call
+func (_e *MockIPeerService_Expecter) IsReady() *MockIPeerService_IsReady_Call {
+	return &MockIPeerService_IsReady_Call{Call: _e.mock.On("IsReady")}
+}
+
+func (_c *MockIPeerService_IsReady_Call) Run(run func()) *MockIPeerService_IsReady_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_IsReady_Call) Return(_a0 bool) *MockIPeerService_IsReady_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_IsReady_Call) RunAndReturn(run func() bool) *MockIPeerService_IsReady_Call {
 	_c.Call.Return(run)
 	return _c
 }
 
 // JoinPeer provides a mock function with given fields: peer
-func (_m *MockIPeerService) JoinPeer(peer string) {
-	_m.Called(peer)
+func (_m *MockIPeerService) JoinPeer(peer string) error {
+	ret := _m.Called(peer)
+
+	if len(ret) == 0 {
+		panic("no return value specified for JoinPeer")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(string) error); ok {
+		r0 = rf(peer)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
 }
 
 // MockIPeerService_JoinPeer_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'JoinPeer'
@@ -211,16 +603,892 @@ func (_c *MockIPeerService_JoinPeer_Call) Run(run func(peer string)) *MockIPeerS
 	return _c
 }
 
-func (_c *MockIPeerService_JoinPeer_Call) Return() *MockIPeerService_JoinPeer_Call {
-	_c.Call.Return()
+func (_c *MockIPeerService_JoinPeer_Call) Return(_a0 error) *MockIPeerService_JoinPeer_Call {
+	_c.Call.Return(_a0)
 	return _c
 }
 
-func (_c *MockIPeerService_JoinPeer_Call) RunAndReturn(run func(string)) *MockIPeerService_JoinPeer_Call {
+func (_c *MockIPeerService_JoinPeer_Call) RunAndReturn(run func(string) error) *MockIPeerService_JoinPeer_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// ListCounters provides a mock function with no fields
+func (_m *MockIPeerService) ListCounters() map[string]int64 {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for ListCounters")
+	}
+
+	var r0 map[string]int64
+	if rf, ok := ret.Get(0).(func() map[string]int64); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]int64)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerService_ListCounters_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ListCounters'
+type MockIPeerService_ListCounters_Call struct {
+	*mock.Call
+}
+
+// ListCounters is a helper method to define mock.On call
+func (_e *MockIPeerService_Expecter) ListCounters() *MockIPeerService_ListCounters_Call {
+	return &MockIPeerService_ListCounters_Call{Call: _e.mock.On("ListCounters")}
+}
+
+func (_c *MockIPeerService_ListCounters_Call) Run(run func()) *MockIPeerService_ListCounters_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_ListCounters_Call) Return(_a0 map[string]int64) *MockIPeerService_ListCounters_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_ListCounters_Call) RunAndReturn(run func() map[string]int64) *MockIPeerService_ListCounters_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// ListDeadLetters provides a mock function with no fields
+func (_m *MockIPeerService) ListDeadLetters() []service.DeadLetter {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for ListDeadLetters")
+	}
+
+	var r0 []service.DeadLetter
+	if rf, ok := ret.Get(0).(func() []service.DeadLetter); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]service.DeadLetter)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerService_ListDeadLetters_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ListDeadLetters'
+type MockIPeerService_ListDeadLetters_Call struct {
+	*mock.Call
+}
+
+// ListDeadLetters is a helper method to define mock.On call
+func (_e *MockIPeerService_Expecter) ListDeadLetters() *MockIPeerService_ListDeadLetters_Call {
+	return &MockIPeerService_ListDeadLetters_Call{Call: _e.mock.On("ListDeadLetters")}
+}
+
+func (_c *MockIPeerService_ListDeadLetters_Call) Run(run func()) *MockIPeerService_ListDeadLetters_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_ListDeadLetters_Call) Return(_a0 []service.DeadLetter) *MockIPeerService_ListDeadLetters_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_ListDeadLetters_Call) RunAndReturn(run func() []service.DeadLetter) *MockIPeerService_ListDeadLetters_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Members provides a mock function with no fields
+func (_m *MockIPeerService) Members() []peerStore.Member {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for Members")
+	}
+
+	var r0 []peerStore.Member
+	if rf, ok := ret.Get(0).(func() []peerStore.Member); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]peerStore.Member)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerService_Members_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Members'
+type MockIPeerService_Members_Call struct {
+	*mock.Call
+}
+
+// Members is a helper method to define mock.On call
+func (_e *MockIPeerService_Expecter) Members() *MockIPeerService_Members_Call {
+	return &MockIPeerService_Members_Call{Call: _e.mock.On("Members")}
+}
+
+func (_c *MockIPeerService_Members_Call) Run(run func()) *MockIPeerService_Members_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Members_Call) Return(_a0 []peerStore.Member) *MockIPeerService_Members_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_Members_Call) RunAndReturn(run func() []peerStore.Member) *MockIPeerService_Members_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// MembershipIndex provides a mock function with no fields
+func (_m *MockIPeerService) MembershipIndex() uint64 {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for MembershipIndex")
+	}
+
+	var r0 uint64
+	if rf, ok := ret.Get(0).(func() uint64); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(uint64)
+	}
+
+	return r0
+}
+
+// MockIPeerService_MembershipIndex_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'MembershipIndex'
+type MockIPeerService_MembershipIndex_Call struct {
+	*mock.Call
+}
+
+// MembershipIndex is a helper method to define mock.On call
+func (_e *MockIPeerService_Expecter) MembershipIndex() *MockIPeerService_MembershipIndex_Call {
+	return &MockIPeerService_MembershipIndex_Call{Call: _e.mock.On("MembershipIndex")}
+}
+
+func (_c *MockIPeerService_MembershipIndex_Call) Run(run func()) *MockIPeerService_MembershipIndex_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_MembershipIndex_Call) Return(_a0 uint64) *MockIPeerService_MembershipIndex_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_MembershipIndex_Call) RunAndReturn(run func() uint64) *MockIPeerService_MembershipIndex_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// MergeStates provides a mock function with given fields: states
+func (_m *MockIPeerService) MergeStates(states map[string]counter.State) {
+	_m.Called(states)
+}
+
+// MockIPeerService_MergeStates_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'MergeStates'
+type MockIPeerService_MergeStates_Call struct {
+	*mock.Call
+}
+
+// MergeStates is a helper method to define mock.On call
+//   - states map[string]counter.State
+func (_e *MockIPeerService_Expecter) MergeStates(states interface{}) *MockIPeerService_MergeStates_Call {
+	return &MockIPeerService_MergeStates_Call{Call: _e.mock.On("MergeStates", states)}
+}
+
+func (_c *MockIPeerService_MergeStates_Call) Run(run func(states map[string]counter.State)) *MockIPeerService_MergeStates_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(map[string]counter.State))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_MergeStates_Call) Return() *MockIPeerService_MergeStates_Call {
+	_c.Call.Return()
+	return _c
+}
+
+func (_c *MockIPeerService_MergeStates_Call) RunAndReturn(run func(map[string]counter.State)) *MockIPeerService_MergeStates_Call {
+	_c.Run(run)
+	return _c
+}
+
+// PeerLeft provides a mock function with given fields: peer, incarnation
+func (_m *MockIPeerService) PeerLeft(peer string, incarnation uint64) {
+	_m.Called(peer, incarnation)
+}
+
+// MockIPeerService_PeerLeft_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'PeerLeft'
+type MockIPeerService_PeerLeft_Call struct {
+	*mock.Call
+}
+
+// PeerLeft is a helper method to define mock.On call
+//   - peer string
+//   - incarnation uint64
+func (_e *MockIPeerService_Expecter) PeerLeft(peer interface{}, incarnation interface{}) *MockIPeerService_PeerLeft_Call {
+	return &MockIPeerService_PeerLeft_Call{Call: _e.mock.On("PeerLeft", peer, incarnation)}
+}
+
+func (_c *MockIPeerService_PeerLeft_Call) Run(run func(peer string, incarnation uint64)) *MockIPeerService_PeerLeft_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(uint64))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_PeerLeft_Call) Return() *MockIPeerService_PeerLeft_Call {
+	_c.Call.Return()
+	return _c
+}
+
+func (_c *MockIPeerService_PeerLeft_Call) RunAndReturn(run func(string, uint64)) *MockIPeerService_PeerLeft_Call {
+	_c.Run(run)
+	return _c
+}
+
+// Ping provides a mock function with given fields: target, addr, ping
+func (_m *MockIPeerService) Ping(target string, addr string, ping client.Ping) (client.Ack, error) {
+	ret := _m.Called(target, addr, ping)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Ping")
+	}
+
+	var r0 client.Ack
+	var r1 error
+	if rf, ok := ret.Get(0).(func(string, string, client.Ping) (client.Ack, error)); ok {
+		return rf(target, addr, ping)
+	}
+	if rf, ok := ret.Get(0).(func(string, string, client.Ping) client.Ack); ok {
+		r0 = rf(target, addr, ping)
+	} else {
+		r0 = ret.Get(0).(client.Ack)
+	}
+
+	if rf, ok := ret.Get(1).(func(string, string, client.Ping) error); ok {
+		r1 = rf(target, addr, ping)
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// MockIPeerService_Ping_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Ping'
+type MockIPeerService_Ping_Call struct {
+	*mock.Call
+}
+
+// Ping is a helper method to define mock.On call
+//   - target string
+//   - addr string
+//   - ping client.Ping
+func (_e *MockIPeerService_Expecter) Ping(target interface{}, addr interface{}, ping interface{}) *MockIPeerService_Ping_Call {
+	return &MockIPeerService_Ping_Call{Call: _e.mock.On("Ping", target, addr, ping)}
+}
+
+func (_c *MockIPeerService_Ping_Call) Run(run func(target string, addr string, ping client.Ping)) *MockIPeerService_Ping_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(string), args[1].(string), args[2].(client.Ping))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Ping_Call) Return(_a0 client.Ack, _a1 error) *MockIPeerService_Ping_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *MockIPeerService_Ping_Call) RunAndReturn(run func(string, string, client.Ping) (client.Ack, error)) *MockIPeerService_Ping_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Register provides a mock function with given fields: inst
+func (_m *MockIPeerService) Register(inst registry.Instance) registry.Instance {
+	ret := _m.Called(inst)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Register")
+	}
+
+	var r0 registry.Instance
+	if rf, ok := ret.Get(0).(func(registry.Instance) registry.Instance); ok {
+		r0 = rf(inst)
+	} else {
+		r0 = ret.Get(0).(registry.Instance)
+	}
+
+	return r0
+}
+
+// MockIPeerService_Register_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Register'
+type MockIPeerService_Register_Call struct {
+	*mock.Call
+}
+
+// Register is a helper method to define mock.On call
+//   - inst registry.Instance
+func (_e *MockIPeerService_Expecter) Register(inst interface{}) *MockIPeerService_Register_Call {
+	return &MockIPeerService_Register_Call{Call: _e.mock.On("Register", inst)}
+}
+
+func (_c *MockIPeerService_Register_Call) Run(run func(inst registry.Instance)) *MockIPeerService_Register_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(registry.Instance))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Register_Call) Return(_a0 registry.Instance) *MockIPeerService_Register_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_Register_Call) RunAndReturn(run func(registry.Instance) registry.Instance) *MockIPeerService_Register_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// RegistryState provides a mock function with no fields
+func (_m *MockIPeerService) RegistryState() []registry.Instance {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for RegistryState")
+	}
+
+	var r0 []registry.Instance
+	if rf, ok := ret.Get(0).(func() []registry.Instance); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]registry.Instance)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerService_RegistryState_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'RegistryState'
+type MockIPeerService_RegistryState_Call struct {
+	*mock.Call
+}
+
+// RegistryState is a helper method to define mock.On call
+func (_e *MockIPeerService_Expecter) RegistryState() *MockIPeerService_RegistryState_Call {
+	return &MockIPeerService_RegistryState_Call{Call: _e.mock.On("RegistryState")}
+}
+
+func (_c *MockIPeerService_RegistryState_Call) Run(run func()) *MockIPeerService_RegistryState_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_RegistryState_Call) Return(_a0 []registry.Instance) *MockIPeerService_RegistryState_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_RegistryState_Call) RunAndReturn(run func() []registry.Instance) *MockIPeerService_RegistryState_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// ReplayDeadLetters provides a mock function with given fields: ids
+func (_m *MockIPeerService) ReplayDeadLetters(ids []uint64) service.ReplayResult {
+	ret := _m.Called(ids)
+
+	if len(ret) == 0 {
+		panic("no return value specified for ReplayDeadLetters")
+	}
+
+	var r0 service.ReplayResult
+	if rf, ok := ret.Get(0).(func([]uint64) service.ReplayResult); ok {
+		r0 = rf(ids)
+	} else {
+		r0 = ret.Get(0).(service.ReplayResult)
+	}
+
+	return r0
+}
+
+// MockIPeerService_ReplayDeadLetters_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ReplayDeadLetters'
+type MockIPeerService_ReplayDeadLetters_Call struct {
+	*mock.Call
+}
+
+// ReplayDeadLetters is a helper method to define mock.On call
+//   - ids []uint64
+func (_e *MockIPeerService_Expecter) ReplayDeadLetters(ids interface{}) *MockIPeerService_ReplayDeadLetters_Call {
+	return &MockIPeerService_ReplayDeadLetters_Call{Call: _e.mock.On("ReplayDeadLetters", ids)}
+}
+
+func (_c *MockIPeerService_ReplayDeadLetters_Call) Run(run func(ids []uint64)) *MockIPeerService_ReplayDeadLetters_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].([]uint64))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_ReplayDeadLetters_Call) Return(_a0 service.ReplayResult) *MockIPeerService_ReplayDeadLetters_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_ReplayDeadLetters_Call) RunAndReturn(run func([]uint64) service.ReplayResult) *MockIPeerService_ReplayDeadLetters_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Replicate provides a mock function with given fields: event
+func (_m *MockIPeerService) Replicate(event counter.Event) error {
+	ret := _m.Called(event)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Replicate")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(counter.Event) error); ok {
+		r0 = rf(event)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockIPeerService_Replicate_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Replicate'
+type MockIPeerService_Replicate_Call struct {
+	*mock.Call
+}
+
+// Replicate is a helper method to define mock.On call
+//   - event counter.Event
+func (_e *MockIPeerService_Expecter) Replicate(event interface{}) *MockIPeerService_Replicate_Call {
+	return &MockIPeerService_Replicate_Call{Call: _e.mock.On("Replicate", event)}
+}
+
+func (_c *MockIPeerService_Replicate_Call) Run(run func(event counter.Event)) *MockIPeerService_Replicate_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(counter.Event))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Replicate_Call) Return(_a0 error) *MockIPeerService_Replicate_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_Replicate_Call) RunAndReturn(run func(counter.Event) error) *MockIPeerService_Replicate_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// ReplicateInstance provides a mock function with given fields: inst
+func (_m *MockIPeerService) ReplicateInstance(inst registry.Instance) error {
+	ret := _m.Called(inst)
+
+	if len(ret) == 0 {
+		panic("no return value specified for ReplicateInstance")
+	}
+
+	var r0 error
+	if rf, ok := ret.Get(0).(func(registry.Instance) error); ok {
+		r0 = rf(inst)
+	} else {
+		r0 = ret.Error(0)
+	}
+
+	return r0
+}
+
+// MockIPeerService_ReplicateInstance_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'ReplicateInstance'
+type MockIPeerService_ReplicateInstance_Call struct {
+	*mock.Call
+}
+
+// ReplicateInstance is a helper method to define mock.On call
+//   - inst registry.Instance
+func (_e *MockIPeerService_Expecter) ReplicateInstance(inst interface{}) *MockIPeerService_ReplicateInstance_Call {
+	return &MockIPeerService_ReplicateInstance_Call{Call: _e.mock.On("ReplicateInstance", inst)}
+}
+
+func (_c *MockIPeerService_ReplicateInstance_Call) Run(run func(inst registry.Instance)) *MockIPeerService_ReplicateInstance_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(registry.Instance))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_ReplicateInstance_Call) Return(_a0 error) *MockIPeerService_ReplicateInstance_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_ReplicateInstance_Call) RunAndReturn(run func(registry.Instance) error) *MockIPeerService_ReplicateInstance_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Snapshot provides a mock function with no fields
+func (_m *MockIPeerService) Snapshot() (service.SnapshotInfo, error) {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for Snapshot")
+	}
+
+	var r0 service.SnapshotInfo
+	var r1 error
+	if rf, ok := ret.Get(0).(func() (service.SnapshotInfo, error)); ok {
+		return rf()
+	}
+	if rf, ok := ret.Get(0).(func() service.SnapshotInfo); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(service.SnapshotInfo)
+	}
+
+	if rf, ok := ret.Get(1).(func() error); ok {
+		r1 = rf()
+	} else {
+		r1 = ret.Error(1)
+	}
+
+	return r0, r1
+}
+
+// MockIPeerService_Snapshot_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Snapshot'
+type MockIPeerService_Snapshot_Call struct {
+	*mock.Call
+}
+
+// Snapshot is a helper method to define mock.On call
+func (_e *MockIPeerService_Expecter) Snapshot() *MockIPeerService_Snapshot_Call {
+	return &MockIPeerService_Snapshot_Call{Call: _e.mock.On("Snapshot")}
+}
+
+func (_c *MockIPeerService_Snapshot_Call) Run(run func()) *MockIPeerService_Snapshot_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Snapshot_Call) Return(_a0 service.SnapshotInfo, _a1 error) *MockIPeerService_Snapshot_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *MockIPeerService_Snapshot_Call) RunAndReturn(run func() (service.SnapshotInfo, error)) *MockIPeerService_Snapshot_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Status provides a mock function with no fields
+func (_m *MockIPeerService) Status() service.Status {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for Status")
+	}
+
+	var r0 service.Status
+	if rf, ok := ret.Get(0).(func() service.Status); ok {
+		r0 = rf()
+	} else {
+		r0 = ret.Get(0).(service.Status)
+	}
+
+	return r0
+}
+
+// MockIPeerService_Status_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Status'
+type MockIPeerService_Status_Call struct {
+	*mock.Call
+}
+
+// Status is a helper method to define mock.On call
+func (_e *MockIPeerService_Expecter) Status() *MockIPeerService_Status_Call {
+	return &MockIPeerService_Status_Call{Call: _e.mock.On("Status")}
+}
+
+func (_c *MockIPeerService_Status_Call) Run(run func()) *MockIPeerService_Status_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Status_Call) Return(_a0 service.Status) *MockIPeerService_Status_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_Status_Call) RunAndReturn(run func() service.Status) *MockIPeerService_Status_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Subscribe provides a mock function with no fields
+func (_m *MockIPeerService) Subscribe() *events.Subscription {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for Subscribe")
+	}
+
+	var r0 *events.Subscription
+	if rf, ok := ret.Get(0).(func() *events.Subscription); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(*events.Subscription)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerService_Subscribe_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Subscribe'
+type MockIPeerService_Subscribe_Call struct {
+	*mock.Call
+}
+
+// Subscribe is a helper method to define mock.On call
+func (_e *MockIPeerService_Expecter) Subscribe() *MockIPeerService_Subscribe_Call {
+	return &MockIPeerService_Subscribe_Call{Call: _e.mock.On("Subscribe")}
+}
+
+func (_c *MockIPeerService_Subscribe_Call) Run(run func()) *MockIPeerService_Subscribe_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Subscribe_Call) Return(_a0 *events.Subscription) *MockIPeerService_Subscribe_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_Subscribe_Call) RunAndReturn(run func() *events.Subscription) *MockIPeerService_Subscribe_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Sync provides a mock function with given fields: digests
+func (_m *MockIPeerService) Sync(digests map[string]counter.Digest) (map[string]counter.State, map[string][]string) {
+	ret := _m.Called(digests)
+
+	if len(ret) == 0 {
+		panic("no return value specified for Sync")
+	}
+
+	var r0 map[string]counter.State
+	var r1 map[string][]string
+	if rf, ok := ret.Get(0).(func(map[string]counter.Digest) (map[string]counter.State, map[string][]string)); ok {
+		return rf(digests)
+	}
+	if rf, ok := ret.Get(0).(func(map[string]counter.Digest) map[string]counter.State); ok {
+		r0 = rf(digests)
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).(map[string]counter.State)
+		}
+	}
+
+	if rf, ok := ret.Get(1).(func(map[string]counter.Digest) map[string][]string); ok {
+		r1 = rf(digests)
+	} else {
+		if ret.Get(1) != nil {
+			r1 = ret.Get(1).(map[string][]string)
+		}
+	}
+
+	return r0, r1
+}
+
+// MockIPeerService_Sync_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Sync'
+type MockIPeerService_Sync_Call struct {
+	*mock.Call
+}
+
+// Sync is a helper method to define mock.On call
+//   - digests map[string]counter.Digest
+func (_e *MockIPeerService_Expecter) Sync(digests interface{}) *MockIPeerService_Sync_Call {
+	return &MockIPeerService_Sync_Call{Call: _e.mock.On("Sync", digests)}
+}
+
+func (_c *MockIPeerService_Sync_Call) Run(run func(digests map[string]counter.Digest)) *MockIPeerService_Sync_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(map[string]counter.Digest))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Sync_Call) Return(_a0 map[string]counter.State, _a1 map[string][]string) *MockIPeerService_Sync_Call {
+	_c.Call.Return(_a0, _a1)
+	return _c
+}
+
+func (_c *MockIPeerService_Sync_Call) RunAndReturn(run func(map[string]counter.Digest) (map[string]counter.State, map[string][]string)) *MockIPeerService_Sync_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// Unsubscribe provides a mock function with given fields: sub
+func (_m *MockIPeerService) Unsubscribe(sub *events.Subscription) {
+	_m.Called(sub)
+}
+
+// MockIPeerService_Unsubscribe_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'Unsubscribe'
+type MockIPeerService_Unsubscribe_Call struct {
+	*mock.Call
+}
+
+// Unsubscribe is a helper method to define mock.On call
+//   - sub *events.Subscription
+func (_e *MockIPeerService_Expecter) Unsubscribe(sub interface{}) *MockIPeerService_Unsubscribe_Call {
+	return &MockIPeerService_Unsubscribe_Call{Call: _e.mock.On("Unsubscribe", sub)}
+}
+
+func (_c *MockIPeerService_Unsubscribe_Call) Run(run func(sub *events.Subscription)) *MockIPeerService_Unsubscribe_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(*events.Subscription))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_Unsubscribe_Call) Return() *MockIPeerService_Unsubscribe_Call {
+	_c.Call.Return()
+	return _c
+}
+
+func (_c *MockIPeerService_Unsubscribe_Call) RunAndReturn(run func(*events.Subscription)) *MockIPeerService_Unsubscribe_Call {
 	_c.Run(run)
 	return _c
 }
 
+// View provides a mock function with no fields
+func (_m *MockIPeerService) View() []peerStore.Update {
+	ret := _m.Called()
+
+	if len(ret) == 0 {
+		panic("no return value specified for View")
+	}
+
+	var r0 []peerStore.Update
+	if rf, ok := ret.Get(0).(func() []peerStore.Update); ok {
+		r0 = rf()
+	} else {
+		if ret.Get(0) != nil {
+			r0 = ret.Get(0).([]peerStore.Update)
+		}
+	}
+
+	return r0
+}
+
+// MockIPeerService_View_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'View'
+type MockIPeerService_View_Call struct {
+	*mock.Call
+}
+
+// View is a helper method to define mock.On call
+func (_e *MockIPeerService_Expecter) View() *MockIPeerService_View_Call {
+	return &MockIPeerService_View_Call{Call: _e.mock.On("View")}
+}
+
+func (_c *MockIPeerService_View_Call) Run(run func()) *MockIPeerService_View_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run()
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_View_Call) Return(_a0 []peerStore.Update) *MockIPeerService_View_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_View_Call) RunAndReturn(run func() []peerStore.Update) *MockIPeerService_View_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
+// WaitMembers provides a mock function with given fields: ctx, index
+func (_m *MockIPeerService) WaitMembers(ctx context.Context, index uint64) uint64 {
+	ret := _m.Called(ctx, index)
+
+	if len(ret) == 0 {
+		panic("no return value specified for WaitMembers")
+	}
+
+	var r0 uint64
+	if rf, ok := ret.Get(0).(func(context.Context, uint64) uint64); ok {
+		r0 = rf(ctx, index)
+	} else {
+		r0 = ret.Get(0).(uint64)
+	}
+
+	return r0
+}
+
+// MockIPeerService_WaitMembers_Call is a *mock.Call that shadows Run/Return methods with type explicit version for method 'WaitMembers'
+type MockIPeerService_WaitMembers_Call struct {
+	*mock.Call
+}
+
+// WaitMembers is a helper method to define mock.On call
+//   - ctx context.Context
+//   - index uint64
+func (_e *MockIPeerService_Expecter) WaitMembers(ctx interface{}, index interface{}) *MockIPeerService_WaitMembers_Call {
+	return &MockIPeerService_WaitMembers_Call{Call: _e.mock.On("WaitMembers", ctx, index)}
+}
+
+func (_c *MockIPeerService_WaitMembers_Call) Run(run func(ctx context.Context, index uint64)) *MockIPeerService_WaitMembers_Call {
+	_c.Call.Run(func(args mock.Arguments) {
+		run(args[0].(context.Context), args[1].(uint64))
+	})
+	return _c
+}
+
+func (_c *MockIPeerService_WaitMembers_Call) Return(_a0 uint64) *MockIPeerService_WaitMembers_Call {
+	_c.Call.Return(_a0)
+	return _c
+}
+
+func (_c *MockIPeerService_WaitMembers_Call) RunAndReturn(run func(context.Context, uint64) uint64) *MockIPeerService_WaitMembers_Call {
+	_c.Call.Return(run)
+	return _c
+}
+
 // NewMockIPeerService creates a new instance of MockIPeerService. It also registers a testing interface on the mock and a cleanup function to assert the mocks expectations.
 // The first argument is typically a *testing.T value.
 func NewMockIPeerService(t interface {
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultBreakerThreshold is how many failed requests in a row open the
+	// circuit to a peer.
+	DefaultBreakerThreshold = 5
+	// DefaultBreakerCooldown is how long an open circuit turns requests away
+	// before one is let through to try the peer again.
+	DefaultBreakerCooldown = 10 * time.Second
+)
+
+// ErrCircuitOpen is returned, without a request being made, for a peer whose
+// circuit is open.
+var ErrCircuitOpen = errors.New("circuit open")
+
+type BreakerState string
+
+const (
+	BreakerClosed   BreakerState = "closed"
+	BreakerOpen     BreakerState = "open"
+	BreakerHalfOpen BreakerState = "half-open"
+)
+
+// BreakerStatus describes the circuit to one peer.
+type BreakerStatus struct {
+	Peer           string       `json:"peer"`
+	State          BreakerState `json:"state"`
+	Failures       int          `json:"failures"`
+	RetryInSeconds float64      `json:"retry_in_seconds,omitempty"`
+}
+
+type breaker struct {
+	failures int
+	openedAt time.Time // zero while closed
+	trying   bool      // a half-open trial request is in flight
+}
+
+// Breakers keeps a circuit breaker per peer address. A circuit opens after
+// Threshold failed requests in a row and turns requests away for Cooldown;
+// then a single trial request is let through, which closes it on success or
+// opens it again on failure. A nil *Breakers lets everything through.
+type Breakers struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu    sync.Mutex
+	peers map[string]*breaker
+}
+
+func NewBreakers(threshold int, cooldown time.Duration) *Breakers {
+	return &Breakers{
+		Threshold: threshold,
+		Cooldown:  cooldown,
+		peers:     make(map[string]*breaker),
+	}
+}
+
+// Allow reports whether a request to peer may be made. Once an open circuit
+// has cooled down, the request it allows is the trial.
+func (b *Breakers) Allow(peer string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, ok := b.peers[peer]
+	if !ok || br.openedAt.IsZero() {
+		return nil
+	}
+	if br.trying || time.Since(br.openedAt) < b.Cooldown {
+		return ErrCircuitOpen
+	}
+	br.trying = true
+	return nil
+}
+
+// Success closes the circuit to peer.
+func (b *Breakers) Success(peer string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.peers, peer)
+}
+
+// Failure counts a failed request to peer, opening its circuit once there
+// were Threshold in a row or if it was the trial. A late failure of a request
+// made before the circuit opened leaves the cooldown where it was.
+func (b *Breakers) Failure(peer string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	br, ok := b.peers[peer]
+	if !ok {
+		br = &breaker{}
+		b.peers[peer] = br
+	}
+	br.failures++
+	if br.trying || (br.openedAt.IsZero() && br.failures >= b.Threshold) {
+		br.openedAt = time.Now()
+		br.trying = false
+	}
+}
+
+// Forget drops the circuit to a peer that is gone, so breakers do not pile up
+// for every address that ever failed.
+func (b *Breakers) Forget(peer string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.peers, peer)
+}
+
+// State returns the circuit to peer. An open circuit that has cooled down is
+// reported half-open, as the next request to it is let through.
+func (b *Breakers) State(peer string) BreakerStatus {
+	if b == nil {
+		return BreakerStatus{Peer: peer, State: BreakerClosed}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.status(peer, b.peers[peer])
+}
+
+// States returns every circuit that saw a failure since it last closed,
+// sorted by peer.
+func (b *Breakers) States() []BreakerStatus {
+	if b == nil {
+		return []BreakerStatus{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	states := make([]BreakerStatus, 0, len(b.peers))
+	for peer, br := range b.peers {
+		states = append(states, b.status(peer, br))
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Peer < states[j].Peer })
+	return states
+}
+
+// status describes br, which may be nil. b.mu must be held.
+func (b *Breakers) status(peer string, br *breaker) BreakerStatus {
+	status := BreakerStatus{Peer: peer, State: BreakerClosed}
+	if br == nil {
+		return status
+	}
+	status.Failures = br.failures
+	if br.openedAt.IsZero() {
+		return status
+	}
+
+	status.State = BreakerHalfOpen
+	if retryIn := b.Cooldown - time.Since(br.openedAt); retryIn > 0 {
+		status.State = BreakerOpen
+		status.RetryInSeconds = retryIn.Seconds()
+	}
+	return status
+}
+
+// RetryIn is how long an open circuit keeps turning requests away.
+func (s BreakerStatus) RetryIn() time.Duration {
+	return time.Duration(s.RetryInSeconds * float64(time.Second))
+}
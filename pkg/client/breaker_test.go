@@ -0,0 +1,89 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakers_OpensAfterThreshold(t *testing.T) {
+	b := NewBreakers(3, time.Hour)
+
+	b.Failure("peer1")
+	b.Failure("peer1")
+	assert.NoError(t, b.Allow("peer1"))
+	assert.Equal(t, BreakerStatus{Peer: "peer1", State: BreakerClosed, Failures: 2}, b.State("peer1"))
+
+	// A success starts the count over
+	b.Success("peer1")
+	assert.Empty(t, b.States())
+
+	for i := 0; i < 3; i++ {
+		b.Failure("peer1")
+	}
+	assert.ErrorIs(t, b.Allow("peer1"), ErrCircuitOpen)
+	status := b.State("peer1")
+	assert.Equal(t, BreakerOpen, status.State)
+	assert.InDelta(t, time.Hour.Seconds(), status.RetryInSeconds, 1)
+
+	// Other peers are not affected
+	assert.NoError(t, b.Allow("peer2"))
+	assert.Equal(t, BreakerClosed, b.State("peer2").State)
+}
+
+func TestBreakers_HalfOpenTrial(t *testing.T) {
+	b := NewBreakers(1, 20*time.Millisecond)
+	b.Failure("peer1")
+	assert.ErrorIs(t, b.Allow("peer1"), ErrCircuitOpen)
+
+	// Once cooled down a single trial is let through
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, BreakerHalfOpen, b.State("peer1").State)
+	assert.NoError(t, b.Allow("peer1"))
+	assert.ErrorIs(t, b.Allow("peer1"), ErrCircuitOpen)
+
+	// A failed trial opens the circuit again
+	b.Failure("peer1")
+	assert.Equal(t, BreakerOpen, b.State("peer1").State)
+
+	time.Sleep(30 * time.Millisecond)
+	assert.NoError(t, b.Allow("peer1"))
+	b.Success("peer1")
+	assert.Equal(t, BreakerStatus{Peer: "peer1", State: BreakerClosed}, b.State("peer1"))
+	assert.NoError(t, b.Allow("peer1"))
+}
+
+func TestBreakers_LateFailureKeepsCooldown(t *testing.T) {
+	b := NewBreakers(1, 40*time.Millisecond)
+	b.Failure("peer1")
+
+	// A request made before the circuit opened fails once it is open
+	time.Sleep(30 * time.Millisecond)
+	b.Failure("peer1")
+	assert.Equal(t, 2, b.State("peer1").Failures)
+
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, BreakerHalfOpen, b.State("peer1").State)
+	assert.NoError(t, b.Allow("peer1"))
+}
+
+func TestBreakers_Forget(t *testing.T) {
+	b := NewBreakers(1, time.Hour)
+	b.Failure("peer1")
+	b.Failure("peer2")
+
+	b.Forget("peer1")
+	assert.NoError(t, b.Allow("peer1"))
+	if states := b.States(); assert.Len(t, states, 1) {
+		assert.Equal(t, "peer2", states[0].Peer)
+	}
+}
+
+func TestBreakers_Nil(t *testing.T) {
+	var b *Breakers
+	b.Failure("peer1")
+	assert.NoError(t, b.Allow("peer1"))
+	assert.Equal(t, BreakerClosed, b.State("peer1").State)
+	assert.Empty(t, b.States())
+}
@@ -2,42 +2,135 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"log"
 	"net/http"
+	"service_discovery/pkg/counter"
+	"service_discovery/pkg/peerStore"
+	"service_discovery/pkg/registry"
 	"time"
 )
 
+// PingTimeout bounds a direct probe. It is well below the client timeout so a
+// relay can still answer a ping-req after its own probe timed out.
+const PingTimeout = 500 * time.Millisecond
+
 type Client struct {
 	httpClient *http.Client
+	Breakers   *Breakers
 }
 
 func NewClient() *Client {
 	return &Client{
 		httpClient: &http.Client{Timeout: 2 * time.Second},
+		Breakers:   NewBreakers(DefaultBreakerThreshold, DefaultBreakerCooldown),
+	}
+}
+
+// do sends req to peer through the peer's circuit breaker, counting transport
+// errors and non-2xx answers as failures. Probes and ping-reqs do not use it:
+// the failure detector must keep talking to a peer to see it come back, and a
+// relay answering that the target is down says nothing about the relay.
+// Requests whose answer has a body to read use fetch instead.
+func (c *Client) do(peer string, req *http.Request) (*http.Response, error) {
+	if err := c.Breakers.Allow(peer); err != nil {
+		return nil, err
+	}
+
+	resp, err := c.send(peer, req)
+	if err != nil {
+		c.Breakers.Failure(peer)
+	} else {
+		c.Breakers.Success(peer)
+	}
+	return resp, err
+}
+
+// fetch is do for requests whose answer has a body, which is decoded into v.
+// The circuit is only closed once the body has been read: one that timed out
+// or broke off part way counts as a failure like a request that got no answer.
+func (c *Client) fetch(peer string, req *http.Request, v any) error {
+	if err := c.Breakers.Allow(peer); err != nil {
+		return err
+	}
+
+	resp, err := c.send(peer, req)
+	if err != nil {
+		c.Breakers.Failure(peer)
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		e := bodyError(peer, req, err)
+		if e.Kind == ErrMalformed {
+			// The peer did answer, just not in a way we understand
+			c.Breakers.Success(peer)
+		} else {
+			c.Breakers.Failure(peer)
+		}
+		return e
 	}
+	c.Breakers.Success(peer)
+	return nil
+}
+
+// send makes a request, turning a failure to get an answer or an answer other
+// than 2xx into an *Error. Reading the body of a 2xx answer is up to the
+// caller.
+func (c *Client) send(peer string, req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, transportError(peer, req, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		return nil, rejectedError(peer, resp)
+	}
+	return resp, nil
 }
 
 type IClient interface {
-	JoinCluster(peerId, selfId string) ([]string, error)
-	Heartbeat(peer, selfID string) error
-	SendIncrement(peer, selfId, eventId string) error
+	JoinCluster(peerId, selfId, selfAddr string, incarnation uint64, meta peerStore.Meta, wantState bool) (JoinClusterResponse, error)
+	Heartbeat(peer, selfID string, ping Ping) (Ack, error)
+	PingReq(relay, selfId, target, targetAddr string, ping Ping) (Ack, error)
+	Gossip(peer, selfId string, updates []peerStore.Update) error
+	Leave(peer, selfId string, incarnation uint64) error
+	SendIncrement(peer, selfId string, event counter.Event) error
+	SendIncrements(peer, selfId string, events []counter.Event) ([]ReplicateResult, error)
+	SyncDigest(peer, selfId string, digests map[string]counter.Digest) (SyncResponse, error)
+	PushState(peer, selfId string, states map[string]counter.State) error
+	SendInstance(peer, selfId string, inst registry.Instance) error
 }
 
-type Payload struct {
-	NodeId string `json:"node_id"`
+type JoinPayload struct {
+	NodeId      string         `json:"node_id"`
+	Addr        string         `json:"addr"`
+	Incarnation uint64         `json:"incarnation"`
+	Meta        peerStore.Meta `json:"meta"`
+	WantState   bool           `json:"want_state"`
 }
 
+// JoinClusterResponse lists the node that was joined and the live members it
+// knows of and, if it was asked for, a snapshot of its counter state.
 type JoinClusterResponse struct {
-	Peers []string `json:"peers"`
+	Peers     []peerStore.Update       `json:"peers"`
+	State     map[string]counter.State `json:"state,omitempty"`
+	Instances []registry.Instance      `json:"instances,omitempty"`
 }
 
-func (c *Client) JoinCluster(peerId, selfId string) ([]string, error) {
-	payload := Payload{
-		NodeId: selfId,
+func (c *Client) JoinCluster(peerId, selfId, selfAddr string, incarnation uint64, meta peerStore.Meta, wantState bool) (JoinClusterResponse, error) {
+	payload := JoinPayload{
+		NodeId:      selfId,
+		Addr:        selfAddr,
+		Incarnation: incarnation,
+		Meta:        meta,
+		WantState:   wantState,
 	}
 
-	var result []string
+	var result JoinClusterResponse
 	payloadBytes, err := json.Marshal(payload)
 
 	if err != nil {
@@ -59,29 +152,155 @@ func (c *Client) JoinCluster(peerId, selfId string) ([]string, error) {
 
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	if err := c.fetch(peerId, req, &result); err != nil {
+		log.Println("error in sending the client request", err)
+		return result, err
+	}
+
+	return result, nil
+
+}
+
+// Ping carries the sender's address, incarnation and metadata and its view
+// of the target, so a target that learns it is suspected can refute it in the
+// Ack. Both sides piggyback pending membership updates.
+type Ping struct {
+	Addr              string             `json:"addr"`
+	Incarnation       uint64             `json:"incarnation"`
+	TargetIncarnation uint64             `json:"target_incarnation"`
+	Suspected         bool               `json:"suspected"`
+	Meta              peerStore.Meta     `json:"meta"`
+	Updates           []peerStore.Update `json:"updates,omitempty"`
+}
+
+type HeartbeatPayload struct {
+	NodeId string `json:"node_id"`
+	Ping
+}
+
+type Ack struct {
+	NodeId      string             `json:"node_id"`
+	Incarnation uint64             `json:"incarnation"`
+	Meta        peerStore.Meta     `json:"meta"`
+	Updates     []peerStore.Update `json:"updates,omitempty"`
+}
+
+// Heartbeat is the direct SWIM ping: it fails unless the peer acknowledges
+// within PingTimeout.
+func (c *Client) Heartbeat(peer, selfID string, ping Ping) (Ack, error) {
+	payload := HeartbeatPayload{
+		NodeId: selfID,
+		Ping:   ping,
+	}
+
+	var result Ack
+	payloadBytes, err := json.Marshal(payload)
+
+	if err != nil {
+		log.Println("error in marshalling the payload bytes", err)
+		return result, err
+	}
+
+	url := "http://" + peer + "/nodes/heartbeat"
+
+	ctx, cancel := context.WithTimeout(context.Background(), PingTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		url,
+		bytes.NewReader(payloadBytes),
+	)
+	if err != nil {
+		log.Println("error in forming the request", err)
+		return result, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.send(peer, req)
 	if err != nil {
 		log.Println("error in sending the client request", err)
 		return result, err
 	}
 	defer resp.Body.Close()
 
-	var Response JoinClusterResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+
+	if err != nil {
+		log.Println("error in decoding the response ", err)
+		return result, bodyError(peer, req, err)
+	}
+
+	return result, nil
+}
+
+type PingReqPayload struct {
+	NodeId     string `json:"node_id"`
+	Target     string `json:"target"`
+	TargetAddr string `json:"target_addr"`
+	Ping
+}
+
+// PingReq asks relay to probe target on our behalf. It fails unless the
+// relay got an acknowledgement from the target, which it passes back.
+func (c *Client) PingReq(relay, selfId, target, targetAddr string, ping Ping) (Ack, error) {
+	payload := PingReqPayload{
+		NodeId:     selfId,
+		Target:     target,
+		TargetAddr: targetAddr,
+		Ping:       ping,
+	}
+
+	var result Ack
+	payloadBytes, err := json.Marshal(payload)
+
+	if err != nil {
+		log.Println("error in marshalling the payload bytes", err)
+		return result, err
+	}
+
+	url := "http://" + relay + "/nodes/ping-req"
+
+	req, err := http.NewRequest(
+		http.MethodPost,
+		url,
+		bytes.NewReader(payloadBytes),
+	)
+	if err != nil {
+		log.Println("error in forming the request", err)
+		return result, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.send(relay, req)
+	if err != nil {
+		log.Println("error in sending the client request", err)
+		return result, err
+	}
+	defer resp.Body.Close()
 
-	err = json.NewDecoder(resp.Body).Decode(&Response)
+	err = json.NewDecoder(resp.Body).Decode(&result)
 
 	if err != nil {
 		log.Println("error in decoding the response ", err)
+		return result, bodyError(relay, req, err)
 	}
-	result = Response.Peers
 
 	return result, nil
+}
 
+type SendIncrementPayload struct {
+	NodeId string `json:"node_id"`
+	counter.Event
 }
 
-func (c *Client) Heartbeat(peer, selfID string) error {
-	payload := Payload{
-		NodeId: selfID,
+func (c *Client) SendIncrement(peer, selfId string, event counter.Event) error {
+	payload := SendIncrementPayload{
+		NodeId: selfId,
+		Event:  event,
 	}
 
 	payloadBytes, err := json.Marshal(payload)
@@ -91,7 +310,7 @@ func (c *Client) Heartbeat(peer, selfID string) error {
 		return err
 	}
 
-	url := "http://" + peer + "/nodes/heartbeat"
+	url := "http://" + peer + "/counter/replicate"
 
 	req, err := http.NewRequest(
 		http.MethodPost,
@@ -105,7 +324,7 @@ func (c *Client) Heartbeat(peer, selfID string) error {
 
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(peer, req)
 	if err != nil {
 		log.Println("error in sending the client request", err)
 		return err
@@ -115,15 +334,128 @@ func (c *Client) Heartbeat(peer, selfID string) error {
 	return nil
 }
 
-type SendIncrementPayload struct {
-	NodeId  string `json:"node_id"`
-	EventId string `json:"event_id"`
+type ReplicateBatchPayload struct {
+	NodeId string          `json:"node_id"`
+	Events []counter.Event `json:"events"`
 }
 
-func (c *Client) SendIncrement(peer, selfId, eventId string) error {
-	payload := SendIncrementPayload{
+type ReplicateStatus string
+
+const (
+	ReplicateApplied   ReplicateStatus = "applied"
+	ReplicateDuplicate ReplicateStatus = "duplicate"
+	ReplicateRejected  ReplicateStatus = "rejected"
+)
+
+// ReplicateResult is what the receiver did with one event of a batch. Only a
+// rejected event carries an error; a duplicate was delivered before.
+type ReplicateResult struct {
+	Status ReplicateStatus `json:"status"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type ReplicateBatchResponse struct {
+	Results []ReplicateResult `json:"results"`
+}
+
+// SendIncrements replicates several events in one request and returns the
+// outcome of each, in the order they were sent.
+func (c *Client) SendIncrements(peer, selfId string, events []counter.Event) ([]ReplicateResult, error) {
+	payload := ReplicateBatchPayload{
+		NodeId: selfId,
+		Events: events,
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+
+	if err != nil {
+		log.Println("error in marshalling the payload bytes", err)
+		return nil, err
+	}
+
+	url := "http://" + peer + "/counter/replicate/batch"
+
+	req, err := http.NewRequest(
+		http.MethodPost,
+		url,
+		bytes.NewReader(payloadBytes),
+	)
+	if err != nil {
+		log.Println("error in forming the request", err)
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	var result ReplicateBatchResponse
+	if err := c.fetch(peer, req, &result); err != nil {
+		log.Println("error in sending the client request", err)
+		return nil, err
+	}
+	if len(result.Results) != len(events) {
+		return nil, malformedError(peer, req, fmt.Errorf("%d results for a batch of %d events", len(result.Results), len(events)))
+	}
+
+	return result.Results, nil
+}
+
+type SyncDigestPayload struct {
+	NodeId  string                    `json:"node_id"`
+	Digests map[string]counter.Digest `json:"digests"`
+}
+
+// SyncResponse carries the entries the requester is missing and, per counter,
+// the origins the responder wants pushed back to it.
+type SyncResponse struct {
+	States map[string]counter.State `json:"states"`
+	Wants  map[string][]string      `json:"wants"`
+}
+
+func (c *Client) SyncDigest(peer, selfId string, digests map[string]counter.Digest) (SyncResponse, error) {
+	payload := SyncDigestPayload{
 		NodeId:  selfId,
-		EventId: eventId,
+		Digests: digests,
+	}
+
+	var result SyncResponse
+	payloadBytes, err := json.Marshal(payload)
+
+	if err != nil {
+		log.Println("error in marshalling the payload bytes", err)
+		return result, err
+	}
+
+	url := "http://" + peer + "/counter/sync"
+
+	req, err := http.NewRequest(
+		http.MethodPost,
+		url,
+		bytes.NewReader(payloadBytes),
+	)
+	if err != nil {
+		log.Println("error in forming the request", err)
+		return result, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if err := c.fetch(peer, req, &result); err != nil {
+		log.Println("error in sending the client request", err)
+		return result, err
+	}
+
+	return result, nil
+}
+
+type PushStatePayload struct {
+	NodeId string                   `json:"node_id"`
+	States map[string]counter.State `json:"states"`
+}
+
+func (c *Client) PushState(peer, selfId string, states map[string]counter.State) error {
+	payload := PushStatePayload{
+		NodeId: selfId,
+		States: states,
 	}
 
 	payloadBytes, err := json.Marshal(payload)
@@ -133,7 +465,7 @@ func (c *Client) SendIncrement(peer, selfId, eventId string) error {
 		return err
 	}
 
-	url := "http://" + peer + "/counter/replicate"
+	url := "http://" + peer + "/counter/merge"
 
 	req, err := http.NewRequest(
 		http.MethodPost,
@@ -147,7 +479,134 @@ func (c *Client) SendIncrement(peer, selfId, eventId string) error {
 
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
+	resp, err := c.do(peer, req)
+	if err != nil {
+		log.Println("error in sending the client request", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+type SendInstancePayload struct {
+	NodeId string `json:"node_id"`
+	registry.Instance
+}
+
+func (c *Client) SendInstance(peer, selfId string, inst registry.Instance) error {
+	payload := SendInstancePayload{
+		NodeId:   selfId,
+		Instance: inst,
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+
+	if err != nil {
+		log.Println("error in marshalling the payload bytes", err)
+		return err
+	}
+
+	url := "http://" + peer + "/registry/replicate"
+
+	req, err := http.NewRequest(
+		http.MethodPost,
+		url,
+		bytes.NewReader(payloadBytes),
+	)
+	if err != nil {
+		log.Println("error in forming the request", err)
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(peer, req)
+	if err != nil {
+		log.Println("error in sending the client request", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+type GossipPayload struct {
+	NodeId  string             `json:"node_id"`
+	Updates []peerStore.Update `json:"updates"`
+}
+
+func (c *Client) Gossip(peer, selfId string, updates []peerStore.Update) error {
+	payload := GossipPayload{
+		NodeId:  selfId,
+		Updates: updates,
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+
+	if err != nil {
+		log.Println("error in marshalling the payload bytes", err)
+		return err
+	}
+
+	url := "http://" + peer + "/nodes/gossip"
+
+	req, err := http.NewRequest(
+		http.MethodPost,
+		url,
+		bytes.NewReader(payloadBytes),
+	)
+	if err != nil {
+		log.Println("error in forming the request", err)
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(peer, req)
+	if err != nil {
+		log.Println("error in sending the client request", err)
+		return err
+	}
+	defer resp.Body.Close()
+
+	return nil
+}
+
+type LeavePayload struct {
+	NodeId      string `json:"node_id"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+// Leave tells peer that this node is leaving the cluster on purpose.
+func (c *Client) Leave(peer, selfId string, incarnation uint64) error {
+	payload := LeavePayload{
+		NodeId:      selfId,
+		Incarnation: incarnation,
+	}
+
+	payloadBytes, err := json.Marshal(payload)
+
+	if err != nil {
+		log.Println("error in marshalling the payload bytes", err)
+		return err
+	}
+
+	url := "http://" + peer + "/nodes/leave"
+
+	req, err := http.NewRequest(
+		http.MethodPost,
+		url,
+		bytes.NewReader(payloadBytes),
+	)
+	if err != nil {
+		log.Println("error in forming the request", err)
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.do(peer, req)
 	if err != nil {
 		log.Println("error in sending the client request", err)
 		return err
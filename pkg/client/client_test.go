@@ -4,7 +4,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"service_discovery/pkg/counter"
+	"service_discovery/pkg/peerStore"
+	"service_discovery/pkg/registry"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -12,34 +16,251 @@ import (
 func TestJoinCluster(t *testing.T) {
 	// Create a fake server
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		json.NewEncoder(w).Encode([]string{"peer1", "peer2"})
+		json.NewEncoder(w).Encode(JoinClusterResponse{Peers: []peerStore.Update{
+			{ID: "peer1", Addr: "10.0.0.1:8080", State: peerStore.StateAlive, Incarnation: 1},
+			{ID: "peer2", Addr: "10.0.0.2:8080", State: peerStore.StateAlive, Incarnation: 1},
+		}})
 	}))
 	defer server.Close()
 
 	c := &Client{httpClient: server.Client()}
-	peers, err := c.JoinCluster(server.Listener.Addr().String(), "self")
+	resp, err := c.JoinCluster(server.Listener.Addr().String(), "self", "10.0.0.9:8080", 1, peerStore.Meta{}, false)
 	assert.NoError(t, err)
-	assert.Equal(t, []string{"peer1", "peer2"}, peers)
+	assert.Len(t, resp.Peers, 2)
+	assert.Equal(t, "10.0.0.2:8080", resp.Peers[1].Addr)
+	assert.Nil(t, resp.State)
+}
+
+func TestJoinCluster_WithState(t *testing.T) {
+	var received JoinPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+
+		state := counter.NewState()
+		state.P["peer1"] = 5
+		state.Seq["peer1"] = 5
+		json.NewEncoder(w).Encode(JoinClusterResponse{
+			Peers: []peerStore.Update{{ID: "peer1", Addr: "peer1", State: peerStore.StateAlive}},
+			State: map[string]counter.State{"orders": state},
+		})
+	}))
+	defer server.Close()
+
+	c := &Client{httpClient: server.Client()}
+	meta := peerStore.Meta{Tags: map[string]string{"zone": "a"}, Version: "1.2.0"}
+	resp, err := c.JoinCluster(server.Listener.Addr().String(), "self", "10.0.0.9:8080", 7, meta, true)
+	assert.NoError(t, err)
+	assert.Equal(t, JoinPayload{NodeId: "self", Addr: "10.0.0.9:8080", Incarnation: 7, Meta: meta, WantState: true}, received)
+	assert.Equal(t, int64(5), resp.State["orders"].Value())
 }
 
 func TestHeartbeat(t *testing.T) {
+	var received HeartbeatPayload
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
+		json.NewDecoder(r.Body).Decode(&received)
+		json.NewEncoder(w).Encode(Ack{NodeId: "peer1", Incarnation: 4})
+	}))
+	defer server.Close()
+
+	ping := Ping{Addr: "10.0.0.9:8080", Incarnation: 1, TargetIncarnation: 3, Suspected: true}
+
+	c := &Client{httpClient: server.Client()}
+	ack, err := c.Heartbeat(server.Listener.Addr().String(), "self", ping)
+	assert.NoError(t, err)
+	assert.Equal(t, HeartbeatPayload{NodeId: "self", Ping: ping}, received)
+	assert.Equal(t, Ack{NodeId: "peer1", Incarnation: 4}, ack)
+}
+
+func TestHeartbeat_NotAcknowledged(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	c := &Client{httpClient: server.Client()}
+	_, err := c.Heartbeat(server.Listener.Addr().String(), "self", Ping{})
+	assert.Error(t, err)
+}
+
+func TestPingReq(t *testing.T) {
+	var received PingReqPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		if received.Target == "peer2" {
+			json.NewEncoder(w).Encode(Ack{NodeId: "peer2", Incarnation: 2})
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
 	}))
 	defer server.Close()
 
 	c := &Client{httpClient: server.Client()}
-	err := c.Heartbeat(server.Listener.Addr().String(), "self")
+	ack, err := c.PingReq(server.Listener.Addr().String(), "self", "peer2", "10.0.0.2:8080", Ping{TargetIncarnation: 2})
 	assert.NoError(t, err)
+	assert.Equal(t, PingReqPayload{NodeId: "self", Target: "peer2", TargetAddr: "10.0.0.2:8080", Ping: Ping{TargetIncarnation: 2}}, received)
+	assert.Equal(t, uint64(2), ack.Incarnation)
+
+	_, err = c.PingReq(server.Listener.Addr().String(), "self", "peer3", "peer3", Ping{})
+	assert.Error(t, err)
 }
 
 func TestSendIncrement(t *testing.T) {
+	var received SendIncrementPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	event := counter.Event{Counter: "orders", Origin: "self", Seq: 4, Delta: 3}
+
+	c := &Client{httpClient: server.Client()}
+	err := c.SendIncrement(server.Listener.Addr().String(), "self", event)
+	assert.NoError(t, err)
+	assert.Equal(t, "self", received.NodeId)
+	assert.Equal(t, event, received.Event)
+}
+
+func TestSendIncrements(t *testing.T) {
+	var received ReplicateBatchPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/counter/replicate/batch", r.URL.Path)
+		json.NewDecoder(r.Body).Decode(&received)
+		json.NewEncoder(w).Encode(ReplicateBatchResponse{Results: []ReplicateResult{
+			{Status: ReplicateApplied},
+			{Status: ReplicateDuplicate},
+		}})
+	}))
+	defer server.Close()
+
+	events := []counter.Event{
+		{Counter: "orders", Origin: "self", Seq: 4, Delta: 3},
+		{Counter: "orders", Origin: "self", Seq: 5, Delta: -1},
+	}
+
+	c := &Client{httpClient: server.Client()}
+	results, err := c.SendIncrements(server.Listener.Addr().String(), "self", events)
+	assert.NoError(t, err)
+	assert.Equal(t, "self", received.NodeId)
+	assert.Equal(t, events, received.Events)
+	assert.Equal(t, ReplicateDuplicate, results[1].Status)
+
+	// A result per event is required
+	_, err = c.SendIncrements(server.Listener.Addr().String(), "self", events[:1])
+	assert.Error(t, err)
+}
+
+func TestSendInstance(t *testing.T) {
+	var received SendInstancePayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	inst := registry.Instance{Service: "api", ID: "api-1", Address: "10.0.0.1", Port: 80, TTL: 10, Version: 3, Origin: "self"}
+
+	c := &Client{httpClient: server.Client()}
+	err := c.SendInstance(server.Listener.Addr().String(), "self", inst)
+	assert.NoError(t, err)
+	assert.Equal(t, "self", received.NodeId)
+	assert.Equal(t, inst, received.Instance)
+}
+
+func TestSyncDigest(t *testing.T) {
+	var received SyncDigestPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+
+		state := counter.NewState()
+		state.Seq["peer1"] = 2
+		json.NewEncoder(w).Encode(SyncResponse{
+			States: map[string]counter.State{"orders": state},
+			Wants:  map[string][]string{"orders": {"self"}},
+		})
+	}))
+	defer server.Close()
+
+	digests := map[string]counter.Digest{"orders": {Seq: map[string]uint64{"self": 1}}}
+
+	c := &Client{httpClient: server.Client()}
+	resp, err := c.SyncDigest(server.Listener.Addr().String(), "self", digests)
+	assert.NoError(t, err)
+	assert.Equal(t, digests, received.Digests)
+	assert.Equal(t, uint64(2), resp.States["orders"].Seq["peer1"])
+	assert.Equal(t, []string{"self"}, resp.Wants["orders"])
+}
+
+func TestPushState(t *testing.T) {
+	var received PushStatePayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	state := counter.NewState()
+	state.P["self"] = 4
+	state.Seq["self"] = 4
+
+	c := &Client{httpClient: server.Client()}
+	err := c.PushState(server.Listener.Addr().String(), "self", map[string]counter.State{"orders": state})
+	assert.NoError(t, err)
+	assert.Equal(t, "self", received.NodeId)
+	assert.Equal(t, int64(4), received.States["orders"].P["self"])
+}
+
+func TestGossip(t *testing.T) {
+	var received GossipPayload
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	updates := []peerStore.Update{{ID: "peer2", State: peerStore.StateSuspect, Incarnation: 3}}
+
+	c := &Client{httpClient: server.Client()}
+	err := c.Gossip(server.Listener.Addr().String(), "self", updates)
+	assert.NoError(t, err)
+	assert.Equal(t, GossipPayload{NodeId: "self", Updates: updates}, received)
+}
+
+func TestLeave(t *testing.T) {
+	var received LeavePayload
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
 		w.WriteHeader(http.StatusOK)
 	}))
 	defer server.Close()
 
 	c := &Client{httpClient: server.Client()}
-	err := c.SendIncrement(server.Listener.Addr().String(), "self", "event1")
+	err := c.Leave(server.Listener.Addr().String(), "self", 4)
 	assert.NoError(t, err)
+	assert.Equal(t, LeavePayload{NodeId: "self", Incarnation: 4}, received)
+}
+
+func TestClient_ShortCircuitsFailingPeer(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	peer := server.Listener.Addr().String()
+	c := &Client{httpClient: server.Client(), Breakers: NewBreakers(2, time.Hour)}
+
+	// Error statuses count as failures even where the answer is not read
+	c.PushState(peer, "self", nil)
+	c.SendInstance(peer, "self", registry.Instance{Service: "api", ID: "api-1"})
+	assert.Equal(t, BreakerOpen, c.Breakers.State(peer).State)
+
+	err := c.Gossip(peer, "self", nil)
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Equal(t, 2, requests)
+
+	// The failure detector still reaches the peer
+	c.Heartbeat(peer, "self", Ping{})
+	assert.Equal(t, 3, requests)
 }
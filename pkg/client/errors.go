@@ -0,0 +1,109 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ErrorKind says what went wrong with a request to a peer.
+type ErrorKind string
+
+const (
+	// ErrTransport is a request that never got an answer: the peer could
+	// not be reached or the connection broke.
+	ErrTransport ErrorKind = "transport"
+	// ErrTimeout is a request the peer did not answer in time.
+	ErrTimeout ErrorKind = "timeout"
+	// ErrRejected is an answer with a status other than 2xx.
+	ErrRejected ErrorKind = "rejected"
+	// ErrMalformed is a 2xx answer whose body arrived whole but could not be
+	// understood. A body cut short is ErrTransport or ErrTimeout.
+	ErrMalformed ErrorKind = "malformed"
+)
+
+// Error is returned by every client method that reached the point of sending
+// a request. Op is the path that was requested; Status is only set for
+// ErrRejected.
+type Error struct {
+	Kind   ErrorKind
+	Peer   string
+	Op     string
+	Status int
+	Err    error
+}
+
+func (e *Error) Error() string {
+	if e.Kind == ErrRejected {
+		return fmt.Sprintf("%s to %s answered %d: %v", e.Op, e.Peer, e.Status, e.Err)
+	}
+	return fmt.Sprintf("%s to %s: %s: %v", e.Op, e.Peer, e.Kind, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Retryable reports whether sending the same request again may succeed. A
+// peer that could not be reached, timed out or failed on its side may do
+// better later; one that refused the request or answered nonsense will not.
+func (e *Error) Retryable() bool {
+	switch e.Kind {
+	case ErrTransport, ErrTimeout:
+		return true
+	case ErrRejected:
+		return e.Status >= 500 || e.Status == http.StatusRequestTimeout || e.Status == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// Retryable reports whether a client method that failed with err may succeed
+// if called again. Requests turned away by an open circuit are retryable.
+func Retryable(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return true
+	}
+	var e *Error
+	return errors.As(err, &e) && e.Retryable()
+}
+
+// transportError classifies a request that got no answer.
+func transportError(peer string, req *http.Request, err error) *Error {
+	kind := ErrTransport
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		kind = ErrTimeout
+	}
+	return &Error{Kind: kind, Peer: peer, Op: req.URL.Path, Err: err}
+}
+
+// rejectedError describes a non-2xx answer, with the start of its body as the
+// reason the peer gave.
+func rejectedError(peer string, resp *http.Response) *Error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	reason := strings.TrimSpace(string(body))
+	if reason == "" {
+		reason = http.StatusText(resp.StatusCode)
+	}
+	return &Error{Kind: ErrRejected, Peer: peer, Op: resp.Request.URL.Path, Status: resp.StatusCode, Err: errors.New(reason)}
+}
+
+// malformedError describes a 2xx answer that could not be understood.
+func malformedError(peer string, req *http.Request, err error) *Error {
+	return &Error{Kind: ErrMalformed, Peer: peer, Op: req.URL.Path, Err: err}
+}
+
+// bodyError classifies a failure to decode the body of a 2xx answer. A body
+// that timed out or broke off part way never fully arrived, which is a
+// transport failure worth retrying rather than a malformed answer.
+func bodyError(peer string, req *http.Request, err error) *Error {
+	var netErr net.Error
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) {
+		return transportError(peer, req, err)
+	}
+	return malformedError(peer, req, err)
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"service_discovery/pkg/counter"
+	"service_discovery/pkg/peerStore"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func assertKind(t *testing.T, err error, kind ErrorKind) *Error {
+	var e *Error
+	if assert.ErrorAs(t, err, &e) {
+		assert.Equal(t, kind, e.Kind)
+	}
+	return e
+}
+
+func TestErrors_RejectedStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/nodes/join" {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "disk full", http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	peer := server.Listener.Addr().String()
+	c := &Client{httpClient: server.Client()}
+
+	// A server error may pass
+	err := c.SendIncrement(peer, "self", counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 1})
+	e := assertKind(t, err, ErrRejected)
+	assert.Equal(t, http.StatusInternalServerError, e.Status)
+	assert.Equal(t, "/counter/replicate", e.Op)
+	assert.EqualError(t, e.Err, "disk full")
+	assert.True(t, Retryable(err))
+
+	// A refused request will not
+	_, err = c.JoinCluster(peer, "self", "10.0.0.9:8080", 1, peerStore.Meta{}, false)
+	assertKind(t, err, ErrRejected)
+	assert.False(t, Retryable(err))
+}
+
+func TestErrors_MalformedResponse(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"peers": "nobody"}`))
+	}))
+	defer server.Close()
+
+	c := &Client{httpClient: server.Client()}
+	_, err := c.JoinCluster(server.Listener.Addr().String(), "self", "10.0.0.9:8080", 1, peerStore.Meta{}, false)
+	assertKind(t, err, ErrMalformed)
+	assert.False(t, Retryable(err))
+}
+
+func TestErrors_BodyCutShort(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/counter/sync" {
+			// The connection breaks half way through the body
+			conn, buf, _ := w.(http.Hijacker).Hijack()
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n{\"states\": {")
+			buf.Flush()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(`{"results": [`))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+	peer := server.Listener.Addr().String()
+
+	c := &Client{httpClient: &http.Client{Timeout: 50 * time.Millisecond}, Breakers: NewBreakers(2, time.Minute)}
+	event := counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 1}
+	_, err := c.SendIncrements(peer, "self", []counter.Event{event})
+	assertKind(t, err, ErrTimeout)
+	assert.True(t, Retryable(err))
+
+	_, err = c.SyncDigest(peer, "self", nil)
+	assertKind(t, err, ErrTransport)
+	assert.True(t, Retryable(err))
+
+	// Both count against the circuit although the status was 200
+	assert.Equal(t, BreakerOpen, c.Breakers.State(peer).State)
+}
+
+func TestErrors_TransportAndTimeout(t *testing.T) {
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	peer := server.Listener.Addr().String()
+
+	c := &Client{httpClient: &http.Client{Timeout: 50 * time.Millisecond}}
+	err := c.PushState(peer, "self", nil)
+	assertKind(t, err, ErrTimeout)
+	assert.True(t, Retryable(err))
+
+	close(release)
+	server.Close()
+	err = c.PushState(peer, "self", nil)
+	assertKind(t, err, ErrTransport)
+	assert.True(t, Retryable(err))
+
+	// Only errors from a request are classified
+	assert.True(t, Retryable(ErrCircuitOpen))
+	assert.False(t, Retryable(errors.New("json: unsupported value")))
+}
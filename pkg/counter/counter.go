@@ -1,39 +1,404 @@
 package counter
 
-import "sync"
+import (
+	"errors"
+	"service_discovery/pkg/events"
+	"sort"
+	"sync"
+)
+
+// Event is a single counter update as it travels between nodes. Every update
+// is identified by the node it originated on and that node's sequence
+// number, which increases by one with each local update.
+type Event struct {
+	Counter string `json:"counter"`
+	Origin  string `json:"origin"`
+	Seq     uint64 `json:"seq"`
+	Delta   int64  `json:"delta"`
+}
+
+// State is the replicable part of a PN-Counter: for every origin node, the
+// total it has added (P) and subtracted (N), together with the sequence
+// numbers those totals cover: everything up to Seq plus the out-of-order
+// sequences in Ahead, whose deltas are listed in Deltas in the same order.
+// Merging takes the union of the sequences both sides have seen, so it is
+// idempotent and never counts an update twice.
+type State struct {
+	P      map[string]int64    `json:"p"`
+	N      map[string]int64    `json:"n"`
+	Seq    map[string]uint64   `json:"seq"`
+	Ahead  map[string][]uint64 `json:"ahead,omitempty"`
+	Deltas map[string][]int64  `json:"deltas,omitempty"`
+}
+
+func NewState() State {
+	return State{
+		P:      make(map[string]int64),
+		N:      make(map[string]int64),
+		Seq:    make(map[string]uint64),
+		Ahead:  make(map[string][]uint64),
+		Deltas: make(map[string][]int64),
+	}
+}
+
+// Value returns the counter value represented by the state.
+func (st State) Value() int64 {
+	var value int64
+	for _, v := range st.P {
+		value += v
+	}
+	for _, v := range st.N {
+		value -= v
+	}
+	return value
+}
+
+// Digest summarises which sequences a counter has seen from each origin,
+// without the totals. Peers exchange digests to find out cheaply which of
+// them is missing updates.
+type Digest struct {
+	Seq   map[string]uint64   `json:"seq"`
+	Ahead map[string][]uint64 `json:"ahead,omitempty"`
+}
+
+func (d Digest) state() State {
+	return State{Seq: d.Seq, Ahead: d.Ahead}
+}
+
+// MaxAhead is how far past an origin's watermark an update may be applied.
+// Updates further ahead are refused rather than remembered, so a sequence
+// that never arrives cannot make the dedup state grow without bound;
+// anti-entropy brings them in once the gap is filled.
+const MaxAhead = 1024
+
+var (
+	// ErrDuplicate is returned for an update that was applied before.
+	ErrDuplicate = errors.New("counter update already applied")
+	// ErrTooFarAhead is returned for an update more than MaxAhead past the
+	// watermark of its origin.
+	ErrTooFarAhead = errors.New("counter update too far ahead of its origin's watermark")
+)
+
+// entry is the per-origin part of a counter. Deduplication only needs the
+// contiguous watermark plus the few sequences that arrived ahead of it, so
+// its size is bounded by the number of nodes rather than the number of
+// events. The deltas of the sequences ahead are kept so that two entries
+// missing different sequences can be combined.
+type entry struct {
+	p         int64
+	n         int64
+	watermark uint64
+	ahead     map[uint64]int64 // delta by sequence
+	partial   bool             // the deltas in ahead are unknown
+}
+
+func (e *entry) has(seq uint64) bool {
+	if seq <= e.watermark {
+		return true
+	}
+	_, ok := e.ahead[seq]
+	return ok
+}
+
+// covers reports whether e has seen every sequence other has seen.
+func (e *entry) covers(other *entry) bool {
+	for seq := e.watermark + 1; seq <= other.watermark; seq++ {
+		if !e.has(seq) {
+			return false
+		}
+	}
+	for seq := range other.ahead {
+		if !e.has(seq) {
+			return false
+		}
+	}
+	return true
+}
+
+// union returns an entry with every sequence a or b has seen, or nil if that
+// cannot be worked out. The totals up to the higher watermark are taken from
+// the entry that has it, and the sequences only the other saw ahead of it are
+// added with their deltas.
+func union(a, b *entry) *entry {
+	if a.watermark < b.watermark {
+		a, b = b, a
+	}
+	if b.partial {
+		return nil
+	}
+
+	u := &entry{p: a.p, n: a.n, watermark: a.watermark, ahead: make(map[uint64]int64), partial: a.partial}
+	for seq, delta := range a.ahead {
+		u.ahead[seq] = delta
+	}
+	for seq, delta := range b.ahead {
+		if !u.has(seq) {
+			u.record(seq, delta)
+		}
+	}
+	if len(u.ahead) > MaxAhead {
+		return nil
+	}
+	return u
+}
+
+func (e *entry) record(seq uint64, delta int64) {
+	if delta >= 0 {
+		e.p += delta
+	} else {
+		e.n -= delta
+	}
+
+	e.ahead[seq] = delta
+	for {
+		if _, ok := e.ahead[e.watermark+1]; !ok {
+			break
+		}
+		delete(e.ahead, e.watermark+1)
+		e.watermark++
+	}
+}
 
 type Counter struct {
-	mu    sync.Mutex
-	value int64
-	seen  map[string]struct{}
+	mu      sync.Mutex
+	nodeID  string
+	entries map[string]*entry
+	name    string      // set by Counters, only used in published events
+	events  events.IBus // optional, notified of every change
 }
 
-func NewCounter() *Counter {
+func NewCounter(nodeID string) *Counter {
 	return &Counter{
-		seen: make(map[string]struct{}),
+		nodeID:  nodeID,
+		entries: make(map[string]*entry),
 	}
 }
 
 type IPeerCounter interface {
-	Apply(eventID string, delta int64) bool
+	ApplyLocal(delta int64) uint64
+	Apply(origin string, seq uint64, delta int64) error
+	Merge(state State) bool
+	State() State
+	Delta(nodeIDs ...string) State
+	Digest() Digest
+	Compare(digest Digest) (State, []string)
 	Get() int64
 }
 
-func (c *Counter) Apply(eventID string, delta int64) bool {
+func (c *Counter) entry(origin string) *entry {
+	e, ok := c.entries[origin]
+	if !ok {
+		e = &entry{ahead: make(map[uint64]int64)}
+		c.entries[origin] = e
+	}
+	return e
+}
+
+// ApplyLocal records an update made on this node and returns the sequence
+// number assigned to it.
+func (c *Counter) ApplyLocal(delta int64) uint64 {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	if _, ok := c.seen[eventID]; ok {
-		return false
+	e := c.entry(c.nodeID)
+	seq := e.watermark + 1
+	e.record(seq, delta)
+	c.changed()
+	return seq
+}
+
+// Apply records an update from origin. Updates are deduplicated by
+// (origin, seq), so replaying the same event is a no-op. An update more than
+// MaxAhead past the watermark is refused with ErrTooFarAhead.
+func (c *Counter) Apply(origin string, seq uint64, delta int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e := c.entry(origin)
+	if e.has(seq) {
+		return ErrDuplicate
+	}
+	if seq > e.watermark+MaxAhead {
+		return ErrTooFarAhead
 	}
 
-	c.value += delta
-	c.seen[eventID] = struct{}{}
-	return true
+	e.record(seq, delta)
+	c.changed()
+	return nil
+}
+
+// Merge folds a remote state into the counter and reports whether anything
+// changed. Merging is idempotent, so replayed states are harmless.
+func (c *Counter) Merge(state State) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	changed := false
+	for _, origin := range state.origins() {
+		other := state.entry(origin)
+		mine := c.entry(origin)
+		switch {
+		case mine.covers(other):
+			continue
+		case other.covers(mine):
+			c.entries[origin] = other
+		default:
+			// Each side has sequences the other lacks
+			u := union(mine, other)
+			if u == nil {
+				continue
+			}
+			c.entries[origin] = u
+		}
+		changed = true
+	}
+	if changed {
+		c.changed()
+	}
+	return changed
+}
+
+// changed publishes the counter's new value. c.mu must be held.
+func (c *Counter) changed() {
+	if c.events == nil {
+		return
+	}
+	c.events.Publish(events.CounterChanged, events.CounterData{Counter: c.name, Value: c.value()})
+}
+
+func (st State) origins() []string {
+	seen := make(map[string]struct{})
+	for origin := range st.Seq {
+		seen[origin] = struct{}{}
+	}
+	for origin := range st.Ahead {
+		seen[origin] = struct{}{}
+	}
+
+	origins := make([]string, 0, len(seen))
+	for origin := range seen {
+		origins = append(origins, origin)
+	}
+	return origins
+}
+
+func (st State) entry(origin string) *entry {
+	ahead, deltas := st.Ahead[origin], st.Deltas[origin]
+	e := &entry{
+		p:         st.P[origin],
+		n:         st.N[origin],
+		watermark: st.Seq[origin],
+		ahead:     make(map[uint64]int64),
+		partial:   len(deltas) != len(ahead),
+	}
+	for i, seq := range ahead {
+		if !e.partial {
+			e.ahead[seq] = deltas[i]
+		} else {
+			e.ahead[seq] = 0 // unknown, see partial
+		}
+	}
+	return e
+}
+
+func (st State) put(origin string, e *entry) {
+	st.P[origin] = e.p
+	st.N[origin] = e.n
+	st.Seq[origin] = e.watermark
+	if len(e.ahead) == 0 {
+		return
+	}
+
+	ahead := make([]uint64, 0, len(e.ahead))
+	for seq := range e.ahead {
+		ahead = append(ahead, seq)
+	}
+	sort.Slice(ahead, func(i, j int) bool { return ahead[i] < ahead[j] })
+	st.Ahead[origin] = ahead
+	if e.partial {
+		return
+	}
+
+	deltas := make([]int64, len(ahead))
+	for i, seq := range ahead {
+		deltas[i] = e.ahead[seq]
+	}
+	st.Deltas[origin] = deltas
+}
+
+// State returns a copy of the full counter state.
+func (c *Counter) State() State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := NewState()
+	for origin, e := range c.entries {
+		st.put(origin, e)
+	}
+	return st
+}
+
+// Delta returns the part of the state owned by the given nodes, which is all
+// a peer needs to catch up with those nodes' updates.
+func (c *Counter) Delta(nodeIDs ...string) State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st := NewState()
+	for _, nodeID := range nodeIDs {
+		if e, ok := c.entries[nodeID]; ok {
+			st.put(nodeID, e)
+		}
+	}
+	return st
+}
+
+// Digest returns the sequences seen per origin.
+func (c *Counter) Digest() Digest {
+	st := c.State()
+	return Digest{Seq: st.Seq, Ahead: st.Ahead}
+}
+
+// Compare checks a peer's digest against the counter. It returns the entries
+// the peer is missing, and the origins for which the peer has seen updates
+// that this counter has not.
+func (c *Counter) Compare(digest Digest) (State, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	remote := digest.state()
+	newer := NewState()
+	for origin, mine := range c.entries {
+		if !remote.entry(origin).covers(mine) {
+			newer.put(origin, mine)
+		}
+	}
+
+	var wanted []string
+	for _, origin := range remote.origins() {
+		mine, ok := c.entries[origin]
+		if !ok {
+			mine = &entry{}
+		}
+		if !mine.covers(remote.entry(origin)) {
+			wanted = append(wanted, origin)
+		}
+	}
+	sort.Strings(wanted)
+	return newer, wanted
 }
 
 func (c *Counter) Get() int64 {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.value
+	return c.value()
+}
+
+// value sums the counter over all origins. c.mu must be held.
+func (c *Counter) value() int64 {
+	var value int64
+	for _, e := range c.entries {
+		value += e.p - e.n
+	}
+	return value
 }
@@ -0,0 +1,196 @@
+package counter
+
+import (
+	"service_discovery/pkg/events"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyLocalAssignsSequence(t *testing.T) {
+	c := NewCounter("node1")
+
+	assert.Equal(t, uint64(1), c.ApplyLocal(1))
+	assert.Equal(t, uint64(2), c.ApplyLocal(-3))
+
+	assert.Equal(t, int64(-2), c.Get())
+}
+
+func TestApplyDeduplicates(t *testing.T) {
+	c := NewCounter("node1")
+
+	assert.NoError(t, c.Apply("node2", 1, 1))
+	assert.ErrorIs(t, c.Apply("node2", 1, 1), ErrDuplicate)
+
+	// Out of order delivery is applied once and then rejected
+	assert.NoError(t, c.Apply("node2", 3, 5))
+	assert.ErrorIs(t, c.Apply("node2", 3, 5), ErrDuplicate)
+	assert.NoError(t, c.Apply("node2", 2, 1))
+	assert.ErrorIs(t, c.Apply("node2", 2, 1), ErrDuplicate)
+
+	assert.Equal(t, int64(7), c.Get())
+}
+
+func TestDedupStateIsBounded(t *testing.T) {
+	c := NewCounter("node1")
+
+	for seq := uint64(1000); seq >= 1; seq-- {
+		c.Apply("node2", seq, 1)
+	}
+
+	st := c.State()
+	assert.Equal(t, uint64(1000), st.Seq["node2"])
+	assert.Empty(t, st.Ahead["node2"])
+	assert.Equal(t, int64(1000), c.Get())
+}
+
+func TestApplyRefusesTooFarAhead(t *testing.T) {
+	c := NewCounter("node1")
+
+	// Sequence 1 never arrives
+	assert.NoError(t, c.Apply("node2", MaxAhead, 1))
+	assert.ErrorIs(t, c.Apply("node2", MaxAhead+1, 1), ErrTooFarAhead)
+	assert.Len(t, c.State().Ahead["node2"], 1)
+
+	// Filling the gap moves the window on
+	assert.NoError(t, c.Apply("node2", 1, 1))
+	assert.NoError(t, c.Apply("node2", MaxAhead+1, 1))
+}
+
+func TestMergeConverges(t *testing.T) {
+	a := NewCounter("a")
+	b := NewCounter("b")
+
+	a.ApplyLocal(2)
+	a.ApplyLocal(-1)
+	b.ApplyLocal(5)
+
+	// Exchange whole state in both directions
+	assert.True(t, a.Merge(b.State()))
+	assert.True(t, b.Merge(a.State()))
+
+	assert.Equal(t, int64(6), a.Get())
+	assert.Equal(t, a.Get(), b.Get())
+
+	// Merging the same state again changes nothing
+	assert.False(t, a.Merge(b.State()))
+	assert.Equal(t, int64(6), a.Get())
+}
+
+func TestMergeDoesNotDoubleCount(t *testing.T) {
+	a := NewCounter("a")
+	a.ApplyLocal(1)
+	a.ApplyLocal(1)
+
+	b := NewCounter("b")
+	assert.True(t, b.Merge(a.State()))
+
+	// Events already covered by the merged state are duplicates
+	assert.ErrorIs(t, b.Apply("a", 2, 1), ErrDuplicate)
+	assert.Equal(t, int64(2), b.Get())
+
+	// A state that knows less than we do is ignored
+	c := NewCounter("c")
+	c.Apply("a", 1, 1)
+	assert.False(t, b.Merge(c.State()))
+	assert.Equal(t, int64(2), b.Get())
+}
+
+func TestMergeUnionsDisjointUpdates(t *testing.T) {
+	// Both replicas missed a different update from o
+	a := NewCounter("a")
+	a.Apply("o", 1, 1)
+	a.Apply("o", 3, 1)
+	b := NewCounter("b")
+	b.Apply("o", 1, 1)
+	b.Apply("o", 2, 1)
+
+	newer, wanted := a.Compare(b.Digest())
+	assert.Equal(t, map[string]uint64{"o": 1}, newer.Seq)
+	assert.Equal(t, []string{"o"}, wanted)
+
+	assert.True(t, b.Merge(newer))
+	assert.True(t, a.Merge(b.Delta(wanted...)))
+	assert.Equal(t, int64(3), a.Get())
+	assert.Equal(t, int64(3), b.Get())
+
+	// Both now cover 1 to 3, so there is nothing left to exchange
+	assert.ErrorIs(t, a.Apply("o", 2, 1), ErrDuplicate)
+	assert.ErrorIs(t, b.Apply("o", 3, 1), ErrDuplicate)
+	newer, wanted = a.Compare(b.Digest())
+	assert.Empty(t, newer.Seq)
+	assert.Empty(t, wanted)
+}
+
+func TestDeltaOnlyContainsNode(t *testing.T) {
+	c := NewCounter("a")
+	c.ApplyLocal(4)
+	c.Apply("b", 1, 7)
+
+	delta := c.Delta("a")
+	assert.Equal(t, map[string]int64{"a": 4}, delta.P)
+	assert.Equal(t, map[string]uint64{"a": 1}, delta.Seq)
+	assert.Equal(t, int64(4), delta.Value())
+}
+
+func TestCountersAreIndependent(t *testing.T) {
+	cs := NewCounters("a")
+
+	_, ok := cs.Get("orders")
+	assert.False(t, ok)
+
+	cs.GetOrCreate("orders").ApplyLocal(2)
+	cs.GetOrCreate("stock").ApplyLocal(-1)
+
+	orders, ok := cs.Get("orders")
+	assert.True(t, ok)
+	assert.Equal(t, int64(2), orders.Get())
+
+	stock, _ := cs.Get("stock")
+	assert.Equal(t, int64(-1), stock.Get())
+
+	assert.Equal(t, []string{"orders", "stock"}, cs.Names())
+}
+
+func TestCompareFindsMissingEntries(t *testing.T) {
+	a := NewCounter("a")
+	a.ApplyLocal(1)
+	a.ApplyLocal(1)
+	a.Apply("c", 1, 5)
+
+	b := NewCounter("b")
+	b.ApplyLocal(3)
+	b.Apply("a", 1, 1)
+
+	newer, wanted := a.Compare(b.Digest())
+
+	// b is behind on a's and c's updates, a has never seen b's
+	assert.Equal(t, map[string]uint64{"a": 2, "c": 1}, newer.Seq)
+	assert.Equal(t, []string{"b"}, wanted)
+
+	assert.True(t, b.Merge(newer))
+	assert.True(t, a.Merge(b.Delta("b")))
+	assert.Equal(t, a.Get(), b.Get())
+	assert.Equal(t, int64(10), a.Get())
+
+	newer, wanted = a.Compare(b.Digest())
+	assert.Empty(t, newer.Seq)
+	assert.Empty(t, wanted)
+}
+
+func TestCountersPublishChanges(t *testing.T) {
+	bus := events.NewBus(events.DefaultBuffer)
+	sub := bus.Subscribe()
+	cs := NewCounters("node1")
+	cs.Events = bus
+
+	c := cs.GetOrCreate("orders")
+	c.ApplyLocal(2)
+	c.Apply("node2", 1, 3)
+	// A duplicate changes nothing
+	c.Apply("node2", 1, 3)
+
+	assert.Len(t, sub.C, 2)
+	assert.Equal(t, events.CounterData{Counter: "orders", Value: 2}, (<-sub.C).Data)
+	assert.Equal(t, events.CounterData{Counter: "orders", Value: 5}, (<-sub.C).Data)
+}
@@ -0,0 +1,71 @@
+package counter
+
+import (
+	"service_discovery/pkg/events"
+	"sort"
+	"sync"
+)
+
+// DefaultName is the counter served by the legacy /counter/* endpoints.
+const DefaultName = "default"
+
+// Counters holds every named counter hosted by a node. Counters are created
+// lazily on first write and each keeps its own state and deduplication.
+type Counters struct {
+	mu       sync.RWMutex
+	nodeID   string
+	counters map[string]*Counter
+
+	Events events.IBus // if set, counters created from now on publish their changes
+}
+
+func NewCounters(nodeID string) *Counters {
+	return &Counters{
+		nodeID:   nodeID,
+		counters: make(map[string]*Counter),
+	}
+}
+
+type ICounters interface {
+	Get(name string) (IPeerCounter, bool)
+	GetOrCreate(name string) IPeerCounter
+	Names() []string
+}
+
+func (cs *Counters) Get(name string) (IPeerCounter, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	c, ok := cs.counters[name]
+	if !ok {
+		return nil, false
+	}
+	return c, true
+}
+
+func (cs *Counters) GetOrCreate(name string) IPeerCounter {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	c, ok := cs.counters[name]
+	if !ok {
+		c = NewCounter(cs.nodeID)
+		c.name = name
+		c.events = cs.Events
+		cs.counters[name] = c
+	}
+	return c
+}
+
+// Names returns the names of all counters in sorted order.
+func (cs *Counters) Names() []string {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+
+	names := make([]string, 0, len(cs.counters))
+	for name := range cs.counters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
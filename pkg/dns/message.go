@@ -0,0 +1,197 @@
+package dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Just enough of the RFC 1035 wire format to answer A, AAAA and SRV queries.
+
+const (
+	TypeA    uint16 = 1
+	TypeAAAA uint16 = 28
+	TypeSRV  uint16 = 33
+	TypeANY  uint16 = 255
+
+	ClassIN  uint16 = 1
+	ClassANY uint16 = 255
+)
+
+const (
+	RCodeSuccess        uint16 = 0
+	RCodeFormatError    uint16 = 1
+	RCodeServerFailure  uint16 = 2
+	RCodeNameError      uint16 = 3
+	RCodeNotImplemented uint16 = 4
+	RCodeRefused        uint16 = 5
+)
+
+// MaxUDPSize is the largest reply sent over UDP. EDNS is not supported, so a
+// larger reply is truncated and the client retries over TCP.
+const MaxUDPSize = 512
+
+const (
+	flagResponse      uint16 = 1 << 15
+	flagAuthoritative uint16 = 1 << 10
+	flagTruncated     uint16 = 1 << 9
+	flagRecursion     uint16 = 1 << 8
+	maskOpcode        uint16 = 0xf << 11
+
+	headerSize    = 12
+	maxNameLength = 255
+	maxLabelSize  = 63
+)
+
+var (
+	errShort     = errors.New("dns message shorter than its header")
+	errMalformed = errors.New("malformed dns message")
+	errName      = errors.New("invalid domain name")
+)
+
+type question struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// record is a resource record of class IN. Data is the encoded RDATA.
+type record struct {
+	Name string
+	Type uint16
+	TTL  uint32
+	Data []byte
+}
+
+type message struct {
+	ID        uint16
+	Flags     uint16
+	Questions []question
+	Answers   []record
+	Extra     []record
+}
+
+// parseMessage reads the header and questions of a query. The remaining
+// sections, such as an EDNS record, are ignored. The header is returned even
+// if the questions cannot be read, so the error can be answered.
+func parseMessage(b []byte) (message, error) {
+	if len(b) < headerSize {
+		return message{}, errShort
+	}
+	m := message{
+		ID:    binary.BigEndian.Uint16(b[0:]),
+		Flags: binary.BigEndian.Uint16(b[2:]),
+	}
+
+	off := headerSize
+	for i := 0; i < int(binary.BigEndian.Uint16(b[4:])); i++ {
+		name, next, err := readName(b, off)
+		if err != nil {
+			return m, err
+		}
+		if next+4 > len(b) {
+			return m, errMalformed
+		}
+		m.Questions = append(m.Questions, question{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(b[next:]),
+			Class: binary.BigEndian.Uint16(b[next+2:]),
+		})
+		off = next + 4
+	}
+	return m, nil
+}
+
+// readName reads an uncompressed name at off and returns it in dotted form
+// along with the offset just past it. Queries have nothing to compress, so a
+// compression pointer is rejected.
+func readName(b []byte, off int) (string, int, error) {
+	var labels []string
+	length := 1
+	for {
+		if off >= len(b) {
+			return "", 0, errMalformed
+		}
+		size := int(b[off])
+		off++
+		if size == 0 {
+			break
+		}
+		if size > maxLabelSize || off+size > len(b) {
+			return "", 0, errMalformed
+		}
+		label := string(b[off : off+size])
+		if strings.Contains(label, ".") {
+			return "", 0, errMalformed
+		}
+		length += size + 1
+		if length > maxNameLength {
+			return "", 0, errMalformed
+		}
+		labels = append(labels, label)
+		off += size
+	}
+	return strings.Join(labels, ".") + ".", off, nil
+}
+
+// appendName encodes a dotted name such as "api.service.cluster.".
+func appendName(b []byte, name string) ([]byte, error) {
+	name = strings.TrimSuffix(name, ".")
+	if len(name)+2 > maxNameLength {
+		return nil, errName
+	}
+	if name != "" {
+		for _, label := range strings.Split(name, ".") {
+			if label == "" || len(label) > maxLabelSize {
+				return nil, errName
+			}
+			b = append(b, byte(len(label)))
+			b = append(b, label...)
+		}
+	}
+	return append(b, 0), nil
+}
+
+// srvData encodes the RDATA of an SRV record. Every target gets the same
+// priority and weight; clients spread load by the order of the answers.
+func srvData(port uint16, target string) ([]byte, error) {
+	b := binary.BigEndian.AppendUint16(nil, 1) // priority
+	b = binary.BigEndian.AppendUint16(b, 1)    // weight
+	b = binary.BigEndian.AppendUint16(b, port)
+	return appendName(b, target)
+}
+
+// pack encodes the message. Record names equal to the first question's name
+// are compressed into a pointer to it.
+func (m message) pack() ([]byte, error) {
+	b := make([]byte, headerSize, MaxUDPSize)
+	binary.BigEndian.PutUint16(b[0:], m.ID)
+	binary.BigEndian.PutUint16(b[2:], m.Flags)
+	binary.BigEndian.PutUint16(b[4:], uint16(len(m.Questions)))
+	binary.BigEndian.PutUint16(b[6:], uint16(len(m.Answers)))
+	binary.BigEndian.PutUint16(b[8:], 0)
+	binary.BigEndian.PutUint16(b[10:], uint16(len(m.Extra)))
+
+	var err error
+	for _, q := range m.Questions {
+		if b, err = appendName(b, q.Name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, q.Type)
+		b = binary.BigEndian.AppendUint16(b, q.Class)
+	}
+
+	for _, r := range append(m.Answers[:len(m.Answers):len(m.Answers)], m.Extra...) {
+		if len(m.Questions) > 0 && strings.EqualFold(r.Name, m.Questions[0].Name) {
+			b = binary.BigEndian.AppendUint16(b, 0xc000|headerSize)
+		} else if b, err = appendName(b, r.Name); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, r.Type)
+		b = binary.BigEndian.AppendUint16(b, ClassIN)
+		b = binary.BigEndian.AppendUint32(b, r.TTL)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(r.Data)))
+		b = append(b, r.Data...)
+	}
+	return b, nil
+}
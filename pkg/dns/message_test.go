@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func query(id uint16, name string, qtype uint16) []byte {
+	m := message{ID: id, Flags: flagRecursion, Questions: []question{{Name: name, Type: qtype, Class: ClassIN}}}
+	b, _ := m.pack()
+	return b
+}
+
+func TestParseMessage_RoundTrip(t *testing.T) {
+	m, err := parseMessage(query(7, "Api.Service.cluster.", TypeSRV))
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(7), m.ID)
+	assert.Equal(t, []question{{Name: "Api.Service.cluster.", Type: TypeSRV, Class: ClassIN}}, m.Questions)
+}
+
+func TestParseMessage_RejectsMalformed(t *testing.T) {
+	_, err := parseMessage([]byte{0, 1})
+	assert.ErrorIs(t, err, errShort)
+
+	b := query(7, "nodes.cluster.", TypeA)
+	_, err = parseMessage(b[:len(b)-3])
+	assert.ErrorIs(t, err, errMalformed)
+
+	// A compression pointer where the question name should be
+	b = append(query(7, ".", TypeA)[:headerSize], 0xc0, 0x0c, 0, 1, 0, 1)
+	_, err = parseMessage(b)
+	assert.ErrorIs(t, err, errMalformed)
+}
+
+func TestHandle_Responses(t *testing.T) {
+	s := NewServer(DefaultDomain, fakeSource{})
+
+	// A query for a name that does not exist keeps its ID and question
+	reply, err := parseMessage(s.handle(query(9, "nodes.cluster.", TypeA), MaxUDPSize))
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(9), reply.ID)
+	assert.Equal(t, RCodeNameError, reply.Flags&0xf)
+	assert.NotZero(t, reply.Flags&flagResponse)
+	assert.NotZero(t, reply.Flags&flagRecursion)
+	assert.Len(t, reply.Questions, 1)
+
+	// Only standard queries are supported
+	b := query(10, "nodes.cluster.", TypeA)
+	b[2] |= 1 << 3 // opcode 1
+	reply, _ = parseMessage(s.handle(b, MaxUDPSize))
+	assert.Equal(t, RCodeNotImplemented, reply.Flags&0xf)
+
+	// A response is never answered
+	b = query(11, "nodes.cluster.", TypeA)
+	b[2] |= 0x80
+	assert.Nil(t, s.handle(b, MaxUDPSize))
+}
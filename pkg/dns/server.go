@@ -0,0 +1,321 @@
+package dns
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"service_discovery/pkg/peerStore"
+	"service_discovery/pkg/registry"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultDomain is the zone the server answers for when none is configured.
+const DefaultDomain = "cluster."
+
+// tcpTimeout bounds how long a TCP client may take to send its next query.
+const tcpTimeout = 10 * time.Second
+
+// Source is where names are looked up. *service.PeerService satisfies it.
+type Source interface {
+	View() []peerStore.Update
+	Instances(service string) []registry.Instance
+}
+
+// Server answers queries for the nodes and services of the cluster under its
+// domain:
+//
+//	nodes.<domain>                 alive nodes
+//	<id>.node.<domain>             one alive node
+//	<name>.service.<domain>        healthy instances of a service
+//	_<name>._<proto>.service.<domain>  the same, in RFC 2782 form
+//	<hex ip>.addr.<domain>         the address an SRV target stands for
+//
+// A and AAAA answers carry the addresses that are IPs; SRV answers carry
+// every endpoint with its port. Answers are built from the current view on
+// every query and have a TTL of zero unless TTL is set.
+type Server struct {
+	Domain string
+	Source Source
+	TTL    uint32
+
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+func NewServer(domain string, src Source) *Server {
+	return &Server{Domain: canonical(domain), Source: src}
+}
+
+// canonical lower-cases a name and makes it fully qualified.
+func canonical(name string) string {
+	name = strings.ToLower(name)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// Listen binds UDP and TCP on addr. With port 0, TCP takes the port UDP got.
+func (s *Server) Listen(addr string) error {
+	udp, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		return err
+	}
+	s.udp, s.tcp = udp, tcp
+	return nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.udp.LocalAddr().String()
+}
+
+// Serve answers queries until the server is closed.
+func (s *Server) Serve() {
+	go s.serveTCP()
+	s.serveUDP()
+}
+
+func (s *Server) Close() error {
+	return errors.Join(s.udp.Close(), s.tcp.Close())
+}
+
+func (s *Server) serveUDP() {
+	buf := make([]byte, 4096)
+	for {
+		n, from, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("error in reading a dns query", err)
+			}
+			return
+		}
+		if reply := s.handle(buf[:n], MaxUDPSize); reply != nil {
+			if _, err := s.udp.WriteTo(reply, from); err != nil {
+				log.Println("error in sending a dns reply", err)
+			}
+		}
+	}
+}
+
+func (s *Server) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("error in accepting a dns connection", err)
+			}
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+// serveConn answers length-prefixed queries on a TCP connection until the
+// client closes it or goes quiet.
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		conn.SetDeadline(time.Now().Add(tcpTimeout))
+
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+
+		reply := s.handle(query, 0xffff)
+		if reply == nil {
+			return
+		}
+		if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(reply))), reply...)); err != nil {
+			return
+		}
+	}
+}
+
+// handle answers one query. A reply longer than limit is sent truncated. It
+// returns nil for messages not worth answering.
+func (s *Server) handle(query []byte, limit int) []byte {
+	req, err := parseMessage(query)
+	if errors.Is(err, errShort) || req.Flags&flagResponse != 0 {
+		return nil
+	}
+
+	resp := message{ID: req.ID, Flags: flagResponse | flagAuthoritative | req.Flags&(maskOpcode|flagRecursion)}
+	rcode := RCodeSuccess
+	switch {
+	case err != nil || len(req.Questions) != 1:
+		rcode = RCodeFormatError
+	case req.Flags&maskOpcode != 0:
+		resp.Questions = req.Questions
+		rcode = RCodeNotImplemented
+	default:
+		resp.Questions = req.Questions
+		rcode, resp.Answers, resp.Extra = s.resolve(req.Questions[0])
+	}
+	resp.Flags |= rcode
+
+	reply, err := resp.pack()
+	if err == nil && len(reply) > limit {
+		resp.Flags |= flagTruncated
+		resp.Answers, resp.Extra = nil, nil
+		reply, err = resp.pack()
+	}
+	if err != nil {
+		log.Println("error in packing a dns reply", err)
+		resp = message{ID: req.ID, Flags: flagResponse | RCodeServerFailure}
+		reply, _ = resp.pack()
+	}
+	return reply
+}
+
+// endpoint is somewhere a name points to. Host is an IP or a host name.
+type endpoint struct {
+	Host string
+	Port uint16
+}
+
+// resolve looks the question up and returns the rcode with the answer and
+// additional records.
+func (s *Server) resolve(q question) (uint16, []record, []record) {
+	if q.Class != ClassIN && q.Class != ClassANY {
+		return RCodeRefused, nil, nil
+	}
+	name := canonical(q.Name)
+	if name != s.Domain && !strings.HasSuffix(name, "."+s.Domain) {
+		// Not ours, and we do not recurse
+		return RCodeRefused, nil, nil
+	}
+	labels := strings.Split(strings.TrimSuffix(strings.TrimSuffix(name, s.Domain), "."), ".")
+
+	var endpoints []endpoint
+	switch {
+	case len(labels) == 1 && labels[0] == "nodes":
+		endpoints = s.nodes("")
+	case len(labels) == 2 && labels[1] == "node":
+		endpoints = s.nodes(labels[0])
+	case len(labels) == 2 && labels[1] == "service":
+		endpoints = s.services(labels[0])
+	case len(labels) == 3 && labels[2] == "service" && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_"):
+		endpoints = s.services(labels[0][1:])
+	case len(labels) == 2 && labels[1] == "addr":
+		if ip := decodeAddr(labels[0]); ip != nil {
+			endpoints = []endpoint{{Host: ip.String()}}
+		}
+	}
+	if len(endpoints) == 0 {
+		return RCodeNameError, nil, nil
+	}
+	rand.Shuffle(len(endpoints), func(i, j int) { endpoints[i], endpoints[j] = endpoints[j], endpoints[i] })
+
+	var answers, extra []record
+	if q.Type == TypeA || q.Type == TypeAAAA || q.Type == TypeANY {
+		answers = s.addresses(q.Name, q.Type, endpoints)
+	}
+	if q.Type == TypeSRV || q.Type == TypeANY {
+		seen := make(map[string]bool)
+		for _, e := range endpoints {
+			target := e.Host + "."
+			ip := net.ParseIP(e.Host)
+			if ip != nil {
+				target = s.addrName(ip)
+			}
+			data, err := srvData(e.Port, target)
+			if err != nil {
+				continue
+			}
+			answers = append(answers, record{Name: q.Name, Type: TypeSRV, TTL: s.TTL, Data: data})
+			if ip != nil && !seen[target] {
+				seen[target] = true
+				extra = append(extra, s.addresses(target, TypeANY, []endpoint{e})...)
+			}
+		}
+	}
+	return RCodeSuccess, answers, extra
+}
+
+// addresses returns the A and/or AAAA records for the endpoints that are IPs,
+// one per distinct address.
+func (s *Server) addresses(name string, qtype uint16, endpoints []endpoint) []record {
+	var records []record
+	seen := make(map[string]bool)
+	for _, e := range endpoints {
+		ip := net.ParseIP(e.Host)
+		if ip == nil || seen[ip.String()] {
+			continue
+		}
+		seen[ip.String()] = true
+		if ip4 := ip.To4(); ip4 != nil {
+			if qtype != TypeAAAA {
+				records = append(records, record{Name: name, Type: TypeA, TTL: s.TTL, Data: ip4})
+			}
+		} else if qtype != TypeA {
+			records = append(records, record{Name: name, Type: TypeAAAA, TTL: s.TTL, Data: ip.To16()})
+		}
+	}
+	return records
+}
+
+// nodes returns the alive nodes, or only the one with the given ID. IDs are
+// compared case-insensitively, as DNS names are.
+func (s *Server) nodes(id string) []endpoint {
+	var endpoints []endpoint
+	for _, u := range s.Source.View() {
+		if u.State != peerStore.StateAlive || (id != "" && !strings.EqualFold(u.ID, id)) {
+			continue
+		}
+		host, port, err := net.SplitHostPort(u.Addr)
+		if err != nil {
+			continue
+		}
+		p, _ := strconv.ParseUint(port, 10, 16)
+		endpoints = append(endpoints, endpoint{Host: host, Port: uint16(p)})
+	}
+	return endpoints
+}
+
+// services returns the instances of a service that are not failing their
+// check.
+func (s *Server) services(name string) []endpoint {
+	var endpoints []endpoint
+	for _, inst := range s.Source.Instances(name) {
+		if inst.Health.Status == registry.HealthCritical || inst.Address == "" {
+			continue
+		}
+		endpoints = append(endpoints, endpoint{Host: inst.Address, Port: uint16(inst.Port)})
+	}
+	return endpoints
+}
+
+// addrName is the name an SRV answer uses for a target that is an IP, since
+// SRV targets must be names.
+func (s *Server) addrName(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	return hex.EncodeToString(ip) + ".addr." + s.Domain
+}
+
+func decodeAddr(label string) net.IP {
+	b, err := hex.DecodeString(label)
+	if err != nil || (len(b) != net.IPv4len && len(b) != net.IPv6len) {
+		return nil
+	}
+	return net.IP(b)
+}
@@ -0,0 +1,151 @@
+package dns
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"service_discovery/pkg/peerStore"
+	"service_discovery/pkg/registry"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeSource struct {
+	view      []peerStore.Update
+	instances map[string][]registry.Instance
+}
+
+func (f fakeSource) View() []peerStore.Update {
+	return f.view
+}
+
+func (f fakeSource) Instances(service string) []registry.Instance {
+	return f.instances[service]
+}
+
+// startServer serves src on a loopback port and returns a resolver that only
+// ever asks it.
+func startServer(t *testing.T, src Source) *net.Resolver {
+	s := NewServer(DefaultDomain, src)
+	if err := s.Listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve()
+	t.Cleanup(func() { s.Close() })
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, s.Addr())
+		},
+	}
+}
+
+func assertNotFound(t *testing.T, err error) {
+	var dnsErr *net.DNSError
+	if assert.ErrorAs(t, err, &dnsErr) {
+		assert.True(t, dnsErr.IsNotFound)
+	}
+}
+
+func lookupContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func TestServer_Nodes(t *testing.T) {
+	resolver := startServer(t, fakeSource{view: []peerStore.Update{
+		{ID: "a", Addr: "10.0.0.1:8080", State: peerStore.StateAlive},
+		{ID: "b", Addr: "10.0.0.2:8081", State: peerStore.StateAlive},
+		{ID: "c", Addr: "10.0.0.3:8082", State: peerStore.StateSuspect},
+		{ID: "d", Addr: "localhost:8083", State: peerStore.StateAlive},
+	}})
+	ctx := lookupContext(t)
+
+	// Suspected nodes are left out, and so are host names from A answers
+	hosts, err := resolver.LookupHost(ctx, "nodes.cluster.")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2"}, hosts)
+
+	_, srvs, err := resolver.LookupSRV(ctx, "", "", "nodes.cluster.")
+	assert.NoError(t, err)
+	var targets []string
+	for _, srv := range srvs {
+		targets = append(targets, fmt.Sprintf("%s:%d", srv.Target, srv.Port))
+	}
+	assert.ElementsMatch(t, []string{"0a000001.addr.cluster.:8080", "0a000002.addr.cluster.:8081", "localhost.:8083"}, targets)
+
+	// SRV targets resolve back to their address
+	hosts, err = resolver.LookupHost(ctx, "0a000002.addr.cluster.")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2"}, hosts)
+
+	hosts, err = resolver.LookupHost(ctx, "B.node.cluster.")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.2"}, hosts)
+
+	_, err = resolver.LookupHost(ctx, "c.node.cluster.")
+	assertNotFound(t, err)
+}
+
+func TestServer_Services(t *testing.T) {
+	resolver := startServer(t, fakeSource{instances: map[string][]registry.Instance{
+		"api": {
+			{Service: "api", ID: "api-1", Address: "10.0.1.1", Port: 9000, Health: registry.Health{Status: registry.HealthPassing}},
+			{Service: "api", ID: "api-2", Address: "10.0.1.2", Port: 9001, Health: registry.Health{Status: registry.HealthWarning}},
+			{Service: "api", ID: "api-3", Address: "10.0.1.3", Port: 9002, Health: registry.Health{Status: registry.HealthCritical}},
+			{Service: "api", ID: "api-4", Address: "fd00::4", Port: 9003, Health: registry.Health{Status: registry.HealthPassing}},
+		},
+	}})
+	ctx := lookupContext(t)
+
+	hosts, err := resolver.LookupHost(ctx, "api.service.cluster.")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"10.0.1.1", "10.0.1.2", "fd00::4"}, hosts)
+
+	_, srvs, err := resolver.LookupSRV(ctx, "api", "tcp", "service.cluster.")
+	assert.NoError(t, err)
+	var ports []int
+	for _, srv := range srvs {
+		ports = append(ports, int(srv.Port))
+	}
+	sort.Ints(ports)
+	assert.Equal(t, []int{9000, 9001, 9003}, ports)
+
+	_, err = resolver.LookupHost(ctx, "db.service.cluster.")
+	assertNotFound(t, err)
+}
+
+func TestServer_FallsBackToTCPForLargeAnswers(t *testing.T) {
+	var instances []registry.Instance
+	for i := 1; i <= 40; i++ {
+		instances = append(instances, registry.Instance{
+			Service: "api",
+			ID:      fmt.Sprintf("api-%d", i),
+			Address: fmt.Sprintf("10.0.2.%d", i),
+			Port:    9000,
+			Health:  registry.Health{Status: registry.HealthPassing},
+		})
+	}
+	resolver := startServer(t, fakeSource{instances: map[string][]registry.Instance{"api": instances}})
+
+	// 40 SRV answers with their addresses do not fit in 512 bytes of UDP
+	_, srvs, err := resolver.LookupSRV(lookupContext(t), "", "", "api.service.cluster.")
+	assert.NoError(t, err)
+	assert.Len(t, srvs, 40)
+}
+
+func TestServer_RefusesOtherZones(t *testing.T) {
+	s := NewServer("Cluster", fakeSource{})
+	assert.Equal(t, "cluster.", s.Domain)
+
+	rcode, _, _ := s.resolve(question{Name: "example.com.", Type: TypeA, Class: ClassIN})
+	assert.Equal(t, RCodeRefused, rcode)
+	rcode, _, _ = s.resolve(question{Name: "nodes.cluster.", Type: TypeA, Class: 3})
+	assert.Equal(t, RCodeRefused, rcode)
+}
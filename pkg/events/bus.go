@@ -0,0 +1,115 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+type Type string
+
+const (
+	PeerJoined        Type = "peer_joined"
+	PeerSuspected     Type = "peer_suspected"
+	PeerRemoved       Type = "peer_removed"
+	CounterChanged    Type = "counter_changed"
+	ReplicationFailed Type = "replication_failed"
+)
+
+// DefaultBuffer is how many events a subscriber may fall behind by before it
+// is dropped.
+const DefaultBuffer = 64
+
+// Event is something that happened on this node. ID increases by one with
+// every event published on the bus.
+type Event struct {
+	ID   uint64    `json:"id"`
+	Type Type      `json:"type"`
+	Time time.Time `json:"time"`
+	Data any       `json:"data"`
+}
+
+type PeerData struct {
+	ID          string `json:"id"`
+	Addr        string `json:"addr"`
+	State       string `json:"state"`
+	Incarnation uint64 `json:"incarnation"`
+}
+
+type CounterData struct {
+	Counter string `json:"counter"`
+	Value   int64  `json:"value"`
+}
+
+type ReplicationData struct {
+	Peer    string `json:"peer"`
+	Counter string `json:"counter"`
+	Origin  string `json:"origin"`
+	Seq     uint64 `json:"seq"`
+	Attempt int    `json:"attempt"`
+	Error   string `json:"error"`
+}
+
+// Subscription delivers events on C. C is closed when the subscriber is
+// dropped for falling behind or unsubscribes.
+type Subscription struct {
+	C  <-chan Event
+	ch chan Event
+}
+
+// Bus fans events out to subscribers. Publishing never blocks: a subscriber
+// whose buffer is full is dropped instead of holding up the write path.
+type Bus struct {
+	mu     sync.Mutex
+	buffer int
+	nextID uint64
+	subs   map[*Subscription]struct{}
+}
+
+func NewBus(buffer int) *Bus {
+	return &Bus{
+		buffer: buffer,
+		subs:   make(map[*Subscription]struct{}),
+	}
+}
+
+type IBus interface {
+	Publish(t Type, data any)
+	Subscribe() *Subscription
+	Unsubscribe(sub *Subscription)
+}
+
+func (b *Bus) Publish(t Type, data any) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.nextID++
+	e := Event{ID: b.nextID, Type: t, Time: time.Now(), Data: data}
+	for sub := range b.subs {
+		select {
+		case sub.ch <- e:
+		default:
+			delete(b.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+func (b *Bus) Subscribe() *Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, b.buffer)
+	sub := &Subscription{C: ch, ch: ch}
+	b.subs[sub] = struct{}{}
+	return sub
+}
+
+func (b *Bus) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subs[sub]; ok {
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+}
@@ -0,0 +1,53 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBus_DeliversToEverySubscriber(t *testing.T) {
+	bus := NewBus(DefaultBuffer)
+	a, b := bus.Subscribe(), bus.Subscribe()
+
+	bus.Publish(PeerJoined, PeerData{ID: "peer1"})
+	bus.Publish(CounterChanged, CounterData{Counter: "orders", Value: 3})
+
+	for _, sub := range []*Subscription{a, b} {
+		first, second := <-sub.C, <-sub.C
+		assert.Equal(t, PeerJoined, first.Type)
+		assert.Equal(t, CounterChanged, second.Type)
+		assert.Equal(t, first.ID+1, second.ID)
+	}
+}
+
+func TestBus_DropsSlowSubscribers(t *testing.T) {
+	bus := NewBus(2)
+	slow, fast := bus.Subscribe(), bus.Subscribe()
+
+	for i := 0; i < 3; i++ {
+		bus.Publish(CounterChanged, CounterData{Counter: "orders", Value: int64(i)})
+		<-fast.C
+	}
+
+	// The slow subscriber gets what fit in its buffer, then its channel closes
+	<-slow.C
+	<-slow.C
+	_, ok := <-slow.C
+	assert.False(t, ok)
+
+	bus.Publish(CounterChanged, CounterData{Counter: "orders", Value: 3})
+	assert.Equal(t, int64(3), (<-fast.C).Data.(CounterData).Value)
+}
+
+func TestBus_Unsubscribe(t *testing.T) {
+	bus := NewBus(DefaultBuffer)
+	sub := bus.Subscribe()
+
+	bus.Unsubscribe(sub)
+	bus.Unsubscribe(sub)
+	_, ok := <-sub.C
+	assert.False(t, ok)
+
+	bus.Publish(PeerRemoved, PeerData{ID: "peer1"})
+}
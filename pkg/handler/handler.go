@@ -1,11 +1,31 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
-	"github.com/google/uuid"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"service_discovery/pkg/client"
+	"service_discovery/pkg/counter"
+	"service_discovery/pkg/events"
+	"service_discovery/pkg/peerStore"
+	"service_discovery/pkg/registry"
 	"service_discovery/pkg/service"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultWait is how long a blocking query waits when it gives no wait.
+	DefaultWait = 30 * time.Second
+	// MaxWait caps how long a blocking query may wait.
+	MaxWait = 5 * time.Minute
+	// KeepAlive is how often an idle event stream sends a comment, so proxies
+	// and clients do not time it out.
+	KeepAlive = 15 * time.Second
 )
 
 type PeerHandler struct {
@@ -16,71 +36,653 @@ func NewPeerHandler(s service.IPeerService) *PeerHandler {
 	return &PeerHandler{Service: s}
 }
 
-type NodeRequestBody struct {
-	NodeID string `json:"node_id"`
+type JoinRequestBody struct {
+	NodeID      string         `json:"node_id"`
+	Addr        string         `json:"addr"`
+	Incarnation uint64         `json:"incarnation"`
+	Meta        peerStore.Meta `json:"meta"`
+	WantState   bool           `json:"want_state"`
+}
+
+type JoinResponseBody struct {
+	Peers     []peerStore.Update       `json:"peers"`
+	State     map[string]counter.State `json:"state,omitempty"`
+	Instances []registry.Instance      `json:"instances,omitempty"`
 }
 
 func (ph *PeerHandler) Join(w http.ResponseWriter, r *http.Request) {
 
-	var body NodeRequestBody
+	var body JoinRequestBody
 	err := json.NewDecoder(r.Body).Decode(&body)
 
-	if err != nil {
+	if err != nil || body.NodeID == "" {
 		log.Println("error in decoding the body", err)
 		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
 	}
 
-	ph.Service.AddPeer(body.NodeID)
+	// A join is first-hand, so a newer incarnation revives a tombstone
+	ph.Service.Alive(body.NodeID, body.Addr, body.Incarnation, body.Meta)
+
+	resp := JoinResponseBody{
+		Peers: ph.Service.View(),
+	}
+	log.Println("peers are", resp.Peers)
 
-	resp := map[string][]string{
-		"peers": ph.Service.GetPeersList(),
+	// Hand the joining node everything it missed so far
+	if body.WantState {
+		resp.State = ph.Service.CounterStates()
+		resp.Instances = ph.Service.RegistryState()
 	}
-	log.Println("peers are", resp)
 	json.NewEncoder(w).Encode(resp)
 }
 
-func (h *PeerHandler) List(w http.ResponseWriter, _ *http.Request) {
-	json.NewEncoder(w).Encode(h.Service.GetPeersList())
+// List returns the members, optionally only those carrying every tag given
+// as ?tag=key:value. With ?index=N it blocks until the membership changed
+// past N or ?wait (default 30s) elapsed. The index to pass next is returned
+// in the X-Membership-Index header.
+func (h *PeerHandler) List(w http.ResponseWriter, r *http.Request) {
+	tags, err := queryTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	index := h.Service.MembershipIndex()
+	if query.Has("index") {
+		after, err := strconv.ParseUint(query.Get("index"), 10, 64)
+		if err != nil {
+			http.Error(w, "index must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+
+		wait := DefaultWait
+		if query.Has("wait") {
+			wait, err = time.ParseDuration(query.Get("wait"))
+			if err != nil || wait < 0 {
+				http.Error(w, "wait must be a duration such as 30s", http.StatusBadRequest)
+				return
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), min(wait, MaxWait))
+		defer cancel()
+		index = h.Service.WaitMembers(ctx, after)
+	}
+	w.Header().Set("X-Membership-Index", strconv.FormatUint(index, 10))
+
+	members := make([]peerStore.Member, 0)
+	for _, m := range h.Service.Members() {
+		if m.Meta.HasTags(tags) {
+			members = append(members, m)
+		}
+	}
+	json.NewEncoder(w).Encode(members)
+}
+
+// queryTags parses the repeated ?tag=key:value query parameters.
+func queryTags(r *http.Request) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, tag := range r.URL.Query()["tag"] {
+		k, v, err := peerStore.ParseTag(tag, ":")
+		if err != nil {
+			return nil, err
+		}
+		tags[k] = v
+	}
+	return tags, nil
+}
+
+type HeartbeatBody struct {
+	NodeID string `json:"node_id"`
+	client.Ping
 }
 
 func (h *PeerHandler) Heartbeat(w http.ResponseWriter, r *http.Request) {
-	var body NodeRequestBody
+	var body HeartbeatBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil || body.NodeID == "" {
+		log.Println("error in decoding the body", err)
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(h.Service.Ack(body.NodeID, body.Ping))
+}
+
+type PingReqBody struct {
+	NodeID     string `json:"node_id"`
+	Target     string `json:"target"`
+	TargetAddr string `json:"target_addr"`
+	client.Ping
+}
+
+// PingReq probes the target on behalf of a peer that could not reach it and
+// acknowledges only if the target answered.
+func (h *PeerHandler) PingReq(w http.ResponseWriter, r *http.Request) {
+	var body PingReqBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil || body.Target == "" {
+		log.Println("error in decoding the body", err)
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	ack, err := h.Service.Ping(body.Target, body.TargetAddr, body.Ping)
+	if err != nil {
+		http.Error(w, "target did not acknowledge", http.StatusBadGateway)
+		return
+	}
+	json.NewEncoder(w).Encode(ack)
+}
+
+type GossipBody struct {
+	NodeID  string             `json:"node_id"`
+	Updates []peerStore.Update `json:"updates"`
+}
+
+func (h *PeerHandler) Gossip(w http.ResponseWriter, r *http.Request) {
+	var body GossipBody
 	err := json.NewDecoder(r.Body).Decode(&body)
 
 	if err != nil {
 		log.Println("error in decoding the body", err)
 		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
 	}
 
-	h.Service.AddPeer(body.NodeID)
+	h.Service.Gossip(body.NodeID, body.Updates)
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *PeerHandler) Increment(w http.ResponseWriter, _ *http.Request) {
-	eventID := uuid.NewString()
+type LeaveBody struct {
+	NodeID      string `json:"node_id"`
+	Incarnation uint64 `json:"incarnation"`
+}
 
-	log.Println("Received request for increment of counter", eventID)
+func (h *PeerHandler) Leave(w http.ResponseWriter, r *http.Request) {
+	var body LeaveBody
+	err := json.NewDecoder(r.Body).Decode(&body)
 
-	h.Service.Increment(eventID)
+	if err != nil || body.NodeID == "" {
+		log.Println("error in decoding the body", err)
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	h.Service.PeerLeft(body.NodeID, body.Incarnation)
+	w.WriteHeader(http.StatusOK)
+}
+
+type DeltaBody struct {
+	Delta *int64 `json:"delta"`
+}
+
+// readDelta decodes the optional {"delta": n} body, defaulting to 1 when the
+// body is empty.
+func readDelta(r *http.Request) (int64, error) {
+	var body DeltaBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err == io.EOF || (err == nil && body.Delta == nil) {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return *body.Delta, nil
+}
+
+func (h *PeerHandler) Increment(w http.ResponseWriter, r *http.Request) {
+	delta, err := readDelta(r)
+	if err != nil {
+		log.Println("error in decoding the body", err)
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if delta == 0 {
+		http.Error(w, "delta must be non-zero", http.StatusBadRequest)
+		return
+	}
+
+	h.apply(w, counterName(r), delta)
+}
+
+func (h *PeerHandler) Decrement(w http.ResponseWriter, r *http.Request) {
+	delta, err := readDelta(r)
+	if err != nil {
+		log.Println("error in decoding the body", err)
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if delta <= 0 {
+		http.Error(w, "delta must be positive", http.StatusBadRequest)
+		return
+	}
+
+	h.apply(w, counterName(r), -delta)
+}
+
+// counterName returns the counter addressed by the request, falling back to
+// the default counter for the legacy /counter/* routes.
+func counterName(r *http.Request) string {
+	if name := r.PathValue("name"); name != "" {
+		return name
+	}
+	return counter.DefaultName
+}
+
+func (h *PeerHandler) apply(w http.ResponseWriter, name string, delta int64) {
+	log.Println("Received request for update of counter", name, delta)
+
+	if err := h.Service.Increment(name, delta); err != nil {
+		log.Println("error in applying the update", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
 type ReplicateBody struct {
-	EventID string `json:"event_id"`
+	NodeID string `json:"node_id"`
+	counter.Event
 }
 
 func (h *PeerHandler) Replicate(w http.ResponseWriter, r *http.Request) {
 	var body ReplicateBody
-	log.Println("received request to replicate counter", body.EventID)
-	_ = json.NewDecoder(r.Body).Decode(&body)
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		log.Println("error in decoding the body", err)
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if body.Origin == "" || body.Seq == 0 {
+		http.Error(w, "origin and seq are required", http.StatusBadRequest)
+		return
+	}
+	if body.Counter == "" {
+		body.Counter = counter.DefaultName
+	}
+
+	log.Println("received request to replicate counter", body.Counter, body.Origin, body.Seq, "from", body.NodeID)
+
+	h.Service.Replicate(body.Event)
+	w.WriteHeader(http.StatusOK)
+}
+
+type SyncBody struct {
+	NodeID  string                    `json:"node_id"`
+	Digests map[string]counter.Digest `json:"digests"`
+}
+
+type SyncResponseBody struct {
+	States map[string]counter.State `json:"states"`
+	Wants  map[string][]string      `json:"wants"`
+}
+
+// MaxBatch is the most events accepted in one replication batch.
+const MaxBatch = 1024
+
+type ReplicateBatchBody struct {
+	NodeID string          `json:"node_id"`
+	Events []counter.Event `json:"events"`
+}
+
+// ReplicateBatch applies a batch of events from a peer one by one, with the
+// same deduplication as a single event, and reports what happened to each.
+func (h *PeerHandler) ReplicateBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body ReplicateBatchBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		log.Println("error in decoding the body", err)
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(body.Events) > MaxBatch {
+		http.Error(w, "too many events in one batch", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	results := make([]client.ReplicateResult, len(body.Events))
+	for i, event := range body.Events {
+		if event.Origin == "" || event.Seq == 0 {
+			results[i] = client.ReplicateResult{Status: client.ReplicateRejected, Error: "origin and seq are required"}
+			continue
+		}
+		if event.Counter == "" {
+			event.Counter = counter.DefaultName
+		}
+		// An event too far ahead is rejected, so the sender brings us up to
+		// date with a state sync instead
+		err := h.Service.Replicate(event)
+		if errors.Is(err, counter.ErrTooFarAhead) {
+			results[i] = client.ReplicateResult{Status: client.ReplicateRejected, Error: err.Error()}
+			continue
+		}
+		if err != nil {
+			results[i] = client.ReplicateResult{Status: client.ReplicateDuplicate}
+			continue
+		}
+		results[i] = client.ReplicateResult{Status: client.ReplicateApplied}
+	}
+
+	log.Println("received a batch of", len(body.Events), "counter events from", body.NodeID)
+
+	json.NewEncoder(w).Encode(client.ReplicateBatchResponse{Results: results})
+}
+
+func (h *PeerHandler) Sync(w http.ResponseWriter, r *http.Request) {
+	var body SyncBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		log.Println("error in decoding the body", err)
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	states, wants := h.Service.Sync(body.Digests)
 
-	h.Service.Increment(body.EventID)
+	json.NewEncoder(w).Encode(SyncResponseBody{
+		States: states,
+		Wants:  wants,
+	})
+}
+
+type MergeBody struct {
+	NodeID string                   `json:"node_id"`
+	States map[string]counter.State `json:"states"`
+}
+
+func (h *PeerHandler) Merge(w http.ResponseWriter, r *http.Request) {
+	var body MergeBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		log.Println("error in decoding the body", err)
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	log.Println("received counter state from", body.NodeID)
+
+	h.Service.MergeStates(body.States)
 	w.WriteHeader(http.StatusOK)
 }
 
-func (h *PeerHandler) Count(w http.ResponseWriter, _ *http.Request) {
-	json.NewEncoder(w).Encode(map[string]int64{
-		"count": h.Service.GetCounterValue(),
+type CountResponseBody struct {
+	Count int64 `json:"count"`
+	Ready bool  `json:"ready"`
+}
+
+func (h *PeerHandler) Count(w http.ResponseWriter, r *http.Request) {
+	name := counterName(r)
+	value, ok := h.Service.GetCounterValue(name)
+
+	// The default counter always exists from the caller's point of view
+	if !ok && name != counter.DefaultName {
+		http.Error(w, "counter not found", http.StatusNotFound)
+		return
+	}
+
+	resp := CountResponseBody{
+		Count: value,
+		Ready: h.Service.IsReady(),
+	}
+
+	// A bootstrapping node may not have caught up with the cluster yet
+	if !resp.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (h *PeerHandler) ListCounters(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(map[string]map[string]int64{
+		"counters": h.Service.ListCounters(),
 	})
 }
+
+func (h *PeerHandler) Snapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	info, err := h.Service.Snapshot()
+	if err != nil {
+		log.Println("error in taking a snapshot", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(info)
+}
+
+func (h *PeerHandler) Status(w http.ResponseWriter, _ *http.Request) {
+	json.NewEncoder(w).Encode(h.Service.Status())
+}
+
+type BreakersResponseBody struct {
+	Breakers []client.BreakerStatus `json:"breakers"`
+}
+
+// Breakers lists the circuits to peers that have failed requests. A peer that
+// is not listed has its circuit closed.
+func (h *PeerHandler) Breakers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	json.NewEncoder(w).Encode(BreakersResponseBody{Breakers: h.Service.BreakerStates()})
+}
+
+type DeadLettersResponseBody struct {
+	DeadLetters []service.DeadLetter `json:"dead_letters"`
+}
+
+type ReplayBody struct {
+	IDs []uint64 `json:"ids"`
+}
+
+// DeadLetters lists the events given up on with GET, and queues them for
+// delivery again with POST: the ones named in the body, or all of them.
+func (h *PeerHandler) DeadLetters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(DeadLettersResponseBody{DeadLetters: h.Service.ListDeadLetters()})
+	case http.MethodPost:
+		var body ReplayBody
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(h.Service.ReplayDeadLetters(body.IDs))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Events streams what happens on this node as server-sent events until the
+// client goes away. A client that cannot keep up is disconnected.
+func (h *PeerHandler) Events(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	sub := h.Service.Subscribe()
+	defer h.Service.Unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(KeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+			if err := writeEvent(w, e); err != nil {
+				log.Println("error in streaming an event", err)
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeEvent(w io.Writer, e events.Event) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+	return err
+}
+
+type RegisterBody struct {
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Tags    map[string]string `json:"tags"`
+	TTL     int               `json:"ttl"`
+	Check   *registry.Check   `json:"check"`
+}
+
+// Instance registers or renews (PUT) and deregisters (DELETE) the service
+// instance named in the path.
+func (h *PeerHandler) Instance(w http.ResponseWriter, r *http.Request) {
+	name, id := r.PathValue("name"), r.PathValue("id")
+
+	switch r.Method {
+	case http.MethodPut:
+		var body RegisterBody
+		err := json.NewDecoder(r.Body).Decode(&body)
+
+		if err != nil {
+			log.Println("error in decoding the body", err)
+			http.Error(w, "invalid request body", http.StatusBadRequest)
+			return
+		}
+		if body.Address == "" || body.Port <= 0 || body.Port > 65535 || body.TTL < 0 {
+			http.Error(w, "address, a valid port and a non-negative ttl are required", http.StatusBadRequest)
+			return
+		}
+		if body.Check != nil {
+			if err := body.Check.Validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		inst := h.Service.Register(registry.Instance{
+			Service: name,
+			ID:      id,
+			Address: body.Address,
+			Port:    body.Port,
+			Tags:    body.Tags,
+			TTL:     body.TTL,
+			Check:   body.Check,
+		})
+		json.NewEncoder(w).Encode(inst)
+	case http.MethodDelete:
+		if !h.Service.Deregister(name, id) {
+			http.Error(w, "instance not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Instances returns the live instances of a service, optionally only those
+// carrying every tag given as ?tag=key:value. Critical instances are left out
+// unless ?health=any is given; ?health=passing also leaves out warnings.
+func (h *PeerHandler) Instances(w http.ResponseWriter, r *http.Request) {
+	tags, err := queryTags(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	health := r.URL.Query().Get("health")
+	if health != "" && health != "any" && health != string(registry.HealthPassing) {
+		http.Error(w, "health must be passing or any", http.StatusBadRequest)
+		return
+	}
+
+	instances := make([]registry.Instance, 0)
+	for _, inst := range h.Service.Instances(r.PathValue("name")) {
+		if inst.HasTags(tags) && healthy(inst.Health.Status, health) {
+			instances = append(instances, inst)
+		}
+	}
+	json.NewEncoder(w).Encode(instances)
+}
+
+// healthy reports whether an instance with the given status is returned for
+// the ?health filter.
+func healthy(status registry.HealthStatus, filter string) bool {
+	switch filter {
+	case "any":
+		return true
+	case string(registry.HealthPassing):
+		return status == registry.HealthPassing
+	default:
+		return status != registry.HealthCritical
+	}
+}
+
+type ReplicateInstanceBody struct {
+	NodeID string `json:"node_id"`
+	registry.Instance
+}
+
+func (h *PeerHandler) ReplicateInstance(w http.ResponseWriter, r *http.Request) {
+	var body ReplicateInstanceBody
+	err := json.NewDecoder(r.Body).Decode(&body)
+
+	if err != nil {
+		log.Println("error in decoding the body", err)
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	if body.Service == "" || body.ID == "" || body.Origin == "" {
+		http.Error(w, "service, id and origin are required", http.StatusBadRequest)
+		return
+	}
+
+	log.Println("received request to replicate service instance", body.Service, body.ID, body.Version, "from", body.NodeID)
+
+	h.Service.ReplicateInstance(body.Instance)
+	w.WriteHeader(http.StatusOK)
+}
@@ -2,29 +2,42 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"service_discovery/mocks/service_discovery/pkg/service"
+	"service_discovery/pkg/client"
+	"service_discovery/pkg/counter"
+	"service_discovery/pkg/events"
+	"service_discovery/pkg/peerStore"
+	"service_discovery/pkg/registry"
+	pService "service_discovery/pkg/service"
 )
 
 func TestJoinHandler(t *testing.T) {
 	mockService := &service.MockIPeerService{}
 
 	// Setup expectations for the mock
-	mockService.On("AddPeer", "peer1").Return()
-	mockService.On("GetPeersList").Return([]string{"peer1", "peer2"})
+	meta := peerStore.Meta{Tags: map[string]string{"zone": "a"}}
+	mockService.On("Alive", "peer1", "localhost:8081", uint64(3), meta).Return()
+	mockService.On("View").Return([]peerStore.Update{
+		{ID: "peer1", Addr: "localhost:8081", State: peerStore.StateAlive, Incarnation: 3},
+		{ID: "peer2", Addr: "localhost:8082", State: peerStore.StateAlive, Incarnation: 1},
+	})
 
 	handler := NewPeerHandler(mockService)
 
 	// Prepare HTTP request
-	req := httptest.NewRequest(http.MethodPost, "/join", strings.NewReader(`{"node_id":"peer1"}`))
+	req := httptest.NewRequest(http.MethodPost, "/join", strings.NewReader(`{"node_id":"peer1","addr":"localhost:8081","incarnation":3,"meta":{"tags":{"zone":"a"}}}`))
 	req.Header.Set("Content-Type", "application/json")
 	w := httptest.NewRecorder()
 
@@ -36,16 +49,57 @@ func TestJoinHandler(t *testing.T) {
 	assert.Equal(t, http.StatusOK, resp.StatusCode)
 	assert.Contains(t, string(body), "peer1")
 	assert.Contains(t, string(body), "peer2")
+	assert.Contains(t, string(body), "localhost:8082")
 
 	// Assert that all expectations were met
 	mockService.AssertExpectations(t)
+
+	// A join without a node ID is refused
+	w = httptest.NewRecorder()
+	handler.Join(w, httptest.NewRequest(http.MethodPost, "/join", strings.NewReader(`{"addr":"localhost:8083"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	mockService.AssertNumberOfCalls(t, "Alive", 1)
+}
+
+func TestJoinHandler_WithState(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	state := counter.NewState()
+	state.P["peer2"] = 4
+	state.Seq["peer2"] = 4
+
+	view := []peerStore.Update{
+		{ID: "peer1", Addr: "localhost:8081", State: peerStore.StateAlive},
+		{ID: "peer2", Addr: "localhost:8082", State: peerStore.StateAlive, Incarnation: 1},
+	}
+	mockService.On("Alive", "peer1", "localhost:8081", uint64(0), peerStore.Meta{}).Return()
+	mockService.On("View").Return(view)
+	mockService.On("CounterStates").Return(map[string]counter.State{"orders": state})
+	mockService.On("RegistryState").Return([]registry.Instance{{Service: "api", ID: "api-1", Version: 3, Origin: "peer2"}})
+
+	req := httptest.NewRequest(http.MethodPost, "/join", strings.NewReader(`{"node_id":"peer1","addr":"localhost:8081","want_state":true}`))
+	w := httptest.NewRecorder()
+
+	handler.Join(w, req)
+
+	var resp JoinResponseBody
+	json.NewDecoder(w.Body).Decode(&resp)
+
+	assert.Equal(t, view, resp.Peers)
+	assert.Equal(t, int64(4), resp.State["orders"].Value())
+	assert.Len(t, resp.Instances, 1)
 }
 
 func TestListHandler(t *testing.T) {
 	mockService := &service.MockIPeerService{}
 	handler := NewPeerHandler(mockService)
 
-	mockService.On("GetPeersList").Return([]string{"peer1", "peer2"})
+	mockService.On("MembershipIndex").Return(uint64(4))
+	mockService.On("Members").Return([]peerStore.Member{
+		{ID: "peer1", State: peerStore.StateAlive, Incarnation: 2},
+		{ID: "peer2", State: peerStore.StateDead, Incarnation: 1},
+	})
 
 	req := httptest.NewRequest(http.MethodGet, "/list", nil)
 	w := httptest.NewRecorder()
@@ -55,20 +109,78 @@ func TestListHandler(t *testing.T) {
 	resp := w.Result()
 	defer resp.Body.Close()
 
-	var respBody []string
+	var respBody []peerStore.Member
 	json.NewDecoder(resp.Body).Decode(&respBody)
 
-	assert.Equal(t, []string{"peer1", "peer2"}, respBody)
-	mockService.AssertCalled(t, "GetPeersList")
+	assert.Len(t, respBody, 2)
+	assert.Equal(t, peerStore.StateAlive, respBody[0].State)
+	assert.Equal(t, peerStore.StateDead, respBody[1].State)
+	assert.Equal(t, uint64(2), respBody[0].Incarnation)
+	assert.Equal(t, "4", resp.Header.Get("X-Membership-Index"))
+	mockService.AssertCalled(t, "Members")
+	mockService.AssertNotCalled(t, "WaitMembers", mock.Anything, mock.Anything)
+}
+
+func TestListHandler_BlocksOnIndex(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mockService.On("MembershipIndex").Return(uint64(4))
+	mockService.On("Members").Return([]peerStore.Member{{ID: "peer1"}})
+	mockService.On("WaitMembers", mock.Anything, uint64(4)).Return(func(ctx context.Context, _ uint64) uint64 {
+		deadline, ok := ctx.Deadline()
+		assert.True(t, ok)
+		assert.WithinDuration(t, time.Now().Add(10*time.Second), deadline, time.Second)
+		return 5
+	})
+
+	w := httptest.NewRecorder()
+	handler.List(w, httptest.NewRequest(http.MethodGet, "/nodes?index=4&wait=10s", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "5", w.Header().Get("X-Membership-Index"))
+
+	w = httptest.NewRecorder()
+	handler.List(w, httptest.NewRequest(http.MethodGet, "/nodes?index=four", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.List(w, httptest.NewRequest(http.MethodGet, "/nodes?index=4&wait=soon", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestListHandler_FiltersByTag(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mockService.On("MembershipIndex").Return(uint64(4))
+	mockService.On("Members").Return([]peerStore.Member{
+		{ID: "peer1", Meta: peerStore.Meta{Tags: map[string]string{"role": "api", "zone": "a"}}},
+		{ID: "peer2", Meta: peerStore.Meta{Tags: map[string]string{"role": "api", "zone": "b"}}},
+		{ID: "peer3"},
+	})
+
+	w := httptest.NewRecorder()
+	handler.List(w, httptest.NewRequest(http.MethodGet, "/nodes?tag=role:api&tag=zone:b", nil))
+
+	var members []peerStore.Member
+	json.NewDecoder(w.Body).Decode(&members)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, members, 1)
+	assert.Equal(t, "peer2", members[0].ID)
+
+	w = httptest.NewRecorder()
+	handler.List(w, httptest.NewRequest(http.MethodGet, "/nodes?tag=zone", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
 
 func TestHeartbeatHandler(t *testing.T) {
 	mockService := &service.MockIPeerService{}
 	handler := NewPeerHandler(mockService)
 
-	mockService.On("AddPeer", "peer1").Return()
+	ping := client.Ping{Incarnation: 2, TargetIncarnation: 5, Suspected: true}
+	mockService.On("Ack", "peer1", ping).Return(client.Ack{NodeId: "self", Incarnation: 6})
 
-	body := map[string]string{"node_id": "peer1"}
+	body := HeartbeatBody{NodeID: "peer1", Ping: ping}
 	bodyBytes, _ := json.Marshal(body)
 
 	req := httptest.NewRequest(http.MethodPost, "/heartbeat", bytes.NewReader(bodyBytes))
@@ -76,15 +188,76 @@ func TestHeartbeatHandler(t *testing.T) {
 
 	handler.Heartbeat(w, req)
 
+	var ack client.Ack
+	json.NewDecoder(w.Body).Decode(&ack)
+
 	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
-	mockService.AssertCalled(t, "AddPeer", "peer1")
+	assert.Equal(t, uint64(6), ack.Incarnation)
+	mockService.AssertCalled(t, "Ack", "peer1", ping)
+
+	w = httptest.NewRecorder()
+	handler.Heartbeat(w, httptest.NewRequest(http.MethodPost, "/heartbeat", strings.NewReader(`{"incarnation":2}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	mockService.AssertNumberOfCalls(t, "Ack", 1)
+}
+
+func TestPingReqHandler(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mockService.On("Ping", "peer2", "localhost:8082", client.Ping{}).Return(client.Ack{NodeId: "peer2", Incarnation: 1}, nil)
+	mockService.On("Ping", "peer3", "", client.Ping{}).Return(client.Ack{}, errors.New("timeout"))
+
+	w := httptest.NewRecorder()
+	handler.PingReq(w, httptest.NewRequest(http.MethodPost, "/nodes/ping-req", strings.NewReader(`{"node_id":"peer1","target":"peer2","target_addr":"localhost:8082"}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.PingReq(w, httptest.NewRequest(http.MethodPost, "/nodes/ping-req", strings.NewReader(`{"node_id":"peer1","target":"peer3"}`)))
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.PingReq(w, httptest.NewRequest(http.MethodPost, "/nodes/ping-req", strings.NewReader(`{"node_id":"peer1"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestGossipHandler(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	updates := []peerStore.Update{{ID: "peer3", State: peerStore.StateAlive, Incarnation: 1}}
+	mockService.On("Gossip", "peer1", updates).Return()
+
+	body, _ := json.Marshal(GossipBody{NodeID: "peer1", Updates: updates})
+
+	w := httptest.NewRecorder()
+	handler.Gossip(w, httptest.NewRequest(http.MethodPost, "/nodes/gossip", bytes.NewReader(body)))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	mockService.AssertCalled(t, "Gossip", "peer1", updates)
+}
+
+func TestLeaveHandler(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mockService.On("PeerLeft", "peer1", uint64(4)).Return()
+
+	w := httptest.NewRecorder()
+	handler.Leave(w, httptest.NewRequest(http.MethodPost, "/nodes/leave", strings.NewReader(`{"node_id":"peer1","incarnation":4}`)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	mockService.AssertCalled(t, "PeerLeft", "peer1", uint64(4))
+
+	w = httptest.NewRecorder()
+	handler.Leave(w, httptest.NewRequest(http.MethodPost, "/nodes/leave", strings.NewReader(`{}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
 }
 
 func TestIncrementHandler(t *testing.T) {
 	mockService := &service.MockIPeerService{}
 	handler := NewPeerHandler(mockService)
 
-	mockService.On("Increment", mock.Anything).Return(nil)
+	mockService.On("Increment", counter.DefaultName, int64(1)).Return(nil)
 
 	req := httptest.NewRequest(http.MethodPost, "/increment", nil)
 	w := httptest.NewRecorder()
@@ -92,23 +265,504 @@ func TestIncrementHandler(t *testing.T) {
 	handler.Increment(w, req)
 
 	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
-	mockService.AssertCalled(t, "Increment", mock.Anything)
+	mockService.AssertCalled(t, "Increment", counter.DefaultName, int64(1))
+}
+
+func TestIncrementHandler_WithDelta(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mockService.On("Increment", counter.DefaultName, int64(-4)).Return(nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/increment", strings.NewReader(`{"delta":-4}`))
+	w := httptest.NewRecorder()
+
+	handler.Increment(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	mockService.AssertCalled(t, "Increment", counter.DefaultName, int64(-4))
+}
+
+func TestIncrementHandler_NotReady(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+	mockService.On("Increment", counter.DefaultName, int64(1)).Return(pService.ErrNotReady)
+
+	w := httptest.NewRecorder()
+	handler.Increment(w, httptest.NewRequest(http.MethodPost, "/counter/increment", nil))
+
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestIncrementHandler_ZeroDelta(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	req := httptest.NewRequest(http.MethodPost, "/increment", strings.NewReader(`{"delta":0}`))
+	w := httptest.NewRecorder()
+
+	handler.Increment(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	mockService.AssertNotCalled(t, "Increment", mock.Anything, mock.Anything)
+}
+
+func TestDecrementHandler(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mockService.On("Increment", counter.DefaultName, int64(-2)).Return(nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/decrement", strings.NewReader(`{"delta":2}`))
+	w := httptest.NewRecorder()
+
+	handler.Decrement(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	mockService.AssertCalled(t, "Increment", counter.DefaultName, int64(-2))
+}
+
+func TestReplicateHandler(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	event := counter.Event{Counter: counter.DefaultName, Origin: "peer1", Seq: 1, Delta: 2}
+	mockService.On("Replicate", event).Return(nil)
+
+	body := `{"node_id":"peer1","origin":"peer1","seq":1,"delta":2}`
+	req := httptest.NewRequest(http.MethodPost, "/replicate", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.Replicate(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Result().StatusCode)
+	mockService.AssertCalled(t, "Replicate", event)
+}
+
+func TestReplicateHandler_MissingSequence(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	body := `{"node_id":"peer1","origin":"peer1","delta":2}`
+	req := httptest.NewRequest(http.MethodPost, "/replicate", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.Replicate(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+	mockService.AssertNotCalled(t, "Replicate", mock.Anything)
+}
+
+func TestReplicateBatchHandler(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	applied := counter.Event{Counter: "orders", Origin: "peer1", Seq: 2, Delta: 2}
+	seen := counter.Event{Counter: counter.DefaultName, Origin: "peer1", Seq: 1, Delta: 1}
+	ahead := counter.Event{Counter: counter.DefaultName, Origin: "peer1", Seq: 5000, Delta: 1}
+	mockService.On("Replicate", applied).Return(nil)
+	mockService.On("Replicate", seen).Return(counter.ErrDuplicate)
+	mockService.On("Replicate", ahead).Return(counter.ErrTooFarAhead)
+
+	body := `{"node_id":"peer1","events":[
+		{"counter":"orders","origin":"peer1","seq":2,"delta":2},
+		{"origin":"peer1","seq":1,"delta":1},
+		{"origin":"peer1","delta":5},
+		{"origin":"peer1","seq":5000,"delta":1}
+	]}`
+	w := httptest.NewRecorder()
+	handler.ReplicateBatch(w, httptest.NewRequest(http.MethodPost, "/counter/replicate/batch", strings.NewReader(body)))
+
+	var resp client.ReplicateBatchResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []client.ReplicateStatus{client.ReplicateApplied, client.ReplicateDuplicate, client.ReplicateRejected},
+		[]client.ReplicateStatus{resp.Results[0].Status, resp.Results[1].Status, resp.Results[2].Status})
+	assert.NotEmpty(t, resp.Results[2].Error)
+
+	// An event too far ahead is rejected with the reason, not taken for a duplicate
+	assert.Equal(t, client.ReplicateRejected, resp.Results[3].Status)
+	assert.Equal(t, counter.ErrTooFarAhead.Error(), resp.Results[3].Error)
+	mockService.AssertNumberOfCalls(t, "Replicate", 3)
+}
+
+func TestSyncHandler(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	state := counter.NewState()
+	state.Seq["self"] = 2
+	digests := map[string]counter.Digest{"orders": {Seq: map[string]uint64{"peer1": 1}}}
+	mockService.On("Sync", digests).Return(map[string]counter.State{"orders": state}, map[string][]string{"orders": {"peer1"}})
+
+	body := `{"node_id":"peer1","digests":{"orders":{"seq":{"peer1":1}}}}`
+	req := httptest.NewRequest(http.MethodPost, "/counter/sync", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.Sync(w, req)
+
+	var resp SyncResponseBody
+	json.NewDecoder(w.Body).Decode(&resp)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, uint64(2), resp.States["orders"].Seq["self"])
+	assert.Equal(t, []string{"peer1"}, resp.Wants["orders"])
+}
+
+func TestMergeHandler(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mockService.On("MergeStates", mock.Anything).Return()
+
+	body := `{"node_id":"peer1","states":{"orders":{"p":{"peer1":3},"n":{},"seq":{"peer1":3}}}}`
+	req := httptest.NewRequest(http.MethodPost, "/counter/merge", strings.NewReader(body))
+	w := httptest.NewRecorder()
+
+	handler.Merge(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	mockService.AssertCalled(t, "MergeStates", mock.MatchedBy(func(states map[string]counter.State) bool {
+		return states["orders"].P["peer1"] == 3
+	}))
 }
 
 func TestCountHandler(t *testing.T) {
 	mockService := &service.MockIPeerService{}
 	handler := NewPeerHandler(mockService)
 
-	mockService.On("GetCounterValue").Return(int64(42))
+	mockService.On("GetCounterValue", counter.DefaultName).Return(int64(42), true)
+	mockService.On("IsReady").Return(true)
+
+	req := httptest.NewRequest(http.MethodGet, "/count", nil)
+	w := httptest.NewRecorder()
+
+	handler.Count(w, req)
+
+	var respBody CountResponseBody
+	json.NewDecoder(w.Body).Decode(&respBody)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, int64(42), respBody.Count)
+	assert.True(t, respBody.Ready)
+	mockService.AssertCalled(t, "GetCounterValue", counter.DefaultName)
+}
+
+func TestCountHandler_Bootstrapping(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mockService.On("GetCounterValue", counter.DefaultName).Return(int64(0), false)
+	mockService.On("IsReady").Return(false)
 
 	req := httptest.NewRequest(http.MethodGet, "/count", nil)
 	w := httptest.NewRecorder()
 
 	handler.Count(w, req)
 
-	var respBody map[string]int64
+	var respBody CountResponseBody
 	json.NewDecoder(w.Body).Decode(&respBody)
 
-	assert.Equal(t, int64(42), respBody["count"])
-	mockService.AssertCalled(t, "GetCounterValue")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.False(t, respBody.Ready)
+}
+
+func TestNamedCounterHandlers(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mockService.On("Increment", "orders", int64(1)).Return(nil)
+	mockService.On("GetCounterValue", "orders").Return(int64(1), true)
+	mockService.On("GetCounterValue", "missing").Return(int64(0), false)
+	mockService.On("ListCounters").Return(map[string]int64{"orders": 1})
+	mockService.On("IsReady").Return(true)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/counters", handler.ListCounters)
+	mux.HandleFunc("/counters/{name}", handler.Count)
+	mux.HandleFunc("/counters/{name}/increment", handler.Increment)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/counters/orders/increment", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	mockService.AssertCalled(t, "Increment", "orders", int64(1))
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/counters/orders", nil))
+	var count CountResponseBody
+	json.NewDecoder(w.Body).Decode(&count)
+	assert.Equal(t, int64(1), count.Count)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/counters/missing", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/counters", nil))
+	var list map[string]map[string]int64
+	json.NewDecoder(w.Body).Decode(&list)
+	assert.Equal(t, map[string]int64{"orders": 1}, list["counters"])
+}
+
+func TestSnapshotHandler(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mockService.On("Snapshot").Return(pService.SnapshotInfo{LSN: 7}, nil)
+
+	w := httptest.NewRecorder()
+	handler.Snapshot(w, httptest.NewRequest(http.MethodPost, "/admin/snapshot", nil))
+
+	var info pService.SnapshotInfo
+	json.NewDecoder(w.Body).Decode(&info)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, uint64(7), info.LSN)
+}
+
+func TestSnapshotHandler_Disabled(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mockService.On("Snapshot").Return(pService.SnapshotInfo{}, errors.New("persistence is disabled"))
+
+	w := httptest.NewRecorder()
+	handler.Snapshot(w, httptest.NewRequest(http.MethodPost, "/admin/snapshot", nil))
+
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestStatusHandler(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mockService.On("Status").Return(pService.Status{
+		NodeID:             "self",
+		Persistent:         true,
+		Snapshot:           &pService.SnapshotInfo{LSN: 7},
+		SnapshotAgeSeconds: 12,
+	})
+
+	w := httptest.NewRecorder()
+	handler.Status(w, httptest.NewRequest(http.MethodGet, "/admin/status", nil))
+
+	var status pService.Status
+	json.NewDecoder(w.Body).Decode(&status)
+
+	assert.True(t, status.Persistent)
+	assert.Equal(t, float64(12), status.SnapshotAgeSeconds)
+}
+
+func TestServiceRegistryRoutes(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	registered := registry.Instance{Service: "api", ID: "api-1", Address: "10.0.0.1", Port: 80, Tags: map[string]string{"zone": "a"}, TTL: 10}
+	mockService.On("Register", registered).Return(registry.Instance{Service: "api", ID: "api-1", Version: 5, Origin: "self"})
+	mockService.On("Instances", "api").Return([]registry.Instance{
+		{Service: "api", ID: "api-1", Tags: map[string]string{"zone": "a"}},
+		{Service: "api", ID: "api-2", Tags: map[string]string{"zone": "b"}},
+	})
+	mockService.On("Deregister", "api", "api-1").Return(true)
+	mockService.On("Deregister", "api", "api-9").Return(false)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services/{name}", handler.Instances)
+	mux.HandleFunc("/services/{name}/instances/{id}", handler.Instance)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/services/api/instances/api-1", strings.NewReader(`{"address":"10.0.0.1","port":80,"tags":{"zone":"a"},"ttl":10}`)))
+	var inst registry.Instance
+	json.NewDecoder(w.Body).Decode(&inst)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, uint64(5), inst.Version)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/services/api/instances/api-1", strings.NewReader(`{"port":80}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/services/api?tag=zone:b", nil))
+	var instances []registry.Instance
+	json.NewDecoder(w.Body).Decode(&instances)
+	assert.Len(t, instances, 1)
+	assert.Equal(t, "api-2", instances[0].ID)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/services/api/instances/api-1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/services/api/instances/api-9", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/services/api/instances/api-1", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestReplicateInstanceHandler(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	inst := registry.Instance{Service: "api", ID: "api-1", Address: "10.0.0.1", Port: 80, TTL: 10, Version: 3, Origin: "peer1"}
+	mockService.On("ReplicateInstance", inst).Return(nil)
+
+	bodyBytes, _ := json.Marshal(ReplicateInstanceBody{NodeID: "peer1", Instance: inst})
+
+	w := httptest.NewRecorder()
+	handler.ReplicateInstance(w, httptest.NewRequest(http.MethodPost, "/registry/replicate", bytes.NewReader(bodyBytes)))
+	assert.Equal(t, http.StatusOK, w.Code)
+	mockService.AssertCalled(t, "ReplicateInstance", inst)
+
+	w = httptest.NewRecorder()
+	handler.ReplicateInstance(w, httptest.NewRequest(http.MethodPost, "/registry/replicate", strings.NewReader(`{"node_id":"peer1","service":"api"}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestInstancesHandler_FiltersByHealth(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mockService.On("Instances", "api").Return([]registry.Instance{
+		{Service: "api", ID: "api-1", Health: registry.Health{Status: registry.HealthPassing}},
+		{Service: "api", ID: "api-2", Health: registry.Health{Status: registry.HealthWarning}},
+		{Service: "api", ID: "api-3", Health: registry.Health{Status: registry.HealthCritical}},
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services/{name}", handler.Instances)
+
+	ids := func(query string) []string {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/services/api"+query, nil))
+		var instances []registry.Instance
+		json.NewDecoder(w.Body).Decode(&instances)
+		var ids []string
+		for _, inst := range instances {
+			ids = append(ids, inst.ID)
+		}
+		return ids
+	}
+
+	assert.Equal(t, []string{"api-1", "api-2"}, ids(""))
+	assert.Equal(t, []string{"api-1"}, ids("?health=passing"))
+	assert.Equal(t, []string{"api-1", "api-2", "api-3"}, ids("?health=any"))
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/services/api?health=warning", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestInstanceHandler_RejectsInvalidCheck(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/services/{name}/instances/{id}", handler.Instance)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/services/api/instances/api-1", strings.NewReader(`{"address":"10.0.0.1","port":80,"check":{"http":"/health"}}`)))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	mockService.AssertNotCalled(t, "Register", mock.Anything)
+}
+
+func TestEventsHandler_StreamsUntilDropped(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	bus := events.NewBus(events.DefaultBuffer)
+	sub := bus.Subscribe()
+	mockService.On("Subscribe").Return(sub)
+	mockService.On("Unsubscribe", sub).Return()
+
+	bus.Publish(events.PeerJoined, events.PeerData{ID: "peer1", State: "alive"})
+	bus.Publish(events.CounterChanged, events.CounterData{Counter: "orders", Value: 3})
+	// Dropping the subscriber ends the stream once it has caught up
+	bus.Unsubscribe(sub)
+
+	w := httptest.NewRecorder()
+	handler.Events(w, httptest.NewRequest(http.MethodGet, "/events", nil))
+
+	assert.Equal(t, "text/event-stream", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, "id: 1\nevent: peer_joined\ndata: {")
+	assert.Contains(t, body, "id: 2\nevent: counter_changed\ndata: {")
+	assert.Contains(t, body, `"data":{"counter":"orders","value":3}`)
+	mockService.AssertCalled(t, "Unsubscribe", sub)
+}
+
+func TestEventsHandler_StopsWhenClientLeaves(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	sub := events.NewBus(events.DefaultBuffer).Subscribe()
+	mockService.On("Subscribe").Return(sub)
+	mockService.On("Unsubscribe", sub).Return()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		handler.Events(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/events", nil).WithContext(ctx))
+		close(done)
+	}()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stream did not end after the client left")
+	}
+	mockService.AssertCalled(t, "Unsubscribe", sub)
+}
+
+func TestDeadLettersHandler(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	letter := pService.DeadLetter{ID: 3, Peer: "peer1", Event: counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 1}, Reason: "still undelivered after 100 attempts"}
+	mockService.On("ListDeadLetters").Return([]pService.DeadLetter{letter})
+	mockService.On("ReplayDeadLetters", []uint64{3}).Return(pService.ReplayResult{Requeued: 1})
+	mockService.On("ReplayDeadLetters", []uint64(nil)).Return(pService.ReplayResult{Skipped: 2})
+
+	w := httptest.NewRecorder()
+	handler.DeadLetters(w, httptest.NewRequest(http.MethodGet, "/admin/deadletter", nil))
+	var list DeadLettersResponseBody
+	json.NewDecoder(w.Body).Decode(&list)
+	assert.Equal(t, []pService.DeadLetter{letter}, list.DeadLetters)
+
+	w = httptest.NewRecorder()
+	handler.DeadLetters(w, httptest.NewRequest(http.MethodPost, "/admin/deadletter", strings.NewReader(`{"ids":[3]}`)))
+	var result pService.ReplayResult
+	json.NewDecoder(w.Body).Decode(&result)
+	assert.Equal(t, pService.ReplayResult{Requeued: 1}, result)
+
+	// Without a body every dead letter is replayed
+	w = httptest.NewRecorder()
+	handler.DeadLetters(w, httptest.NewRequest(http.MethodPost, "/admin/deadletter", nil))
+	json.NewDecoder(w.Body).Decode(&result)
+	assert.Equal(t, pService.ReplayResult{Skipped: 2}, result)
+
+	w = httptest.NewRecorder()
+	handler.DeadLetters(w, httptest.NewRequest(http.MethodDelete, "/admin/deadletter", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestBreakersHandler(t *testing.T) {
+	mockService := &service.MockIPeerService{}
+	handler := NewPeerHandler(mockService)
+
+	open := client.BreakerStatus{Peer: "10.0.0.1:8080", State: client.BreakerOpen, Failures: 5, RetryInSeconds: 4}
+	mockService.On("BreakerStates").Return([]client.BreakerStatus{open})
+
+	w := httptest.NewRecorder()
+	handler.Breakers(w, httptest.NewRequest(http.MethodGet, "/admin/breakers", nil))
+	var body BreakersResponseBody
+	json.NewDecoder(w.Body).Decode(&body)
+	assert.Equal(t, []client.BreakerStatus{open}, body.Breakers)
+
+	w = httptest.NewRecorder()
+	handler.Breakers(w, httptest.NewRequest(http.MethodPost, "/admin/breakers", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
 }
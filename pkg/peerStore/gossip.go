@@ -0,0 +1,141 @@
+package peerStore
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// RetransmitMult scales how many times an update is gossiped before it is
+// dropped: RetransmitMult * ceil(log10(cluster size + 1)).
+const RetransmitMult = 4
+
+// Update is a membership change as it is gossiped between nodes.
+type Update struct {
+	ID          string      `json:"id"`
+	Addr        string      `json:"addr"`
+	State       MemberState `json:"state"`
+	Incarnation uint64      `json:"incarnation"`
+	Meta        Meta        `json:"meta"`
+}
+
+// Broadcast is an update waiting to be gossiped and how often it already was.
+type Broadcast struct {
+	Update    Update
+	Transmits int
+}
+
+// enqueue schedules an update for gossip, replacing any older update about
+// the same member. Every change of a member's state goes through here, so it
+// also raises the membership index. ps.Mutex must be held.
+func (ps *PeerStore) enqueue(id string, state MemberState, incarnation uint64) {
+	addr, meta := ps.Addr, ps.Meta
+	if m, ok := ps.Peers[id]; ok {
+		addr, meta = m.Addr, m.Meta
+	}
+	ps.Queue[id] = &Broadcast{Update: Update{ID: id, Addr: addr, State: state, Incarnation: incarnation, Meta: meta}}
+	ps.bump()
+}
+
+// Broadcasts returns up to limit queued updates, least gossiped first, and
+// drops the ones that have now been sent often enough.
+func (ps *PeerStore) Broadcasts(limit int) []Update {
+	ps.Mutex.Lock()
+	defer ps.Mutex.Unlock()
+
+	queued := make([]*Broadcast, 0, len(ps.Queue))
+	for _, b := range ps.Queue {
+		queued = append(queued, b)
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		if queued[i].Transmits != queued[j].Transmits {
+			return queued[i].Transmits < queued[j].Transmits
+		}
+		return queued[i].Update.ID < queued[j].Update.ID
+	})
+	if len(queued) > limit {
+		queued = queued[:limit]
+	}
+
+	maxTransmits := RetransmitMult * int(math.Ceil(math.Log10(float64(len(ps.Peers)+2))))
+	updates := make([]Update, 0, len(queued))
+	for _, b := range queued {
+		updates = append(updates, b.Update)
+		b.Transmits++
+		if b.Transmits >= maxTransmits {
+			delete(ps.Queue, b.Update.ID)
+		}
+	}
+	return updates
+}
+
+// Apply merges a gossiped update using the SWIM precedence rules and
+// re-gossips it if it changed our view. Updates claiming that this node is
+// suspect or dead are refuted with a newer incarnation.
+func (ps *PeerStore) Apply(u Update) bool {
+	ps.Mutex.Lock()
+	defer ps.Mutex.Unlock()
+
+	if u.ID == ps.ID {
+		if (u.State == StateSuspect || u.State == StateDead) && u.Incarnation >= ps.Incarnation {
+			ps.Incarnation = u.Incarnation + 1
+			ps.enqueue(ps.ID, StateAlive, ps.Incarnation)
+			return true
+		}
+		return false
+	}
+
+	now := time.Now()
+	m, ok := ps.Peers[u.ID]
+	if !ok {
+		// Only an alive update introduces a member we have never heard of
+		if u.State != StateAlive {
+			return false
+		}
+		m = &Member{ID: u.ID, Addr: u.Addr, State: StateAlive, Incarnation: u.Incarnation, LastSeen: now, StateChanged: now, Meta: u.Meta}
+		ps.Peers[u.ID] = m
+		ps.enqueue(u.ID, u.State, u.Incarnation)
+		ps.publish(m, "")
+		return true
+	}
+
+	var changed bool
+	switch u.State {
+	case StateAlive:
+		changed = u.Incarnation > m.Incarnation
+		if changed && (m.State == StateDead || m.State == StateLeft) {
+			delete(ps.Detectors, u.ID)
+		}
+	case StateSuspect:
+		changed = (m.State == StateAlive && u.Incarnation >= m.Incarnation) ||
+			(m.State == StateSuspect && u.Incarnation > m.Incarnation)
+	case StateDead:
+		changed = (m.State == StateAlive || m.State == StateSuspect) && u.Incarnation >= m.Incarnation
+	case StateLeft:
+		changed = m.State != StateLeft && u.Incarnation >= m.Incarnation
+	}
+	if !changed {
+		// Fill in metadata for a member we only knew by address
+		if m.Meta.IsZero() && !u.Meta.IsZero() && u.Incarnation == m.Incarnation {
+			m.Meta = u.Meta
+			ps.bump()
+		}
+		return false
+	}
+
+	from := m.State
+	if m.State != u.State {
+		m.StateChanged = now
+	}
+	m.State = u.State
+	m.Incarnation = u.Incarnation
+	if u.Addr != "" {
+		m.Addr = u.Addr
+	}
+	if !u.Meta.IsZero() {
+		m.Meta = u.Meta
+	}
+	ps.enqueue(u.ID, u.State, u.Incarnation)
+	ps.publish(m, from)
+	return true
+}
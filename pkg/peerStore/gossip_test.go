@@ -0,0 +1,85 @@
+package peerStore
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApply_IntroducesMembers(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+
+	assert.True(t, ps.Apply(Update{ID: "peer1", Addr: "10.0.0.1:8080", State: StateAlive, Incarnation: 2}))
+	assert.False(t, ps.Apply(Update{ID: "peer1", State: StateAlive, Incarnation: 2}))
+
+	// Never heard of peer2, a suspicion about it is not enough to add it
+	assert.False(t, ps.Apply(Update{ID: "peer2", State: StateSuspect, Incarnation: 1}))
+
+	assert.Equal(t, []string{"peer1"}, ps.GetPeers())
+}
+
+func TestApply_Precedence(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	ps.Apply(Update{ID: "peer1", State: StateAlive, Incarnation: 2})
+
+	// Stale suspicion is ignored, a current one wins over alive
+	assert.False(t, ps.Apply(Update{ID: "peer1", State: StateSuspect, Incarnation: 1}))
+	assert.True(t, ps.Apply(Update{ID: "peer1", State: StateSuspect, Incarnation: 2}))
+
+	// Alive at the same incarnation cannot clear it, a refutation can
+	assert.False(t, ps.Apply(Update{ID: "peer1", State: StateAlive, Incarnation: 2}))
+	assert.True(t, ps.Apply(Update{ID: "peer1", State: StateAlive, Incarnation: 3}))
+
+	assert.True(t, ps.Apply(Update{ID: "peer1", State: StateDead, Incarnation: 3}))
+	assert.False(t, ps.Apply(Update{ID: "peer1", State: StateSuspect, Incarnation: 3}))
+
+	member, _ := ps.GetMember("peer1")
+	assert.Equal(t, StateDead, member.State)
+}
+
+func TestApply_RefutesSuspicionOfSelf(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	ps.Incarnation = 4
+
+	assert.False(t, ps.Apply(Update{ID: "self", State: StateSuspect, Incarnation: 3}))
+	assert.True(t, ps.Apply(Update{ID: "self", State: StateSuspect, Incarnation: 4}))
+	assert.Equal(t, uint64(5), ps.SelfIncarnation())
+
+	assert.Contains(t, ps.Broadcasts(10), Update{ID: "self", Addr: "self", State: StateAlive, Incarnation: 5})
+}
+
+func TestBroadcasts_BoundedRetransmits(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	ps.Alive("peer1", "peer1", 1, Meta{})
+	ps.SuspectPeer("peer1")
+
+	// The newer update about a member replaces the older one
+	assert.Equal(t, []Update{{ID: "peer1", Addr: "peer1", State: StateSuspect, Incarnation: 1}}, ps.Broadcasts(10))
+
+	sent := 1
+	for len(ps.Broadcasts(10)) > 0 {
+		sent++
+	}
+	assert.Equal(t, RetransmitMult, sent)
+}
+
+func TestBroadcasts_LeastSentFirst(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	ps.Alive("peer1", "peer1", 1, Meta{})
+	ps.Alive("peer2", "peer2", 1, Meta{})
+
+	assert.Equal(t, []Update{{ID: "peer1", Addr: "peer1", State: StateAlive, Incarnation: 1}}, ps.Broadcasts(1))
+	assert.Equal(t, []Update{{ID: "peer2", Addr: "peer2", State: StateAlive, Incarnation: 1}}, ps.Broadcasts(1))
+}
+
+func TestApply_FollowsAddressChanges(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	ps.Apply(Update{ID: "peer1", Addr: "10.0.0.1:8080", State: StateAlive, Incarnation: 1})
+
+	// The node restarted on another address, same identity
+	ps.Apply(Update{ID: "peer1", Addr: "10.0.0.2:9090", State: StateAlive, Incarnation: 2})
+
+	member, _ := ps.GetMember("peer1")
+	assert.Equal(t, "10.0.0.2:9090", member.Addr)
+	assert.Len(t, ps.Members(), 1)
+}
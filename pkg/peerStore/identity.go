@@ -0,0 +1,62 @@
+package peerStore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// NodeIDFile holds a node's ID inside its data directory.
+const NodeIDFile = "node-id"
+
+// ErrNodeIDMismatch is returned for a node ID that differs from the one
+// stored in the data directory.
+var ErrNodeIDMismatch = errors.New("node id differs from the stored one")
+
+// NewNodeID returns a random node ID.
+func NewNodeID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// LoadNodeID returns the ID stored in dir, storing id on first use or a
+// generated one if id is empty, so a node keeps its identity across restarts
+// and address changes. A non-empty id other than the stored one is refused
+// with ErrNodeIDMismatch, as the data in dir belongs to another node.
+func LoadNodeID(dir, id string) (string, error) {
+	path := filepath.Join(dir, NodeIDFile)
+
+	data, err := os.ReadFile(path)
+	if err == nil {
+		if stored := strings.TrimSpace(string(data)); stored != "" {
+			if id != "" && id != stored {
+				return "", fmt.Errorf("%w: %s is stored in %s", ErrNodeIDMismatch, stored, dir)
+			}
+			return stored, nil
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+
+	// Write through a temporary file so a crash never leaves a partial ID
+	if id == "" {
+		id = NewNodeID()
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(id+"\n"), 0o644); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return "", err
+	}
+	return id, nil
+}
@@ -0,0 +1,54 @@
+package peerStore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadNodeID_GeneratesOnce(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+
+	id, err := LoadNodeID(dir, "")
+	assert.NoError(t, err)
+	assert.Len(t, id, 32)
+
+	again, err := LoadNodeID(dir, "")
+	assert.NoError(t, err)
+	assert.Equal(t, id, again)
+}
+
+func TestLoadNodeID_UsesStoredID(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, NodeIDFile), []byte("node-a\n"), 0o644))
+
+	id, err := LoadNodeID(dir, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "node-a", id)
+
+	id, err = LoadNodeID(dir, "node-a")
+	assert.NoError(t, err)
+	assert.Equal(t, "node-a", id)
+}
+
+func TestLoadNodeID_StoresGivenID(t *testing.T) {
+	dir := t.TempDir()
+
+	id, err := LoadNodeID(dir, "node-a")
+	assert.NoError(t, err)
+	assert.Equal(t, "node-a", id)
+
+	// The stored ID wins over a flag left out, and refuses another one
+	id, err = LoadNodeID(dir, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "node-a", id)
+
+	_, err = LoadNodeID(dir, "node-b")
+	assert.ErrorIs(t, err, ErrNodeIDMismatch)
+}
+
+func TestNewNodeID_Unique(t *testing.T) {
+	assert.NotEqual(t, NewNodeID(), NewNodeID())
+}
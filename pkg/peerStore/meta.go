@@ -0,0 +1,39 @@
+package peerStore
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Meta is what a node declares about itself when it starts. It does not
+// change for the lifetime of an incarnation.
+type Meta struct {
+	Tags      map[string]string `json:"tags,omitempty"`
+	Version   string            `json:"version,omitempty"`
+	StartedAt time.Time         `json:"started_at,omitempty"`
+}
+
+func (m Meta) IsZero() bool {
+	return len(m.Tags) == 0 && m.Version == "" && m.StartedAt.IsZero()
+}
+
+// HasTags reports whether every given tag is set to the given value.
+func (m Meta) HasTags(tags map[string]string) bool {
+	for k, v := range tags {
+		if got, ok := m.Tags[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseTag splits a "key<sep>value" tag, as given on the command line
+// (role=api) or in a query (role:api).
+func ParseTag(tag, sep string) (string, string, error) {
+	k, v, ok := strings.Cut(tag, sep)
+	if !ok || k == "" {
+		return "", "", fmt.Errorf("tag %q is not of the form key%svalue", tag, sep)
+	}
+	return k, v, nil
+}
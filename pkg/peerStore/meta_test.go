@@ -0,0 +1,59 @@
+package peerStore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeta_HasTags(t *testing.T) {
+	meta := Meta{Tags: map[string]string{"role": "api", "zone": "a"}}
+
+	assert.True(t, meta.HasTags(nil))
+	assert.True(t, meta.HasTags(map[string]string{"zone": "a"}))
+	assert.True(t, meta.HasTags(map[string]string{"role": "api", "zone": "a"}))
+	assert.False(t, meta.HasTags(map[string]string{"zone": "b"}))
+	assert.False(t, meta.HasTags(map[string]string{"rack": "1"}))
+}
+
+func TestParseTag(t *testing.T) {
+	k, v, err := ParseTag("zone:a", ":")
+	assert.NoError(t, err)
+	assert.Equal(t, "zone", k)
+	assert.Equal(t, "a", v)
+
+	_, _, err = ParseTag("zone", ":")
+	assert.Error(t, err)
+	_, _, err = ParseTag("=a", "=")
+	assert.Error(t, err)
+}
+
+func TestAlive_KeepsMetaWhenNoneGiven(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	meta := Meta{Tags: map[string]string{"role": "api"}, Version: "1.2.0", StartedAt: time.Now()}
+
+	ps.Alive("peer1", "peer1", 1, meta)
+	// An indirect probe only learns the incarnation
+	ps.Alive("peer1", "peer1", 1, Meta{})
+
+	member, _ := ps.GetMember("peer1")
+	assert.Equal(t, "api", member.Meta.Tags["role"])
+	assert.Equal(t, "1.2.0", member.Meta.Version)
+}
+
+func TestApply_SpreadsMeta(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	ps.Meta = Meta{Tags: map[string]string{"zone": "a"}}
+
+	// A member first known by address picks its metadata up from gossip
+	ps.AddPeer("peer1")
+	ps.Apply(Update{ID: "peer1", Addr: "peer1", State: StateAlive, Meta: Meta{Version: "1.2.0"}})
+
+	member, _ := ps.GetMember("peer1")
+	assert.Equal(t, "1.2.0", member.Meta.Version)
+
+	// Our own metadata travels with the view handed to joining nodes
+	view := ps.View()
+	assert.Equal(t, "a", view[1].Meta.Tags["zone"])
+}
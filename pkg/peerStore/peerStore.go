@@ -1,67 +1,439 @@
 package peerStore
 
 import (
+	"context"
+	"service_discovery/pkg/events"
+	"sort"
 	"sync"
 	"time"
 )
 
+type MemberState string
+
+const (
+	StateAlive   MemberState = "alive"
+	StateSuspect MemberState = "suspect"
+	StateDead    MemberState = "dead"
+	StateLeft    MemberState = "left"
+)
+
+// Member is this node's view of another node. ID is the node's stable
+// identity and Addr is where it can currently be reached. Incarnation is
+// owned by that node: only it can raise it, which is how it refutes a
+// suspicion.
+type Member struct {
+	ID           string      `json:"id"`
+	Addr         string      `json:"addr"`
+	State        MemberState `json:"state"`
+	Incarnation  uint64      `json:"incarnation"`
+	LastSeen     time.Time   `json:"last_seen"`
+	StateChanged time.Time   `json:"state_changed"`
+	Phi          float64     `json:"phi"`
+	Meta         Meta        `json:"meta"`
+}
+
 type PeerStore struct {
-	ID    string
-	Mutex sync.RWMutex
-	Peers map[string]time.Time
+	ID          string
+	Addr        string // address peers dial to reach this node
+	Incarnation uint64
+	Meta        Meta // what this node declares about itself, set before it serves
+	Mutex       sync.RWMutex
+	Peers       map[string]*Member
+	Detectors   map[string]*PhiDetector
+	Queue       map[string]*Broadcast // membership updates waiting to be gossiped
+	Index       uint64                // raised on every change to the membership
+	changed     chan struct{}         // closed and replaced whenever Index is raised
+	Events      events.IBus           // optional, told when members join, are suspected or go away
 }
 
-func NewPeerStore(peerId string) *PeerStore {
+func NewPeerStore(peerId, addr string) *PeerStore {
 	return &PeerStore{
-		ID:    peerId,
-		Peers: make(map[string]time.Time),
+		ID:   peerId,
+		Addr: addr,
+		// Start above anything a previous run of this node could have reached,
+		// so a restarted node outranks its own tombstone
+		Incarnation: uint64(time.Now().Unix()),
+		Peers:       make(map[string]*Member),
+		Detectors:   make(map[string]*PhiDetector),
+		Queue:       make(map[string]*Broadcast),
+		Index:       1,
+		changed:     make(chan struct{}),
 	}
 }
 
 type IPeerStore interface {
 	AddPeer(peerId string)
+	Alive(peerId, addr string, incarnation uint64, meta Meta)
+	SuspectPeer(peerId string)
+	SuspectByPhi(threshold float64) []string
+	ExpireSuspects(timeout time.Duration) []string
+	PruneTombstones(ttl time.Duration) []string
 	RemovePeer(peerId string)
 	GetPeers() []string
+	GetMember(peerId string) (Member, bool)
+	Members() []Member
 	SelfID() string
+	SelfAddr() string
+	SelfMeta() Meta
+	View() []Update
+	SelfIncarnation() uint64
+	Refute(incarnation uint64) uint64
+	Apply(u Update) bool
+	Broadcasts(limit int) []Update
 	SnapshotOfPeers() map[string]time.Time
+	MembershipIndex() uint64
+	WaitIndex(ctx context.Context, index uint64) uint64
 }
 
+// AddPeer records a peer we only heard about from someone else, by an ID
+// that is also its address. It never revives a member we already know, so a
+// stale peer list cannot bring back a node that was declared dead.
 func (ps *PeerStore) AddPeer(peerId string) {
 	if peerId == ps.ID {
 		return
 	}
 	ps.Mutex.Lock()
 	defer ps.Mutex.Unlock()
-	ps.Peers[peerId] = time.Now()
+
+	if _, ok := ps.Peers[peerId]; ok {
+		return
+	}
+	now := time.Now()
+	m := &Member{ID: peerId, Addr: peerId, State: StateAlive, LastSeen: now, StateChanged: now}
+	ps.Peers[peerId] = m
+	ps.bump()
+	ps.publish(m, "")
+}
+
+// Alive applies first-hand evidence that the peer is up at the given
+// incarnation and address. A suspicion is only cleared, and a tombstone only
+// revived, by a newer incarnation than the one it was raised for. An empty
+// meta leaves what we know about the peer untouched.
+func (ps *PeerStore) Alive(peerId, addr string, incarnation uint64, meta Meta) {
+	if peerId == ps.ID {
+		return
+	}
+	ps.Mutex.Lock()
+	defer ps.Mutex.Unlock()
+
+	now := time.Now()
+	m, ok := ps.Peers[peerId]
+	if !ok {
+		m = &Member{ID: peerId, Addr: addr, State: StateAlive, Incarnation: incarnation, LastSeen: now, StateChanged: now, Meta: meta}
+		ps.Peers[peerId] = m
+		ps.enqueue(peerId, StateAlive, incarnation)
+		ps.heartbeat(peerId, now)
+		ps.publish(m, "")
+		return
+	}
+
+	switch {
+	case m.State == StateAlive && incarnation >= m.Incarnation:
+		changed := incarnation > m.Incarnation || (addr != "" && addr != m.Addr) || (m.Meta.IsZero() && !meta.IsZero())
+		m.Incarnation = incarnation
+		m.LastSeen = now
+		if addr != "" {
+			m.Addr = addr
+		}
+		if !meta.IsZero() {
+			m.Meta = meta
+		}
+		if changed {
+			ps.enqueue(peerId, StateAlive, incarnation)
+		}
+	case incarnation > m.Incarnation:
+		// The gap while a member was dead says nothing about its usual pace
+		if m.State == StateDead || m.State == StateLeft {
+			delete(ps.Detectors, peerId)
+		}
+		from := m.State
+		m.State = StateAlive
+		m.Incarnation = incarnation
+		m.LastSeen = now
+		m.StateChanged = now
+		if addr != "" {
+			m.Addr = addr
+		}
+		if !meta.IsZero() {
+			m.Meta = meta
+		}
+		ps.enqueue(peerId, StateAlive, incarnation)
+		ps.publish(m, from)
+	case m.State == StateSuspect && incarnation == m.Incarnation:
+		m.LastSeen = now
+	default:
+		return
+	}
+	ps.heartbeat(peerId, now)
+}
+
+// heartbeat feeds the peer's failure detector. ps.Mutex must be held.
+func (ps *PeerStore) heartbeat(peerId string, now time.Time) {
+	d, ok := ps.Detectors[peerId]
+	if !ok {
+		d = NewPhiDetector()
+		ps.Detectors[peerId] = d
+	}
+	d.Heartbeat(now)
+}
+
+// SuspectPeer marks an alive member as suspected of having failed at its
+// current incarnation.
+func (ps *PeerStore) SuspectPeer(peerId string) {
+	ps.Mutex.Lock()
+	defer ps.Mutex.Unlock()
+
+	m, ok := ps.Peers[peerId]
+	if !ok || m.State != StateAlive {
+		return
+	}
+	m.State = StateSuspect
+	m.StateChanged = time.Now()
+	ps.enqueue(peerId, StateSuspect, m.Incarnation)
+	ps.publish(m, StateAlive)
+}
+
+// SuspectByPhi marks every alive member whose phi exceeds threshold as
+// suspected and returns their IDs.
+func (ps *PeerStore) SuspectByPhi(threshold float64) []string {
+	ps.Mutex.Lock()
+	defer ps.Mutex.Unlock()
+
+	now := time.Now()
+	var suspected []string
+	for id, m := range ps.Peers {
+		if m.State == StateAlive && ps.phi(id, now) > threshold {
+			m.State = StateSuspect
+			m.StateChanged = now
+			ps.enqueue(id, StateSuspect, m.Incarnation)
+			ps.publish(m, StateAlive)
+			suspected = append(suspected, id)
+		}
+	}
+	return suspected
+}
+
+// phi returns the peer's current suspicion level. ps.Mutex must be held.
+func (ps *PeerStore) phi(peerId string, now time.Time) float64 {
+	d, ok := ps.Detectors[peerId]
+	if !ok {
+		return 0
+	}
+	return d.Phi(now)
+}
+
+// ExpireSuspects declares dead every member that stayed suspected for longer
+// than timeout and returns their IDs.
+func (ps *PeerStore) ExpireSuspects(timeout time.Duration) []string {
+	ps.Mutex.Lock()
+	defer ps.Mutex.Unlock()
+
+	now := time.Now()
+	var dead []string
+	for id, m := range ps.Peers {
+		if m.State == StateSuspect && now.Sub(m.StateChanged) > timeout {
+			m.State = StateDead
+			m.StateChanged = now
+			ps.enqueue(id, StateDead, m.Incarnation)
+			ps.publish(m, StateSuspect)
+			dead = append(dead, id)
+		}
+	}
+	return dead
+}
+
+// PruneTombstones forgets dead and departed members once their tombstone is
+// older than ttl and returns their IDs.
+func (ps *PeerStore) PruneTombstones(ttl time.Duration) []string {
+	ps.Mutex.Lock()
+	defer ps.Mutex.Unlock()
+
+	now := time.Now()
+	var pruned []string
+	for id, m := range ps.Peers {
+		if (m.State == StateDead || m.State == StateLeft) && now.Sub(m.StateChanged) > ttl {
+			delete(ps.Peers, id)
+			delete(ps.Detectors, id)
+			pruned = append(pruned, id)
+		}
+	}
+	if len(pruned) > 0 {
+		ps.bump()
+	}
+	return pruned
 }
 
 func (ps *PeerStore) RemovePeer(peer string) {
 	ps.Mutex.Lock()
 	defer ps.Mutex.Unlock()
+	if m, ok := ps.Peers[peer]; ok {
+		ps.bump()
+		gone := *m
+		gone.State = StateLeft
+		ps.publish(&gone, m.State)
+	}
 	delete(ps.Peers, peer)
+	delete(ps.Detectors, peer)
+}
+
+// publish reports a member's change of state on the event bus, if there is
+// one. Only joins, new suspicions and departures are reported; a refuted
+// suspicion is not. ps.Mutex must be held.
+func (ps *PeerStore) publish(m *Member, from MemberState) {
+	if ps.Events == nil {
+		return
+	}
+	gone := func(s MemberState) bool { return s == StateDead || s == StateLeft }
+
+	var t events.Type
+	switch {
+	case m.State == StateAlive && (from == "" || gone(from)):
+		t = events.PeerJoined
+	case m.State == StateSuspect && from == StateAlive:
+		t = events.PeerSuspected
+	case gone(m.State) && !gone(from):
+		t = events.PeerRemoved
+	default:
+		return
+	}
+	ps.Events.Publish(t, events.PeerData{ID: m.ID, Addr: m.Addr, State: string(m.State), Incarnation: m.Incarnation})
+}
+
+// bump raises the membership index and wakes everyone waiting on it.
+// ps.Mutex must be held.
+func (ps *PeerStore) bump() {
+	ps.Index++
+	close(ps.changed)
+	ps.changed = make(chan struct{})
+}
+
+func (ps *PeerStore) MembershipIndex() uint64 {
+	ps.Mutex.RLock()
+	defer ps.Mutex.RUnlock()
+	return ps.Index
 }
 
+// WaitIndex blocks until the membership index is above index or ctx is done,
+// and returns the index at that point. The index starts over when the node
+// restarts, so an index above the current one was handed out by an earlier
+// run: it returns straight away and the caller starts over from the index it
+// gets back.
+func (ps *PeerStore) WaitIndex(ctx context.Context, index uint64) uint64 {
+	for {
+		ps.Mutex.RLock()
+		current, changed := ps.Index, ps.changed
+		ps.Mutex.RUnlock()
+
+		if current != index {
+			return current
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return current
+		}
+	}
+}
+
+// GetPeers returns the members that are alive or only suspected.
 func (ps *PeerStore) GetPeers() []string {
 	ps.Mutex.RLock()
 	defer ps.Mutex.RUnlock()
 
 	peers := make([]string, 0, len(ps.Peers))
-	for p := range ps.Peers {
-		peers = append(peers, p)
+	for p, m := range ps.Peers {
+		if m.State == StateAlive || m.State == StateSuspect {
+			peers = append(peers, p)
+		}
 	}
 	return peers
 }
+
+func (ps *PeerStore) GetMember(peerId string) (Member, bool) {
+	ps.Mutex.RLock()
+	defer ps.Mutex.RUnlock()
+
+	m, ok := ps.Peers[peerId]
+	if !ok {
+		return Member{}, false
+	}
+	member := *m
+	member.Phi = ps.phi(peerId, time.Now())
+	return member, true
+}
+
+// Members returns every known member, tombstones included, sorted by ID.
+func (ps *PeerStore) Members() []Member {
+	ps.Mutex.RLock()
+	defer ps.Mutex.RUnlock()
+
+	now := time.Now()
+	members := make([]Member, 0, len(ps.Peers))
+	for id, m := range ps.Peers {
+		member := *m
+		member.Phi = ps.phi(id, now)
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
 func (ps *PeerStore) SelfID() string {
 	return ps.ID
 }
 
+func (ps *PeerStore) SelfAddr() string {
+	return ps.Addr
+}
+
+func (ps *PeerStore) SelfMeta() Meta {
+	return ps.Meta
+}
+
+// View returns this node and every live member as updates, which is what a
+// joining node needs to learn the cluster.
+func (ps *PeerStore) View() []Update {
+	ps.Mutex.RLock()
+	defer ps.Mutex.RUnlock()
+
+	view := []Update{{ID: ps.ID, Addr: ps.Addr, State: StateAlive, Incarnation: ps.Incarnation, Meta: ps.Meta}}
+	for _, m := range ps.Peers {
+		if m.State == StateAlive || m.State == StateSuspect {
+			view = append(view, Update{ID: m.ID, Addr: m.Addr, State: m.State, Incarnation: m.Incarnation, Meta: m.Meta})
+		}
+	}
+	sort.Slice(view, func(i, j int) bool { return view[i].ID < view[j].ID })
+	return view
+}
+
+func (ps *PeerStore) SelfIncarnation() uint64 {
+	ps.Mutex.RLock()
+	defer ps.Mutex.RUnlock()
+	return ps.Incarnation
+}
+
+// Refute answers a suspicion raised against this node at the given
+// incarnation by moving past it. It returns the new incarnation.
+func (ps *PeerStore) Refute(incarnation uint64) uint64 {
+	ps.Mutex.Lock()
+	defer ps.Mutex.Unlock()
+
+	if incarnation >= ps.Incarnation {
+		ps.Incarnation = incarnation + 1
+	}
+	ps.enqueue(ps.ID, StateAlive, ps.Incarnation)
+	return ps.Incarnation
+}
+
 func (ps *PeerStore) SnapshotOfPeers() map[string]time.Time {
 	ps.Mutex.RLock()
 	defer ps.Mutex.RUnlock()
 
 	copy := make(map[string]time.Time)
-	for k, v := range ps.Peers {
-		copy[k] = v
+	for k, m := range ps.Peers {
+		if m.State == StateAlive || m.State == StateSuspect {
+			copy[k] = m.LastSeen
+		}
 	}
 	return copy
 }
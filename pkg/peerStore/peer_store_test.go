@@ -1,6 +1,8 @@
 package peerStore
 
 import (
+	"context"
+	"service_discovery/pkg/events"
 	"testing"
 	"time"
 
@@ -8,7 +10,7 @@ import (
 )
 
 func TestAddRemoveGetPeers(t *testing.T) {
-	ps := NewPeerStore("self")
+	ps := NewPeerStore("self", "self")
 
 	ps.AddPeer("peer1")
 	ps.AddPeer("peer2")
@@ -25,7 +27,7 @@ func TestAddRemoveGetPeers(t *testing.T) {
 }
 
 func TestSnapshotOfPeers(t *testing.T) {
-	ps := NewPeerStore("self")
+	ps := NewPeerStore("self", "self")
 	ps.AddPeer("peer1")
 	ps.AddPeer("peer2")
 
@@ -38,6 +40,183 @@ func TestSnapshotOfPeers(t *testing.T) {
 }
 
 func TestSelfID(t *testing.T) {
-	ps := NewPeerStore("self")
+	ps := NewPeerStore("self", "self")
 	assert.Equal(t, "self", ps.SelfID())
 }
+
+func TestSuspectPeer(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	ps.Alive("peer1", "peer1", 3, Meta{})
+
+	ps.SuspectPeer("peer1")
+	ps.SuspectPeer("unknown") // not a member, ignored
+
+	member, ok := ps.GetMember("peer1")
+	assert.True(t, ok)
+	assert.Equal(t, StateSuspect, member.State)
+	assert.Contains(t, ps.GetPeers(), "peer1")
+
+	// Hearing about the peer second hand or at the same incarnation does not clear it
+	ps.AddPeer("peer1")
+	ps.Alive("peer1", "peer1", 3, Meta{})
+	member, _ = ps.GetMember("peer1")
+	assert.Equal(t, StateSuspect, member.State)
+
+	// The peer refutes with a newer incarnation
+	ps.Alive("peer1", "peer1", 4, Meta{})
+	member, _ = ps.GetMember("peer1")
+	assert.Equal(t, StateAlive, member.State)
+	assert.Equal(t, uint64(4), member.Incarnation)
+}
+
+func TestExpireSuspects_KeepsTombstones(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	ps.Alive("peer1", "peer1", 1, Meta{})
+	ps.Alive("peer2", "peer2", 1, Meta{})
+	ps.SuspectPeer("peer1")
+
+	ps.Peers["peer1"].StateChanged = time.Now().Add(-time.Minute)
+	assert.Equal(t, []string{"peer1"}, ps.ExpireSuspects(5*time.Second))
+
+	member, _ := ps.GetMember("peer1")
+	assert.Equal(t, StateDead, member.State)
+	assert.Equal(t, []string{"peer2"}, ps.GetPeers())
+	assert.Len(t, ps.Members(), 2)
+
+	// A stale peer list does not bring the dead node back
+	ps.AddPeer("peer1")
+	ps.Alive("peer1", "peer1", 1, Meta{})
+	member, _ = ps.GetMember("peer1")
+	assert.Equal(t, StateDead, member.State)
+
+	// The tombstone is forgotten once it expires
+	assert.Empty(t, ps.PruneTombstones(time.Minute))
+	ps.Peers["peer1"].StateChanged = time.Now().Add(-2 * time.Minute)
+	assert.Equal(t, []string{"peer1"}, ps.PruneTombstones(time.Minute))
+	_, ok := ps.GetMember("peer1")
+	assert.False(t, ok)
+}
+
+func TestAlive_RevivesTombstoneWithNewerIncarnation(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	ps.Alive("peer1", "peer1", 1, Meta{})
+	ps.SuspectPeer("peer1")
+	ps.Peers["peer1"].StateChanged = time.Now().Add(-time.Minute)
+	ps.ExpireSuspects(time.Second)
+
+	ps.Alive("peer1", "peer1", 2, Meta{})
+
+	member, _ := ps.GetMember("peer1")
+	assert.Equal(t, StateAlive, member.State)
+	assert.Contains(t, ps.GetPeers(), "peer1")
+}
+
+func TestRefute(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	ps.Incarnation = 5
+
+	assert.Equal(t, uint64(6), ps.Refute(5))
+	assert.Equal(t, uint64(10), ps.Refute(9))
+
+	// An old suspicion is already refuted
+	assert.Equal(t, uint64(10), ps.Refute(3))
+	assert.Equal(t, uint64(10), ps.SelfIncarnation())
+}
+
+func TestSuspectByPhi(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	ps.Alive("peer1", "peer1", 1, Meta{})
+	ps.Alive("peer2", "peer2", 1, Meta{})
+
+	// peer1 used to answer every second and has been silent for a minute
+	start := time.Now().Add(-time.Minute - 10*time.Second)
+	ps.Detectors["peer1"] = NewPhiDetector()
+	for i := 0; i < 10; i++ {
+		ps.Detectors["peer1"].Heartbeat(start.Add(time.Duration(i) * time.Second))
+	}
+
+	assert.Equal(t, []string{"peer1"}, ps.SuspectByPhi(DefaultPhiThreshold))
+
+	members := ps.Members()
+	assert.Equal(t, StateSuspect, members[0].State)
+	assert.Greater(t, members[0].Phi, DefaultPhiThreshold)
+	assert.Equal(t, StateAlive, members[1].State)
+	assert.Equal(t, 0.0, members[1].Phi)
+}
+
+func TestView_IncludesSelfAndLiveMembers(t *testing.T) {
+	ps := NewPeerStore("node-a", "10.0.0.1:8080")
+	ps.Incarnation = 3
+	ps.Alive("node-b", "10.0.0.2:8080", 1, Meta{})
+	ps.Alive("node-c", "10.0.0.3:8080", 1, Meta{})
+	ps.SuspectPeer("node-c")
+	ps.Peers["node-c"].State = StateDead
+
+	assert.Equal(t, []Update{
+		{ID: "node-a", Addr: "10.0.0.1:8080", State: StateAlive, Incarnation: 3},
+		{ID: "node-b", Addr: "10.0.0.2:8080", State: StateAlive, Incarnation: 1},
+	}, ps.View())
+}
+
+func TestMembershipIndex_RaisedOnChanges(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	index := ps.MembershipIndex()
+
+	ps.Alive("peer1", "peer1", 1, Meta{})
+	assert.Greater(t, ps.MembershipIndex(), index)
+	index = ps.MembershipIndex()
+
+	// Hearing from a member again is not a change
+	ps.Alive("peer1", "peer1", 1, Meta{})
+	assert.Equal(t, index, ps.MembershipIndex())
+
+	ps.SuspectPeer("peer1")
+	assert.Greater(t, ps.MembershipIndex(), index)
+	index = ps.MembershipIndex()
+
+	ps.RemovePeer("peer1")
+	assert.Greater(t, ps.MembershipIndex(), index)
+}
+
+func TestWaitIndex(t *testing.T) {
+	ps := NewPeerStore("self", "self")
+	index := ps.MembershipIndex()
+
+	// Behind the current index returns straight away
+	assert.Equal(t, index, ps.WaitIndex(context.Background(), index-1))
+
+	// So does one from before a restart, which is ahead of it
+	assert.Equal(t, index, ps.WaitIndex(context.Background(), index+100))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, index, ps.WaitIndex(ctx, index))
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		ps.Alive("peer1", "peer1", 1, Meta{})
+	}()
+	assert.Greater(t, ps.WaitIndex(context.Background(), index), index)
+}
+
+func TestPeerStore_PublishesTransitions(t *testing.T) {
+	bus := events.NewBus(events.DefaultBuffer)
+	sub := bus.Subscribe()
+	ps := NewPeerStore("self", "self")
+	ps.Events = bus
+
+	ps.Alive("peer1", "peer1", 1, Meta{})
+	ps.SuspectPeer("peer1")
+	// A refuted suspicion is not an event of its own
+	ps.Alive("peer1", "peer1", 2, Meta{})
+	ps.Apply(Update{ID: "peer1", Addr: "peer1", State: StateDead, Incarnation: 2})
+	ps.Alive("peer1", "peer1", 3, Meta{})
+
+	var got []events.Type
+	for len(sub.C) > 0 {
+		e := <-sub.C
+		assert.Equal(t, "peer1", e.Data.(events.PeerData).ID)
+		got = append(got, e.Type)
+	}
+	assert.Equal(t, []events.Type{events.PeerJoined, events.PeerSuspected, events.PeerRemoved, events.PeerJoined}, got)
+}
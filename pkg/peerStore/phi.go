@@ -0,0 +1,69 @@
+package peerStore
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// PhiWindowSize is how many inter-arrival times are kept per peer.
+	PhiWindowSize = 100
+	// PhiMinStdDev keeps a very regular peer from being suspected the moment
+	// a single message is a little late.
+	PhiMinStdDev = 500 * time.Millisecond
+	// DefaultPhiThreshold suspects a peer once the chance that it is merely
+	// slow drops to about 1 in 10^8.
+	DefaultPhiThreshold = 8.0
+)
+
+// PhiDetector is a phi-accrual failure detector. Instead of a fixed timeout
+// it learns how often a peer is normally heard from and turns the time since
+// the last message into a suspicion level.
+type PhiDetector struct {
+	Intervals []float64 // milliseconds between consecutive arrivals
+	Last      time.Time
+}
+
+func NewPhiDetector() *PhiDetector {
+	return &PhiDetector{}
+}
+
+// Heartbeat records that the peer was heard from at now.
+func (d *PhiDetector) Heartbeat(now time.Time) {
+	if !d.Last.IsZero() {
+		d.Intervals = append(d.Intervals, float64(now.Sub(d.Last).Milliseconds()))
+		if len(d.Intervals) > PhiWindowSize {
+			d.Intervals = d.Intervals[len(d.Intervals)-PhiWindowSize:]
+		}
+	}
+	d.Last = now
+}
+
+// Phi returns the suspicion level at now. It stays at zero until at least
+// one interval has been observed.
+func (d *PhiDetector) Phi(now time.Time) float64 {
+	if len(d.Intervals) == 0 {
+		return 0
+	}
+
+	var sum float64
+	for _, v := range d.Intervals {
+		sum += v
+	}
+	mean := sum / float64(len(d.Intervals))
+
+	var variance float64
+	for _, v := range d.Intervals {
+		variance += (v - mean) * (v - mean)
+	}
+	stdDev := math.Max(math.Sqrt(variance/float64(len(d.Intervals))), float64(PhiMinStdDev.Milliseconds()))
+
+	// Logistic approximation of the normal CDF, as used by Akka and Cassandra
+	elapsed := float64(now.Sub(d.Last).Milliseconds())
+	y := (elapsed - mean) / stdDev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
@@ -0,0 +1,56 @@
+package peerStore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPhi_NoHistory(t *testing.T) {
+	d := NewPhiDetector()
+	assert.Equal(t, 0.0, d.Phi(time.Now()))
+
+	d.Heartbeat(time.Now())
+	assert.Equal(t, 0.0, d.Phi(time.Now().Add(time.Hour)))
+}
+
+func TestPhi_GrowsWithSilence(t *testing.T) {
+	d := NewPhiDetector()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		d.Heartbeat(start.Add(time.Duration(i) * time.Second))
+	}
+	last := d.Last
+
+	onTime := d.Phi(last.Add(time.Second))
+	late := d.Phi(last.Add(3 * time.Second))
+	silent := d.Phi(last.Add(10 * time.Second))
+
+	assert.Less(t, onTime, 1.0)
+	assert.Less(t, onTime, late)
+	assert.Less(t, late, silent)
+	assert.Greater(t, silent, DefaultPhiThreshold)
+}
+
+func TestPhi_AdaptsToSlowPeers(t *testing.T) {
+	fast, slow := NewPhiDetector(), NewPhiDetector()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		fast.Heartbeat(start.Add(time.Duration(i) * time.Second))
+		slow.Heartbeat(start.Add(time.Duration(i) * 5 * time.Second))
+	}
+
+	// Five seconds of silence is alarming for one peer and normal for the other
+	assert.Greater(t, fast.Phi(fast.Last.Add(5*time.Second)), DefaultPhiThreshold)
+	assert.Less(t, slow.Phi(slow.Last.Add(5*time.Second)), 1.0)
+}
+
+func TestPhi_BoundedWindow(t *testing.T) {
+	d := NewPhiDetector()
+	start := time.Now()
+	for i := 0; i < 2*PhiWindowSize; i++ {
+		d.Heartbeat(start.Add(time.Duration(i) * time.Second))
+	}
+	assert.Len(t, d.Intervals, PhiWindowSize)
+}
@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+type HealthStatus string
+
+const (
+	HealthPassing  HealthStatus = "passing"
+	HealthWarning  HealthStatus = "warning"
+	HealthCritical HealthStatus = "critical"
+)
+
+const (
+	// DefaultCheckInterval is used for checks that do not ask for an interval.
+	DefaultCheckInterval = 10
+	// DefaultCheckTimeout is used for checks that do not ask for a timeout.
+	DefaultCheckTimeout = 2
+)
+
+// Check tells the cluster how to verify an instance: an HTTP GET that must
+// answer 2xx (429 counts as a warning) or a TCP connect that must succeed.
+type Check struct {
+	HTTP     string `json:"http,omitempty"`
+	TCP      string `json:"tcp,omitempty"`
+	Interval int    `json:"interval,omitempty"` // seconds
+	Timeout  int    `json:"timeout,omitempty"`  // seconds
+}
+
+// Health is the latest result of an instance's check. Version orders results
+// independently of the registration, so a result never renews the TTL.
+type Health struct {
+	Status    HealthStatus `json:"status"`
+	Output    string       `json:"output,omitempty"`
+	Version   uint64       `json:"version"`
+	CheckedBy string       `json:"checked_by,omitempty"`
+}
+
+// newer reports whether a is a later result than b. Two owners may take the
+// same version while ownership moves, the checking node breaks the tie.
+func (a Health) newer(b Health) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	return a.CheckedBy > b.CheckedBy
+}
+
+func (c Check) Validate() error {
+	if (c.HTTP == "") == (c.TCP == "") {
+		return errors.New("a check needs exactly one of http or tcp")
+	}
+	if c.Interval < 0 || c.Timeout < 0 {
+		return errors.New("check interval and timeout must not be negative")
+	}
+	if c.HTTP != "" {
+		u, err := url.Parse(c.HTTP)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("http check needs an absolute http or https url")
+		}
+	}
+	if c.TCP != "" {
+		if _, _, err := net.SplitHostPort(c.TCP); err != nil {
+			return errors.New("tcp check needs a host:port address")
+		}
+	}
+	return nil
+}
+
+func (c Check) IntervalDuration() time.Duration {
+	if c.Interval <= 0 {
+		return DefaultCheckInterval * time.Second
+	}
+	return time.Duration(c.Interval) * time.Second
+}
+
+// TimeoutDuration never exceeds the interval, so runs of a check cannot
+// overlap.
+func (c Check) TimeoutDuration() time.Duration {
+	timeout := DefaultCheckTimeout * time.Second
+	if c.Timeout > 0 {
+		timeout = time.Duration(c.Timeout) * time.Second
+	}
+	return min(timeout, c.IntervalDuration())
+}
+
+// Run executes the check once and returns its status and a short description
+// of the outcome.
+func (c Check) Run() (HealthStatus, string) {
+	timeout := c.TimeoutDuration()
+
+	if c.TCP != "" {
+		conn, err := net.DialTimeout("tcp", c.TCP, timeout)
+		if err != nil {
+			return HealthCritical, err.Error()
+		}
+		conn.Close()
+		return HealthPassing, "connected to " + c.TCP
+	}
+
+	httpClient := &http.Client{Timeout: timeout}
+	resp, err := httpClient.Get(c.HTTP)
+	if err != nil {
+		return HealthCritical, err.Error()
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return HealthPassing, resp.Status
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return HealthWarning, resp.Status
+	default:
+		return HealthCritical, resp.Status
+	}
+}
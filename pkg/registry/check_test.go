@@ -0,0 +1,63 @@
+package registry
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck_HTTP(t *testing.T) {
+	code := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(code)
+	}))
+	defer server.Close()
+
+	check := Check{HTTP: server.URL}
+
+	status, _ := check.Run()
+	assert.Equal(t, HealthPassing, status)
+
+	code = http.StatusTooManyRequests
+	status, _ = check.Run()
+	assert.Equal(t, HealthWarning, status)
+
+	code = http.StatusServiceUnavailable
+	status, output := check.Run()
+	assert.Equal(t, HealthCritical, status)
+	assert.Contains(t, output, "503")
+}
+
+func TestCheck_TCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	addr := ln.Addr().String()
+
+	status, _ := Check{TCP: addr}.Run()
+	assert.Equal(t, HealthPassing, status)
+
+	ln.Close()
+	status, _ = Check{TCP: addr}.Run()
+	assert.Equal(t, HealthCritical, status)
+}
+
+func TestCheck_Validate(t *testing.T) {
+	assert.NoError(t, Check{HTTP: "http://10.0.0.1:8080/health"}.Validate())
+	assert.NoError(t, Check{TCP: "10.0.0.1:5432", Interval: 5}.Validate())
+
+	assert.Error(t, Check{}.Validate())
+	assert.Error(t, Check{HTTP: "http://10.0.0.1/health", TCP: "10.0.0.1:5432"}.Validate())
+	assert.Error(t, Check{HTTP: "/health"}.Validate())
+	assert.Error(t, Check{TCP: "10.0.0.1"}.Validate())
+	assert.Error(t, Check{TCP: "10.0.0.1:5432", Interval: -1}.Validate())
+}
+
+func TestCheck_TimeoutWithinInterval(t *testing.T) {
+	assert.Equal(t, DefaultCheckInterval*time.Second, Check{}.IntervalDuration())
+	assert.Equal(t, DefaultCheckTimeout*time.Second, Check{}.TimeoutDuration())
+	assert.Equal(t, time.Second, Check{Interval: 1, Timeout: 5}.TimeoutDuration())
+}
@@ -0,0 +1,263 @@
+package registry
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTTL is used for registrations that do not ask for a TTL.
+const DefaultTTL = 30
+
+// Instance is one registered instance of an application service. Version
+// and Origin order writes to the same instance: the highest version wins and
+// the origin breaks ties, so every node settles on the same registration.
+type Instance struct {
+	Service string            `json:"service"`
+	ID      string            `json:"id"`
+	Address string            `json:"address"`
+	Port    int               `json:"port"`
+	Tags    map[string]string `json:"tags,omitempty"`
+	TTL     int               `json:"ttl"` // seconds
+	Check   *Check            `json:"check,omitempty"`
+	Health  Health            `json:"health"`
+	Version uint64            `json:"version"`
+	Origin  string            `json:"origin"`
+	Deleted bool              `json:"deleted,omitempty"`
+	Expires time.Time         `json:"expires"` // local, reset whenever a write is applied
+}
+
+// newer reports whether a is a later write than b.
+func (a Instance) newer(b Instance) bool {
+	if a.Version != b.Version {
+		return a.Version > b.Version
+	}
+	return a.Origin > b.Origin
+}
+
+// HasTags reports whether every given tag is set to the given value.
+func (a Instance) HasTags(tags map[string]string) bool {
+	for k, v := range tags {
+		if got, ok := a.Tags[k]; !ok || got != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Registry holds the service instances known to a node. Registrations are
+// soft state: an instance whose TTL runs out without a renewal is dropped.
+type Registry struct {
+	mu       sync.RWMutex
+	services map[string]map[string]*Instance
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		services: make(map[string]map[string]*Instance),
+	}
+}
+
+type IRegistry interface {
+	Register(inst Instance, origin string, now time.Time) Instance
+	Deregister(service, id, origin string, now time.Time) (Instance, bool)
+	Apply(inst Instance, now time.Time) bool
+	SetHealth(service, id string, check *Check, status HealthStatus, output, checker string) (Instance, bool)
+	Instances(service string, now time.Time) []Instance
+	Checks(now time.Time) []Instance
+	All(now time.Time) []Instance
+	Expire(now time.Time) []Instance
+}
+
+// Register records a local write, registering or renewing an instance, and
+// returns it stamped with a version above any write seen for it so far. A
+// renewal with the same check keeps the last check result; a new check starts
+// out critical until it has passed once, with a health version above the last
+// result so it replaces it everywhere.
+func (r *Registry) Register(inst Instance, origin string, now time.Time) Instance {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if inst.TTL <= 0 {
+		inst.TTL = DefaultTTL
+	}
+	inst.Deleted = false
+
+	existing, ok := r.services[inst.Service][inst.ID]
+	if ok && !existing.Deleted && sameCheck(existing.Check, inst.Check) {
+		inst.Health = existing.Health
+	} else {
+		inst.Health = Health{Status: HealthPassing, Version: 1}
+		if inst.Check != nil {
+			inst.Health.Status = HealthCritical
+			inst.Health.Output = "not checked yet"
+		}
+		if ok {
+			inst.Health.Version = existing.Health.Version + 1
+		}
+	}
+
+	r.stamp(&inst, origin, now)
+	return r.store(inst, now)
+}
+
+func sameCheck(a, b *Check) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// Deregister records a local removal of an instance. The removal is kept as a
+// tombstone for the instance's TTL so a delayed registration cannot undo it.
+func (r *Registry) Deregister(service, id, origin string, now time.Time) (Instance, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.services[service][id]
+	if !ok || existing.Deleted {
+		return Instance{}, false
+	}
+
+	inst := *existing
+	inst.Deleted = true
+	r.stamp(&inst, origin, now)
+	return r.store(inst, now), true
+}
+
+// stamp versions a local write. Versions follow the wall clock but never go
+// backwards for an instance. r.mu must be held.
+func (r *Registry) stamp(inst *Instance, origin string, now time.Time) {
+	inst.Origin = origin
+	inst.Version = uint64(now.UnixNano())
+	if existing, ok := r.services[inst.Service][inst.ID]; ok && existing.Version >= inst.Version {
+		inst.Version = existing.Version + 1
+	}
+}
+
+// Apply merges a write replicated from a peer and reports whether it
+// changed the registration or its health. Only a newer registration restarts
+// the TTL. A health result only counts for the check it came from: one for a
+// check the registration no longer has is dropped.
+func (r *Registry) Apply(inst Instance, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.services[inst.Service][inst.ID]
+	if !ok || inst.newer(*existing) {
+		if ok && sameCheck(existing.Check, inst.Check) && existing.Health.newer(inst.Health) {
+			inst.Health = existing.Health
+		}
+		r.store(inst, now)
+		return true
+	}
+	if sameCheck(existing.Check, inst.Check) && inst.Health.newer(existing.Health) {
+		existing.Health = inst.Health
+		return true
+	}
+	return false
+}
+
+// SetHealth records the result of a check run by this node. It returns the
+// instance to replicate if the status changed. A result of a check that has
+// since been replaced by a renewal is dropped, as it says nothing about the
+// new one. Health versions count up from the last result, so they order
+// results whichever node's clock took them.
+func (r *Registry) SetHealth(service, id string, check *Check, status HealthStatus, output, checker string) (Instance, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.services[service][id]
+	if !ok || existing.Deleted || !sameCheck(existing.Check, check) || existing.Health.Status == status {
+		return Instance{}, false
+	}
+
+	existing.Health = Health{Status: status, Output: output, Version: existing.Health.Version + 1, CheckedBy: checker}
+	return *existing, true
+}
+
+// store saves inst, restarts its TTL and returns what was stored. r.mu must
+// be held.
+func (r *Registry) store(inst Instance, now time.Time) Instance {
+	inst.Expires = now.Add(time.Duration(inst.TTL) * time.Second)
+
+	instances, ok := r.services[inst.Service]
+	if !ok {
+		instances = make(map[string]*Instance)
+		r.services[inst.Service] = instances
+	}
+	instances[inst.ID] = &inst
+	return inst
+}
+
+// Instances returns the live instances of a service sorted by ID.
+func (r *Registry) Instances(service string, now time.Time) []Instance {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	instances := make([]Instance, 0, len(r.services[service]))
+	for _, inst := range r.services[service] {
+		if !inst.Deleted && now.Before(inst.Expires) {
+			instances = append(instances, *inst)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool { return instances[i].ID < instances[j].ID })
+	return instances
+}
+
+// Checks returns every live instance that has a check defined.
+func (r *Registry) Checks(now time.Time) []Instance {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var checks []Instance
+	for _, instances := range r.services {
+		for _, inst := range instances {
+			if inst.Check != nil && !inst.Deleted && now.Before(inst.Expires) {
+				checks = append(checks, *inst)
+			}
+		}
+	}
+	return checks
+}
+
+// All returns every instance and tombstone whose TTL has not run out, so a
+// node that joins can catch up on registrations made before it did.
+func (r *Registry) All(now time.Time) []Instance {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var all []Instance
+	for _, instances := range r.services {
+		for _, inst := range instances {
+			if now.Before(inst.Expires) {
+				all = append(all, *inst)
+			}
+		}
+	}
+	return all
+}
+
+// Expire forgets every instance and tombstone whose TTL ran out and returns
+// the instances that were still registered.
+func (r *Registry) Expire(now time.Time) []Instance {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var expired []Instance
+	for service, instances := range r.services {
+		for id, inst := range instances {
+			if now.Before(inst.Expires) {
+				continue
+			}
+			if !inst.Deleted {
+				expired = append(expired, *inst)
+			}
+			delete(instances, id)
+		}
+		if len(instances) == 0 {
+			delete(r.services, service)
+		}
+	}
+	return expired
+}
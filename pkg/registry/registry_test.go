@@ -0,0 +1,192 @@
+package registry
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegister_RenewsAndExpires(t *testing.T) {
+	r := NewRegistry()
+	now := time.Now()
+
+	inst := r.Register(Instance{Service: "api", ID: "api-1", Address: "10.0.0.1", Port: 80, TTL: 10}, "node-a", now)
+	assert.Equal(t, "node-a", inst.Origin)
+	assert.Equal(t, now.Add(10*time.Second), inst.Expires)
+	assert.Len(t, r.Instances("api", now), 1)
+
+	// A renewal restarts the TTL
+	r.Register(Instance{Service: "api", ID: "api-1", Address: "10.0.0.1", Port: 80, TTL: 10}, "node-a", now.Add(8*time.Second))
+	assert.Len(t, r.Instances("api", now.Add(15*time.Second)), 1)
+
+	expired := r.Expire(now.Add(20 * time.Second))
+	assert.Len(t, expired, 1)
+	assert.Empty(t, r.Instances("api", now.Add(20*time.Second)))
+}
+
+func TestRegister_DefaultTTL(t *testing.T) {
+	r := NewRegistry()
+	inst := r.Register(Instance{Service: "api", ID: "api-1"}, "node-a", time.Now())
+	assert.Equal(t, DefaultTTL, inst.TTL)
+}
+
+func TestRegister_VersionNeverGoesBackwards(t *testing.T) {
+	r := NewRegistry()
+	now := time.Now()
+
+	first := r.Register(Instance{Service: "api", ID: "api-1"}, "node-a", now)
+	// This node's clock stepped back
+	second := r.Register(Instance{Service: "api", ID: "api-1"}, "node-a", now.Add(-time.Minute))
+	assert.Greater(t, second.Version, first.Version)
+}
+
+func TestApply_LastWriteWins(t *testing.T) {
+	r := NewRegistry()
+	now := time.Now()
+
+	assert.True(t, r.Apply(Instance{Service: "api", ID: "api-1", Address: "10.0.0.1", TTL: 10, Version: 2, Origin: "node-a"}, now))
+	assert.False(t, r.Apply(Instance{Service: "api", ID: "api-1", Address: "10.0.0.2", TTL: 10, Version: 1, Origin: "node-b"}, now))
+	assert.False(t, r.Apply(Instance{Service: "api", ID: "api-1", Address: "10.0.0.1", TTL: 10, Version: 2, Origin: "node-a"}, now))
+
+	// Same version from two nodes: the origin decides
+	assert.True(t, r.Apply(Instance{Service: "api", ID: "api-1", Address: "10.0.0.3", TTL: 10, Version: 2, Origin: "node-c"}, now))
+	assert.Equal(t, "10.0.0.3", r.Instances("api", now)[0].Address)
+}
+
+func TestDeregister_TombstoneBlocksStaleWrites(t *testing.T) {
+	r := NewRegistry()
+	now := time.Now()
+
+	inst := r.Register(Instance{Service: "api", ID: "api-1", TTL: 10}, "node-a", now)
+	removed, ok := r.Deregister("api", "api-1", "node-a", now)
+	assert.True(t, ok)
+	assert.True(t, removed.Deleted)
+	assert.Empty(t, r.Instances("api", now))
+
+	// The registration arriving late from a peer does not bring it back
+	assert.False(t, r.Apply(inst, now))
+	assert.Empty(t, r.Instances("api", now))
+
+	_, ok = r.Deregister("api", "api-1", "node-a", now)
+	assert.False(t, ok)
+
+	// Tombstones expire silently
+	assert.Empty(t, r.Expire(now.Add(time.Minute)))
+}
+
+func TestAll_IncludesTombstones(t *testing.T) {
+	r := NewRegistry()
+	now := time.Now()
+
+	r.Register(Instance{Service: "api", ID: "api-1", TTL: 10}, "node-a", now)
+	r.Register(Instance{Service: "api", ID: "api-2", TTL: 10}, "node-a", now)
+	r.Register(Instance{Service: "web", ID: "web-1", TTL: 30}, "node-a", now)
+	r.Deregister("api", "api-2", "node-a", now)
+
+	// A joining node needs the tombstone so a late registration cannot revive it
+	assert.Len(t, r.All(now), 3)
+	assert.Len(t, r.All(now.Add(20*time.Second)), 1)
+}
+
+func TestInstance_HasTags(t *testing.T) {
+	inst := Instance{Tags: map[string]string{"zone": "a", "env": "prod"}}
+	assert.True(t, inst.HasTags(map[string]string{"zone": "a"}))
+	assert.False(t, inst.HasTags(map[string]string{"zone": "b"}))
+}
+
+func TestRegister_CheckStartsCritical(t *testing.T) {
+	r := NewRegistry()
+	now := time.Now()
+	check := &Check{TCP: "10.0.0.1:80"}
+
+	assert.Equal(t, HealthPassing, r.Register(Instance{Service: "api", ID: "api-1"}, "node-a", now).Health.Status)
+	assert.Equal(t, HealthCritical, r.Register(Instance{Service: "api", ID: "api-2", Check: check}, "node-a", now).Health.Status)
+
+	// A renewal keeps the result of the same check
+	_, ok := r.SetHealth("api", "api-2", check, HealthPassing, "connected", "node-b")
+	assert.True(t, ok)
+	renewed := r.Register(Instance{Service: "api", ID: "api-2", Check: &Check{TCP: "10.0.0.1:80"}}, "node-a", now)
+	assert.Equal(t, HealthPassing, renewed.Health.Status)
+
+	// A different check has to pass again
+	changed := r.Register(Instance{Service: "api", ID: "api-2", Check: &Check{TCP: "10.0.0.1:81"}}, "node-a", now)
+	assert.Equal(t, HealthCritical, changed.Health.Status)
+}
+
+func TestSetHealth_OnlyReportsChanges(t *testing.T) {
+	r := NewRegistry()
+	now := time.Now()
+	check := &Check{TCP: "10.0.0.1:80"}
+	r.Register(Instance{Service: "api", ID: "api-1", Check: check}, "node-a", now)
+
+	updated, ok := r.SetHealth("api", "api-1", check, HealthPassing, "connected", "node-b")
+	assert.True(t, ok)
+	assert.Equal(t, "node-b", updated.Health.CheckedBy)
+
+	_, ok = r.SetHealth("api", "api-1", check, HealthPassing, "connected", "node-b")
+	assert.False(t, ok)
+	_, ok = r.SetHealth("api", "api-9", check, HealthPassing, "connected", "node-b")
+	assert.False(t, ok)
+}
+
+func TestSetHealth_DropsResultOfReplacedCheck(t *testing.T) {
+	r := NewRegistry()
+	now := time.Now()
+	old := &Check{TCP: "10.0.0.1:80"}
+	r.Register(Instance{Service: "api", ID: "api-1", Check: old}, "node-a", now)
+	checked, _ := r.SetHealth("api", "api-1", old, HealthPassing, "connected", "node-b")
+
+	// The check was changed while the old one ran
+	renewed := r.Register(Instance{Service: "api", ID: "api-1", Check: &Check{TCP: "10.0.0.1:81"}}, "node-a", now)
+	assert.Greater(t, renewed.Health.Version, checked.Health.Version)
+
+	_, ok := r.SetHealth("api", "api-1", old, HealthPassing, "connected", "node-b")
+	assert.False(t, ok)
+	assert.False(t, r.Apply(checked, now))
+	assert.Equal(t, HealthCritical, r.Instances("api", now)[0].Health.Status)
+}
+
+func TestApply_HealthTieGoesToHigherChecker(t *testing.T) {
+	now := time.Now()
+	check := &Check{TCP: "10.0.0.1:80"}
+	inst := Instance{Service: "api", ID: "api-1", Check: check}
+
+	// Two owners took the same health version while ownership moved
+	nodeA, nodeB := NewRegistry(), NewRegistry()
+	registered := nodeA.Register(inst, "node-a", now)
+	nodeB.Apply(registered, now)
+	fromA, _ := nodeA.SetHealth("api", "api-1", check, HealthPassing, "connected", "node-a")
+	fromB, _ := nodeB.SetHealth("api", "api-1", check, HealthWarning, "slow", "node-b")
+	assert.Equal(t, fromA.Health.Version, fromB.Health.Version)
+
+	assert.True(t, nodeA.Apply(fromB, now))
+	assert.False(t, nodeB.Apply(fromA, now))
+	assert.Equal(t, HealthWarning, nodeA.Instances("api", now)[0].Health.Status)
+	assert.Equal(t, HealthWarning, nodeB.Instances("api", now)[0].Health.Status)
+}
+
+func TestApply_HealthDoesNotRenewTTL(t *testing.T) {
+	origin := NewRegistry()
+	peer := NewRegistry()
+	now := time.Now()
+
+	inst := origin.Register(Instance{Service: "api", ID: "api-1", TTL: 10, Check: &Check{TCP: "10.0.0.1:80"}}, "node-a", now)
+	assert.True(t, peer.Apply(inst, now))
+
+	// A check result arrives later with the same registration
+	checked, _ := origin.SetHealth("api", "api-1", inst.Check, HealthPassing, "connected", "node-a")
+	assert.True(t, peer.Apply(checked, now.Add(8*time.Second)))
+	assert.False(t, peer.Apply(checked, now.Add(8*time.Second)))
+
+	assert.Equal(t, HealthPassing, peer.Instances("api", now)[0].Health.Status)
+	assert.Empty(t, peer.Instances("api", now.Add(11*time.Second)))
+
+	// An older result never replaces a newer one carried by a renewal
+	renewed := origin.Register(Instance{Service: "api", ID: "api-1", TTL: 10, Check: &Check{TCP: "10.0.0.1:80"}}, "node-a", now.Add(9*time.Second))
+	stale := renewed
+	stale.Health = inst.Health
+	stale.Version++
+	assert.True(t, peer.Apply(stale, now.Add(9*time.Second)))
+	assert.Equal(t, HealthPassing, peer.Instances("api", now.Add(9*time.Second))[0].Health.Status)
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"service_discovery/pkg/client"
+	"service_discovery/pkg/counter"
+	"time"
+)
+
+const (
+	// DefaultBatchSize is the most events sent to a peer in one request.
+	DefaultBatchSize = 64
+	// DefaultBatchLinger is how long the first event of a batch waits for
+	// others to join it.
+	DefaultBatchLinger = 5 * time.Millisecond
+)
+
+// batcher collects the counter events bound for one peer. Its goroutine sends
+// them in batches, so a burst of increments costs one request per peer
+// instead of a request and a goroutine per event. Events waiting in a batcher
+// are not journaled, as that would cost an fsync per event and peer; those
+// lost in a crash are repaired by anti-entropy from the journaled counters.
+type batcher struct {
+	in   chan counter.Event
+	done chan struct{} // closed once the goroutine has sent what it had
+}
+
+// propagate hands an event to the batcher of every peer. An event for a peer
+// whose circuit is open, that finds a batcher full, or that comes after Leave
+// goes to the retry queue instead.
+func (s *PeerService) propagate(event counter.Event) {
+	var peers, overflow []string
+	for _, peer := range s.GetPeersList() {
+		if s.breaker(peer).State == client.BreakerOpen {
+			overflow = append(overflow, peer)
+		} else {
+			peers = append(peers, peer)
+		}
+	}
+
+	s.BMutex.Lock()
+	for _, peer := range peers {
+		b := s.batcher(peer)
+		if b == nil {
+			overflow = append(overflow, peer)
+			continue
+		}
+		select {
+		case b.in <- event:
+		default:
+			overflow = append(overflow, peer)
+		}
+	}
+	s.BMutex.Unlock()
+
+	for _, peer := range overflow {
+		s.enqueue(peer, event)
+	}
+}
+
+// batcher returns the peer's batcher, starting it on first use, or nil once
+// the node is leaving. s.BMutex must be held.
+func (s *PeerService) batcher(peer string) *batcher {
+	if s.draining {
+		return nil
+	}
+	b, ok := s.batchers[peer]
+	if !ok {
+		size := max(s.BatchSize, 1)
+		b = &batcher{in: make(chan counter.Event, 4*size), done: make(chan struct{})}
+		s.batchers[peer] = b
+		go s.runBatcher(peer, b, size)
+	}
+	return b
+}
+
+// runBatcher sends a batch once it has size events or its first event has
+// waited BatchLinger, whichever comes first, until the batcher is closed.
+func (s *PeerService) runBatcher(peer string, b *batcher, size int) {
+	defer close(b.done)
+
+	for {
+		first, ok := <-b.in
+		if !ok {
+			return
+		}
+		batch := []counter.Event{first}
+
+		linger := time.NewTimer(s.BatchLinger)
+	collect:
+		for len(batch) < size {
+			select {
+			case e, ok := <-b.in:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, e)
+			case <-linger.C:
+				break collect
+			}
+		}
+		linger.Stop()
+
+		s.sendBatch(peer, batch)
+	}
+}
+
+// sendBatch delivers a batch to a peer. If the request fails in a way that
+// may pass, every event is queued for retry; if the peer refused it, the
+// events are dead-lettered instead. Events the peer rejected are refused the
+// same way, as sending them again would not change the answer.
+func (s *PeerService) sendBatch(peer string, batch []counter.Event) {
+	results, err := s.Client.SendIncrements(s.addrOf(peer), s.SelfId, batch)
+	if err != nil && !client.Retryable(err) {
+		for _, e := range batch {
+			s.replicationFailed(peer, e, 0, err)
+		}
+		s.refused(peer, batch, err)
+		return
+	}
+	if err != nil {
+		for _, e := range batch {
+			s.replicationFailed(peer, e, 0, err)
+			s.enqueue(peer, e)
+		}
+		return
+	}
+
+	rejected, reason := rejectedBy(peer, batch, results)
+	if len(rejected) > 0 {
+		events := make([]counter.Event, len(rejected))
+		for j, i := range rejected {
+			events[j] = batch[i]
+		}
+		s.refused(peer, events, reason)
+	}
+}
+
+// stopBatcher ends the batcher of a peer that is gone for good and waits
+// until it has sent, or queued, what it holds.
+func (s *PeerService) stopBatcher(peer string) {
+	s.BMutex.Lock()
+	b, ok := s.batchers[peer]
+	if ok {
+		delete(s.batchers, peer)
+		close(b.in)
+	}
+	s.BMutex.Unlock()
+
+	if ok {
+		<-b.done
+	}
+}
+
+// drainBatchers stops batching and waits until every batched event has been
+// sent or queued for retry.
+func (s *PeerService) drainBatchers() {
+	s.BMutex.Lock()
+	s.draining = true
+	batchers := s.batchers
+	s.batchers = make(map[string]*batcher)
+	for _, b := range batchers {
+		close(b.in)
+	}
+	s.BMutex.Unlock()
+
+	for _, b := range batchers {
+		<-b.done
+	}
+}
@@ -0,0 +1,322 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"service_discovery/pkg/client"
+	"service_discovery/pkg/counter"
+	pstore "service_discovery/pkg/peerStore"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxPendingPerPeer is how many undelivered events a single peer
+	// may have queued before its queue is abandoned.
+	DefaultMaxPendingPerPeer = 10000
+	// DefaultMaxPending caps the undelivered events queued for all peers.
+	DefaultMaxPending = 100000
+	// DefaultMaxAttempts is how many times the oldest queued event of a peer
+	// is retried before the peer's queue is abandoned.
+	DefaultMaxAttempts = 100
+	// DefaultMaxPendingAge is how long an event may wait for its peer.
+	DefaultMaxPendingAge = 30 * time.Minute
+	// MaxDeadLetters is how many abandoned events are kept for inspection.
+	MaxDeadLetters = 10000
+)
+
+// DeadLetter is an event that was given up on for a peer. Nothing is lost by
+// it: the peer is brought up to date by a full state sync instead.
+type DeadLetter struct {
+	ID          uint64        `json:"id"`
+	Peer        string        `json:"peer"`
+	Event       counter.Event `json:"event"`
+	Reason      string        `json:"reason"`
+	Attempts    int           `json:"attempts"`
+	QueuedAt    time.Time     `json:"queued_at"`
+	AbandonedAt time.Time     `json:"abandoned_at"`
+}
+
+// ReplayResult counts what became of the dead letters asked to be replayed.
+// Letters for peers that have left stay where they are.
+type ReplayResult struct {
+	Requeued int `json:"requeued"`
+	Skipped  int `json:"skipped"`
+}
+
+// enforceLimits abandons the queue of a peer that went over its cap, or the
+// largest queue if all of them together did, and reports whether it did.
+// PMutex must be held.
+func (s *PeerService) enforceLimits(peer string) bool {
+	if len(s.Pending[peer]) > s.MaxPendingPerPeer {
+		s.abandon(peer, fmt.Sprintf("more than %d events queued for the peer", s.MaxPendingPerPeer))
+		return true
+	}
+
+	total, largest := 0, ""
+	for p, queued := range s.Pending {
+		total += len(queued)
+		if largest == "" || len(queued) > len(s.Pending[largest]) {
+			largest = p
+		}
+	}
+	if total > s.MaxPending {
+		s.abandon(largest, fmt.Sprintf("more than %d events queued for all peers", s.MaxPending))
+		return true
+	}
+	return false
+}
+
+// expired tells why a peer's queue should be given up on, judging by its
+// oldest event, or returns "" if it should not.
+func (s *PeerService) expired(e *PendingEvent, now time.Time) string {
+	switch {
+	case e.Attempt >= s.MaxAttempts:
+		return fmt.Sprintf("still undelivered after %d attempts", e.Attempt)
+	case now.Sub(e.QueuedAt) > s.MaxPendingAge:
+		return fmt.Sprintf("still undelivered after %s", s.MaxPendingAge)
+	}
+	return ""
+}
+
+// abandon moves every event queued for a peer to the dead letters and marks
+// the peer for a state sync, which carries those events and any later ones.
+// The mark is journaled on its own, as the queue may have been empty. Nothing
+// is synced: PMutex must be held, and syncJournal called once it is released.
+func (s *PeerService) abandon(peer, reason string) {
+	queued := s.Pending[peer]
+	log.Println("abandoning pending events for", peer, len(queued), reason)
+
+	s.deadLetter(peer, queued, reason)
+	delete(s.Pending, peer)
+	s.markResync(peer)
+}
+
+// markResync marks a peer for a state sync, journaled unsynced. PMutex must
+// be held.
+func (s *PeerService) markResync(peer string) {
+	s.resync[peer] = true
+	s.journalUnsynced(JournalRecord{Type: RecordResync, Peer: peer})
+}
+
+// clearResync forgets that a peer is owed a state sync. It is journaled even
+// if the peer is not marked, as a sync in flight unmarks it early. PMutex
+// must be held.
+func (s *PeerService) clearResync(peer string) {
+	delete(s.resync, peer)
+	s.journal(JournalRecord{Type: RecordSynced, Peer: peer})
+}
+
+// deadLetter keeps events as dead letters for peer, journaled unsynced in a
+// single record. PMutex must be held.
+func (s *PeerService) deadLetter(peer string, queued []*PendingEvent, reason string) {
+	if len(queued) == 0 {
+		return
+	}
+
+	now := time.Now()
+	letters := make([]DeadLetter, 0, len(queued))
+	for _, e := range queued {
+		s.nextDeadLetter++
+		dl := DeadLetter{
+			ID:          s.nextDeadLetter,
+			Peer:        peer,
+			Event:       e.Event,
+			Reason:      reason,
+			Attempts:    e.Attempt,
+			QueuedAt:    e.QueuedAt,
+			AbandonedAt: now,
+		}
+		s.addDeadLetter(dl)
+		letters = append(letters, dl)
+	}
+	s.journalUnsynced(JournalRecord{Type: RecordDeadLetter, Peer: peer, Dead: letters})
+}
+
+// refused handles events a peer refused for good: they are dead-lettered with
+// the peer's queue and the peer is brought up to date by a state sync, which
+// it may take where it would not take the events.
+func (s *PeerService) refused(peer string, events []counter.Event, err error) {
+	var refused []*PendingEvent
+	for _, e := range events {
+		refused = append(refused, &PendingEvent{Event: e, QueuedAt: time.Now()})
+	}
+
+	s.PMutex.Lock()
+	s.deadLetter(peer, refused, err.Error())
+	s.abandon(peer, err.Error())
+	s.PMutex.Unlock()
+	s.syncJournal()
+}
+
+// rejectedBy picks the events of a delivered batch that the peer rejected,
+// as indexes into events, along with the reason given for the first one.
+func rejectedBy(peer string, events []counter.Event, results []client.ReplicateResult) ([]int, error) {
+	var rejected []int
+	var reason error
+	for i, e := range events {
+		if results[i].Status != client.ReplicateRejected {
+			continue
+		}
+		log.Println("peer rejected counter event", peer, e.Counter, e.Origin, e.Seq, results[i].Error)
+		if reason == nil {
+			reason = errors.New(results[i].Error)
+		}
+		rejected = append(rejected, i)
+	}
+	return rejected, reason
+}
+
+// addDeadLetter keeps a dead letter, forgetting the oldest once there are
+// too many. PMutex must be held.
+func (s *PeerService) addDeadLetter(dl DeadLetter) {
+	s.DeadLetters = append(s.DeadLetters, dl)
+	if over := len(s.DeadLetters) - MaxDeadLetters; over > 0 {
+		s.DeadLetters = append([]DeadLetter(nil), s.DeadLetters[over:]...)
+	}
+	s.nextDeadLetter = max(s.nextDeadLetter, dl.ID)
+}
+
+// ListDeadLetters returns the abandoned events, oldest first.
+func (s *PeerService) ListDeadLetters() []DeadLetter {
+	s.PMutex.Lock()
+	defer s.PMutex.Unlock()
+
+	return append([]DeadLetter{}, s.DeadLetters...)
+}
+
+// ReplayDeadLetters queues the dead letters with the given IDs, or all of
+// them if ids is empty, for delivery to their peer again.
+func (s *PeerService) ReplayDeadLetters(ids []uint64) ReplayResult {
+	wanted := make(map[uint64]bool)
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	// Look members up first, PStore is never used under PMutex
+	s.PMutex.Lock()
+	peers := make(map[string]bool)
+	for _, dl := range s.DeadLetters {
+		peers[dl.Peer] = true
+	}
+	s.PMutex.Unlock()
+	for peer := range peers {
+		m, ok := s.PStore.GetMember(peer)
+		peers[peer] = ok && m.State != pstore.StateLeft
+	}
+
+	s.PMutex.Lock()
+	defer s.PMutex.Unlock()
+
+	var result ReplayResult
+	var kept []DeadLetter
+	for _, dl := range s.DeadLetters {
+		if len(wanted) > 0 && !wanted[dl.ID] {
+			kept = append(kept, dl)
+			continue
+		}
+		if !peers[dl.Peer] {
+			kept = append(kept, dl)
+			result.Skipped++
+			continue
+		}
+		s.requeue(dl.Peer, dl.Event, time.Now())
+		s.journal(JournalRecord{Type: RecordRequeue, Peer: dl.Peer, Event: &dl.Event})
+		result.Requeued++
+	}
+	s.DeadLetters = kept
+	return result
+}
+
+// requeue puts an event back in a peer's queue as if it was new. PMutex must
+// be held.
+func (s *PeerService) requeue(peer string, event counter.Event, now time.Time) {
+	s.Pending[peer] = append(s.Pending[peer], &PendingEvent{
+		Event:    event,
+		QueuedAt: now,
+	})
+	s.wakeWorker(peer)
+}
+
+// removeDeadLetter forgets the first dead letter of event for peer. PMutex
+// must be held.
+func (s *PeerService) removeDeadLetter(peer string, event counter.Event) {
+	for i, dl := range s.DeadLetters {
+		if dl.Peer == peer && dl.Event == event {
+			s.DeadLetters = append(s.DeadLetters[:i], s.DeadLetters[i+1:]...)
+			return
+		}
+	}
+}
+
+// resyncPeers runs a full state sync with every reachable peer whose queue
+// was abandoned. A peer stays marked until a sync with it succeeds.
+func (s *PeerService) resyncPeers() {
+	reachable := make(map[string]bool)
+	for _, peer := range s.PStore.GetPeers() {
+		reachable[peer] = true
+	}
+
+	s.PMutex.Lock()
+	var due []string
+	for peer := range s.resync {
+		// Events for the peer are queued again from here on, so nothing
+		// applied during the sync is missed. The mark stays journaled until
+		// the sync went through.
+		if reachable[peer] {
+			due = append(due, peer)
+			delete(s.resync, peer)
+		}
+	}
+	s.PMutex.Unlock()
+	sort.Strings(due)
+
+	// A slow peer does not hold up the others
+	var wg sync.WaitGroup
+	for _, peer := range due {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.syncWith(peer); err != nil {
+				log.Println("error in state sync with", peer, err)
+				s.PMutex.Lock()
+				s.resync[peer] = true
+				s.PMutex.Unlock()
+				return
+			}
+			log.Println("state sync brought", peer, "up to date")
+			s.PMutex.Lock()
+			s.journal(JournalRecord{Type: RecordSynced, Peer: peer})
+			s.PMutex.Unlock()
+		}()
+	}
+	wg.Wait()
+}
+
+// Resyncing returns the peers waiting for a state sync in place of their
+// abandoned queue.
+func (s *PeerService) Resyncing() []string {
+	s.PMutex.Lock()
+	defer s.PMutex.Unlock()
+
+	peers := make([]string, 0, len(s.resync))
+	for peer := range s.resync {
+		peers = append(peers, peer)
+	}
+	sort.Strings(peers)
+	return peers
+}
+
+// forgetPeer drops everything kept for a peer that is gone for good: its
+// queue, its state sync mark and its backoff. PMutex must be held.
+func (s *PeerService) forgetPeer(peer string) {
+	if events, ok := s.Pending[peer]; ok {
+		log.Println("dropping pending events for departed peer", peer, len(events))
+		delete(s.Pending, peer)
+		s.journal(JournalRecord{Type: RecordDrop, Peer: peer})
+	}
+	s.clearResync(peer)
+	delete(s.backoff, peer)
+}
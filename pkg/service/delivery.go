@@ -0,0 +1,171 @@
+package service
+
+import (
+	"service_discovery/pkg/client"
+	"service_discovery/pkg/counter"
+	"time"
+)
+
+const (
+	// MinRetryDelay is how long a peer is left alone after a failed delivery.
+	// It doubles with every failure in a row, up to MaxRetryDelay.
+	MinRetryDelay = 100 * time.Millisecond
+	MaxRetryDelay = 10 * time.Second
+)
+
+// peerBackoff holds off deliveries to a peer that keeps failing them. It is
+// kept per peer rather than per event, so a dead peer costs one request per
+// delay however many events are queued for it.
+type peerBackoff struct {
+	Failures int       // failed deliveries in a row
+	RetryAt  time.Time // no delivery is tried before
+}
+
+// delay is how long to wait after the latest failure.
+func (b *peerBackoff) delay() time.Duration {
+	return min(MinRetryDelay<<min(b.Failures-1, 10), MaxRetryDelay)
+}
+
+// wakeWorker starts delivering the queue of a peer unless a worker already
+// is, or the retry loop has not started yet. PMutex must be held.
+func (s *PeerService) wakeWorker(peer string) {
+	if !s.retrying || s.workers[peer] {
+		return
+	}
+	s.workers[peer] = true
+	go s.runWorker(peer)
+}
+
+// runWorker delivers the queue of one peer until it is empty. Each peer has
+// its own worker, so a slow or dead peer only ever delays its own events.
+func (s *PeerService) runWorker(peer string) {
+	for {
+		wait := s.deliverPending(peer)
+		if wait == 0 {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// deliverPending sends what is queued for a peer in batches, until the queue
+// is empty or a batch fails. A batch the peer refused for good, or an event
+// it rejected, abandons the queue instead of being retried. It returns how
+// long to wait before trying again, or 0 once there is nothing left to
+// deliver. No lock is held while the peer is called.
+func (s *PeerService) deliverPending(peer string) time.Duration {
+	for {
+		// Looked up first, PStore is never used under PMutex
+		addr := s.addrOf(peer)
+
+		s.PMutex.Lock()
+		queued := s.Pending[peer]
+		if len(queued) == 0 {
+			delete(s.workers, peer)
+			s.PMutex.Unlock()
+			return 0
+		}
+
+		// The oldest event decides whether the peer is given up on
+		now := time.Now()
+		if reason := s.expired(queued[0], now); reason != "" {
+			s.abandon(peer, reason)
+			delete(s.workers, peer)
+			s.PMutex.Unlock()
+			s.syncJournal()
+			return 0
+		}
+		if b, ok := s.backoff[peer]; ok && now.Before(b.RetryAt) {
+			s.PMutex.Unlock()
+			return b.RetryAt.Sub(now)
+		}
+		if breaker := s.Breakers.State(addr); breaker.State == client.BreakerOpen {
+			s.PMutex.Unlock()
+			return max(breaker.RetryIn(), time.Millisecond)
+		}
+
+		batch := append([]*PendingEvent(nil), queued[:min(len(queued), max(s.BatchSize, 1))]...)
+		s.PMutex.Unlock()
+
+		events := make([]counter.Event, len(batch))
+		for i, e := range batch {
+			events[i] = e.Event
+		}
+		results, err := s.Client.SendIncrements(addr, s.SelfId, events)
+
+		s.PMutex.Lock()
+		if len(s.Pending[peer]) == 0 {
+			// The queue was dropped or abandoned while we were sending
+			delete(s.workers, peer)
+			s.PMutex.Unlock()
+			return 0
+		}
+		if err != nil && !client.Retryable(err) {
+			for _, e := range batch {
+				s.replicationFailed(peer, e.Event, e.Attempt+1, err)
+			}
+			// Whatever else is queued would be refused too
+			s.abandon(peer, err.Error())
+			delete(s.workers, peer)
+			s.PMutex.Unlock()
+			s.syncJournal()
+			return 0
+		}
+		if err != nil {
+			b, ok := s.backoff[peer]
+			if !ok {
+				b = &peerBackoff{}
+				s.backoff[peer] = b
+			}
+			b.Failures++
+			b.RetryAt = time.Now().Add(b.delay())
+			for _, e := range batch {
+				e.Attempt++
+				s.replicationFailed(peer, e.Event, e.Attempt, err)
+			}
+			s.PMutex.Unlock()
+			return b.delay()
+		}
+
+		delete(s.backoff, peer)
+		s.removeDelivered(peer, batch)
+		if rejected, reason := rejectedBy(peer, events, results); len(rejected) > 0 {
+			refused := make([]*PendingEvent, len(rejected))
+			for j, i := range rejected {
+				refused[j] = batch[i]
+			}
+			s.deadLetter(peer, refused, reason.Error())
+			s.abandon(peer, reason.Error())
+			delete(s.workers, peer)
+			s.PMutex.Unlock()
+			s.syncJournal()
+			return 0
+		}
+		s.PMutex.Unlock()
+	}
+}
+
+// removeDelivered takes delivered events off a peer's queue. Events that are
+// no longer queued, because the queue was dropped or abandoned meanwhile, are
+// skipped. PMutex must be held.
+func (s *PeerService) removeDelivered(peer string, delivered []*PendingEvent) {
+	done := make(map[*PendingEvent]bool, len(delivered))
+	for _, e := range delivered {
+		done[e] = true
+	}
+
+	var remaining []*PendingEvent
+	for _, e := range s.Pending[peer] {
+		if !done[e] {
+			remaining = append(remaining, e)
+			continue
+		}
+		s.journal(JournalRecord{Type: RecordDeliver, Event: &e.Event, Peer: peer})
+	}
+
+	if len(remaining) == 0 {
+		delete(s.Pending, peer)
+	} else {
+		s.Pending[peer] = remaining
+	}
+}
@@ -0,0 +1,307 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"service_discovery/pkg/counter"
+	"service_discovery/pkg/wal"
+	"time"
+)
+
+// Journal record types
+const (
+	RecordApply   = "apply"
+	RecordMerge   = "merge"
+	RecordEnqueue = "enqueue"
+	RecordDeliver = "deliver"
+	RecordDrop    = "drop"
+	// Events moved from a peer's queue to the dead letters, and one back
+	RecordDeadLetter = "deadletter"
+	RecordRequeue    = "requeue"
+	// A peer became owed a state sync, and no longer is
+	RecordResync = "resync"
+	RecordSynced = "synced"
+)
+
+// JournalRecord is one entry of the write-ahead log. Replaying every record
+// in order rebuilds the counters and the queue of undelivered events.
+type JournalRecord struct {
+	Type    string         `json:"type"`
+	Event   *counter.Event `json:"event,omitempty"`
+	Counter string         `json:"counter,omitempty"`
+	State   *counter.State `json:"state,omitempty"`
+	Peer    string         `json:"peer,omitempty"`
+	Dead    []DeadLetter   `json:"dead,omitempty"`
+}
+
+func (s *PeerService) journal(rec JournalRecord) {
+	if s.WAL != nil {
+		s.writeJournal(s.WAL.Append, rec)
+	}
+}
+
+// journalUnsynced journals a record without waiting for the disk, so the
+// records of a change made under PMutex keep their order but are synced once
+// by syncJournal, after the lock is released.
+func (s *PeerService) journalUnsynced(rec JournalRecord) {
+	if s.WAL != nil {
+		s.writeJournal(s.WAL.Write, rec)
+	}
+}
+
+// syncJournal makes the records journaled unsynced so far durable.
+func (s *PeerService) syncJournal() {
+	if s.WAL == nil {
+		return
+	}
+	if err := s.WAL.Sync(); err != nil {
+		log.Println("error in syncing the write-ahead log", err)
+	}
+}
+
+func (s *PeerService) writeJournal(write func([]byte) (uint64, error), rec JournalRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		log.Println("error in marshalling the journal record", err)
+		return
+	}
+
+	if _, err := write(data); err != nil {
+		log.Println("error in appending to the write-ahead log", err)
+	}
+}
+
+// Snapshot is the serialised state of a node at a point in the log: every
+// counter with its dedup watermarks, and the queue of undelivered events.
+type Snapshot struct {
+	TakenAt     time.Time                  `json:"taken_at"`
+	Counters    map[string]counter.State   `json:"counters"`
+	Pending     map[string][]counter.Event `json:"pending"`
+	DeadLetters []DeadLetter               `json:"dead_letters,omitempty"`
+	Resync      []string                   `json:"resync,omitempty"`
+}
+
+type SnapshotInfo struct {
+	LSN     uint64    `json:"lsn"`
+	TakenAt time.Time `json:"taken_at"`
+}
+
+// Restore loads the latest snapshot, replays the write-ahead log records
+// after it into memory, and journals every later change to the log. It must
+// run before the node starts serving requests. It fails rather than start
+// with missing updates if the snapshot covering compacted records is lost.
+func (s *PeerService) Restore(w wal.IWAL) error {
+	lsn, data, err := w.LoadSnapshot()
+	if err != nil {
+		return err
+	}
+
+	if data != nil {
+		var snap Snapshot
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return err
+		}
+
+		s.MergeStates(snap.Counters)
+		s.PMutex.Lock()
+		// How long an event had waited is not kept, its age restarts
+		for peer, events := range snap.Pending {
+			for _, event := range events {
+				s.requeue(peer, event, time.Now())
+			}
+		}
+		for _, dl := range snap.DeadLetters {
+			s.addDeadLetter(dl)
+		}
+		for _, peer := range snap.Resync {
+			s.resync[peer] = true
+		}
+		s.PMutex.Unlock()
+
+		s.setLastSnapshot(SnapshotInfo{LSN: lsn, TakenAt: snap.TakenAt})
+		log.Println("loaded snapshot at lsn", lsn)
+	}
+
+	records := 0
+	err = w.Replay(lsn, func(_ uint64, data []byte) error {
+		var rec JournalRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+
+		s.replay(rec)
+		records++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("replayed write-ahead log records", records)
+	s.WAL = w
+	return nil
+}
+
+func (s *PeerService) replay(rec JournalRecord) {
+	switch rec.Type {
+	case RecordApply:
+		s.Counters.GetOrCreate(rec.Event.Counter).Apply(rec.Event.Origin, rec.Event.Seq, rec.Event.Delta)
+	case RecordMerge:
+		s.Counters.GetOrCreate(rec.Counter).Merge(*rec.State)
+	case RecordEnqueue:
+		s.PMutex.Lock()
+		s.requeue(rec.Peer, *rec.Event, time.Now())
+		s.PMutex.Unlock()
+	case RecordDeliver:
+		s.PMutex.Lock()
+		s.removePending(rec.Peer, *rec.Event)
+		s.PMutex.Unlock()
+	case RecordDrop:
+		s.PMutex.Lock()
+		delete(s.Pending, rec.Peer)
+		s.PMutex.Unlock()
+	case RecordDeadLetter:
+		s.PMutex.Lock()
+		for _, dl := range rec.Dead {
+			s.removePending(rec.Peer, dl.Event)
+			s.addDeadLetter(dl)
+		}
+		s.resync[rec.Peer] = true
+		s.PMutex.Unlock()
+	case RecordRequeue:
+		s.PMutex.Lock()
+		s.removeDeadLetter(rec.Peer, *rec.Event)
+		s.requeue(rec.Peer, *rec.Event, time.Now())
+		s.PMutex.Unlock()
+	case RecordResync:
+		s.PMutex.Lock()
+		s.resync[rec.Peer] = true
+		s.PMutex.Unlock()
+	case RecordSynced:
+		s.PMutex.Lock()
+		delete(s.resync, rec.Peer)
+		s.PMutex.Unlock()
+	default:
+		log.Println("skipping unknown journal record", rec.Type)
+	}
+}
+
+// StartSnapshots periodically snapshots the node's state and compacts the
+// write-ahead log.
+func (s *PeerService) StartSnapshots(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		if _, err := s.Snapshot(); err != nil {
+			log.Println("error in taking a snapshot", err)
+		}
+	}
+}
+
+// Snapshot serialises the counters and the pending queue, then deletes the
+// log segments the snapshot covers.
+func (s *PeerService) Snapshot() (SnapshotInfo, error) {
+	if s.WAL == nil {
+		return SnapshotInfo{}, errors.New("persistence is disabled")
+	}
+
+	s.SMutex.Lock()
+	defer s.SMutex.Unlock()
+
+	// Hold off every change so the snapshot matches the log up to lsn
+	s.WMutex.Lock()
+	s.PMutex.Lock()
+	lsn := s.WAL.LastLSN()
+	snap := Snapshot{
+		TakenAt:  time.Now(),
+		Counters: s.CounterStates(),
+		Pending:  make(map[string][]counter.Event),
+	}
+	for peer, events := range s.Pending {
+		for _, e := range events {
+			snap.Pending[peer] = append(snap.Pending[peer], e.Event)
+		}
+	}
+	snap.DeadLetters = append(snap.DeadLetters, s.DeadLetters...)
+	for peer := range s.resync {
+		snap.Resync = append(snap.Resync, peer)
+	}
+	s.PMutex.Unlock()
+	s.WMutex.Unlock()
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	if err := s.WAL.WriteSnapshot(lsn, data); err != nil {
+		return SnapshotInfo{}, err
+	}
+	if err := s.WAL.Compact(lsn); err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	info := SnapshotInfo{LSN: lsn, TakenAt: snap.TakenAt}
+	s.setLastSnapshot(info)
+	log.Println("snapshot taken at lsn", lsn)
+	return info, nil
+}
+
+func (s *PeerService) setLastSnapshot(info SnapshotInfo) {
+	s.lastSnapshot.Store(&info)
+}
+
+// Status reports the node's persistence state.
+type Status struct {
+	NodeID             string        `json:"node_id"`
+	Ready              bool          `json:"ready"`
+	Persistent         bool          `json:"persistent"`
+	LastLSN            uint64        `json:"last_lsn"`
+	Snapshot           *SnapshotInfo `json:"snapshot,omitempty"`
+	SnapshotAgeSeconds float64       `json:"snapshot_age_seconds,omitempty"`
+	Pending            int           `json:"pending"`
+	DeadLetters        int           `json:"dead_letters"`
+	Resyncing          []string      `json:"resyncing,omitempty"`
+}
+
+func (s *PeerService) Status() Status {
+	status := Status{
+		NodeID:     s.SelfId,
+		Ready:      s.IsReady(),
+		Persistent: s.WAL != nil,
+	}
+	if s.WAL != nil {
+		status.LastLSN = s.WAL.LastLSN()
+	}
+	if info := s.lastSnapshot.Load(); info != nil {
+		status.Snapshot = info
+		status.SnapshotAgeSeconds = time.Since(info.TakenAt).Seconds()
+	}
+
+	s.PMutex.Lock()
+	for _, events := range s.Pending {
+		status.Pending += len(events)
+	}
+	status.DeadLetters = len(s.DeadLetters)
+	s.PMutex.Unlock()
+	status.Resyncing = s.Resyncing()
+	return status
+}
+
+// removePending drops the first queued delivery of event to peer. PMutex
+// must be held.
+func (s *PeerService) removePending(peer string, event counter.Event) {
+	events := s.Pending[peer]
+	for i, e := range events {
+		if e.Event == event {
+			events = append(events[:i], events[i+1:]...)
+			break
+		}
+	}
+
+	if len(events) == 0 {
+		delete(s.Pending, peer)
+	} else {
+		s.Pending[peer] = events
+	}
+}
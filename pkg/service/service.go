@@ -1,172 +1,1028 @@
 package service
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"hash/fnv"
 	"log"
+	"math/rand/v2"
 	"service_discovery/pkg/client"
 	"service_discovery/pkg/counter"
+	"service_discovery/pkg/events"
 	pstore "service_discovery/pkg/peerStore"
+	"service_discovery/pkg/registry"
+	"service_discovery/pkg/wal"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// SuspicionTimeout is how long a suspected peer has to refute the
+	// suspicion before it is declared dead.
+	SuspicionTimeout = 5 * time.Second
+	// TombstoneTimeout is how long dead and departed peers are remembered, so
+	// stale peer lists cannot re-add them.
+	TombstoneTimeout = time.Minute
+	// FlushTimeout bounds how long a leaving node spends delivering its
+	// queued events.
+	FlushTimeout = 10 * time.Second
+	// MaxPiggyback caps the membership updates carried by a single message.
+	MaxPiggyback = 8
+)
+
 type PeerService struct {
-	SelfId  string
-	PStore  pstore.IPeerStore
-	Client  client.IClient
-	Counter counter.IPeerCounter
-	Pending map[string][]*PendingEvent
-	PMutex  sync.Mutex
+	SelfId   string
+	PStore   pstore.IPeerStore
+	Client   client.IClient
+	Breakers *client.Breakers // the circuits Client keeps, nil if it keeps none
+	Counters counter.ICounters
+	Registry registry.IRegistry
+	Events   events.IBus
+	Pending  map[string][]*PendingEvent
+	PMutex   sync.Mutex
+	WAL      wal.IWAL
+	WMutex   sync.Mutex // keeps counter changes in the same order as their journal records
+	SMutex   sync.Mutex // serialises snapshots
+	HMutex   sync.Mutex // guards checkDue
+	BMutex   sync.Mutex // guards batchers and draining
+	ready    atomic.Bool
+
+	PhiThreshold float64       // phi above which a silent peer is suspected
+	BatchSize    int           // most counter events sent to a peer in one request
+	BatchLinger  time.Duration // how long an event waits for others to share its request
+
+	MaxPendingPerPeer int           // undelivered events one peer may have queued
+	MaxPending        int           // undelivered events all peers may have queued
+	MaxAttempts       int           // retries of a peer's oldest event before its queue is abandoned
+	MaxPendingAge     time.Duration // how long an event may wait before its peer's queue is abandoned
+	DeadLetters       []DeadLetter  // abandoned events, guarded by PMutex
+
+	lastSnapshot   atomic.Pointer[SnapshotInfo]
+	probeOrder     []string             // members left to probe in the current round
+	checkDue       map[string]time.Time // next run of each health check this node owns
+	batchers       map[string]*batcher  // outbound counter events, per peer
+	draining       bool                 // set by Leave, events are no longer batched
+	resync         map[string]bool      // peers owed a state sync for an abandoned queue, guarded by PMutex
+	retrying       bool                 // set by StartRetryLoop, guarded by PMutex
+	workers        map[string]bool      // peers whose queue is being delivered, guarded by PMutex
+	backoff        map[string]*peerBackoff
+	nextDeadLetter uint64
 }
 
 type PendingEvent struct {
-	EventID   string
-	Attempt   int
-	NextRetry time.Time
+	Event    counter.Event
+	Attempt  int // failed deliveries so far
+	QueuedAt time.Time
 }
 
-func NewPeerService(selfId string, p pstore.IPeerStore, cl client.IClient, pCounter counter.IPeerCounter) *PeerService {
-	return &PeerService{
-		SelfId:  selfId,
-		PStore:  p,
-		Client:  cl,
-		Counter: pCounter,
-		Pending: make(map[string][]*PendingEvent),
+func NewPeerService(selfId string, p pstore.IPeerStore, cl client.IClient, pCounters counter.ICounters) *PeerService {
+	s := &PeerService{
+		SelfId:   selfId,
+		PStore:   p,
+		Client:   cl,
+		Counters: pCounters,
+		Registry: registry.NewRegistry(),
+		Events:   events.NewBus(events.DefaultBuffer),
+		Pending:  make(map[string][]*PendingEvent),
+		checkDue: make(map[string]time.Time),
+		batchers: make(map[string]*batcher),
+		resync:   make(map[string]bool),
+		workers:  make(map[string]bool),
+		backoff:  make(map[string]*peerBackoff),
+
+		PhiThreshold: pstore.DefaultPhiThreshold,
+		BatchSize:    DefaultBatchSize,
+		BatchLinger:  DefaultBatchLinger,
+
+		MaxPendingPerPeer: DefaultMaxPendingPerPeer,
+		MaxPending:        DefaultMaxPending,
+		MaxAttempts:       DefaultMaxAttempts,
+		MaxPendingAge:     DefaultMaxPendingAge,
 	}
+	s.ready.Store(true)
+	return s
 }
 
 type IPeerService interface {
-	JoinPeer(peer string)
+	JoinPeer(peer string) error
+	IsReady() bool
 	AddPeer(peer string)
+	Alive(peer, addr string, incarnation uint64, meta pstore.Meta)
 	GetPeersList() []string
-	Increment(eventID string) error
-	GetCounterValue() int64
+	Members() []pstore.Member
+	MembershipIndex() uint64
+	WaitMembers(ctx context.Context, index uint64) uint64
+	View() []pstore.Update
+	Increment(name string, delta int64) error
+	Replicate(event counter.Event) error
+	GetCounterValue(name string) (int64, bool)
+	ListCounters() map[string]int64
+	CounterStates() map[string]counter.State
+	Sync(digests map[string]counter.Digest) (map[string]counter.State, map[string][]string)
+	MergeStates(states map[string]counter.State)
+	Register(inst registry.Instance) registry.Instance
+	Deregister(service, id string) bool
+	Instances(service string) []registry.Instance
+	ReplicateInstance(inst registry.Instance) error
+	RegistryState() []registry.Instance
+	Ack(from string, ping client.Ping) client.Ack
+	Ping(target, addr string, ping client.Ping) (client.Ack, error)
+	Gossip(from string, updates []pstore.Update)
+	PeerLeft(peer string, incarnation uint64)
+	Snapshot() (SnapshotInfo, error)
+	Status() Status
+	BreakerStates() []client.BreakerStatus
+	ListDeadLetters() []DeadLetter
+	ReplayDeadLetters(ids []uint64) ReplayResult
+	Subscribe() *events.Subscription
+	Unsubscribe(sub *events.Subscription)
 }
 
-func (s *PeerService) JoinPeer(peer string) {
-	peers, err := s.Client.JoinCluster(peer, s.PStore.SelfID())
+// JoinPeer joins the cluster through the seed at the given address.
+func (s *PeerService) JoinPeer(peer string) error {
+	resp, err := s.Client.JoinCluster(peer, s.PStore.SelfID(), s.PStore.SelfAddr(), s.PStore.SelfIncarnation(), s.PStore.SelfMeta(), true)
 	if err != nil {
+		return err
+	}
+
+	log.Println("peers are ", resp.Peers)
+	s.applyUpdates(resp.Peers)
+
+	// Catch up on every update made before we joined
+	s.MergeStates(resp.State)
+	s.MergeInstances(resp.Instances)
+	s.ready.Store(true)
+	return nil
+}
+
+// Bootstrap joins the cluster through the given seeds. The node reports
+// itself as not ready until one of them has handed over its counter state,
+// and keeps retrying in the background if none is reachable yet.
+func (s *PeerService) Bootstrap(seeds []string, retryInterval time.Duration) {
+	s.ready.Store(false)
+	if s.joinAny(seeds) {
 		return
 	}
 
-	log.Println("peers are ", peers)
-	s.PStore.AddPeer(peer)
-	for _, p := range peers {
-		s.PStore.AddPeer(p)
+	go func() {
+		ticker := time.NewTicker(retryInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if s.joinAny(seeds) {
+				return
+			}
+		}
+	}()
+}
+
+func (s *PeerService) joinAny(seeds []string) bool {
+	joined := false
+	for _, seed := range seeds {
+		if err := s.JoinPeer(seed); err != nil {
+			log.Println("error in joining the cluster through", seed, err)
+			continue
+		}
+		joined = true
 	}
+	return joined
+}
+
+func (s *PeerService) IsReady() bool {
+	return s.ready.Load()
 }
 
 func (s *PeerService) AddPeer(peer string) {
 	s.PStore.AddPeer(peer)
 }
 
+func (s *PeerService) Alive(peer, addr string, incarnation uint64, meta pstore.Meta) {
+	s.PStore.Alive(peer, addr, incarnation, meta)
+}
+
 func (s *PeerService) GetPeersList() []string {
 	return s.PStore.GetPeers()
 }
 
-func (s *PeerService) StartHeartbeat() {
-	ticker := time.NewTicker(2 * time.Second)
-	for range ticker.C {
-		for _, peer := range s.PStore.GetPeers() {
-			_ = s.Client.Heartbeat(peer, s.PStore.SelfID())
+func (s *PeerService) Members() []pstore.Member {
+	return s.PStore.Members()
+}
+
+func (s *PeerService) MembershipIndex() uint64 {
+	return s.PStore.MembershipIndex()
+}
+
+// WaitMembers blocks until the membership changed past index or ctx is done.
+func (s *PeerService) WaitMembers(ctx context.Context, index uint64) uint64 {
+	return s.PStore.WaitIndex(ctx, index)
+}
+
+func (s *PeerService) View() []pstore.Update {
+	return s.PStore.View()
+}
+
+// addrOf resolves a member's ID to the address it is reachable at. Members
+// only known by an address use it as their ID.
+func (s *PeerService) addrOf(peer string) string {
+	if m, ok := s.PStore.GetMember(peer); ok && m.Addr != "" {
+		return m.Addr
+	}
+	return peer
+}
+
+// breaker returns the state of the circuit to a peer.
+func (s *PeerService) breaker(peer string) client.BreakerStatus {
+	return s.Breakers.State(s.addrOf(peer))
+}
+
+// reachable leaves out the peers whose circuit is open, as requests to them
+// would be turned away.
+func (s *PeerService) reachable(peers []string) []string {
+	var open []string
+	for _, peer := range peers {
+		if s.breaker(peer).State != client.BreakerOpen {
+			open = append(open, peer)
 		}
 	}
+	return open
 }
 
-func (s *PeerService) StartCleanup(interval time.Duration) {
+// BreakerStates returns the circuits to peers that have failed requests.
+func (s *PeerService) BreakerStates() []client.BreakerStatus {
+	return s.Breakers.States()
+}
+
+// StartProbing runs the SWIM failure detector: every interval one member is
+// pinged, and if it does not answer, indirect probes are asked for through
+// up to indirect other members before the target is suspected.
+func (s *PeerService) StartProbing(interval time.Duration, indirect int) {
 	ticker := time.NewTicker(interval)
 	for range ticker.C {
-		now := time.Now()
-		for peer, last := range s.PStore.SnapshotOfPeers() {
-			if now.Sub(last) > 6*time.Second {
-				s.PStore.RemovePeer(peer)
+		s.probe(indirect)
+	}
+}
+
+func (s *PeerService) probe(indirect int) {
+	target := s.nextProbeTarget()
+	if target == "" {
+		return
+	}
+
+	// Tell the target if we suspect it, so it gets the chance to refute
+	var ping client.Ping
+	if m, ok := s.PStore.GetMember(target); ok {
+		ping.TargetIncarnation = m.Incarnation
+		ping.Suspected = m.State == pstore.StateSuspect
+	}
+
+	if _, err := s.Ping(target, s.addrOf(target), ping); err == nil || s.probeIndirectly(target, indirect, ping) {
+		return
+	}
+
+	log.Println("peer suspected", target)
+	s.PStore.SuspectPeer(target)
+}
+
+// nextProbeTarget walks the members in a random order, reshuffling once every
+// member has been probed, so a failed node is found within one round.
+func (s *PeerService) nextProbeTarget() string {
+	if len(s.probeOrder) == 0 {
+		s.probeOrder = s.PStore.GetPeers()
+		rand.Shuffle(len(s.probeOrder), func(i, j int) {
+			s.probeOrder[i], s.probeOrder[j] = s.probeOrder[j], s.probeOrder[i]
+		})
+	}
+	if len(s.probeOrder) == 0 {
+		return ""
+	}
+
+	target := s.probeOrder[0]
+	s.probeOrder = s.probeOrder[1:]
+	return target
+}
+
+func (s *PeerService) probeIndirectly(target string, indirect int, ping client.Ping) bool {
+	var relays []string
+	for _, peer := range s.PStore.GetPeers() {
+		if peer != target {
+			relays = append(relays, peer)
+		}
+	}
+	rand.Shuffle(len(relays), func(i, j int) {
+		relays[i], relays[j] = relays[j], relays[i]
+	})
+	if len(relays) > indirect {
+		relays = relays[:indirect]
+	}
+	if len(relays) == 0 {
+		return false
+	}
+
+	ping.Addr = s.PStore.SelfAddr()
+	ping.Meta = s.PStore.SelfMeta()
+	ping.Incarnation = s.PStore.SelfIncarnation()
+	ping.Updates = s.PStore.Broadcasts(MaxPiggyback)
+	targetAddr := s.addrOf(target)
+
+	acks := make(chan bool, len(relays))
+	for _, relay := range relays {
+		go func(relay string) {
+			ack, err := s.Client.PingReq(s.addrOf(relay), s.SelfId, target, targetAddr, ping)
+			if err == nil {
+				s.PStore.Alive(target, targetAddr, ack.Incarnation, ack.Meta)
+				s.applyUpdates(ack.Updates)
 			}
+			acks <- err == nil
+		}(relay)
+	}
+
+	for range relays {
+		if <-acks {
+			return true
 		}
 	}
+	return false
 }
 
-func (s *PeerService) Increment(eventID string) error {
-	applied := s.Counter.Apply(eventID, 1)
-	if !applied {
-		return errors.New("counter not applied")
+// Ping probes target, either for our own failure detector or on behalf of a
+// peer that could not reach it directly.
+func (s *PeerService) Ping(target, addr string, ping client.Ping) (client.Ack, error) {
+	// Updates from a ping-req are ours to pass on from here
+	s.applyUpdates(ping.Updates)
+
+	if addr == "" {
+		addr = s.addrOf(target)
 	}
+	ping.Addr = s.PStore.SelfAddr()
+	ping.Meta = s.PStore.SelfMeta()
+	ping.Incarnation = s.PStore.SelfIncarnation()
+	ping.Updates = s.PStore.Broadcasts(MaxPiggyback)
 
-	log.Println("Counter applied,sending to peers")
+	ack, err := s.Client.Heartbeat(addr, s.SelfId, ping)
+	if err != nil {
+		return ack, err
+	}
+	// The address may have been taken over by another node since
+	if ack.NodeId != target {
+		return ack, fmt.Errorf("%s answered for %s at %s", ack.NodeId, target, addr)
+	}
+	s.PStore.Alive(target, addr, ack.Incarnation, ack.Meta)
+	s.applyUpdates(ack.Updates)
+	return ack, nil
+}
 
-	// Propagate asynchronously to peers
-	for _, peer := range s.GetPeersList() {
-		go func(p string) {
-			go s.sendOrQueue(p, eventID)
-		}(peer)
+// Ack answers a probe from a peer, refuting the suspicion if the peer
+// suspects us.
+func (s *PeerService) Ack(from string, ping client.Ping) client.Ack {
+	s.PStore.Alive(from, ping.Addr, ping.Incarnation, ping.Meta)
+	s.applyUpdates(ping.Updates)
+
+	incarnation := s.PStore.SelfIncarnation()
+	if ping.Suspected {
+		incarnation = s.PStore.Refute(ping.TargetIncarnation)
+		log.Println("refuting suspicion from", from, incarnation)
+	}
+	return client.Ack{
+		NodeId:      s.SelfId,
+		Incarnation: incarnation,
+		Meta:        s.PStore.SelfMeta(),
+		Updates:     s.PStore.Broadcasts(MaxPiggyback),
 	}
+}
 
-	return nil
+// StartGossip spreads pending membership updates to fanout random peers every
+// interval, on top of what is piggybacked on probes.
+func (s *PeerService) StartGossip(interval time.Duration, fanout int) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		s.gossip(fanout)
+	}
 }
 
-func (s *PeerService) sendOrQueue(peer, eventID string) {
-	if err := s.Client.SendIncrement(peer, s.SelfId, eventID); err != nil {
-		s.enqueue(peer, eventID)
+func (s *PeerService) gossip(fanout int) {
+	peers := s.reachable(s.PStore.GetPeers())
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > fanout {
+		peers = peers[:fanout]
+	}
+
+	for _, peer := range peers {
+		updates := s.PStore.Broadcasts(MaxPiggyback)
+		if len(updates) == 0 {
+			return
+		}
+		go func(peer string) {
+			if err := s.Client.Gossip(s.addrOf(peer), s.SelfId, updates); err != nil {
+				log.Println("error in gossiping to", peer, err)
+			}
+		}(peer)
 	}
 }
 
-func (s *PeerService) enqueue(peer, eventID string) {
+// Gossip applies membership updates received from a peer. Whatever changes
+// our view is queued to be gossiped onwards.
+func (s *PeerService) Gossip(from string, updates []pstore.Update) {
+	s.applyUpdates(updates)
+}
+
+// PeerLeft handles a peer announcing that it leaves the cluster on purpose:
+// its departure is gossiped and the events still queued for it are dropped.
+func (s *PeerService) PeerLeft(peer string, incarnation uint64) {
+	if s.PStore.Apply(pstore.Update{ID: peer, State: pstore.StateLeft, Incarnation: incarnation}) {
+		log.Println("peer left", peer)
+	}
+	s.Breakers.Forget(s.addrOf(peer))
+
 	s.PMutex.Lock()
 	defer s.PMutex.Unlock()
+	s.forgetPeer(peer)
+}
 
-	event := &PendingEvent{
-		EventID:   eventID,
-		Attempt:   0,
-		NextRetry: time.Now(),
+// Leave announces to every peer that this node is leaving on purpose, then
+// makes a last attempt to deliver its queued events.
+func (s *PeerService) Leave() {
+	incarnation := s.PStore.SelfIncarnation()
+
+	var wg sync.WaitGroup
+	for _, peer := range s.PStore.GetPeers() {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if err := s.Client.Leave(s.addrOf(peer), s.SelfId, incarnation); err != nil {
+				log.Println("error in announcing departure to", peer, err)
+			}
+		}(peer)
 	}
-	s.Pending[peer] = append(s.Pending[peer], event)
+	wg.Wait()
+
+	s.drainBatchers()
+	s.flushPending()
 }
 
-func (s *PeerService) GetCounterValue() int64 {
+// flushPending tries every queued event once, ignoring backoff, with the
+// peers flushed in parallel and in batches of BatchSize. A batch its peer
+// cannot take for now is handed to another peer, which applies and floods it;
+// one the peer refused for good, or with an event it rejected, abandons its
+// queue as deliverPending does.
+// Nothing is sent after FlushTimeout, and anything still undelivered stays
+// journaled for the next start.
+func (s *PeerService) flushPending() {
+	deadline := time.Now().Add(FlushTimeout)
+
+	s.PMutex.Lock()
+	queues := make(map[string][]*PendingEvent, len(s.Pending))
+	for peer, queued := range s.Pending {
+		queues[peer] = append([]*PendingEvent(nil), queued...)
+	}
+	s.PMutex.Unlock()
 
-	return s.Counter.Get()
+	var wg sync.WaitGroup
+	for peer, queued := range queues {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.flushPeer(peer, queued, deadline)
+		}()
+	}
+	wg.Wait()
 }
 
-func (s *PeerService) StartRetryLoop() {
-	go func() {
-		for {
-			s.syncPending()
-			time.Sleep(2 * time.Second)
+// flushPeer sends the events queued for one peer until deadline. Once the
+// peer failed a batch it is not tried again, the rest is only handed off.
+func (s *PeerService) flushPeer(peer string, queued []*PendingEvent, deadline time.Time) {
+	addr := s.addrOf(peer)
+	reachable := true
+
+	var delivered []*PendingEvent
+	for len(queued) > 0 && time.Now().Before(deadline) {
+		batch := queued[:min(len(queued), max(s.BatchSize, 1))]
+		queued = queued[len(batch):]
+
+		events := make([]counter.Event, len(batch))
+		for i, e := range batch {
+			events[i] = e.Event
 		}
-	}()
-}
+		if reachable {
+			results, err := s.Client.SendIncrements(addr, s.SelfId, events)
+			if err == nil {
+				delivered = append(delivered, batch...)
+				rejected, reason := rejectedBy(peer, events, results)
+				if len(rejected) == 0 {
+					continue
+				}
+				refused := make([]*PendingEvent, len(rejected))
+				for j, i := range rejected {
+					refused[j] = batch[i]
+				}
+				s.PMutex.Lock()
+				s.removeDelivered(peer, delivered)
+				s.deadLetter(peer, refused, reason.Error())
+				s.abandon(peer, reason.Error())
+				s.PMutex.Unlock()
+				s.syncJournal()
+				return
+			}
+			if !client.Retryable(err) {
+				s.PMutex.Lock()
+				s.abandon(peer, err.Error())
+				s.PMutex.Unlock()
+				s.syncJournal()
+				return
+			}
+			log.Println("error in flushing pending events to", peer, err)
+			reachable = false
+		}
+
+		handed := s.handOff(peer, events, deadline)
+		for i, e := range batch {
+			if handed[i] {
+				delivered = append(delivered, e)
+			}
+		}
+	}
 
-func (s *PeerService) syncPending() {
 	s.PMutex.Lock()
 	defer s.PMutex.Unlock()
+	s.removeDelivered(peer, delivered)
+	if left := len(s.Pending[peer]); left > 0 {
+		log.Println("could not deliver pending events before leaving", peer, left)
+	}
+}
 
-	now := time.Now()
-	for peer, events := range s.Pending {
-		var remaining []*PendingEvent
+// handOff asks the other peers to apply events meant for peer, so they flood
+// them on to peer, and tells which of the events were handed off. This only
+// works for a peer that had not seen an event yet: one that reports it as a
+// duplicate will not send it on again, so an event is only handed off once
+// some peer reports it applied.
+func (s *PeerService) handOff(peer string, events []counter.Event, deadline time.Time) []bool {
+	handed := make([]bool, len(events))
+	for _, other := range s.PStore.GetPeers() {
+		if other == peer || !time.Now().Before(deadline) {
+			continue
+		}
 
-		for _, e := range events {
-			if now.Before(e.NextRetry) {
-				remaining = append(remaining, e)
-				continue
+		var indexes []int
+		var rest []counter.Event
+		for i, e := range events {
+			if !handed[i] {
+				indexes = append(indexes, i)
+				rest = append(rest, e)
 			}
+		}
+		if len(rest) == 0 {
+			break
+		}
 
-			if err := s.Client.SendIncrement(peer, s.SelfId, e.EventID); err != nil {
-				// Failed, schedule next retry with exponential backoff
-				e.Attempt++
+		results, err := s.Client.SendIncrements(s.addrOf(other), s.SelfId, rest)
+		if err != nil {
+			continue
+		}
+		for j, i := range indexes {
+			handed[i] = results[j].Status == client.ReplicateApplied
+		}
+	}
+	return handed
+}
 
-				delay := time.Millisecond * 100 * (1 << (e.Attempt - 1))
-				if delay > time.Second*10 {
-					delay = time.Second * 10 // max backoff
-				}
-				e.NextRetry = time.Now().Add(delay)
-				remaining = append(remaining, e)
+func (s *PeerService) applyUpdates(updates []pstore.Update) {
+	for _, u := range updates {
+		if s.PStore.Apply(u) {
+			log.Println("membership update", u.ID, u.State, u.Incarnation)
+		}
+	}
+}
+
+// StartCleanup suspects peers whose phi crossed PhiThreshold, declares dead
+// the peers that stayed suspected for longer than SuspicionTimeout, and
+// forgets tombstones older than TombstoneTimeout.
+func (s *PeerService) StartCleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		for _, peer := range s.PStore.SuspectByPhi(s.PhiThreshold) {
+			log.Println("peer suspected by phi", peer)
+		}
+		for _, peer := range s.PStore.ExpireSuspects(SuspicionTimeout) {
+			log.Println("suspected peer declared dead", peer)
+		}
+		// Looked up first, a pruned member takes its address with it
+		addrs := make(map[string]string)
+		for _, m := range s.PStore.Members() {
+			addrs[m.ID] = m.Addr
+		}
+		for _, peer := range s.PStore.PruneTombstones(TombstoneTimeout) {
+			// Whatever the batcher still held is queued before the queue goes
+			s.stopBatcher(peer)
+			s.PMutex.Lock()
+			s.forgetPeer(peer)
+			s.PMutex.Unlock()
+			s.Breakers.Forget(addrs[peer])
+		}
+		for _, inst := range s.Registry.Expire(time.Now()) {
+			log.Println("service instance expired", inst.Service, inst.ID)
+		}
+	}
+}
+
+// ErrNotReady is returned for writes made before the node has caught up with
+// the cluster.
+var ErrNotReady = errors.New("node has not caught up with the cluster yet")
+
+// Increment applies a local update and propagates it. It is refused until
+// the node is ready: a node that lost its state learns the last sequence it
+// used from the join snapshot, and writing before that would reuse sequences
+// peers already hold and drop as duplicates.
+func (s *PeerService) Increment(name string, delta int64) error {
+	if !s.IsReady() {
+		return ErrNotReady
+	}
+
+	s.WMutex.Lock()
+	event := counter.Event{
+		Counter: name,
+		Origin:  s.SelfId,
+		Seq:     s.Counters.GetOrCreate(name).ApplyLocal(delta),
+		Delta:   delta,
+	}
+	s.journal(JournalRecord{Type: RecordApply, Event: &event})
+	s.WMutex.Unlock()
+
+	log.Println("Counter applied,sending to peers", name, event.Seq)
+
+	s.propagate(event)
+
+	return nil
+}
+
+// Replicate applies an event received from a peer and forwards it to the
+// rest of the cluster if it had not been seen before. It returns
+// counter.ErrDuplicate for an event it has applied before and
+// counter.ErrTooFarAhead for one it cannot take until the gap before it is
+// filled.
+func (s *PeerService) Replicate(event counter.Event) error {
+	s.WMutex.Lock()
+	err := s.Counters.GetOrCreate(event.Counter).Apply(event.Origin, event.Seq, event.Delta)
+	if err == nil {
+		s.journal(JournalRecord{Type: RecordApply, Event: &event})
+	}
+	s.WMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	log.Println("Counter event applied,sending to peers", event.Counter, event.Origin, event.Seq)
+
+	s.propagate(event)
+
+	return nil
+}
+
+// replicationFailed reports a failed attempt to hand an event to a peer.
+func (s *PeerService) replicationFailed(peer string, event counter.Event, attempt int, err error) {
+	s.Events.Publish(events.ReplicationFailed, events.ReplicationData{
+		Peer:    peer,
+		Counter: event.Counter,
+		Origin:  event.Origin,
+		Seq:     event.Seq,
+		Attempt: attempt,
+		Error:   err.Error(),
+	})
+}
+
+func (s *PeerService) Subscribe() *events.Subscription {
+	return s.Events.Subscribe()
+}
+
+func (s *PeerService) Unsubscribe(sub *events.Subscription) {
+	s.Events.Unsubscribe(sub)
+}
+
+func (s *PeerService) enqueue(peer string, event counter.Event) {
+	// Nothing is kept for a peer that left on purpose
+	if m, ok := s.PStore.GetMember(peer); ok && m.State == pstore.StateLeft {
+		return
+	}
+
+	s.PMutex.Lock()
+
+	// The state sync the peer is owed will carry this event too
+	if s.resync[peer] {
+		s.PMutex.Unlock()
+		return
+	}
+
+	pending := &PendingEvent{
+		Event:    event,
+		Attempt:  0,
+		QueuedAt: time.Now(),
+	}
+	s.Pending[peer] = append(s.Pending[peer], pending)
+	s.journal(JournalRecord{Type: RecordEnqueue, Event: &event, Peer: peer})
+	abandoned := s.enforceLimits(peer)
+	s.wakeWorker(peer)
+	s.PMutex.Unlock()
+
+	if abandoned {
+		s.syncJournal()
+	}
+}
+
+func (s *PeerService) GetCounterValue(name string) (int64, bool) {
+	c, ok := s.Counters.Get(name)
+	if !ok {
+		return 0, false
+	}
+	return c.Get(), true
+}
+
+func (s *PeerService) ListCounters() map[string]int64 {
+	values := make(map[string]int64)
+	for _, name := range s.Counters.Names() {
+		if value, ok := s.GetCounterValue(name); ok {
+			values[name] = value
+		}
+	}
+	return values
+}
+
+// StartAntiEntropy periodically reconciles counter state with one random
+// peer, so the cluster converges even when pushed events are lost.
+func (s *PeerService) StartAntiEntropy(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		s.antiEntropy()
+	}
+}
+
+func (s *PeerService) antiEntropy() {
+	peers := s.reachable(s.PStore.GetPeers())
+	if len(peers) == 0 {
+		return
+	}
+	peer := peers[rand.IntN(len(peers))]
+
+	if err := s.syncWith(peer); err != nil {
+		log.Println("error in anti-entropy sync with", peer, err)
+	}
+}
+
+// syncWith exchanges counter state with a peer until neither is missing
+// anything the other had.
+func (s *PeerService) syncWith(peer string) error {
+	digests := make(map[string]counter.Digest)
+	for _, name := range s.Counters.Names() {
+		if c, ok := s.Counters.Get(name); ok {
+			digests[name] = c.Digest()
+		}
+	}
+
+	resp, err := s.Client.SyncDigest(s.addrOf(peer), s.SelfId, digests)
+	if err != nil {
+		return err
+	}
+
+	// Pull whatever the peer has that we are missing
+	s.MergeStates(resp.States)
+
+	if len(resp.Wants) == 0 {
+		return nil
+	}
+
+	// Push whatever we have that the peer is missing
+	states := make(map[string]counter.State)
+	for name, origins := range resp.Wants {
+		if c, ok := s.Counters.Get(name); ok {
+			states[name] = c.Delta(origins...)
+		}
+	}
+
+	return s.Client.PushState(s.addrOf(peer), s.SelfId, states)
+}
+
+// Sync compares a peer's digests with our counters. It returns the state the
+// peer is missing and, per counter, the origins we want the peer to push.
+func (s *PeerService) Sync(digests map[string]counter.Digest) (map[string]counter.State, map[string][]string) {
+	states := make(map[string]counter.State)
+	wants := make(map[string][]string)
+
+	for name, digest := range digests {
+		c, ok := s.Counters.Get(name)
+		if !ok {
+			// Compare against an empty counter so we ask for everything
+			c = counter.NewCounter(s.SelfId)
+		}
+
+		newer, wanted := c.Compare(digest)
+		if len(newer.Seq) > 0 {
+			states[name] = newer
+		}
+		if len(wanted) > 0 {
+			wants[name] = wanted
+		}
+	}
+
+	// Counters the peer has never heard of
+	for _, name := range s.Counters.Names() {
+		if _, ok := digests[name]; ok {
+			continue
+		}
+		if c, ok := s.Counters.Get(name); ok {
+			states[name] = c.State()
+		}
+	}
+
+	return states, wants
+}
+
+// CounterStates returns a snapshot of every counter's full state.
+func (s *PeerService) CounterStates() map[string]counter.State {
+	states := make(map[string]counter.State)
+	for _, name := range s.Counters.Names() {
+		if c, ok := s.Counters.Get(name); ok {
+			states[name] = c.State()
+		}
+	}
+	return states
+}
+
+func (s *PeerService) MergeStates(states map[string]counter.State) {
+	s.WMutex.Lock()
+	defer s.WMutex.Unlock()
+
+	for name, state := range states {
+		if s.Counters.GetOrCreate(name).Merge(state) {
+			s.journal(JournalRecord{Type: RecordMerge, Counter: name, State: &state})
+			log.Println("Counter state merged", name)
+		}
+	}
+}
+
+// Register registers or renews a service instance and replicates it to the
+// cluster.
+func (s *PeerService) Register(inst registry.Instance) registry.Instance {
+	inst = s.Registry.Register(inst, s.SelfId, time.Now())
+	log.Println("service instance registered,sending to peers", inst.Service, inst.ID, inst.Version)
+
+	s.propagateInstance(inst)
+	return inst
+}
+
+func (s *PeerService) Deregister(service, id string) bool {
+	inst, ok := s.Registry.Deregister(service, id, s.SelfId, time.Now())
+	if !ok {
+		return false
+	}
+	log.Println("service instance deregistered,sending to peers", service, id, inst.Version)
+
+	s.propagateInstance(inst)
+	return true
+}
+
+func (s *PeerService) Instances(service string) []registry.Instance {
+	return s.Registry.Instances(service, time.Now())
+}
+
+// ReplicateInstance applies a registration received from a peer and forwards
+// it to the rest of the cluster if it was newer than ours.
+func (s *PeerService) ReplicateInstance(inst registry.Instance) error {
+	if !s.Registry.Apply(inst, time.Now()) {
+		return errors.New("service instance not applied")
+	}
+
+	log.Println("service instance applied,sending to peers", inst.Service, inst.ID, inst.Version)
+
+	s.propagateInstance(inst)
+	return nil
+}
+
+// RegistryState returns every registration and tombstone still within its
+// TTL, which a joining node is handed along with the counters.
+func (s *PeerService) RegistryState() []registry.Instance {
+	return s.Registry.All(time.Now())
+}
+
+// MergeInstances applies the registrations handed over on join. They are not
+// forwarded: the node that sent them has already replicated them.
+func (s *PeerService) MergeInstances(instances []registry.Instance) {
+	now := time.Now()
+	for _, inst := range instances {
+		if s.Registry.Apply(inst, now) {
+			log.Println("service instance merged", inst.Service, inst.ID, inst.Version)
+		}
+	}
+}
+
+// propagateInstance sends a registration to every peer. Registrations are
+// soft state that every client renews within its TTL, so a failed send is
+// repaired by the next renewal instead of being queued, and a node that joins
+// later is handed every registration with the join.
+func (s *PeerService) propagateInstance(inst registry.Instance) {
+	// A peer that is down misses nothing: renewals repair it once it is back
+	for _, peer := range s.reachable(s.GetPeersList()) {
+		go func(peer string) {
+			if err := s.Client.SendInstance(s.addrOf(peer), s.SelfId, inst); err != nil {
+				log.Println("error in replicating service instance to", peer, err)
 			}
-			// Success - do not add to remaining, effectively removing it
+		}(peer)
+	}
+}
+
+// StartHealthChecks runs, every interval, the health checks of registered
+// instances that are due and owned by this node.
+func (s *PeerService) StartHealthChecks(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	for range ticker.C {
+		s.runHealthChecks()
+	}
+}
+
+func (s *PeerService) runHealthChecks() {
+	now := time.Now()
+	owned := make(map[string]bool)
+
+	for _, inst := range s.Registry.Checks(now) {
+		key := inst.Service + "/" + inst.ID
+		if s.checkOwner(key) != s.SelfId {
+			continue
 		}
+		owned[key] = true
 
-		if len(remaining) == 0 {
-			delete(s.Pending, peer)
-		} else {
-			s.Pending[peer] = remaining
+		s.HMutex.Lock()
+		due, ok := s.checkDue[key]
+		if ok && now.Before(due) {
+			s.HMutex.Unlock()
+			continue
 		}
+		s.checkDue[key] = now.Add(inst.Check.IntervalDuration())
+		s.HMutex.Unlock()
+
+		go s.runCheck(inst)
 	}
+
+	// Forget the schedule of checks that moved to another node or went away
+	s.HMutex.Lock()
+	for key := range s.checkDue {
+		if !owned[key] {
+			delete(s.checkDue, key)
+		}
+	}
+	s.HMutex.Unlock()
+}
+
+func (s *PeerService) runCheck(inst registry.Instance) {
+	status, output := inst.Check.Run()
+
+	// The check may have been changed by a renewal while it ran
+	updated, changed := s.Registry.SetHealth(inst.Service, inst.ID, inst.Check, status, output, s.SelfId)
+	if !changed {
+		return
+	}
+	log.Println("service instance health changed,sending to peers", inst.Service, inst.ID, status, output)
+
+	s.propagateInstance(updated)
+}
+
+// checkOwner picks the node that runs a health check by rendezvous hashing
+// over this node and its alive members. Every node agrees on the owner once
+// their views agree, and only the checks of a departed owner move.
+func (s *PeerService) checkOwner(key string) string {
+	candidates := []string{s.SelfId}
+	for _, m := range s.PStore.Members() {
+		if m.State == pstore.StateAlive {
+			candidates = append(candidates, m.ID)
+		}
+	}
+
+	var owner string
+	var best uint64
+	for _, id := range candidates {
+		h := fnv.New64a()
+		h.Write([]byte(id + "/" + key))
+		if score := h.Sum64(); owner == "" || score > best || (score == best && id < owner) {
+			owner, best = id, score
+		}
+	}
+	return owner
+}
+
+// StartRetryLoop starts a delivery worker for every peer with queued events,
+// as enqueue does for the ones queued later, and keeps bringing the peers
+// whose queue was abandoned up to date.
+func (s *PeerService) StartRetryLoop() {
+	s.PMutex.Lock()
+	s.retrying = true
+	for peer := range s.Pending {
+		s.wakeWorker(peer)
+	}
+	s.PMutex.Unlock()
+
+	go func() {
+		for {
+			s.resyncPeers()
+			time.Sleep(2 * time.Second)
+		}
+	}()
 }
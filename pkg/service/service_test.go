@@ -2,41 +2,154 @@ package service
 
 import (
 	"errors"
-	"github.com/google/uuid"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
 	"service_discovery/mocks/service_discovery/pkg/client"
 	"service_discovery/mocks/service_discovery/pkg/peerStore"
+	pClient "service_discovery/pkg/client"
 	"service_discovery/pkg/counter"
+	"service_discovery/pkg/events"
+	pstore "service_discovery/pkg/peerStore"
+	"service_discovery/pkg/registry"
+	"service_discovery/pkg/wal"
 	"sync"
 	"testing"
 	"time"
 )
 
+// unreachable is what the client returns for a peer it cannot connect to.
+func unreachable(peer string) error {
+	return &pClient.Error{Kind: pClient.ErrTransport, Peer: peer, Op: "/counter/replicate/batch", Err: errors.New("connection refused")}
+}
+
 func TestJoinPeer_AddsPeers(t *testing.T) {
 	mockClient := &client.MockIClient{}
 	mockStore := &peerStore.MockIPeerStore{}
 
 	// Setup expectations
 	mockStore.On("SelfID").Return("self1")
-	mockStore.On("AddPeer", "peer1").Return()
-	mockStore.On("AddPeer", "peer2").Return()
+	mockStore.On("SelfAddr").Return("localhost:8001")
+	mockStore.On("SelfMeta").Return(pstore.Meta{})
+	mockStore.On("SelfIncarnation").Return(uint64(1))
+	mockStore.On("Apply", pstore.Update{ID: "peer1", Addr: "localhost:8002", State: pstore.StateAlive, Incarnation: 5}).Return(true)
+	mockStore.On("Apply", pstore.Update{ID: "peer2", Addr: "localhost:8003", State: pstore.StateAlive, Incarnation: 6}).Return(true)
 
-	mockClient.On("JoinCluster", "peer1", "self1").Return([]string{"peer2"}, nil)
+	// The seed is dialled by address and answers with IDs and addresses
+	mockClient.On("JoinCluster", "localhost:8002", "self1", "localhost:8001", uint64(1), pstore.Meta{}, true).Return(pClient.JoinClusterResponse{Peers: []pstore.Update{
+		{ID: "peer1", Addr: "localhost:8002", State: pstore.StateAlive, Incarnation: 5},
+		{ID: "peer2", Addr: "localhost:8003", State: pstore.StateAlive, Incarnation: 6},
+	}}, nil)
 
-	service := NewPeerService("self1", mockStore, mockClient, counter.NewCounter())
+	service := NewPeerService("self1", mockStore, mockClient, counter.NewCounters("self1"))
 
-	service.JoinPeer("peer1")
+	err := service.JoinPeer("localhost:8002")
+	assert.NoError(t, err)
 
 	mockStore.AssertExpectations(t)
 	mockClient.AssertExpectations(t)
 }
 
+func TestBootstrap_MergesSnapshotBeforeReady(t *testing.T) {
+	mockClient := &client.MockIClient{}
+	mockStore := &peerStore.MockIPeerStore{}
+
+	mockStore.On("SelfID").Return("self")
+	mockStore.On("SelfAddr").Return("self")
+	mockStore.On("SelfMeta").Return(pstore.Meta{})
+	mockStore.On("SelfIncarnation").Return(uint64(1))
+	mockStore.On("Apply", mock.Anything).Return(true)
+
+	remote := counter.NewCounter("peer1")
+	remote.ApplyLocal(5)
+
+	// The first seed is down, the second hands over its state
+	mockClient.On("JoinCluster", "peer0", "self", "self", uint64(1), pstore.Meta{}, true).Return(pClient.JoinClusterResponse{}, errors.New("connection refused"))
+	mockClient.On("JoinCluster", "peer1", "self", "self", uint64(1), pstore.Meta{}, true).Return(pClient.JoinClusterResponse{
+		Peers: []pstore.Update{{ID: "peer2", Addr: "peer2", State: pstore.StateAlive, Incarnation: 1}},
+		State: map[string]counter.State{"orders": remote.State()},
+		Instances: []registry.Instance{
+			{Service: "api", ID: "api-1", Address: "10.0.0.1", TTL: 600, Version: 2, Origin: "peer1"},
+		},
+	}, nil)
+
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	svc.Bootstrap([]string{"peer0", "peer1"}, time.Second)
+
+	assert.True(t, svc.IsReady())
+	val, ok := svc.GetCounterValue("orders")
+	assert.True(t, ok)
+	assert.Equal(t, int64(5), val)
+
+	// Registrations made before the join are there too, without a renewal
+	assert.Len(t, svc.Instances("api"), 1)
+	mockClient.AssertNotCalled(t, "SendInstance", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestBootstrap_NotReadyUntilJoined(t *testing.T) {
+	mockClient := &client.MockIClient{}
+	mockStore := &peerStore.MockIPeerStore{}
+
+	mockStore.On("SelfID").Return("self")
+	mockStore.On("SelfAddr").Return("self")
+	mockStore.On("SelfMeta").Return(pstore.Meta{})
+	mockStore.On("SelfIncarnation").Return(uint64(1))
+	mockStore.On("Apply", mock.Anything).Return(true)
+
+	// Fail the first attempt, succeed on the background retry
+	mockClient.On("JoinCluster", "peer1", "self", "self", uint64(1), pstore.Meta{}, true).Return(pClient.JoinClusterResponse{}, errors.New("connection refused")).Once()
+	mockClient.On("JoinCluster", "peer1", "self", "self", uint64(1), pstore.Meta{}, true).Return(pClient.JoinClusterResponse{}, nil)
+
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	svc.Bootstrap([]string{"peer1"}, 10*time.Millisecond)
+
+	assert.False(t, svc.IsReady())
+	assert.Eventually(t, svc.IsReady, time.Second, 10*time.Millisecond)
+}
+
+func TestIncrement_ContinuesSequenceAfterLosingState(t *testing.T) {
+	mockClient := &client.MockIClient{}
+	mockStore := &peerStore.MockIPeerStore{}
+
+	mockStore.On("SelfID").Return("self")
+	mockStore.On("SelfAddr").Return("self")
+	mockStore.On("SelfMeta").Return(pstore.Meta{})
+	mockStore.On("SelfIncarnation").Return(uint64(1))
+	mockStore.On("GetPeers").Return([]string{})
+	mockStore.On("Apply", mock.Anything).Return(true)
+
+	// The cluster still holds five updates from our previous run
+	previous := counter.NewCounter("self")
+	for i := 0; i < 5; i++ {
+		previous.ApplyLocal(1)
+	}
+	join := mockClient.On("JoinCluster", "peer1", "self", "self", uint64(1), pstore.Meta{}, true).Return(pClient.JoinClusterResponse{}, errors.New("connection refused"))
+
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	svc.Bootstrap([]string{"peer1"}, time.Hour)
+
+	// Writes are refused until the node has caught up
+	assert.ErrorIs(t, svc.Increment("orders", 1), ErrNotReady)
+
+	join.Unset()
+	mockClient.On("JoinCluster", "peer1", "self", "self", uint64(1), pstore.Meta{}, true).Return(pClient.JoinClusterResponse{
+		State: map[string]counter.State{"orders": previous.State()},
+	}, nil)
+	assert.NoError(t, svc.JoinPeer("peer1"))
+
+	assert.NoError(t, svc.Increment("orders", 1))
+	assert.Equal(t, uint64(6), svc.Counters.GetOrCreate("orders").State().Seq["self"])
+	val, _ := svc.GetCounterValue("orders")
+	assert.Equal(t, int64(6), val)
+}
+
 func TestAddPeer(t *testing.T) {
 	mockStore := &peerStore.MockIPeerStore{}
-	c := counter.NewCounter()
+	counters := counter.NewCounters("self")
 	mockClient := &client.MockIClient{}
-	service := NewPeerService("self", mockStore, mockClient, c)
+	service := NewPeerService("self", mockStore, mockClient, counters)
 
 	mockStore.On("AddPeer", "peer1").Return()
 
@@ -47,9 +160,9 @@ func TestAddPeer(t *testing.T) {
 
 func TestGetPeersList(t *testing.T) {
 	mockStore := &peerStore.MockIPeerStore{}
-	c := counter.NewCounter()
+	counters := counter.NewCounters("self")
 	mockClient := &client.MockIClient{}
-	service := NewPeerService("self", mockStore, mockClient, c)
+	service := NewPeerService("self", mockStore, mockClient, counters)
 
 	mockStore.On("GetPeers").Return([]string{"peer1", "peer2"})
 
@@ -65,70 +178,151 @@ func TestIncrement_Applied(t *testing.T) {
 
 	// Setup peers
 	mockStore.On("GetPeers").Return([]string{"peer1"})
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
 	mockStore.On("SelfID").Return("self")
 
-	// Expect SendIncrement to be called
+	// Expect SendIncrements to be called
 	called := make(chan bool, 1)
-	mockClient.On("SendIncrement", "peer1", "self", "event1").Return(nil).Run(func(args mock.Arguments) {
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{{Counter: counter.DefaultName, Origin: "self", Seq: 1, Delta: 1}}).Return([]pClient.ReplicateResult{{Status: pClient.ReplicateApplied}}, nil).Run(func(args mock.Arguments) {
 		called <- true
 	})
 
-	c := counter.NewCounter()
-	svc := NewPeerService("self", mockStore, mockClient, c)
+	counters := counter.NewCounters("self")
+	svc := NewPeerService("self", mockStore, mockClient, counters)
 
 	// Call Increment
-	_ = svc.Increment("event1")
+	_ = svc.Increment(counter.DefaultName, 1)
 
-	// Wait for SendIncrement to be called
+	// Wait for SendIncrements to be called
 	select {
 	case <-called:
 		// success
 	case <-time.After(time.Second):
-		t.Fatal("SendIncrement was not called")
+		t.Fatal("SendIncrements was not called")
 	}
 
 	mockClient.AssertExpectations(t)
 }
 
-func TestIncrement_AlreadyApplied(t *testing.T) {
+func TestReplicate_AlreadyApplied(t *testing.T) {
+	mockClient := &client.MockIClient{}
+	mockStore := &peerStore.MockIPeerStore{}
+	counters := counter.NewCounters("self")
+	service := NewPeerService("self", mockStore, mockClient, counters)
+
+	service.Counters.GetOrCreate(counter.DefaultName).Apply("peer1", 1, 1)
+
+	err := service.Replicate(counter.Event{Counter: counter.DefaultName, Origin: "peer1", Seq: 1, Delta: 1})
+	assert.ErrorIs(t, err, counter.ErrDuplicate)
+
+	err = service.Replicate(counter.Event{Counter: counter.DefaultName, Origin: "peer1", Seq: counter.MaxAhead + 2, Delta: 1})
+	assert.ErrorIs(t, err, counter.ErrTooFarAhead)
+}
+
+func TestReplicate_AppliesAndForwards(t *testing.T) {
 	mockClient := &client.MockIClient{}
 	mockStore := &peerStore.MockIPeerStore{}
-	c := counter.NewCounter()
-	service := NewPeerService("self", mockStore, mockClient, c)
 
-	service.Counter.Apply("event1", 1)
+	mockStore.On("GetPeers").Return([]string{"peer2"})
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+
+	counters := counter.NewCounters("self")
+	c := counters.GetOrCreate(counter.DefaultName)
+	svc := NewPeerService("self", mockStore, mockClient, counters)
+
+	event := counter.Event{Counter: counter.DefaultName, Origin: "peer1", Seq: 1, Delta: 3}
+
+	// Expect the event to be forwarded unchanged
+	called := make(chan bool, 1)
+	mockClient.On("SendIncrements", "peer2", "self", []counter.Event{event}).Return([]pClient.ReplicateResult{{Status: pClient.ReplicateApplied}}, nil).Run(func(args mock.Arguments) {
+		called <- true
+	})
 
-	err := service.Increment("event1")
+	err := svc.Replicate(event)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), c.Get())
+
+	select {
+	case <-called:
+	case <-time.After(time.Second):
+		t.Fatal("SendIncrements was not called")
+	}
+
+	// Replaying the same event is rejected
+	err = svc.Replicate(event)
 	assert.Error(t, err)
-	assert.Equal(t, "counter not applied", err.Error())
+	assert.Equal(t, int64(3), c.Get())
 }
 
 func TestGetCounterValue(t *testing.T) {
 	mockClient := &client.MockIClient{}
 	mockStore := &peerStore.MockIPeerStore{}
-	c := counter.NewCounter()
-	c.Apply("event1", 1)
+	counters := counter.NewCounters("self")
+	c := counters.GetOrCreate(counter.DefaultName)
+	c.ApplyLocal(1)
 
-	service := NewPeerService("self", mockStore, mockClient, c)
+	service := NewPeerService("self", mockStore, mockClient, counters)
 
-	val := service.GetCounterValue()
+	val, ok := service.GetCounterValue(counter.DefaultName)
+	assert.True(t, ok)
 	assert.Equal(t, int64(1), val)
+
+	_, ok = service.GetCounterValue("missing")
+	assert.False(t, ok)
 }
 
-func TestSendOrQueue_Failure(t *testing.T) {
+func TestSendBatch_Failure(t *testing.T) {
 	mockClient := &client.MockIClient{}
 	mockStore := &peerStore.MockIPeerStore{}
-	c := counter.NewCounter()
-	service := NewPeerService("self", mockStore, mockClient, c)
+	counters := counter.NewCounters("self")
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+	service := NewPeerService("self", mockStore, mockClient, counters)
 
-	mockClient.On("SendIncrement", "peer1", "self", "event1").Return(errors.New("fail"))
+	event := counter.Event{Counter: counter.DefaultName, Origin: "self", Seq: 1, Delta: 1}
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{event}).Return(nil, unreachable("peer1"))
 
-	service.sendOrQueue("peer1", "event1")
+	service.sendBatch("peer1", []counter.Event{event})
 
 	service.PMutex.Lock()
 	defer service.PMutex.Unlock()
 	assert.Len(t, service.Pending["peer1"], 1)
-	assert.Equal(t, "event1", service.Pending["peer1"][0].EventID)
+	assert.Equal(t, event, service.Pending["peer1"][0].Event)
+}
+
+func TestNamedCountersAreIndependent(t *testing.T) {
+	mockClient := &client.MockIClient{}
+	mockStore := &peerStore.MockIPeerStore{}
+
+	mockStore.On("GetPeers").Return([]string{})
+
+	counters := counter.NewCounters("self")
+	svc := NewPeerService("self", mockStore, mockClient, counters)
+
+	assert.NoError(t, svc.Increment("orders", 2))
+	assert.NoError(t, svc.Increment("stock", 7))
+
+	// Each counter deduplicates on its own
+	assert.NoError(t, svc.Replicate(counter.Event{Counter: "orders", Origin: "peer1", Seq: 1, Delta: 0}))
+	assert.Error(t, svc.Replicate(counter.Event{Counter: "orders", Origin: "peer1", Seq: 1, Delta: 0}))
+	assert.NoError(t, svc.Replicate(counter.Event{Counter: "stock", Origin: "peer1", Seq: 1, Delta: 0}))
+
+	assert.Equal(t, map[string]int64{"orders": 2, "stock": 7}, svc.ListCounters())
+}
+
+func TestIncrement_NegativeDelta(t *testing.T) {
+	mockClient := &client.MockIClient{}
+	mockStore := &peerStore.MockIPeerStore{}
+
+	mockStore.On("GetPeers").Return([]string{})
+
+	counters := counter.NewCounters("self")
+	svc := NewPeerService("self", mockStore, mockClient, counters)
+
+	assert.NoError(t, svc.Increment(counter.DefaultName, 5))
+	assert.NoError(t, svc.Increment(counter.DefaultName, -2))
+
+	val, _ := svc.GetCounterValue(counter.DefaultName)
+	assert.Equal(t, int64(3), val)
 }
 
 func TestConcurrentIncrements(t *testing.T) {
@@ -138,8 +332,9 @@ func TestConcurrentIncrements(t *testing.T) {
 	mockStore.On("GetPeers").Return([]string{})
 	mockStore.On("SelfID").Return("node1")
 
-	c := counter.NewCounter()
-	svc := NewPeerService("node1", mockStore, mockClient, c)
+	counters := counter.NewCounters("node1")
+	c := counters.GetOrCreate(counter.DefaultName)
+	svc := NewPeerService("node1", mockStore, mockClient, counters)
 
 	// Run multiple concurrent increments
 	var wg sync.WaitGroup
@@ -148,7 +343,7 @@ func TestConcurrentIncrements(t *testing.T) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			_ = svc.Increment(uuid.NewString())
+			_ = svc.Increment(counter.DefaultName, 1)
 		}()
 	}
 	wg.Wait()
@@ -163,23 +358,24 @@ func TestIncrementPropagation(t *testing.T) {
 	mockClient := &client.MockIClient{}
 
 	mockStore.On("GetPeers").Return([]string{"node2"})
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
 	mockStore.On("SelfID").Return("node1")
 
-	c := counter.NewCounter()
-	svc := NewPeerService("node1", mockStore, mockClient, c)
+	counters := counter.NewCounters("node1")
+	svc := NewPeerService("node1", mockStore, mockClient, counters)
 
-	// Capture call to SendIncrement
+	// Capture call to SendIncrements
 	called := make(chan bool, 1)
-	mockClient.On("SendIncrement", "node2", "node1", "event1").Return(nil).Run(func(args mock.Arguments) {
+	mockClient.On("SendIncrements", "node2", "node1", []counter.Event{{Counter: counter.DefaultName, Origin: "node1", Seq: 1, Delta: 1}}).Return([]pClient.ReplicateResult{{Status: pClient.ReplicateApplied}}, nil).Run(func(args mock.Arguments) {
 		called <- true
 	})
 
-	_ = svc.Increment("event1")
+	_ = svc.Increment(counter.DefaultName, 1)
 
 	select {
 	case <-called:
 	case <-time.After(time.Second):
-		t.Fatal("SendIncrement was not called for propagation")
+		t.Fatal("SendIncrements was not called for propagation")
 	}
 
 	mockClient.AssertExpectations(t)
@@ -190,15 +386,19 @@ func TestDeduplicationAndRetry(t *testing.T) {
 	mockClient := &client.MockIClient{}
 
 	mockStore.On("GetPeers").Return([]string{"peer1"})
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
 	mockStore.On("SelfID").Return("self")
 
-	c := counter.NewCounter()
-	svc := NewPeerService("self", mockStore, mockClient, c)
+	counters := counter.NewCounters("self")
+	c := counters.GetOrCreate(counter.DefaultName)
+	svc := NewPeerService("self", mockStore, mockClient, counters)
 
-	// First attempt succeeds
-	mockClient.On("SendIncrement", "peer1", "self", "event1").Return(errors.New("network error"))
+	// Every attempt fails
+	event := counter.Event{Counter: counter.DefaultName, Origin: "self", Seq: 1, Delta: 1}
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{event}).Return(nil, unreachable("peer1"))
+	mockClient.On("SendIncrement", "peer1", "self", event).Return(errors.New("network error"))
 
-	_ = svc.Increment("event1")
+	_ = svc.Increment(counter.DefaultName, 1)
 
 	// Start retry loop
 	svc.StartRetryLoop()
@@ -212,21 +412,192 @@ func TestDeduplicationAndRetry(t *testing.T) {
 	}
 }
 
+func TestAntiEntropy_PullsAndPushes(t *testing.T) {
+	mockStore := &peerStore.MockIPeerStore{}
+	mockClient := &client.MockIClient{}
+
+	mockStore.On("GetPeers").Return([]string{"peer1"})
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+
+	counters := counter.NewCounters("self")
+	counters.GetOrCreate("orders").ApplyLocal(2)
+	svc := NewPeerService("self", mockStore, mockClient, counters)
+
+	// The peer has an update from itself we lack, and wants ours
+	remote := counter.NewCounter("peer1")
+	remote.ApplyLocal(5)
+	mockClient.On("SyncDigest", "peer1", "self", mock.Anything).Return(pClient.SyncResponse{
+		States: map[string]counter.State{"orders": remote.State()},
+		Wants:  map[string][]string{"orders": {"self"}},
+	}, nil)
+	mockClient.On("PushState", "peer1", "self", mock.Anything).Return(nil)
+
+	svc.antiEntropy()
+
+	val, _ := svc.GetCounterValue("orders")
+	assert.Equal(t, int64(7), val)
+
+	mockClient.AssertCalled(t, "PushState", "peer1", "self", mock.MatchedBy(func(states map[string]counter.State) bool {
+		return states["orders"].P["self"] == 2 && states["orders"].Seq["self"] == 1
+	}))
+}
+
+func TestSync_ComparesDigests(t *testing.T) {
+	mockStore := &peerStore.MockIPeerStore{}
+	mockClient := &client.MockIClient{}
+
+	counters := counter.NewCounters("self")
+	counters.GetOrCreate("orders").ApplyLocal(2)
+	counters.GetOrCreate("stock").ApplyLocal(1)
+	svc := NewPeerService("self", mockStore, mockClient, counters)
+
+	states, wants := svc.Sync(map[string]counter.Digest{
+		"orders": {Seq: map[string]uint64{"peer1": 3}},
+		"users":  {Seq: map[string]uint64{"peer1": 1}},
+	})
+
+	// We are ahead on our own updates and on the counter the peer lacks
+	assert.Equal(t, uint64(1), states["orders"].Seq["self"])
+	assert.Equal(t, int64(1), states["stock"].Value())
+
+	// The peer is ahead on its own updates, including a counter we lack
+	assert.Equal(t, map[string][]string{"orders": {"peer1"}, "users": {"peer1"}}, wants)
+}
+
+func TestRestore_ReplaysJournal(t *testing.T) {
+	dir := t.TempDir()
+
+	mockStore := &peerStore.MockIPeerStore{}
+	mockClient := &client.MockIClient{}
+
+	mockStore.On("GetPeers").Return([]string{})
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+
+	eventLog, err := wal.Open(dir, wal.DefaultSegmentSize)
+	assert.NoError(t, err)
+
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	assert.NoError(t, svc.Restore(eventLog))
+
+	_ = svc.Increment("orders", 3)
+	_ = svc.Replicate(counter.Event{Counter: "orders", Origin: "peer1", Seq: 1, Delta: 2})
+
+	remote := counter.NewCounter("peer2")
+	remote.ApplyLocal(10)
+	svc.MergeStates(map[string]counter.State{"stock": remote.State()})
+
+	// One delivery still pending, one delivered on retry
+	delivered := counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 3}
+	undelivered := counter.Event{Counter: "orders", Origin: "peer1", Seq: 1, Delta: 2}
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{delivered}).Return(nil, unreachable("peer1")).Once()
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{delivered}).Return([]pClient.ReplicateResult{{Status: pClient.ReplicateApplied}}, nil)
+	mockClient.On("SendIncrements", "peer3", "self", []counter.Event{undelivered}).Return(nil, unreachable("peer3"))
+	svc.sendBatch("peer1", []counter.Event{delivered})
+	svc.sendBatch("peer3", []counter.Event{undelivered})
+	svc.deliverPending("peer1")
+	svc.deliverPending("peer3")
+	assert.NoError(t, eventLog.Close())
+
+	// Simulate a restart
+	eventLog, err = wal.Open(dir, wal.DefaultSegmentSize)
+	assert.NoError(t, err)
+
+	restarted := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	assert.NoError(t, restarted.Restore(eventLog))
+
+	assert.Equal(t, map[string]int64{"orders": 5, "stock": 10}, restarted.ListCounters())
+	assert.NotContains(t, restarted.Pending, "peer1")
+	assert.Len(t, restarted.Pending["peer3"], 1)
+	assert.Equal(t, undelivered, restarted.Pending["peer3"][0].Event)
+
+	// Sequence numbers continue after the restart
+	_ = restarted.Increment("orders", 1)
+	assert.Equal(t, uint64(2), restarted.Counters.GetOrCreate("orders").State().Seq["self"])
+}
+
+func TestSnapshot_CompactsAndRestores(t *testing.T) {
+	dir := t.TempDir()
+
+	mockStore := &peerStore.MockIPeerStore{}
+	mockClient := &client.MockIClient{}
+
+	mockStore.On("GetPeers").Return([]string{})
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+
+	// Tiny segments so every record rotates
+	eventLog, err := wal.Open(dir, 10)
+	assert.NoError(t, err)
+
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	assert.NoError(t, svc.Restore(eventLog))
+
+	_ = svc.Increment("orders", 3)
+	_ = svc.Replicate(counter.Event{Counter: "orders", Origin: "peer1", Seq: 2, Delta: 2})
+
+	pending := counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 3}
+	mockClient.On("SendIncrements", "peer2", "self", []counter.Event{pending}).Return(nil, unreachable("peer2"))
+	svc.sendBatch("peer2", []counter.Event{pending})
+
+	info, err := svc.Snapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), info.LSN)
+
+	// Only the active segment survives compaction
+	segments, _ := filepath.Glob(filepath.Join(dir, "*.wal"))
+	assert.Len(t, segments, 1)
+
+	_ = svc.Increment("orders", 1)
+	assert.NoError(t, eventLog.Close())
+
+	eventLog, err = wal.Open(dir, 10)
+	assert.NoError(t, err)
+
+	restarted := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	assert.NoError(t, restarted.Restore(eventLog))
+
+	assert.Equal(t, map[string]int64{"orders": 6}, restarted.ListCounters())
+	restored := restarted.Pending["peer2"]
+	if assert.Len(t, restored, 1) {
+		assert.Equal(t, pending, restored[0].Event)
+		assert.Zero(t, restored[0].Attempt)
+	}
+
+	// The out-of-order watermark survived as well
+	assert.Error(t, restarted.Replicate(counter.Event{Counter: "orders", Origin: "peer1", Seq: 2, Delta: 2}))
+
+	status := restarted.Status()
+	assert.True(t, status.Persistent)
+	assert.Equal(t, uint64(3), status.Snapshot.LSN)
+	assert.Equal(t, uint64(4), status.LastLSN)
+}
+
+func TestSnapshot_WithoutPersistence(t *testing.T) {
+	svc := NewPeerService("self", &peerStore.MockIPeerStore{}, &client.MockIClient{}, counter.NewCounters("self"))
+
+	_, err := svc.Snapshot()
+	assert.Error(t, err)
+	assert.False(t, svc.Status().Persistent)
+}
+
 func TestClusterRebalance(t *testing.T) {
 	// Create mock PeerStore
 	mockStore := &peerStore.MockIPeerStore{}
-	mockStore.On("SnapshotOfPeers").Return(map[string]time.Time{
-		"node1": time.Now(),
-		"node2": time.Now().Add(-10 * time.Second), // should be removed
-	})
-	mockStore.On("RemovePeer", "node2").Return()
+	mockStore.On("SuspectByPhi", 12.0).Return([]string{"node1"})
+	mockStore.On("ExpireSuspects", SuspicionTimeout).Return([]string{"node2"})
+	mockStore.On("Members").Return([]pstore.Member{{ID: "node3", Addr: "10.0.0.3:8080", State: pstore.StateLeft}})
+	mockStore.On("PruneTombstones", TombstoneTimeout).Return([]string{"node3"})
 
 	// Create dummy client and counter
 	mockClient := &client.MockIClient{}
-	counter := counter.NewCounter()
+	counters := counter.NewCounters("self")
 
 	// Create PeerService with mockStore
-	svc := NewPeerService("self", mockStore, mockClient, counter)
+	svc := NewPeerService("self", mockStore, mockClient, counters)
+	svc.PhiThreshold = 12
+	svc.Breakers = pClient.NewBreakers(5, time.Minute)
+	svc.Breakers.Failure("10.0.0.3:8080")
+	svc.Pending["node3"] = []*PendingEvent{{Event: counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 1}}}
+	svc.resync["node3"] = true
 
 	// Start cleanup with short interval for testing
 	go svc.StartCleanup(10 * time.Millisecond)
@@ -234,7 +605,811 @@ func TestClusterRebalance(t *testing.T) {
 	// Wait briefly to allow cleanup goroutine to run
 	time.Sleep(50 * time.Millisecond)
 
-	// Assert RemovePeer was called for node2
-	mockStore.AssertCalled(t, "RemovePeer", "node2")
-	mockStore.AssertNotCalled(t, "RemovePeer", "node1")
+	// Suspects become dead and tombstones are kept, nothing is removed outright
+	mockStore.AssertCalled(t, "SuspectByPhi", 12.0)
+	mockStore.AssertCalled(t, "ExpireSuspects", SuspicionTimeout)
+	mockStore.AssertCalled(t, "PruneTombstones", TombstoneTimeout)
+	mockStore.AssertNotCalled(t, "RemovePeer", mock.Anything)
+
+	// The queue, state sync mark and circuit of a pruned member go with it
+	assert.Empty(t, svc.BreakerStates())
+	assert.Empty(t, svc.Resyncing())
+	svc.PMutex.Lock()
+	assert.NotContains(t, svc.Pending, "node3")
+	svc.PMutex.Unlock()
+}
+
+func TestProbe_DirectAck(t *testing.T) {
+	mockStore := &peerStore.MockIPeerStore{}
+	mockClient := &client.MockIClient{}
+
+	mockStore.On("GetPeers").Return([]string{"peer1"})
+	mockStore.On("GetMember", "peer1").Return(pstore.Member{ID: "peer1", State: pstore.StateAlive, Incarnation: 3}, true)
+	mockStore.On("SelfAddr").Return("self")
+	mockStore.On("SelfMeta").Return(pstore.Meta{})
+	mockStore.On("SelfIncarnation").Return(uint64(1))
+	mockStore.On("Broadcasts", MaxPiggyback).Return([]pstore.Update(nil))
+	mockStore.On("Alive", "peer1", "peer1", uint64(3), pstore.Meta{}).Return()
+	mockClient.On("Heartbeat", "peer1", "self", pClient.Ping{Addr: "self", Incarnation: 1, TargetIncarnation: 3}).Return(pClient.Ack{NodeId: "peer1", Incarnation: 3}, nil)
+
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	svc.probe(3)
+
+	mockStore.AssertCalled(t, "Alive", "peer1", "peer1", uint64(3), pstore.Meta{})
+	mockClient.AssertNotCalled(t, "PingReq", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPing_RejectsAckFromAnotherNode(t *testing.T) {
+	mockStore := &peerStore.MockIPeerStore{}
+	mockClient := &client.MockIClient{}
+
+	mockStore.On("SelfAddr").Return("localhost:8001")
+	mockStore.On("SelfMeta").Return(pstore.Meta{})
+	mockStore.On("SelfIncarnation").Return(uint64(1))
+	mockStore.On("Broadcasts", MaxPiggyback).Return([]pstore.Update(nil))
+
+	// peer1 moved away and another node now listens on its old address
+	mockClient.On("Heartbeat", "localhost:8002", "self", mock.Anything).Return(pClient.Ack{NodeId: "peer9", Incarnation: 2}, nil)
+
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	_, err := svc.Ping("peer1", "localhost:8002", pClient.Ping{})
+
+	assert.Error(t, err)
+	mockStore.AssertNotCalled(t, "Alive", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestProbe_IndirectAck(t *testing.T) {
+	mockStore := &peerStore.MockIPeerStore{}
+	mockClient := &client.MockIClient{}
+
+	mockStore.On("GetPeers").Return([]string{"peer1", "peer2", "peer3"})
+	mockStore.On("GetMember", "peer1").Return(pstore.Member{ID: "peer1", State: pstore.StateAlive, Incarnation: 3}, true)
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+	mockStore.On("SelfAddr").Return("self")
+	mockStore.On("SelfMeta").Return(pstore.Meta{})
+	mockStore.On("SelfIncarnation").Return(uint64(1))
+	mockStore.On("Broadcasts", MaxPiggyback).Return([]pstore.Update(nil))
+	mockStore.On("Alive", "peer1", "peer1", uint64(3), pstore.Meta{}).Return()
+
+	// Only peer1 is unreachable from here, but the others can still see it
+	mockClient.On("Heartbeat", "peer1", "self", mock.Anything).Return(pClient.Ack{}, errors.New("timeout"))
+	mockClient.On("PingReq", mock.Anything, "self", "peer1", "peer1", mock.Anything).Return(pClient.Ack{NodeId: "peer1", Incarnation: 3}, nil)
+
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	svc.probeOrder = []string{"peer1"}
+	svc.probe(1)
+
+	mockStore.AssertCalled(t, "Alive", "peer1", "peer1", uint64(3), pstore.Meta{})
+	mockStore.AssertNotCalled(t, "SuspectPeer", mock.Anything)
+	mockClient.AssertNumberOfCalls(t, "PingReq", 1)
+}
+
+func TestProbe_SuspectsAfterIndirectFailure(t *testing.T) {
+	mockStore := &peerStore.MockIPeerStore{}
+	mockClient := &client.MockIClient{}
+
+	mockStore.On("GetPeers").Return([]string{"peer1", "peer2", "peer3"})
+	mockStore.On("GetMember", "peer1").Return(pstore.Member{ID: "peer1", State: pstore.StateAlive}, true)
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+	mockStore.On("SelfAddr").Return("self")
+	mockStore.On("SelfMeta").Return(pstore.Meta{})
+	mockStore.On("SelfIncarnation").Return(uint64(1))
+	mockStore.On("Broadcasts", MaxPiggyback).Return([]pstore.Update(nil))
+	mockStore.On("SuspectPeer", "peer1").Return()
+
+	mockClient.On("Heartbeat", "peer1", "self", mock.Anything).Return(pClient.Ack{}, errors.New("timeout"))
+	mockClient.On("PingReq", "peer2", "self", "peer1", "peer1", mock.Anything).Return(pClient.Ack{}, errors.New("no ack"))
+	mockClient.On("PingReq", "peer3", "self", "peer1", "peer1", mock.Anything).Return(pClient.Ack{}, errors.New("no ack"))
+
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	svc.probeOrder = []string{"peer1"}
+	svc.probe(3)
+
+	mockStore.AssertCalled(t, "SuspectPeer", "peer1")
+	mockStore.AssertNotCalled(t, "Alive", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	mockClient.AssertNumberOfCalls(t, "PingReq", 2)
+}
+
+func TestProbe_SuspectRefutes(t *testing.T) {
+	store := pstore.NewPeerStore("self", "self")
+	store.Alive("peer1", "peer1", 3, pstore.Meta{})
+	store.SuspectPeer("peer1")
+
+	remote := pstore.NewPeerStore("peer1", "peer1")
+	remote.Incarnation = 3
+
+	mockClient := &client.MockIClient{}
+	svc := NewPeerService("self", store, mockClient, counter.NewCounters("self"))
+	target := NewPeerService("peer1", remote, &client.MockIClient{}, counter.NewCounters("peer1"))
+
+	// Deliver the probe straight to the suspected node
+	mockClient.On("Heartbeat", "peer1", "self", mock.Anything).Return(func(_, from string, ping pClient.Ping) (pClient.Ack, error) {
+		assert.True(t, ping.Suspected)
+		return target.Ack(from, ping), nil
+	})
+
+	svc.probeOrder = []string{"peer1"}
+	svc.probe(3)
+
+	member, _ := store.GetMember("peer1")
+	assert.Equal(t, pstore.StateAlive, member.State)
+	assert.Equal(t, uint64(4), member.Incarnation)
+	assert.Equal(t, uint64(4), remote.SelfIncarnation())
+}
+
+func TestProbe_ExchangesMeta(t *testing.T) {
+	store := pstore.NewPeerStore("self", "self")
+	store.Meta = pstore.Meta{Tags: map[string]string{"role": "api"}}
+	store.Alive("peer1", "peer1", 3, pstore.Meta{})
+
+	remote := pstore.NewPeerStore("peer1", "peer1")
+	remote.Incarnation = 3
+	remote.Meta = pstore.Meta{Tags: map[string]string{"role": "db"}, Version: "1.2.0"}
+
+	mockClient := &client.MockIClient{}
+	svc := NewPeerService("self", store, mockClient, counter.NewCounters("self"))
+	target := NewPeerService("peer1", remote, &client.MockIClient{}, counter.NewCounters("peer1"))
+
+	mockClient.On("Heartbeat", "peer1", "self", mock.Anything).Return(func(_, from string, ping pClient.Ping) (pClient.Ack, error) {
+		return target.Ack(from, ping), nil
+	})
+
+	svc.probeOrder = []string{"peer1"}
+	svc.probe(3)
+
+	// Each side learns the other's metadata from one probe
+	member, _ := store.GetMember("peer1")
+	assert.Equal(t, "db", member.Meta.Tags["role"])
+	assert.Equal(t, "1.2.0", member.Meta.Version)
+
+	prober, _ := remote.GetMember("self")
+	assert.Equal(t, "api", prober.Meta.Tags["role"])
+}
+
+func TestNextProbeTarget_VisitsEveryMember(t *testing.T) {
+	mockStore := &peerStore.MockIPeerStore{}
+	mockStore.On("GetPeers").Return([]string{"peer1", "peer2", "peer3"})
+
+	svc := NewPeerService("self", mockStore, &client.MockIClient{}, counter.NewCounters("self"))
+
+	var round []string
+	for i := 0; i < 3; i++ {
+		round = append(round, svc.nextProbeTarget())
+	}
+	assert.ElementsMatch(t, []string{"peer1", "peer2", "peer3"}, round)
+}
+
+func TestGossip_SpreadsJoinsFromAnySeed(t *testing.T) {
+	nodes := make(map[string]*PeerService)
+	for _, id := range []string{"node1", "node2", "node3", "node4"} {
+		mockClient := &client.MockIClient{}
+		mockClient.On("Gossip", mock.Anything, id, mock.Anything).Return(func(peer, from string, updates []pstore.Update) error {
+			nodes[peer].Gossip(from, updates)
+			return nil
+		})
+		nodes[id] = NewPeerService(id, pstore.NewPeerStore(id, id), mockClient, counter.NewCounters(id))
+	}
+
+	// node1-node3 form a cluster, node4 joins through node3 only
+	for _, a := range []string{"node1", "node2", "node3"} {
+		for _, b := range []string{"node1", "node2", "node3"} {
+			nodes[a].PStore.Alive(b, b, 1, pstore.Meta{})
+		}
+	}
+	nodes["node3"].PStore.Alive("node4", "node4", 1, pstore.Meta{})
+	nodes["node4"].PStore.AddPeer("node3")
+
+	assert.Eventually(t, func() bool {
+		for _, n := range nodes {
+			n.gossip(3)
+		}
+		_, ok1 := nodes["node1"].PStore.GetMember("node4")
+		_, ok2 := nodes["node2"].PStore.GetMember("node4")
+		return ok1 && ok2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPeerLeft_DropsPendingEvents(t *testing.T) {
+	dir := t.TempDir()
+
+	store := pstore.NewPeerStore("self", "self")
+	store.Alive("peer1", "peer1", 3, pstore.Meta{})
+	mockClient := &client.MockIClient{}
+
+	eventLog, err := wal.Open(dir, wal.DefaultSegmentSize)
+	assert.NoError(t, err)
+
+	svc := NewPeerService("self", store, mockClient, counter.NewCounters("self"))
+	assert.NoError(t, svc.Restore(eventLog))
+
+	event := counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 1}
+	mockClient.On("SendIncrements", "peer1", "self", mock.Anything).Return(nil, unreachable("peer1"))
+	svc.sendBatch("peer1", []counter.Event{event})
+	assert.Len(t, svc.Pending["peer1"], 1)
+	svc.Breakers = pClient.NewBreakers(5, time.Minute)
+	svc.Breakers.Failure("peer1")
+
+	svc.PeerLeft("peer1", 3)
+
+	member, _ := store.GetMember("peer1")
+	assert.Equal(t, pstore.StateLeft, member.State)
+	assert.NotContains(t, svc.Pending, "peer1")
+	assert.NotContains(t, store.GetPeers(), "peer1")
+	assert.Empty(t, svc.BreakerStates())
+
+	// Late failures for the departed peer are not queued again
+	svc.sendBatch("peer1", []counter.Event{{Counter: "orders", Origin: "self", Seq: 2, Delta: 1}})
+	assert.NotContains(t, svc.Pending, "peer1")
+	assert.NoError(t, eventLog.Close())
+
+	// The drop survives a restart
+	eventLog, err = wal.Open(dir, wal.DefaultSegmentSize)
+	assert.NoError(t, err)
+
+	restarted := NewPeerService("self", pstore.NewPeerStore("self", "self"), mockClient, counter.NewCounters("self"))
+	assert.NoError(t, restarted.Restore(eventLog))
+	assert.Empty(t, restarted.Pending)
+}
+
+func TestLeave_AnnouncesAndHandsOffPending(t *testing.T) {
+	mockStore := &peerStore.MockIPeerStore{}
+	mockClient := &client.MockIClient{}
+
+	mockStore.On("SelfIncarnation").Return(uint64(7))
+	mockStore.On("GetPeers").Return([]string{"peer1", "peer2"})
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+	mockClient.On("Leave", mock.Anything, "self", uint64(7)).Return(nil)
+
+	// peer1 is unreachable, so its event is handed to peer2
+	event := counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 1}
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{event}).Return(nil, unreachable("peer1"))
+	mockClient.On("SendIncrements", "peer2", "self", []counter.Event{event}).
+		Return([]pClient.ReplicateResult{{Status: pClient.ReplicateApplied}}, nil)
+
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	svc.Pending["peer1"] = []*PendingEvent{{Event: event}}
+	svc.backoff["peer1"] = &peerBackoff{Failures: 5, RetryAt: time.Now().Add(time.Hour)}
+
+	svc.Leave()
+
+	mockClient.AssertCalled(t, "Leave", "peer1", "self", uint64(7))
+	mockClient.AssertCalled(t, "Leave", "peer2", "self", uint64(7))
+	mockClient.AssertCalled(t, "SendIncrements", "peer2", "self", []counter.Event{event})
+	assert.Empty(t, svc.Pending)
+}
+
+func TestLeave_KeepsEventsAPeerAlreadyHad(t *testing.T) {
+	mockStore := &peerStore.MockIPeerStore{}
+	mockClient := &client.MockIClient{}
+
+	mockStore.On("SelfIncarnation").Return(uint64(7))
+	mockStore.On("GetPeers").Return([]string{"peer1", "peer2"})
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+	mockClient.On("Leave", mock.Anything, "self", uint64(7)).Return(nil)
+
+	// peer2 already has the event, so it would never send it on to peer1
+	event := counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 1}
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{event}).Return(nil, unreachable("peer1"))
+	mockClient.On("SendIncrements", "peer2", "self", []counter.Event{event}).
+		Return([]pClient.ReplicateResult{{Status: pClient.ReplicateDuplicate}}, nil)
+
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	svc.Pending["peer1"] = []*PendingEvent{{Event: event}}
+
+	svc.Leave()
+
+	assert.Len(t, svc.Pending["peer1"], 1)
+}
+
+func TestLeave_FlushesInBatches(t *testing.T) {
+	mockStore := &peerStore.MockIPeerStore{}
+	mockClient := &client.MockIClient{}
+
+	mockStore.On("SelfIncarnation").Return(uint64(7))
+	mockStore.On("GetPeers").Return([]string{"peer1", "peer2", "peer3"})
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+	mockClient.On("Leave", mock.Anything, "self", uint64(7)).Return(nil)
+
+	var events []counter.Event
+	for seq := uint64(1); seq <= 3; seq++ {
+		events = append(events, counter.Event{Counter: "orders", Origin: "self", Seq: seq, Delta: 1})
+	}
+	applied := []pClient.ReplicateResult{{Status: pClient.ReplicateApplied}, {Status: pClient.ReplicateApplied}}
+
+	// peer1 is only tried once, both batches are handed to peer2
+	mockClient.On("SendIncrements", "peer1", "self", events[:2]).Return(nil, unreachable("peer1"))
+	mockClient.On("SendIncrements", "peer2", "self", events[:2]).Return(applied, nil)
+	mockClient.On("SendIncrements", "peer2", "self", events[2:]).Return(applied[:1], nil)
+
+	// peer3 refuses its event for good
+	malformed := &pClient.Error{Kind: pClient.ErrMalformed, Peer: "peer3", Op: "/counter/replicate/batch", Err: errors.New("invalid character '<' looking for beginning of value")}
+	mockClient.On("SendIncrements", "peer3", "self", events[:1]).Return(nil, malformed)
+
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	svc.BatchSize = 2
+	for _, e := range events {
+		svc.Pending["peer1"] = append(svc.Pending["peer1"], &PendingEvent{Event: e})
+	}
+	svc.Pending["peer3"] = []*PendingEvent{{Event: events[0]}}
+
+	svc.Leave()
+
+	mockClient.AssertNumberOfCalls(t, "SendIncrements", 4)
+	assert.Empty(t, svc.Pending)
+	assert.Equal(t, []string{"peer3"}, svc.Resyncing())
+	assert.Len(t, svc.ListDeadLetters(), 1)
+}
+
+func TestRegister_ReplicatesAcrossCluster(t *testing.T) {
+	nodes := make(map[string]*PeerService)
+	ids := []string{"node1", "node2", "node3"}
+	for _, id := range ids {
+		mockClient := &client.MockIClient{}
+		mockClient.On("SendInstance", mock.Anything, id, mock.Anything).Return(func(peer, _ string, inst registry.Instance) error {
+			nodes[peer].ReplicateInstance(inst)
+			return nil
+		})
+		nodes[id] = NewPeerService(id, pstore.NewPeerStore(id, id), mockClient, counter.NewCounters(id))
+	}
+	for _, a := range ids {
+		for _, b := range ids {
+			nodes[a].PStore.Alive(b, b, 1, pstore.Meta{})
+		}
+	}
+
+	nodes["node1"].Register(registry.Instance{Service: "api", ID: "api-1", Address: "10.0.0.1", Port: 80, TTL: 10})
+
+	assert.Eventually(t, func() bool {
+		return len(nodes["node2"].Instances("api")) == 1 && len(nodes["node3"].Instances("api")) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	// A deregistration through another node reaches the origin too
+	assert.True(t, nodes["node3"].Deregister("api", "api-1"))
+	assert.Eventually(t, func() bool {
+		return len(nodes["node1"].Instances("api")) == 0 && len(nodes["node2"].Instances("api")) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, nodes["node3"].Deregister("api", "api-1"))
+}
+
+func TestReplicateInstance_IgnoresStaleWrites(t *testing.T) {
+	mockStore := &peerStore.MockIPeerStore{}
+	mockClient := &client.MockIClient{}
+	mockStore.On("GetPeers").Return([]string{})
+
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	inst := registry.Instance{Service: "api", ID: "api-1", TTL: 10, Version: 2, Origin: "peer1"}
+
+	assert.NoError(t, svc.ReplicateInstance(inst))
+	assert.Error(t, svc.ReplicateInstance(inst))
+	mockClient.AssertNotCalled(t, "SendInstance", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCheckOwner_AgreesAcrossNodes(t *testing.T) {
+	ids := []string{"node1", "node2", "node3"}
+	nodes := make(map[string]*PeerService)
+	for _, id := range ids {
+		nodes[id] = NewPeerService(id, pstore.NewPeerStore(id, id), &client.MockIClient{}, counter.NewCounters(id))
+		for _, other := range ids {
+			nodes[id].PStore.Alive(other, other, 1, pstore.Meta{})
+		}
+	}
+
+	owner := nodes["node1"].checkOwner("api/api-1")
+	for _, id := range ids {
+		assert.Equal(t, owner, nodes[id].checkOwner("api/api-1"))
+	}
+
+	// When the owner is gone the others agree on a new one
+	for _, id := range ids {
+		if id != owner {
+			nodes[id].PStore.Apply(pstore.Update{ID: owner, State: pstore.StateDead, Incarnation: 1})
+		}
+	}
+	var next []string
+	for _, id := range ids {
+		if id != owner {
+			next = append(next, nodes[id].checkOwner("api/api-1"))
+		}
+	}
+	assert.NotEqual(t, owner, next[0])
+	assert.Equal(t, next[0], next[1])
+}
+
+func TestHealthChecks_OwnerReplicatesStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ids := []string{"node1", "node2"}
+	nodes := make(map[string]*PeerService)
+	for _, id := range ids {
+		mockClient := &client.MockIClient{}
+		mockClient.On("SendInstance", mock.Anything, id, mock.Anything).Return(func(peer, _ string, inst registry.Instance) error {
+			nodes[peer].ReplicateInstance(inst)
+			return nil
+		})
+		nodes[id] = NewPeerService(id, pstore.NewPeerStore(id, id), mockClient, counter.NewCounters(id))
+	}
+	for _, a := range ids {
+		for _, b := range ids {
+			nodes[a].PStore.Alive(b, b, 1, pstore.Meta{})
+		}
+	}
+
+	inst := nodes["node1"].Register(registry.Instance{Service: "api", ID: "api-1", TTL: 10, Check: &registry.Check{HTTP: server.URL}})
+	assert.Equal(t, registry.HealthCritical, inst.Health.Status)
+	assert.Eventually(t, func() bool { return len(nodes["node2"].Instances("api")) == 1 }, time.Second, 10*time.Millisecond)
+
+	for _, n := range nodes {
+		n.runHealthChecks()
+	}
+
+	owner := nodes["node1"].checkOwner("api/api-1")
+	assert.Eventually(t, func() bool {
+		for _, n := range nodes {
+			if h := n.Instances("api")[0].Health; h.Status != registry.HealthPassing || h.CheckedBy != owner {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestSendBatch_PublishesFailure(t *testing.T) {
+	mockClient := &client.MockIClient{}
+	mockStore := &peerStore.MockIPeerStore{}
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+	service := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	sub := service.Subscribe()
+	defer service.Unsubscribe(sub)
+
+	event := counter.Event{Counter: "orders", Origin: "self", Seq: 4, Delta: 1}
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{event}).Return(nil, unreachable("peer1"))
+
+	service.sendBatch("peer1", []counter.Event{event})
+	service.deliverPending("peer1")
+
+	first, second := <-sub.C, <-sub.C
+	assert.Equal(t, events.ReplicationFailed, first.Type)
+	assert.Equal(t, events.ReplicationData{Peer: "peer1", Counter: "orders", Origin: "self", Seq: 4, Attempt: 0, Error: unreachable("peer1").Error()}, first.Data)
+	assert.Equal(t, 1, second.Data.(events.ReplicationData).Attempt)
+}
+
+func TestPropagate_BatchesPerPeer(t *testing.T) {
+	mockClient := &client.MockIClient{}
+	mockStore := &peerStore.MockIPeerStore{}
+	mockStore.On("GetPeers").Return([]string{"peer1"})
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	svc.BatchSize = 2
+	svc.BatchLinger = time.Hour
+
+	event := func(seq uint64) counter.Event {
+		return counter.Event{Counter: "orders", Origin: "self", Seq: seq, Delta: 1}
+	}
+	full := make(chan bool, 1)
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{event(1), event(2)}).
+		Return([]pClient.ReplicateResult{{Status: pClient.ReplicateApplied}, {Status: pClient.ReplicateDuplicate}}, nil).
+		Run(func(args mock.Arguments) { full <- true })
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{event(3)}).
+		Return([]pClient.ReplicateResult{{Status: pClient.ReplicateApplied}}, nil)
+
+	for i := 0; i < 3; i++ {
+		svc.Increment("orders", 1)
+	}
+
+	// A full batch goes out without waiting for the linger time
+	select {
+	case <-full:
+	case <-time.After(time.Second):
+		t.Fatal("full batch was not sent")
+	}
+
+	// Leaving sends what is still waiting
+	svc.drainBatchers()
+	mockClient.AssertNumberOfCalls(t, "SendIncrements", 2)
+	assert.Empty(t, svc.Pending)
+
+	// Once drained, events go to the retry queue
+	svc.propagate(event(4))
+	assert.Len(t, svc.Pending["peer1"], 1)
+}
+
+func TestEnqueue_DeadLettersOverflowAndResyncs(t *testing.T) {
+	dir := t.TempDir()
+
+	store := pstore.NewPeerStore("self", "self")
+	store.Alive("peer1", "peer1", 1, pstore.Meta{})
+	mockClient := &client.MockIClient{}
+
+	eventLog, err := wal.Open(dir, wal.DefaultSegmentSize)
+	assert.NoError(t, err)
+
+	svc := NewPeerService("self", store, mockClient, counter.NewCounters("self"))
+	svc.MaxPendingPerPeer = 2
+	assert.NoError(t, svc.Restore(eventLog))
+
+	for seq := uint64(1); seq <= 3; seq++ {
+		svc.enqueue("peer1", counter.Event{Counter: "orders", Origin: "self", Seq: seq, Delta: 1})
+	}
+
+	// The third event overflowed the queue, and the peer is owed a state sync
+	assert.NotContains(t, svc.Pending, "peer1")
+	assert.Len(t, svc.ListDeadLetters(), 3)
+	assert.Equal(t, []string{"peer1"}, svc.Resyncing())
+
+	// Three enqueues, then one record for the dead letters and one for the mark
+	assert.Equal(t, uint64(5), eventLog.LastLSN())
+
+	// Later events wait for the sync instead of queuing
+	svc.enqueue("peer1", counter.Event{Counter: "orders", Origin: "self", Seq: 4, Delta: 1})
+	assert.NotContains(t, svc.Pending, "peer1")
+	assert.NoError(t, eventLog.Close())
+
+	// Dead letters survive a restart
+	eventLog, err = wal.Open(dir, wal.DefaultSegmentSize)
+	assert.NoError(t, err)
+	restarted := NewPeerService("self", store, mockClient, counter.NewCounters("self"))
+	assert.NoError(t, restarted.Restore(eventLog))
+	restored := restarted.ListDeadLetters()
+	if assert.Len(t, restored, 3) {
+		assert.Equal(t, uint64(3), restored[2].ID)
+		assert.Equal(t, uint64(3), restored[2].Event.Seq)
+	}
+	assert.Equal(t, []string{"peer1"}, restarted.Resyncing())
+
+	// A failed sync is tried again, a successful one clears the mark
+	mockClient.On("SyncDigest", "peer1", "self", mock.Anything).Return(pClient.SyncResponse{}, errors.New("network error")).Once()
+	restarted.resyncPeers()
+	assert.Equal(t, []string{"peer1"}, restarted.Resyncing())
+
+	mockClient.On("SyncDigest", "peer1", "self", mock.Anything).Return(pClient.SyncResponse{}, nil)
+	restarted.resyncPeers()
+	assert.Empty(t, restarted.Resyncing())
+	assert.Equal(t, 3, restarted.Status().DeadLetters)
+	assert.NoError(t, eventLog.Close())
+
+	// So does the sync having gone through
+	eventLog, err = wal.Open(dir, wal.DefaultSegmentSize)
+	assert.NoError(t, err)
+	restarted = NewPeerService("self", store, mockClient, counter.NewCounters("self"))
+	assert.NoError(t, restarted.Restore(eventLog))
+	assert.Empty(t, restarted.Resyncing())
+}
+
+func TestAbandon_JournalsResyncOfEmptyQueue(t *testing.T) {
+	dir := t.TempDir()
+	mockClient := &client.MockIClient{}
+	mockStore := &peerStore.MockIPeerStore{}
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+
+	eventLog, err := wal.Open(dir, wal.DefaultSegmentSize)
+	assert.NoError(t, err)
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	assert.NoError(t, svc.Restore(eventLog))
+
+	// Refused while nothing else was queued for the peer
+	refused := &pClient.Error{Kind: pClient.ErrRejected, Peer: "peer1", Op: "/counter/replicate/batch", Status: http.StatusNotFound, Err: errors.New("404 page not found")}
+	svc.refused("peer1", nil, refused)
+	assert.Equal(t, []string{"peer1"}, svc.Resyncing())
+	assert.Empty(t, svc.ListDeadLetters())
+	assert.NoError(t, eventLog.Close())
+
+	eventLog, err = wal.Open(dir, wal.DefaultSegmentSize)
+	assert.NoError(t, err)
+	restarted := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	assert.NoError(t, restarted.Restore(eventLog))
+	assert.Equal(t, []string{"peer1"}, restarted.Resyncing())
+}
+
+func TestDeliverPending_DeadLettersExpiredAndReplays(t *testing.T) {
+	store := pstore.NewPeerStore("self", "self")
+	store.Alive("peer1", "peer1", 1, pstore.Meta{})
+	mockClient := &client.MockIClient{}
+
+	svc := NewPeerService("self", store, mockClient, counter.NewCounters("self"))
+	svc.MaxAttempts = 2
+
+	event := counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 1}
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{event}).Return(nil, unreachable("peer1"))
+	svc.enqueue("peer1", event)
+
+	svc.deliverPending("peer1")
+	svc.backoff["peer1"].RetryAt = time.Time{}
+	svc.deliverPending("peer1")
+	assert.Equal(t, 2, svc.Pending["peer1"][0].Attempt)
+
+	// The next pass gives up on it
+	assert.Zero(t, svc.deliverPending("peer1"))
+	letters := svc.ListDeadLetters()
+	if assert.Len(t, letters, 1) {
+		assert.Equal(t, event, letters[0].Event)
+		assert.Equal(t, 2, letters[0].Attempts)
+	}
+	assert.NotContains(t, svc.Pending, "peer1")
+
+	// An age limit works the same way
+	svc.MaxAttempts = DefaultMaxAttempts
+	svc.MaxPendingAge = time.Minute
+	svc.requeue("peer2", event, time.Now().Add(-2*time.Minute))
+	svc.deliverPending("peer2")
+	assert.Len(t, svc.ListDeadLetters(), 2)
+
+	// Only letters for peers still around are replayed
+	result := svc.ReplayDeadLetters(nil)
+	assert.Equal(t, ReplayResult{Requeued: 1, Skipped: 1}, result)
+	assert.Len(t, svc.Pending["peer1"], 1)
+	if letters := svc.ListDeadLetters(); assert.Len(t, letters, 1) {
+		assert.Equal(t, "peer2", letters[0].Peer)
+	}
+}
+
+func TestDeliverPending_BacksOffPerPeer(t *testing.T) {
+	mockStore := &peerStore.MockIPeerStore{}
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+	mockClient := &client.MockIClient{}
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	svc.BatchSize = 2
+
+	var queued []counter.Event
+	for seq := uint64(1); seq <= 3; seq++ {
+		queued = append(queued, counter.Event{Counter: "orders", Origin: "self", Seq: seq, Delta: 1})
+		svc.enqueue("peer1", queued[seq-1])
+	}
+
+	// One failed request holds off the whole queue, not just its events
+	mockClient.On("SendIncrements", "peer1", "self", queued[:2]).Return(nil, unreachable("peer1")).Once()
+	assert.Equal(t, MinRetryDelay, svc.deliverPending("peer1"))
+	assert.Positive(t, svc.deliverPending("peer1"))
+	mockClient.AssertNumberOfCalls(t, "SendIncrements", 1)
+	assert.Equal(t, []int{1, 1, 0}, []int{svc.Pending["peer1"][0].Attempt, svc.Pending["peer1"][1].Attempt, svc.Pending["peer1"][2].Attempt})
+
+	// The delay doubles with every failure in a row
+	svc.backoff["peer1"].RetryAt = time.Time{}
+	mockClient.On("SendIncrements", "peer1", "self", queued[:2]).Return(nil, unreachable("peer1")).Once()
+	assert.Equal(t, 2*MinRetryDelay, svc.deliverPending("peer1"))
+
+	// Once the peer answers, the queue is sent batch by batch
+	svc.backoff["peer1"].RetryAt = time.Time{}
+	applied := pClient.ReplicateResult{Status: pClient.ReplicateApplied}
+	mockClient.On("SendIncrements", "peer1", "self", queued[:2]).Return([]pClient.ReplicateResult{applied, applied}, nil).Once()
+	mockClient.On("SendIncrements", "peer1", "self", queued[2:]).Return([]pClient.ReplicateResult{applied}, nil).Once()
+	assert.Zero(t, svc.deliverPending("peer1"))
+	assert.Empty(t, svc.Pending)
+	assert.Empty(t, svc.backoff)
+}
+
+func TestRetryLoop_SlowPeerDoesNotStallOthers(t *testing.T) {
+	mockClient := &client.MockIClient{}
+	svc := NewPeerService("self", pstore.NewPeerStore("self", "self"), mockClient, counter.NewCounters("self"))
+	svc.StartRetryLoop()
+
+	slow := counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 1}
+	fast := counter.Event{Counter: "orders", Origin: "self", Seq: 2, Delta: 1}
+	applied := []pClient.ReplicateResult{{Status: pClient.ReplicateApplied}}
+
+	// peer1 hangs until released
+	calling, release := make(chan bool, 1), make(chan bool)
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{slow}).
+		Return(applied, nil).
+		Run(func(args mock.Arguments) {
+			calling <- true
+			<-release
+		})
+	mockClient.On("SendIncrements", "peer2", "self", []counter.Event{fast}).Return(applied, nil)
+
+	svc.enqueue("peer1", slow)
+	select {
+	case <-calling:
+	case <-time.After(time.Second):
+		t.Fatal("peer1 was never called")
+	}
+
+	// Queuing is not blocked, and peer2 gets its event meanwhile
+	svc.enqueue("peer2", fast)
+	assert.Eventually(t, func() bool {
+		svc.PMutex.Lock()
+		defer svc.PMutex.Unlock()
+		return len(svc.Pending["peer2"]) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	close(release)
+	assert.Eventually(t, func() bool {
+		svc.PMutex.Lock()
+		defer svc.PMutex.Unlock()
+		return len(svc.Pending) == 0 && len(svc.workers) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestOpenCircuit_QueuesDirectly(t *testing.T) {
+	mockStore := &peerStore.MockIPeerStore{}
+	mockStore.On("GetPeers").Return([]string{"peer1", "peer2"})
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+	mockClient := &client.MockIClient{}
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+	svc.Breakers = pClient.NewBreakers(1, time.Hour)
+	svc.BatchLinger = time.Hour
+	svc.Breakers.Failure("peer1")
+
+	// The event for peer1 skips its batcher
+	event := counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 1}
+	svc.propagate(event)
+	assert.Len(t, svc.Pending["peer1"], 1)
+	assert.NotContains(t, svc.batchers, "peer1")
+	assert.Contains(t, svc.batchers, "peer2")
+
+	// and waits out the circuit rather than being sent
+	wait := svc.deliverPending("peer1")
+	assert.InDelta(t, time.Hour, wait, float64(time.Second))
+	mockClient.AssertNotCalled(t, "SendIncrements", "peer1", mock.Anything, mock.Anything)
+
+	// Fan-out leaves the peer out
+	assert.Equal(t, []string{"peer2"}, svc.reachable(svc.GetPeersList()))
+	if states := svc.BreakerStates(); assert.Len(t, states, 1) {
+		assert.Equal(t, pClient.BreakerOpen, states[0].State)
+	}
+}
+
+func TestSendBatch_DeadLettersRefusedEvents(t *testing.T) {
+	mockClient := &client.MockIClient{}
+	mockStore := &peerStore.MockIPeerStore{}
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+
+	queued := counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 1}
+	svc.enqueue("peer1", queued)
+
+	// A peer that refuses the request will not take it on a retry either
+	event := counter.Event{Counter: "orders", Origin: "self", Seq: 2, Delta: 1}
+	refused := &pClient.Error{Kind: pClient.ErrRejected, Peer: "peer1", Op: "/counter/replicate/batch", Status: http.StatusNotFound, Err: errors.New("404 page not found")}
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{event}).Return(nil, refused)
+	svc.sendBatch("peer1", []counter.Event{event})
+
+	assert.NotContains(t, svc.Pending, "peer1")
+	assert.Len(t, svc.ListDeadLetters(), 2)
+	assert.Equal(t, []string{"peer1"}, svc.Resyncing())
+}
+
+func TestSendBatch_ResyncsPeerThatRejectsEvents(t *testing.T) {
+	mockClient := &client.MockIClient{}
+	mockStore := &peerStore.MockIPeerStore{}
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+
+	// The peer is too far behind to take the second event
+	batch := []counter.Event{
+		{Counter: "orders", Origin: "self", Seq: 1, Delta: 1},
+		{Counter: "orders", Origin: "self", Seq: 2, Delta: 1},
+	}
+	mockClient.On("SendIncrements", "peer1", "self", batch).Return([]pClient.ReplicateResult{
+		{Status: pClient.ReplicateApplied},
+		{Status: pClient.ReplicateRejected, Error: counter.ErrTooFarAhead.Error()},
+	}, nil)
+	svc.sendBatch("peer1", batch)
+
+	if letters := svc.ListDeadLetters(); assert.Len(t, letters, 1) {
+		assert.Equal(t, batch[1], letters[0].Event)
+		assert.Equal(t, counter.ErrTooFarAhead.Error(), letters[0].Reason)
+	}
+	assert.Equal(t, []string{"peer1"}, svc.Resyncing())
+}
+
+func TestDeliverPending_AbandonsRefusedQueue(t *testing.T) {
+	mockClient := &client.MockIClient{}
+	mockStore := &peerStore.MockIPeerStore{}
+	mockStore.On("GetMember", mock.Anything).Return(pstore.Member{}, false)
+	svc := NewPeerService("self", mockStore, mockClient, counter.NewCounters("self"))
+
+	event := counter.Event{Counter: "orders", Origin: "self", Seq: 1, Delta: 1}
+	svc.enqueue("peer1", event)
+	malformed := &pClient.Error{Kind: pClient.ErrMalformed, Peer: "peer1", Op: "/counter/replicate/batch", Err: errors.New("invalid character '<' looking for beginning of value")}
+	mockClient.On("SendIncrements", "peer1", "self", []counter.Event{event}).Return(nil, malformed)
+
+	assert.Zero(t, svc.deliverPending("peer1"))
+	assert.NotContains(t, svc.Pending, "peer1")
+	assert.NotContains(t, svc.backoff, "peer1")
+	if letters := svc.ListDeadLetters(); assert.Len(t, letters, 1) {
+		assert.Equal(t, malformed.Error(), letters[0].Reason)
+	}
 }
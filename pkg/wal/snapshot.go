@@ -0,0 +1,180 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	snapshotExt = ".snap"
+
+	// A snapshot starts with the LSN it covers and a CRC32-C of its payload.
+	snapshotHeaderSize = 12
+)
+
+// ErrGap is returned by LoadSnapshot when the records between the newest
+// valid snapshot and the oldest segment are gone, because a newer snapshot
+// that covered them was compacted and then lost.
+var ErrGap = errors.New("wal: records between the snapshot and the log are missing")
+
+func snapshotName(lsn uint64) string {
+	return fmt.Sprintf("%020d%s", lsn, snapshotExt)
+}
+
+func (w *WAL) listSnapshots() ([]uint64, error) {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var lsns []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, snapshotExt) {
+			continue
+		}
+		lsn, err := strconv.ParseUint(strings.TrimSuffix(name, snapshotExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		lsns = append(lsns, lsn)
+	}
+
+	sort.Slice(lsns, func(i, j int) bool { return lsns[i] > lsns[j] })
+	return lsns, nil
+}
+
+// WriteSnapshot atomically stores data as the state of the log up to and
+// including lsn, and removes older snapshots.
+func (w *WAL) WriteSnapshot(lsn uint64, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	buf := make([]byte, snapshotHeaderSize+len(data))
+	binary.LittleEndian.PutUint64(buf[0:8], lsn)
+	binary.LittleEndian.PutUint32(buf[8:12], crc32.Checksum(data, crcTable))
+	copy(buf[snapshotHeaderSize:], data)
+
+	path := filepath.Join(w.dir, snapshotName(lsn))
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(buf); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		return err
+	}
+
+	// Older snapshots, and the segments a caller compacts next, are only
+	// let go once this one reads back intact
+	if _, err := readSnapshot(path, lsn); err != nil {
+		return err
+	}
+
+	lsns, err := w.listSnapshots()
+	if err != nil {
+		return err
+	}
+	for _, old := range lsns {
+		if old < lsn {
+			os.Remove(filepath.Join(w.dir, snapshotName(old)))
+		}
+	}
+	return nil
+}
+
+// readSnapshot reads the snapshot at path and checks it covers lsn and
+// matches its checksum.
+func readSnapshot(path string, lsn uint64) ([]byte, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < snapshotHeaderSize ||
+		binary.LittleEndian.Uint64(buf[0:8]) != lsn ||
+		crc32.Checksum(buf[snapshotHeaderSize:], crcTable) != binary.LittleEndian.Uint32(buf[8:12]) {
+		return nil, fmt.Errorf("wal: corrupt snapshot %s", path)
+	}
+	return buf[snapshotHeaderSize:], nil
+}
+
+// LoadSnapshot returns the newest valid snapshot and the LSN it covers, or
+// an LSN of zero if there is none. A corrupt snapshot is skipped for an older
+// one only if the log still holds every record after it; otherwise ErrGap is
+// returned rather than state with updates missing.
+func (w *WAL) LoadSnapshot() (uint64, []byte, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lsns, err := w.listSnapshots()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	var lsn uint64
+	var data []byte
+	for _, candidate := range lsns {
+		path := filepath.Join(w.dir, snapshotName(candidate))
+		data, err = readSnapshot(path, candidate)
+		if err != nil {
+			log.Println("skipping corrupt snapshot", path, err)
+			continue
+		}
+		lsn = candidate
+		break
+	}
+
+	if first := w.segments[0].first; first > lsn+1 {
+		return 0, nil, fmt.Errorf("%w: snapshot covers up to %d, log starts at %d", ErrGap, lsn, first)
+	}
+	if data == nil {
+		return 0, nil, nil
+	}
+	return lsn, data, nil
+}
+
+// Compact deletes every segment whose records are all covered by a snapshot
+// taken at lsn. The active segment is always kept.
+func (w *WAL) Compact(lsn uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	removed := 0
+	for removed < len(w.segments)-1 && w.segments[removed+1].first <= lsn+1 {
+		if err := os.Remove(w.segments[removed].path); err != nil {
+			return err
+		}
+		removed++
+	}
+
+	w.segments = w.segments[removed:]
+	if removed > 0 {
+		log.Println("compacted write-ahead log segments", removed)
+		return syncDir(w.dir)
+	}
+	return nil
+}
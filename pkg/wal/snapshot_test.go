@@ -0,0 +1,114 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotAndCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir, 10)
+	assert.NoError(t, err)
+	for _, record := range []string{"one", "two", "three", "four"} {
+		w.Append([]byte(record))
+	}
+
+	lsn := w.LastLSN()
+	assert.Equal(t, uint64(4), lsn)
+	assert.NoError(t, w.WriteSnapshot(3, []byte("state@3")))
+	assert.NoError(t, w.Compact(3))
+
+	// Only the segment holding record four is left
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	assert.Len(t, segments, 1)
+	assert.NoError(t, w.Close())
+
+	w, err = Open(dir, 10)
+	assert.NoError(t, err)
+
+	snapLSN, data, err := w.LoadSnapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), snapLSN)
+	assert.Equal(t, "state@3", string(data))
+
+	var replayed []string
+	w.Replay(snapLSN, func(lsn uint64, data []byte) error {
+		assert.Equal(t, uint64(4), lsn)
+		replayed = append(replayed, string(data))
+		return nil
+	})
+	assert.Equal(t, []string{"four"}, replayed)
+
+	// Numbering continues after the compacted records
+	lsn, _ = w.Append([]byte("five"))
+	assert.Equal(t, uint64(5), lsn)
+}
+
+func TestReplaySkipsRecordsInSameSegment(t *testing.T) {
+	w, _ := Open(t.TempDir(), DefaultSegmentSize)
+	for _, record := range []string{"one", "two", "three"} {
+		w.Append([]byte(record))
+	}
+
+	var replayed []string
+	w.Replay(2, func(_ uint64, data []byte) error {
+		replayed = append(replayed, string(data))
+		return nil
+	})
+	assert.Equal(t, []string{"three"}, replayed)
+}
+
+func TestLoadSnapshotSkipsCorrupt(t *testing.T) {
+	dir := t.TempDir()
+
+	w, _ := Open(dir, DefaultSegmentSize)
+	assert.NoError(t, w.WriteSnapshot(1, []byte("old")))
+
+	// Keep the old snapshot around, then corrupt the new one
+	old, _ := os.ReadFile(filepath.Join(dir, snapshotName(1)))
+	assert.NoError(t, w.WriteSnapshot(2, []byte("new")))
+	os.WriteFile(filepath.Join(dir, snapshotName(1)), old, 0o644)
+
+	path := filepath.Join(dir, snapshotName(2))
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	lsn, snapshot, err := w.LoadSnapshot()
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), lsn)
+	assert.Equal(t, "old", string(snapshot))
+}
+
+func TestLoadSnapshotRefusesGap(t *testing.T) {
+	dir := t.TempDir()
+
+	w, _ := Open(dir, 10)
+	for _, record := range []string{"one", "two", "three", "four"} {
+		w.Append([]byte(record))
+	}
+	assert.NoError(t, w.WriteSnapshot(3, []byte("state@3")))
+	assert.NoError(t, w.Compact(3))
+
+	// The only snapshot covering the compacted records is lost
+	path := filepath.Join(dir, snapshotName(3))
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	_, _, err := w.LoadSnapshot()
+	assert.ErrorIs(t, err, ErrGap)
+}
+
+func TestLoadSnapshotWithoutAny(t *testing.T) {
+	w, _ := Open(t.TempDir(), DefaultSegmentSize)
+
+	lsn, data, err := w.LoadSnapshot()
+	assert.NoError(t, err)
+	assert.Zero(t, lsn)
+	assert.Nil(t, data)
+}
@@ -0,0 +1,373 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultSegmentSize is the size at which the active segment is rotated.
+	DefaultSegmentSize = 16 << 20
+
+	segmentExt = ".wal"
+
+	// Every record is prefixed by its length and a CRC32-C of its payload.
+	headerSize    = 8
+	maxRecordSize = 64 << 20
+)
+
+var ErrCorrupt = errors.New("wal: corrupt record")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WAL is an append-only log split into segment files. Each segment is named
+// after the log sequence number (LSN) of its first record. Records are
+// fsync'd before Append returns, or by the next Sync or Append after Write,
+// and a torn record at the tail of the last segment, as left behind by a
+// crash mid-write, is truncated on Open.
+type WAL struct {
+	mu          sync.Mutex
+	dir         string
+	segmentSize int64
+	segments    []segment
+	file        *os.File
+	size        int64
+	synced      int64  // size of the active segment at the last sync
+	unsynced    uint64 // records written since the last sync
+	nextLSN     uint64
+	broken      error // a failed append left bytes that could not be removed
+}
+
+type segment struct {
+	first uint64
+	path  string
+}
+
+type IWAL interface {
+	Append(data []byte) (uint64, error)
+	Write(data []byte) (uint64, error)
+	Sync() error
+	Replay(after uint64, fn func(lsn uint64, data []byte) error) error
+	LastLSN() uint64
+	WriteSnapshot(lsn uint64, data []byte) error
+	LoadSnapshot() (uint64, []byte, error)
+	Compact(lsn uint64) error
+	Close() error
+}
+
+func Open(dir string, segmentSize int64) (*WAL, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	segments, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{
+		dir:         dir,
+		segmentSize: segmentSize,
+		segments:    segments,
+		nextLSN:     1,
+	}
+
+	if len(segments) == 0 {
+		if err := w.createSegment(w.nextLSN); err != nil {
+			return nil, err
+		}
+		return w, nil
+	}
+
+	w.nextLSN = segments[0].first
+	for i, seg := range segments {
+		if seg.first != w.nextLSN {
+			return nil, fmt.Errorf("wal: segment %s starts at %d, expected %d", seg.path, seg.first, w.nextLSN)
+		}
+
+		last := i == len(segments)-1
+		valid, count, err := scanSegment(seg.path, nil)
+		if err != nil && !(last && errors.Is(err, ErrCorrupt)) {
+			return nil, err
+		}
+		if err != nil {
+			// Only the tail can be torn, drop it and carry on
+			log.Println("truncating torn record at the tail of", seg.path, "offset", valid)
+			if err := os.Truncate(seg.path, valid); err != nil {
+				return nil, err
+			}
+		}
+		w.nextLSN += count
+		w.size = valid
+		w.synced = valid
+	}
+
+	file, err := os.OpenFile(segments[len(segments)-1].path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+	return w, nil
+}
+
+func listSegments(dir string) ([]segment, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{first: first, path: filepath.Join(dir, name)})
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].first < segments[j].first })
+	return segments, nil
+}
+
+func segmentName(first uint64) string {
+	return fmt.Sprintf("%020d%s", first, segmentExt)
+}
+
+// scanSegment reads every record of a segment, passing each payload to fn if
+// it is not nil. It returns the offset just past the last valid record and
+// the number of valid records; a truncated or mismatching record is reported
+// as ErrCorrupt.
+func scanSegment(path string, fn func(data []byte) error) (int64, uint64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, headerSize)
+
+	var offset int64
+	var count uint64
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return offset, count, nil
+			}
+			return offset, count, ErrCorrupt
+		}
+
+		length := binary.LittleEndian.Uint32(header[0:4])
+		checksum := binary.LittleEndian.Uint32(header[4:8])
+		if length > maxRecordSize {
+			return offset, count, ErrCorrupt
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return offset, count, ErrCorrupt
+		}
+		if crc32.Checksum(data, crcTable) != checksum {
+			return offset, count, ErrCorrupt
+		}
+
+		if fn != nil {
+			if err := fn(data); err != nil {
+				return offset, count, err
+			}
+		}
+		offset += int64(headerSize) + int64(length)
+		count++
+	}
+}
+
+func (w *WAL) createSegment(first uint64) error {
+	path := filepath.Join(w.dir, segmentName(first))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		return err
+	}
+
+	w.file = file
+	w.size = 0
+	w.synced = 0
+	w.segments = append(w.segments, segment{first: first, path: path})
+	return nil
+}
+
+func (w *WAL) rotate() error {
+	if err := w.sync(); err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return w.createSegment(w.nextLSN)
+}
+
+// Append writes a record, syncs it to disk and returns its LSN. A record that
+// could not be written or synced in full is cut off again, so the next one
+// does not land behind a torn record in the middle of the segment.
+func (w *WAL) Append(data []byte) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	lsn, err := w.write(data)
+	if err != nil {
+		return 0, err
+	}
+	if err := w.sync(); err != nil {
+		return 0, err
+	}
+	return lsn, nil
+}
+
+// Write writes a record without waiting for it to reach the disk, so many
+// records can share one sync, and returns its LSN. The record is durable once
+// Sync or a later Append returns.
+func (w *WAL) Write(data []byte) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.write(data)
+}
+
+// Sync syncs every record written since the last sync. If that fails, they
+// are cut off again like a failed Append.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.sync()
+}
+
+// write appends a record to the active segment. w.mu must be held.
+func (w *WAL) write(data []byte) (uint64, error) {
+	if w.broken != nil {
+		return 0, w.broken
+	}
+
+	record := make([]byte, headerSize+len(data))
+	binary.LittleEndian.PutUint32(record[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint32(record[4:8], crc32.Checksum(data, crcTable))
+	copy(record[headerSize:], data)
+
+	if w.size > 0 && w.size+int64(len(record)) > w.segmentSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := w.file.Write(record); err != nil {
+		return 0, w.undo(err)
+	}
+
+	lsn := w.nextLSN
+	w.nextLSN++
+	w.size += int64(len(record))
+	w.unsynced++
+	return lsn, nil
+}
+
+// sync syncs the active segment if records were written since the last sync.
+// w.mu must be held.
+func (w *WAL) sync() error {
+	if w.unsynced == 0 {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		w.nextLSN -= w.unsynced
+		w.size = w.synced
+		w.unsynced = 0
+		return w.undo(err)
+	}
+	w.synced = w.size
+	w.unsynced = 0
+	return nil
+}
+
+// undo truncates the active segment back to the end of its last record after
+// an append failed with err. If that fails too, every later append is refused.
+func (w *WAL) undo(err error) error {
+	path := w.segments[len(w.segments)-1].path
+	if terr := os.Truncate(path, w.size); terr != nil {
+		w.broken = fmt.Errorf("wal: cannot undo failed append to %s: %w", path, terr)
+		log.Println("error in wal append", err, w.broken)
+		return w.broken
+	}
+	return err
+}
+
+// Replay calls fn, in LSN order, for every record after the given LSN.
+func (w *WAL) Replay(after uint64, fn func(lsn uint64, data []byte) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for i, seg := range w.segments {
+		// Skip segments that end before the first record we want
+		if i+1 < len(w.segments) && w.segments[i+1].first <= after+1 {
+			continue
+		}
+
+		lsn := seg.first
+		_, _, err := scanSegment(seg.path, func(data []byte) error {
+			defer func() { lsn++ }()
+			if lsn <= after {
+				return nil
+			}
+			return fn(lsn, data)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LastLSN returns the LSN of the last record appended, or zero if the log
+// is empty.
+func (w *WAL) LastLSN() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.nextLSN - 1
+}
+
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.sync(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
@@ -0,0 +1,188 @@
+package wal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func replayAll(t *testing.T, w *WAL) []string {
+	var records []string
+	err := w.Replay(0, func(lsn uint64, data []byte) error {
+		assert.Equal(t, uint64(len(records)+1), lsn)
+		records = append(records, string(data))
+		return nil
+	})
+	assert.NoError(t, err)
+	return records
+}
+
+func TestAppendAndReplay(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir, DefaultSegmentSize)
+	assert.NoError(t, err)
+
+	lsn, err := w.Append([]byte("one"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), lsn)
+
+	lsn, err = w.Append([]byte("two"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), lsn)
+	assert.NoError(t, w.Close())
+
+	// Reopening continues where we left off
+	w, err = Open(dir, DefaultSegmentSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one", "two"}, replayAll(t, w))
+
+	lsn, err = w.Append([]byte("three"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), lsn)
+}
+
+func TestSegmentRotation(t *testing.T) {
+	dir := t.TempDir()
+
+	// Small enough that every record gets its own segment
+	w, err := Open(dir, 10)
+	assert.NoError(t, err)
+
+	for _, record := range []string{"one", "two", "three"} {
+		_, err := w.Append([]byte(record))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, w.Close())
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	assert.Len(t, segments, 3)
+
+	w, err = Open(dir, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one", "two", "three"}, replayAll(t, w))
+}
+
+func TestTornTailIsTruncated(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir, DefaultSegmentSize)
+	assert.NoError(t, err)
+	w.Append([]byte("one"))
+	w.Append([]byte("two"))
+	assert.NoError(t, w.Close())
+
+	// Simulate a crash half way through writing a record
+	path := filepath.Join(dir, segmentName(1))
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	file.Write([]byte{42, 0, 0, 0, 1, 2})
+	file.Close()
+
+	w, err = Open(dir, DefaultSegmentSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one", "two"}, replayAll(t, w))
+
+	// New records land after the truncated tail
+	lsn, err := w.Append([]byte("three"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(3), lsn)
+	assert.NoError(t, w.Close())
+
+	w, _ = Open(dir, DefaultSegmentSize)
+	assert.Equal(t, []string{"one", "two", "three"}, replayAll(t, w))
+}
+
+func TestFailedAppendIsUndone(t *testing.T) {
+	dir := t.TempDir()
+
+	w, err := Open(dir, DefaultSegmentSize)
+	assert.NoError(t, err)
+	w.Append([]byte("one"))
+
+	// A write that got part of a record out before failing
+	path := filepath.Join(dir, segmentName(1))
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	file.Write([]byte{42, 0, 0})
+	file.Close()
+	active := w.file
+	w.file, _ = os.Open(path)
+
+	_, err = w.Append([]byte("two"))
+	assert.Error(t, err)
+	w.file.Close()
+	w.file = active
+
+	lsn, err := w.Append([]byte("three"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(2), lsn)
+	assert.NoError(t, w.Close())
+
+	w, err = Open(dir, DefaultSegmentSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one", "three"}, replayAll(t, w))
+}
+
+func TestChecksumMismatchAtTail(t *testing.T) {
+	dir := t.TempDir()
+
+	w, _ := Open(dir, DefaultSegmentSize)
+	w.Append([]byte("one"))
+	w.Append([]byte("two"))
+	w.Close()
+
+	// Flip a byte in the payload of the last record
+	path := filepath.Join(dir, segmentName(1))
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	w, err := Open(dir, DefaultSegmentSize)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one"}, replayAll(t, w))
+}
+
+func TestCorruptionBeforeTailIsAnError(t *testing.T) {
+	dir := t.TempDir()
+
+	w, _ := Open(dir, 10)
+	w.Append([]byte("one"))
+	w.Append([]byte("two"))
+	w.Close()
+
+	path := filepath.Join(dir, segmentName(1))
+	data, _ := os.ReadFile(path)
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	_, err := Open(dir, 10)
+	assert.ErrorIs(t, err, ErrCorrupt)
+}
+
+func TestWriteIsSyncedLater(t *testing.T) {
+	dir := t.TempDir()
+
+	// Small enough that the second record rotates the segment
+	w, err := Open(dir, 10)
+	assert.NoError(t, err)
+
+	for i, record := range []string{"one", "two", "three"} {
+		lsn, err := w.Write([]byte(record))
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i+1), lsn)
+	}
+	// Rotating synced the records of the segments before
+	assert.Equal(t, uint64(1), w.unsynced)
+	assert.NoError(t, w.Sync())
+	assert.Zero(t, w.unsynced)
+
+	lsn, err := w.Append([]byte("four"))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(4), lsn)
+	assert.NoError(t, w.Close())
+
+	w, err = Open(dir, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one", "two", "three", "four"}, replayAll(t, w))
+}